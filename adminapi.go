@@ -0,0 +1,232 @@
+package ipdestinationguard
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The admin HTTP API, giving access to the live allowlist of a NFTablesManager.
+//
+//	GET    /v1/entries?domain=       lists all dynamic entries, optionally only those of a domain and its subdomains
+//	POST   /v1/entries               adds a temporary entry: {"ip": "192.0.2.1", "ttl": "5m", "scope": ""}
+//	DELETE /v1/entries?ip=&scope=    revokes an entry
+//	GET    /v1/explain?ip=           explains, why an address is allowed
+//	GET    /v1/ruleset               returns the ruleset created by the plugin in nft syntax
+//	GET    /v1/health                returns whether the firewall can be updated, with status 503 if it can't
+type adminServer struct {
+	address  string
+	manager  *NFTablesManager
+	listener net.Listener
+	server   *http.Server
+}
+
+// The body of POST /v1/entries.
+type addEntryRequest struct {
+	IP    string `json:"ip"`
+	TTL   string `json:"ttl"` // Duration like "90s" or "1h"
+	Scope string `json:"scope,omitempty"`
+}
+
+// The body of error responses.
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func newAdminServer(address string, manager *NFTablesManager) *adminServer {
+	return &adminServer{address: address, manager: manager}
+}
+
+// Returns the handler serving all endpoints of the admin API.
+func (admin *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/entries", admin.handleEntries)
+	mux.HandleFunc("/v1/explain", admin.handleExplain)
+	mux.HandleFunc("/v1/ruleset", admin.handleRuleset)
+	mux.HandleFunc("/v1/health", admin.handleHealth)
+
+	return mux
+}
+
+// Starts listening on the configured address.
+func (admin *adminServer) start() error {
+	listener, err := net.Listen("tcp", admin.address)
+	if err != nil {
+		return err
+	}
+
+	admin.listener = listener
+	admin.server = &http.Server{Handler: admin.handler(), ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		if err := admin.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("Admin API on %s stopped: %v", admin.address, err)
+		}
+	}()
+
+	log.Infof("Admin API listening on %s", listener.Addr())
+
+	return nil
+}
+
+// Stops listening, if the server was started.
+func (admin *adminServer) stop() error {
+	if admin.server == nil {
+		return nil
+	}
+
+	err := admin.server.Close()
+	admin.server = nil
+	admin.listener = nil
+
+	return err
+}
+
+func (admin *adminServer) handleEntries(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		entries, err := admin.manager.Entries()
+		if err != nil {
+			writeJSON(writer, http.StatusServiceUnavailable, adminError{Error: err.Error()})
+			return
+		}
+
+		if domain := request.URL.Query().Get("domain"); domain != "" {
+			pattern, err := parseDomainPattern(domain, true)
+			if err != nil {
+				writeJSON(writer, http.StatusBadRequest, adminError{Error: err.Error()})
+				return
+			}
+
+			filteredEntries := make([]AllowListEntry, 0, len(entries))
+			for _, entry := range entries {
+				if entry.Domain != "" && pattern.matches(dns.CanonicalName(entry.Domain)) {
+					filteredEntries = append(filteredEntries, entry)
+				}
+			}
+			entries = filteredEntries
+		}
+
+		writeJSON(writer, http.StatusOK, entries)
+
+	case http.MethodPost:
+		var body addEntryRequest
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			writeJSON(writer, http.StatusBadRequest, adminError{Error: "invalid request body: " + err.Error()})
+			return
+		}
+
+		ip := net.ParseIP(body.IP)
+		if ip == nil {
+			writeJSON(writer, http.StatusBadRequest, adminError{Error: "invalid ip address '" + body.IP + "'"})
+			return
+		}
+
+		lifetime, err := time.ParseDuration(body.TTL)
+		if err != nil || lifetime <= 0 {
+			writeJSON(writer, http.StatusBadRequest, adminError{Error: "invalid ttl '" + body.TTL + "': must be a duration like 90s or 1h"})
+			return
+		}
+
+		if err := admin.manager.AddTemporaryRoute(ip, lifetime, body.Scope); err != nil {
+			writeJSON(writer, http.StatusBadRequest, adminError{Error: err.Error()})
+			return
+		}
+
+		log.Infof("Admin API allowed %s (scope '%s') for %v", ip, body.Scope, lifetime)
+		explanation, err := admin.manager.Explain(ip)
+		if err != nil {
+			writeJSON(writer, http.StatusServiceUnavailable, adminError{Error: err.Error()})
+			return
+		}
+		writeJSON(writer, http.StatusCreated, explanation)
+
+	case http.MethodDelete:
+		ip := net.ParseIP(request.URL.Query().Get("ip"))
+		if ip == nil {
+			writeJSON(writer, http.StatusBadRequest, adminError{Error: "invalid ip address '" + request.URL.Query().Get("ip") + "'"})
+			return
+		}
+
+		scope := request.URL.Query().Get("scope")
+		if err := admin.manager.RevokeRoute(ip, scope); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errRouteNotFound) {
+				status = http.StatusNotFound
+			}
+			writeJSON(writer, status, adminError{Error: err.Error()})
+			return
+		}
+
+		log.Infof("Admin API revoked %s (scope '%s')", ip, scope)
+		writer.WriteHeader(http.StatusNoContent)
+
+	default:
+		writer.Header().Set("Allow", "GET, POST, DELETE")
+		writeJSON(writer, http.StatusMethodNotAllowed, adminError{Error: "method not allowed"})
+	}
+}
+
+func (admin *adminServer) handleExplain(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writer.Header().Set("Allow", "GET")
+		writeJSON(writer, http.StatusMethodNotAllowed, adminError{Error: "method not allowed"})
+		return
+	}
+
+	ip := net.ParseIP(request.URL.Query().Get("ip"))
+	if ip == nil {
+		writeJSON(writer, http.StatusBadRequest, adminError{Error: "invalid ip address '" + request.URL.Query().Get("ip") + "'"})
+		return
+	}
+
+	explanation, err := admin.manager.Explain(ip)
+	if err != nil {
+		writeJSON(writer, http.StatusServiceUnavailable, adminError{Error: err.Error()})
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, explanation)
+}
+
+func (admin *adminServer) handleRuleset(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writer.Header().Set("Allow", "GET")
+		writeJSON(writer, http.StatusMethodNotAllowed, adminError{Error: "method not allowed"})
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(writer, admin.manager.ruleset)
+}
+
+func (admin *adminServer) handleHealth(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writer.Header().Set("Allow", "GET")
+		writeJSON(writer, http.StatusMethodNotAllowed, adminError{Error: "method not allowed"})
+		return
+	}
+
+	health := admin.manager.Health(time.Now())
+	if !health.Healthy {
+		writeJSON(writer, http.StatusServiceUnavailable, health)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, health)
+}
+
+// Writes given value as JSON response with given status.
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+
+	if err := json.NewEncoder(writer).Encode(value); err != nil {
+		log.Warningf("Writing admin API response failed: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package ipdestinationguard
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminAPI(t *testing.T) {
+	manager := newTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+	server := httptest.NewServer(newAdminServer("", manager).handler())
+	defer server.Close()
+
+	request := func(method string, path string, body string) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+
+		return resp
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+	}{
+		{"add entry", http.MethodPost, "/v1/entries", `{"ip": "203.0.113.1", "ttl": "5m"}`, http.StatusCreated},
+		{"add entry with invalid body", http.MethodPost, "/v1/entries", `{`, http.StatusBadRequest},
+		{"add entry with invalid ip", http.MethodPost, "/v1/entries", `{"ip": "example.com", "ttl": "5m"}`, http.StatusBadRequest},
+		{"add entry with invalid ttl", http.MethodPost, "/v1/entries", `{"ip": "203.0.113.1", "ttl": "-5m"}`, http.StatusBadRequest},
+		{"add entry with invalid scope", http.MethodPost, "/v1/entries", `{"ip": "203.0.113.1", "ttl": "5m", "scope": "10.0.0.5"}`, http.StatusBadRequest},
+		{"list entries", http.MethodGet, "/v1/entries", "", http.StatusOK},
+		{"explain", http.MethodGet, "/v1/explain?ip=203.0.113.1", "", http.StatusOK},
+		{"explain invalid ip", http.MethodGet, "/v1/explain?ip=foo", "", http.StatusBadRequest},
+		{"explain with wrong method", http.MethodPost, "/v1/explain?ip=203.0.113.1", "", http.StatusMethodNotAllowed},
+		{"revoke entry", http.MethodDelete, "/v1/entries?ip=203.0.113.1", "", http.StatusNoContent},
+		{"revoke missing entry", http.MethodDelete, "/v1/entries?ip=203.0.113.1", "", http.StatusNotFound},
+		{"revoke invalid ip", http.MethodDelete, "/v1/entries?ip=", "", http.StatusBadRequest},
+		{"entries with wrong method", http.MethodPut, "/v1/entries", "", http.StatusMethodNotAllowed},
+		{"list entries of invalid domain", http.MethodGet, "/v1/entries?domain=*", "", http.StatusBadRequest},
+		{"ruleset", http.MethodGet, "/v1/ruleset", "", http.StatusOK},
+		{"ruleset with wrong method", http.MethodPost, "/v1/ruleset", "", http.StatusMethodNotAllowed},
+		{"health", http.MethodGet, "/v1/health", "", http.StatusOK},
+		{"health with wrong method", http.MethodPost, "/v1/health", "", http.StatusMethodNotAllowed},
+	}
+
+	// The cases build on each other, so they run in order against the same manager
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := request(tt.method, tt.path, tt.body)
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+		})
+	}
+
+	request(http.MethodPost, "/v1/entries", `{"ip": "198.51.100.7", "ttl": "1h"}`)
+
+	var entries []AllowListEntry
+	if err := json.NewDecoder(request(http.MethodGet, "/v1/entries", "").Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].IP != "198.51.100.7" || entries[0].Client != adminClientLabel {
+		t.Errorf("Expected the added entry, got %+v", entries)
+	}
+
+	var explanation Explanation
+	if err := json.NewDecoder(request(http.MethodGet, "/v1/explain?ip=9.9.9.9", "").Body).Decode(&explanation); err != nil {
+		t.Fatal(err)
+	}
+	if !explanation.Allowed || len(explanation.Permanent) != 1 || explanation.Permanent[0].Directive != "allowedIPs" {
+		t.Errorf("Expected 9.9.9.9 to be allowed by allowedIPs, got %+v", explanation)
+	}
+
+	routes := []*allowRoute{{ipAddress: net.ParseIP("203.0.113.9").To4(), validUnitl: time.Now().Add(time.Hour), domain: "api.example.com."}}
+	if err := manager.sendBatch(&allowBatch{routes: routes}); err != nil {
+		t.Fatal(err)
+	}
+
+	for domain, expectedCount := range map[string]int{"example.com": 1, "*.example.com": 1, "api.example.com": 1, "example.org": 0} {
+		entries = nil
+		if err := json.NewDecoder(request(http.MethodGet, "/v1/entries?domain="+domain, "").Body).Decode(&entries); err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != expectedCount {
+			t.Errorf("Expected %d entries for domain %s, got %+v", expectedCount, domain, entries)
+		}
+	}
+
+	ruleset, err := io.ReadAll(request(http.MethodGet, "/v1/ruleset", "").Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ruleset) != manager.ruleset {
+		t.Errorf("Expected the ruleset of the manager, got %q", ruleset)
+	}
+}
+
+func TestAdminAPIOfStoppedManager(t *testing.T) {
+	manager := newStoppedTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+	server := httptest.NewServer(newAdminServer("", manager).handler())
+	defer server.Close()
+
+	// An empty explanation or list would claim, that nothing is allowed
+	for _, path := range []string{"/v1/explain?ip=203.0.113.1", "/v1/entries"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Expected status %d for %s, got %d", http.StatusServiceUnavailable, path, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package ipdestinationguard
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/nftables/binaryutil"
+)
+
+// Returned when revoking a route, that isn't allowed.
+var errRouteNotFound = errors.New("route not found in allowlist")
+
+// Client label of entries added through the admin API.
+const adminClientLabel = "admin"
+
+// AllowListEntry describes a dynamic allowlist entry, as returned by the admin API.
+type AllowListEntry struct {
+	IP      string    `json:"ip"`
+	Scope   string    `json:"scope,omitempty"`  // Label of the scope (client address, uid or cgroup id), empty for global entries
+	Domain  string    `json:"domain,omitempty"` // Queried name, that allowed the entry last
+	Client  string    `json:"client,omitempty"` // Address of the client, that queried the domain
+	Expires time.Time `json:"expires"`
+	TTL     uint32    `json:"ttl"` // Remaining lifetime in seconds
+}
+
+// PermanentMatch describes a configured range allowing an address, as returned by the admin API.
+type PermanentMatch struct {
+	Directive string   `json:"directive"`
+	Range     string   `json:"range"`
+	Chains    []string `json:"chains"`
+	Cgroup    string   `json:"cgroup,omitempty"` // Only set for allowedCgroupIPs
+}
+
+// Explanation describes, why an address is allowed, as returned by the admin API.
+type Explanation struct {
+	IP        string           `json:"ip"`
+	Allowed   bool             `json:"allowed"`
+	Permanent []PermanentMatch `json:"permanent"`
+	Entries   []AllowListEntry `json:"entries"`
+}
+
+// A configured range of allowed addresses, kept to explain why an address is allowed.
+type permanentRange struct {
+	directive string
+	chains    []string
+	cgroup    string
+	start     net.IP
+	end       net.IP // Exclusive, like the ranges of getIPRange
+}
+
+// Returns whether given address is within the range.
+func (ipRange *permanentRange) contains(ip net.IP) bool {
+	if len(ip) != len(ipRange.start) {
+		return false
+	}
+
+	return bytes.Compare(ip, ipRange.start) >= 0 && bytes.Compare(ip, ipRange.end) < 0
+}
+
+// Returns the permanent ranges of given config, that apply to any chain of its mode.
+func buildPermanentRanges(config *parsedConfig) []permanentRange {
+	hasOutput := config.mode == ModeNFTLocal || config.mode == ModeNFTBoth
+	hasForward := config.mode == ModeNFTGateway || config.mode == ModeNFTBoth
+
+	var allChains []string
+	if hasOutput {
+		allChains = append(allChains, "output")
+	}
+	if hasForward {
+		allChains = append(allChains, "forward")
+	}
+
+	var ranges []permanentRange
+	appendRanges := func(directive string, chains []string, cgroup string, ips []net.IP) {
+		for i := 0; i+1 < len(ips); i += 2 {
+			ranges = append(ranges, permanentRange{directive: directive, chains: chains, cgroup: cgroup, start: ips[i], end: ips[i+1]})
+		}
+	}
+
+	appendRanges("allowedIPs", allChains, "", config.allowedIPs)
+	if hasOutput {
+		appendRanges("allowedLocalIPs", []string{"output"}, "", config.allowedLocalIPs)
+		for _, allowance := range config.allowedCgroupIPs {
+			appendRanges("allowedCgroupIPs", []string{"output"}, allowance.path, allowance.allowedIPs)
+		}
+	}
+	if hasForward {
+		appendRanges("allowedGatewayIPs", []string{"forward"}, "", config.allowedGatewayIPs)
+	}
+
+	return ranges
+}
+
+// Returns the scope key and label for given scope label of the admin API. An empty label means the global sets.
+func (manager *NFTablesManager) parseScopeLabel(label string) ([]byte, string, error) {
+	if label == "" {
+		return nil, "", nil
+	}
+
+	switch manager.scope {
+	case ScopeClient:
+		ip := net.ParseIP(label)
+		if ip == nil {
+			return nil, "", fmt.Errorf("invalid client address '%s'", label)
+		}
+		if ipv4 := ip.To4(); ipv4 != nil {
+			ip = ipv4
+		}
+		return ip, ip.String(), nil
+
+	case ScopeUser:
+		uid, err := strconv.ParseUint(label, 10, 32)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid uid '%s'", label)
+		}
+		return binaryutil.NativeEndian.PutUint32(uint32(uid)), strconv.FormatUint(uid, 10), nil
+
+	case ScopeCgroup:
+		// Either the cgroup id, as listed by the admin API, or the cgroup path
+		id, err := strconv.ParseUint(label, 10, 64)
+		if err != nil {
+			id, err = cgroupID(label)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid cgroup '%s': %w", label, err)
+			}
+		}
+		return binaryutil.NativeEndian.PutUint64(id), strconv.FormatUint(id, 10), nil
+	}
+
+	return nil, "", fmt.Errorf("scope '%s' doesn't support scoped entries", manager.scope)
+}
+
+// Sends given batch to the manager goroutine and waits for its result.
+func (manager *NFTablesManager) sendBatch(batch *allowBatch) error {
+	batch.done = make(chan error, 1)
+	if !manager.enqueue(batch) {
+		return errManagerStopped
+	}
+
+	return <-batch.done
+}
+
+// Entries returns all dynamic allowlist entries, sorted by scope and address. Returns errManagerStopped, if they can't
+// be inspected anymore.
+func (manager *NFTablesManager) Entries() ([]AllowListEntry, error) {
+	var entries []AllowListEntry
+	now := time.Now()
+
+	err := manager.sendBatch(&allowBatch{inspect: func(allowList map[routeKey]*allowRoute) {
+		entries = make([]AllowListEntry, 0, len(allowList))
+		for _, route := range allowList {
+			if route.validUnitl.Before(now) {
+				continue
+			}
+			entries = append(entries, newAllowListEntry(route, now))
+		}
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Scope != entries[j].Scope {
+			return entries[i].Scope < entries[j].Scope
+		}
+		return entries[i].IP < entries[j].IP
+	})
+
+	return entries, nil
+}
+
+// Explain returns, why given address is allowed, listing the matching permanent ranges and dynamic entries. Returns
+// errManagerStopped, if the dynamic entries can't be inspected anymore.
+func (manager *NFTablesManager) Explain(ip net.IP) (*Explanation, error) {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+
+	explanation := &Explanation{
+		IP:        ip.String(),
+		Permanent: []PermanentMatch{},
+		Entries:   []AllowListEntry{},
+	}
+
+	for i := range manager.permanentRanges {
+		ipRange := &manager.permanentRanges[i]
+		if ipRange.contains(ip) {
+			explanation.Permanent = append(explanation.Permanent, PermanentMatch{
+				Directive: ipRange.directive,
+				Range:     ipRange.start.String() + "-" + previousIP(ipRange.end).String(),
+				Chains:    ipRange.chains,
+				Cgroup:    ipRange.cgroup,
+			})
+		}
+	}
+
+	now := time.Now()
+	err := manager.sendBatch(&allowBatch{inspect: func(allowList map[routeKey]*allowRoute) {
+		for _, route := range allowList {
+			if route.ipAddress.Equal(ip) && route.validUnitl.After(now) {
+				explanation.Entries = append(explanation.Entries, newAllowListEntry(route, now))
+			}
+		}
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(explanation.Entries, func(i, j int) bool {
+		return explanation.Entries[i].Scope < explanation.Entries[j].Scope
+	})
+
+	explanation.Allowed = len(explanation.Permanent) > 0 || len(explanation.Entries) > 0
+
+	return explanation, nil
+}
+
+// AddTemporaryRoute allows given address for given lifetime, within the scope of given label (or globally, if the
+// label is empty). An existing entry is only extended, never shortened.
+func (manager *NFTablesManager) AddTemporaryRoute(ip net.IP, lifetime time.Duration, scopeLabel string) error {
+	route, err := manager.adminRoute(ip, scopeLabel)
+	if err != nil {
+		return err
+	}
+	if lifetime <= 0 {
+		return fmt.Errorf("lifetime must be greater than zero, got %v", lifetime)
+	}
+
+	route.validUnitl = time.Now().Add(lifetime)
+	route.client = adminClientLabel
+
+	return manager.sendBatch(&allowBatch{routes: []*allowRoute{route}})
+}
+
+// RevokeRoute removes the entry of given address within the scope of given label (or globally, if the label is
+// empty), so traffic to the address is rejected again, unless a permanent range allows it.
+func (manager *NFTablesManager) RevokeRoute(ip net.IP, scopeLabel string) error {
+	route, err := manager.adminRoute(ip, scopeLabel)
+	if err != nil {
+		return err
+	}
+
+	return manager.sendBatch(&allowBatch{routes: []*allowRoute{route}, revoke: true})
+}
+
+// Returns a new route for given address and scope label of the admin API.
+func (manager *NFTablesManager) adminRoute(ip net.IP, scopeLabel string) (*allowRoute, error) {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return nil, fmt.Errorf("invalid ip address %v", ip)
+	}
+
+	scopeKey, label, err := manager.parseScopeLabel(scopeLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	// Client scoped sets concatenate addresses of the same family
+	if manager.scope == ScopeClient && scopeKey != nil && len(scopeKey) != len(ip) {
+		return nil, fmt.Errorf("client %s and address %v have different address families", label, ip)
+	}
+
+	return &allowRoute{ipAddress: ip, scopeKey: scopeKey, scopeLabel: label}, nil
+}
+
+// Returns the admin API representation of given route.
+func newAllowListEntry(route *allowRoute, now time.Time) AllowListEntry {
+	return AllowListEntry{
+		IP:      route.ipAddress.String(),
+		Scope:   route.scopeLabel,
+		Domain:  route.domain,
+		Client:  route.client,
+		Expires: route.validUnitl,
+		TTL:     uint32(route.validUnitl.Sub(now).Seconds()),
+	}
+}
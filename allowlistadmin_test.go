@@ -0,0 +1,184 @@
+package ipdestinationguard
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Returns a config in mode nft-both with permanent ranges, as used by the admin tests.
+func testAdminConfig(t *testing.T, scope Scope) *parsedConfig {
+	t.Helper()
+
+	config := &parsedConfig{
+		mode:             ModeNFTBoth,
+		scope:            scope,
+		ttlPolicy:        defaultTTLPolicy(),
+		recoveryLifetime: defaultRecoveryLifetime,
+	}
+
+	for _, directive := range []struct {
+		target *[]net.IP
+		cidr   string
+	}{
+		{&config.allowedIPs, "9.9.9.9"},
+		{&config.allowedLocalIPs, "10.88.0.0/16"},
+		{&config.allowedGatewayIPs, "192.168.100.0/24"},
+	} {
+		startIP, endIP, err := getIPRange(directive.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		*directive.target = append(*directive.target, startIP, endIP)
+	}
+
+	return config
+}
+
+// Returns the explanation of given address, failing the test, if the manager can't be inspected.
+func mustExplain(t *testing.T, manager *NFTablesManager, ip string) *Explanation {
+	t.Helper()
+
+	explanation, err := manager.Explain(net.ParseIP(ip))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return explanation
+}
+
+// Returns the entries of given manager, failing the test, if the manager can't be inspected.
+func mustEntries(t *testing.T, manager *NFTablesManager) []AllowListEntry {
+	t.Helper()
+
+	entries, err := manager.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return entries
+}
+
+func TestBuildPermanentRanges(t *testing.T) {
+	config := testAdminConfig(t, ScopeGlobal)
+	config.mode = ModeNFTLocal
+
+	ranges := buildPermanentRanges(config)
+
+	// allowedGatewayIPs don't apply to any chain in mode nft-local
+	if len(ranges) != 2 {
+		t.Fatalf("Expected 2 ranges, got %d", len(ranges))
+	}
+
+	if ranges[0].directive != "allowedIPs" || !reflect.DeepEqual(ranges[0].chains, []string{"output"}) {
+		t.Errorf("Expected allowedIPs on the output chain, got %s on %v", ranges[0].directive, ranges[0].chains)
+	}
+
+	if ranges[1].directive != "allowedLocalIPs" || !ranges[1].contains(net.IPv4(10, 88, 255, 255).To4()) {
+		t.Errorf("Expected allowedLocalIPs containing 10.88.255.255, got %s %v-%v", ranges[1].directive, ranges[1].start, ranges[1].end)
+	}
+
+	if ranges[1].contains(net.IPv4(10, 89, 0, 0).To4()) {
+		t.Error("Expected range end to be exclusive")
+	}
+}
+
+func TestManagerAdminOperations(t *testing.T) {
+	manager := newTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+
+	manager.AddRoutes(&QueryInfo{Name: "example.com.", Client: &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 5353}}, []RouteEntry{
+		{IP: net.ParseIP("192.0.2.1").To4(), TTL: 60},
+	})
+
+	entries := mustEntries(t, manager)
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(entries))
+	}
+	if entries[0].IP != "192.0.2.1" || entries[0].Domain != "example.com." || entries[0].Client != "10.0.0.5" || entries[0].Scope != "" {
+		t.Errorf("Unexpected entry %+v", entries[0])
+	}
+	if entries[0].TTL < 85 || entries[0].TTL > 90 {
+		t.Errorf("Expected remaining TTL of about 90 seconds, got %d", entries[0].TTL)
+	}
+
+	explanation := mustExplain(t, manager, "192.0.2.1")
+	if !explanation.Allowed || len(explanation.Entries) != 1 || len(explanation.Permanent) != 0 {
+		t.Errorf("Expected 192.0.2.1 to be allowed by a dynamic entry, got %+v", explanation)
+	}
+
+	explanation = mustExplain(t, manager, "10.88.1.2")
+	expectedMatch := PermanentMatch{Directive: "allowedLocalIPs", Range: "10.88.0.0-10.88.255.255", Chains: []string{"output"}}
+	if !explanation.Allowed || len(explanation.Permanent) != 1 || !reflect.DeepEqual(explanation.Permanent[0], expectedMatch) {
+		t.Errorf("Expected 10.88.1.2 to be allowed by %+v, got %+v", expectedMatch, explanation)
+	}
+
+	explanation = mustExplain(t, manager, "9.9.9.9")
+	if len(explanation.Permanent) != 1 || !reflect.DeepEqual(explanation.Permanent[0].Chains, []string{"output", "forward"}) {
+		t.Errorf("Expected 9.9.9.9 to be allowed on both chains, got %+v", explanation)
+	}
+
+	if explanation := mustExplain(t, manager, "203.0.113.1"); explanation.Allowed {
+		t.Errorf("Expected 203.0.113.1 not to be allowed, got %+v", explanation)
+	}
+
+	if err := manager.AddTemporaryRoute(net.ParseIP("203.0.113.1"), 5*time.Minute, ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	explanation = mustExplain(t, manager, "203.0.113.1")
+	if !explanation.Allowed || len(explanation.Entries) != 1 || explanation.Entries[0].Client != adminClientLabel {
+		t.Errorf("Expected 203.0.113.1 to be allowed by the admin, got %+v", explanation)
+	}
+
+	if err := manager.AddTemporaryRoute(net.ParseIP("203.0.113.2"), 5*time.Minute, "10.0.0.5"); err == nil {
+		t.Error("Expected error adding a scoped entry in scope global")
+	}
+	if err := manager.AddTemporaryRoute(net.ParseIP("203.0.113.2"), 0, ""); err == nil {
+		t.Error("Expected error adding an entry without lifetime")
+	}
+
+	if err := manager.RevokeRoute(net.ParseIP("192.0.2.1"), ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := manager.RevokeRoute(net.ParseIP("192.0.2.1"), ""); !errors.Is(err, errRouteNotFound) {
+		t.Errorf("Expected errRouteNotFound revoking twice, got %v", err)
+	}
+
+	entries = mustEntries(t, manager)
+	if len(entries) != 1 || entries[0].IP != "203.0.113.1" {
+		t.Errorf("Expected only the admin entry to be left, got %+v", entries)
+	}
+}
+
+func TestManagerAdminOperationsClientScope(t *testing.T) {
+	manager := newTestNFTablesManager(t, testAdminConfig(t, ScopeClient))
+
+	if err := manager.AddTemporaryRoute(net.ParseIP("203.0.113.1"), 5*time.Minute, "10.0.0.5"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := manager.AddTemporaryRoute(net.ParseIP("203.0.113.1"), 5*time.Minute, ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	entries := mustEntries(t, manager)
+	if len(entries) != 2 || entries[0].Scope != "" || entries[1].Scope != "10.0.0.5" {
+		t.Errorf("Expected a global and a client scoped entry, got %+v", entries)
+	}
+
+	if err := manager.AddTemporaryRoute(net.ParseIP("2001:db8::1"), 5*time.Minute, "10.0.0.5"); err == nil {
+		t.Error("Expected error adding an entry of another address family than the client")
+	}
+	if err := manager.AddTemporaryRoute(net.ParseIP("203.0.113.1"), 5*time.Minute, "not-a-client"); err == nil {
+		t.Error("Expected error adding an entry with an invalid client")
+	}
+
+	if err := manager.RevokeRoute(net.ParseIP("203.0.113.1"), "10.0.0.5"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	entries = mustEntries(t, manager)
+	if len(entries) != 1 || entries[0].Scope != "" {
+		t.Errorf("Expected only the global entry to be left, got %+v", entries)
+	}
+}
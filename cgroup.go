@@ -0,0 +1,223 @@
+package ipdestinationguard
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Mount point of the cgroupv2 hierarchy, only changed by tests.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// Default cgroup level matched by the OUTPUT chain in scope cgroup, which is the level of systemd units
+// like "system.slice/nginx.service".
+const defaultCgroupLevel = 2
+
+// A static allowlist for all processes within a cgroup, as configured by allowedCgroupIPs.
+type cgroupAllowance struct {
+	path       string   // Path relative to the cgroupv2 root, without leading slash
+	allowedIPs []net.IP // Start and end pairs like parsedConfig.allowedIPs
+}
+
+// Minimum time between two walks of the cgroupv2 hierarchy, so sockets of unknown cgroups can't make every query walk
+// it again.
+const cgroupWalkInterval = time.Second
+
+// Paths of the cgroups by their id, found by walking the cgroupv2 hierarchy. Cgroup ids are unique for the whole host
+// and never reused, so the index is shared by all server blocks, and only walked again for unknown ids.
+var cgroupPaths = newCgroupIndex()
+
+type cgroupIndex struct {
+	mutex    sync.Mutex
+	paths    map[uint64]string
+	walkedAt time.Time
+}
+
+func newCgroupIndex() *cgroupIndex {
+	return &cgroupIndex{paths: make(map[uint64]string)}
+}
+
+// Returns the path of the cgroup with given id relative to the cgroupv2 root. Unknown ids walk the hierarchy again,
+// unless it was walked within cgroupWalkInterval.
+func (index *cgroupIndex) lookup(id uint64, now time.Time) (string, error) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if path, exists := index.paths[id]; exists {
+		return path, nil
+	}
+
+	if index.walkedAt.IsZero() || now.Sub(index.walkedAt) >= cgroupWalkInterval {
+		paths, err := walkCgroups()
+		if err != nil {
+			return "", err
+		}
+		index.paths = paths
+		index.walkedAt = now
+
+		if path, exists := index.paths[id]; exists {
+			return path, nil
+		}
+	}
+
+	return "", fmt.Errorf("no cgroup with id %d found", id)
+}
+
+// Returns the paths of all cgroups of the cgroupv2 hierarchy by their id, which is the inode of their directory.
+func walkCgroups() (map[uint64]string, error) {
+	paths := make(map[uint64]string)
+
+	err := filepath.WalkDir(cgroupRoot, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Cgroups might be removed while walking them
+			if path == cgroupRoot {
+				return err
+			}
+			return nil
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("can't determine inode of cgroup '%s'", path)
+		}
+
+		relativePath, err := filepath.Rel(cgroupRoot, path)
+		if err != nil {
+			return err
+		}
+		if relativePath == "." {
+			relativePath = ""
+		}
+		paths[stat.Ino] = relativePath
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return paths, nil
+}
+
+// Returns the path of the cgroup of given socket, relative to the cgroupv2 root. Without the cgroup id of sock_diag
+// (before linux 5.7, or if sock_diag is unavailable), the process holding the socket is searched in /proc, which reads
+// the file descriptors of all processes.
+func socketCgroupPath(owner *socketOwner) (string, error) {
+	if owner.cgroupID != 0 {
+		return cgroupPaths.lookup(owner.cgroupID, time.Now())
+	}
+
+	return findSocketCgroup(owner.inode)
+}
+
+// Returns the path of the cgroup, that contains the socket with given inode, relative to the cgroupv2 root.
+func findSocketCgroup(inode uint64) (string, error) {
+	pid, err := findSocketProcess(inode)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(procRoot + "/" + strconv.Itoa(pid) + "/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return parseProcCgroup(file)
+}
+
+// Returns the id of a process, that holds a file descriptor of the socket with given inode.
+func findSocketProcess(inode uint64) (int, error) {
+	processDirs, err := os.ReadDir(procRoot)
+	if err != nil {
+		return 0, err
+	}
+
+	socketLink := "socket:[" + strconv.FormatUint(inode, 10) + "]"
+	for _, processDir := range processDirs {
+		pid, err := strconv.Atoi(processDir.Name())
+		if err != nil {
+			continue
+		}
+
+		fdDir := procRoot + "/" + processDir.Name() + "/fd"
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			// The process might be gone already, or belong to someone we can't inspect
+			continue
+		}
+
+		for _, fd := range fds {
+			target, err := os.Readlink(fdDir + "/" + fd.Name())
+			if err == nil && target == socketLink {
+				return pid, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("no process found holding socket %d", inode)
+}
+
+// Parses a /proc/<pid>/cgroup file and returns the cgroupv2 path without leading slash.
+func parseProcCgroup(reader io.Reader) (string, error) {
+	scanner := bufio.NewScanner(reader)
+
+	for scanner.Scan() {
+		// The unified hierarchy is listed as "0::/system.slice/nginx.service"
+		if path, found := strings.CutPrefix(scanner.Text(), "0::"); found {
+			return strings.Trim(path, "/"), nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("no cgroupv2 hierarchy found")
+}
+
+// Returns the ancestor of given cgroup path at given level, like nftables "socket cgroupv2 level" does.
+func cgroupAncestor(path string, level int) (string, error) {
+	components := cgroupPathComponents(path)
+	if len(components) < level {
+		return "", fmt.Errorf("cgroup '%s' is above level %d", path, level)
+	}
+
+	return strings.Join(components[:level], "/"), nil
+}
+
+// Returns the components of given cgroup path, ignoring leading, trailing and duplicate slashes.
+func cgroupPathComponents(path string) []string {
+	return strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+}
+
+// Returns the id of the cgroup with given path, which is the inode of its directory in the cgroupv2 hierarchy.
+func cgroupID(path string) (uint64, error) {
+	info, err := os.Stat(filepath.Join(cgroupRoot, path))
+	if err != nil {
+		return 0, err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("can't determine inode of cgroup '%s'", path)
+	}
+
+	return stat.Ino, nil
+}
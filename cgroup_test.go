@@ -0,0 +1,261 @@
+package ipdestinationguard
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/nftables/binaryutil"
+)
+
+func TestParseProcCgroup(t *testing.T) {
+	tests := []struct {
+		name         string
+		content      string
+		expectedPath string
+		shouldError  bool
+	}{
+		{
+			name:         "unified hierarchy",
+			content:      "0::/system.slice/nginx.service\n",
+			expectedPath: "system.slice/nginx.service",
+		},
+		{
+			name:         "hybrid hierarchy",
+			content:      "12:cpuset:/\n1:name=systemd:/user.slice\n0::/user.slice/user-1000.slice/session-2.scope\n",
+			expectedPath: "user.slice/user-1000.slice/session-2.scope",
+		},
+		{
+			name:         "root cgroup",
+			content:      "0::/\n",
+			expectedPath: "",
+		},
+		{
+			name:        "legacy hierarchy only",
+			content:     "12:cpuset:/\n1:name=systemd:/user.slice\n",
+			shouldError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := parseProcCgroup(strings.NewReader(tt.content))
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if path != tt.expectedPath {
+				t.Errorf("Expected path '%s', got '%s'", tt.expectedPath, path)
+			}
+		})
+	}
+}
+
+func TestCgroupAncestor(t *testing.T) {
+	tests := []struct {
+		path         string
+		level        int
+		expectedPath string
+		shouldError  bool
+	}{
+		{path: "system.slice/nginx.service", level: 2, expectedPath: "system.slice/nginx.service"},
+		{path: "user.slice/user-1000.slice/session-2.scope", level: 2, expectedPath: "user.slice/user-1000.slice"},
+		{path: "/system.slice//nginx.service/", level: 1, expectedPath: "system.slice"},
+		{path: "init.scope", level: 2, shouldError: true},
+		{path: "", level: 1, shouldError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			path, err := cgroupAncestor(tt.path, tt.level)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if path != tt.expectedPath {
+				t.Errorf("Expected path '%s', got '%s'", tt.expectedPath, path)
+			}
+		})
+	}
+}
+
+func TestResolveCgroupScope(t *testing.T) {
+	root := t.TempDir()
+	fakeProcRoot := filepath.Join(root, "proc")
+	fakeCgroupRoot := filepath.Join(root, "cgroup")
+
+	// A process in the nginx unit holding the socket 1234, and one outside of any unit holding the socket 1235
+	writeFiles := map[string]string{
+		"proc/net/udp": procNetTable(
+			procNetAddress("127.0.0.1", 40000)+" 33 1234",
+			procNetAddress("127.0.0.1", 40001)+" 0 1235",
+		),
+		"proc/100/cgroup": "0::/system.slice/nginx.service/worker\n",
+		"proc/200/cgroup": "0::/init.scope\n",
+	}
+	for name, content := range writeFiles {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, dir := range []string{"proc/100/fd", "proc/200/fd", "cgroup/system.slice/nginx.service/worker"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("socket:[1234]", filepath.Join(fakeProcRoot, "100", "fd", "3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("socket:[1235]", filepath.Join(fakeProcRoot, "200", "fd", "3")); err != nil {
+		t.Fatal(err)
+	}
+
+	originalProcRoot, originalCgroupRoot := procRoot, cgroupRoot
+	procRoot, cgroupRoot = fakeProcRoot, fakeCgroupRoot
+	withoutSockDiag(t)
+	defer func() { procRoot, cgroupRoot = originalProcRoot, originalCgroupRoot }()
+
+	nginxID, err := cgroupID("system.slice/nginx.service")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		client        net.Addr
+		expectedKey   []byte
+		expectedLabel string
+		shouldError   bool
+	}{
+		{
+			name:          "process within a unit",
+			client:        &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000},
+			expectedKey:   binaryutil.NativeEndian.PutUint64(nginxID),
+			expectedLabel: strconv.FormatUint(nginxID, 10),
+		},
+		{
+			name:        "process above the cgroup level",
+			client:      &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40001},
+			shouldError: true,
+		},
+		{
+			name:          "remote client uses the global sets",
+			client:        &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 40002},
+			expectedKey:   nil,
+			expectedLabel: "",
+		},
+		{
+			name:        "local client without socket",
+			client:      &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40002},
+			shouldError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := &NFTablesManager{scope: ScopeCgroup, cgroupLevel: defaultCgroupLevel}
+
+			scopeKey, scopeLabel, err := manager.resolveScope(&QueryInfo{Client: tt.client})
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !bytes.Equal(scopeKey, tt.expectedKey) {
+				t.Errorf("Expected scope key %v, got %v", tt.expectedKey, scopeKey)
+			}
+
+			if scopeLabel != tt.expectedLabel {
+				t.Errorf("Expected scope label '%s', got '%s'", tt.expectedLabel, scopeLabel)
+			}
+
+			if scopeKey != nil && manager.scopeLabelFor(scopeKey) != tt.expectedLabel {
+				t.Errorf("Expected scopeLabelFor to return '%s', got '%s'", tt.expectedLabel, manager.scopeLabelFor(scopeKey))
+			}
+		})
+	}
+
+	// With sock_diag, the cgroup id of the socket is looked up in the cgroup hierarchy, without searching the process
+	workerID, err := cgroupID("system.slice/nginx.service/worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	querySocketOwner = func(uint8, net.IP, int, bool) (*socketOwner, error) {
+		return &socketOwner{uid: 33, inode: 4321, cgroupID: workerID}, nil
+	}
+	cgroupPaths = newCgroupIndex()
+	manager := &NFTablesManager{scope: ScopeCgroup, cgroupLevel: defaultCgroupLevel}
+	if _, scopeLabel, err := manager.resolveScope(&QueryInfo{Client: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40003}}); err != nil || scopeLabel != strconv.FormatUint(nginxID, 10) {
+		t.Errorf("Expected the cgroup reported by sock_diag, got '%s' and %v", scopeLabel, err)
+	}
+}
+
+func TestCgroupIndex(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"system.slice/nginx.service", "user.slice"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	originalCgroupRoot := cgroupRoot
+	cgroupRoot = root
+	defer func() { cgroupRoot = originalCgroupRoot }()
+
+	nginxID, err := cgroupID("system.slice/nginx.service")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := newCgroupIndex()
+	now := time.Now()
+	if path, err := index.lookup(nginxID, now); err != nil || path != "system.slice/nginx.service" {
+		t.Fatalf("Expected the path of the cgroup, got '%s' and %v", path, err)
+	}
+
+	// Cgroups created later are found by walking the hierarchy again, but not more often than cgroupWalkInterval
+	if err := os.MkdirAll(filepath.Join(root, "system.slice/backup.service"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	backupID, err := cgroupID("system.slice/backup.service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := index.lookup(backupID, now.Add(cgroupWalkInterval/2)); err == nil {
+		t.Error("Expected the hierarchy not to be walked again right away")
+	}
+	if path, err := index.lookup(backupID, now.Add(cgroupWalkInterval)); err != nil || path != "system.slice/backup.service" {
+		t.Errorf("Expected the new cgroup to be found, got '%s' and %v", path, err)
+	}
+}
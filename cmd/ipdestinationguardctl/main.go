@@ -0,0 +1,403 @@
+// Command ipdestinationguardctl inspects and edits the live allowlist of the ipdestinationguard plugin through its
+// admin API, and checks Corefiles offline.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	ipdestinationguard "github.com/sateffen/coredns-ip-destination-guard"
+)
+
+const usage = `Usage: ipdestinationguardctl [-api URL] <command> [arguments]
+
+Commands talking to the admin API (adminListen) of a running plugin:
+  list                          List all dynamic entries
+  lookup <ip|domain>            Show the entries of an address, or of a domain and its subdomains
+  explain <ip>                  Explain why an address is allowed or rejected
+  add [-scope S] <ip> <ttl>     Allow an address temporarily, like "add 192.0.2.1 10m"
+  revoke [-scope S] <ip>        Revoke the entry of an address
+  ruleset                       Dump the ruleset created by the plugin in nft syntax
+
+Commands working offline:
+  check <Corefile>              Show the parsed configuration, chains and ruleset of a Corefile
+  bootscript <Corefile>         Write the ruleset of a Corefile as "nft -f" script, to be loaded at boot
+
+The API URL defaults to $IPDESTINATIONGUARD_API, or http://127.0.0.1:9180.
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// Runs the CLI with given arguments and returns its exit code.
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("ipdestinationguardctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, usage) }
+
+	defaultAPI := os.Getenv("IPDESTINATIONGUARD_API")
+	if defaultAPI == "" {
+		defaultAPI = "http://127.0.0.1:9180"
+	}
+	apiURL := flags.String("api", defaultAPI, "URL of the admin API")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	client := &apiClient{baseURL: strings.TrimSuffix(*apiURL, "/"), httpClient: &http.Client{Timeout: 10 * time.Second}}
+	command, commandArgs := flags.Arg(0), flags.Args()[1:]
+
+	var err error
+	switch command {
+	case "list":
+		err = client.list(stdout, "")
+	case "lookup":
+		err = requireArgs(commandArgs, 1, "lookup <ip|domain>")
+		if err == nil {
+			if ip := net.ParseIP(commandArgs[0]); ip != nil {
+				err = client.explain(stdout, commandArgs[0])
+			} else {
+				err = client.list(stdout, commandArgs[0])
+			}
+		}
+	case "explain":
+		err = requireArgs(commandArgs, 1, "explain <ip>")
+		if err == nil {
+			err = client.explain(stdout, commandArgs[0])
+		}
+	case "add", "revoke":
+		err = runEdit(client, command, commandArgs, stdout, stderr)
+	case "ruleset":
+		err = client.ruleset(stdout)
+	case "check":
+		err = requireArgs(commandArgs, 1, "check <Corefile>")
+		if err == nil {
+			err = check(stdout, commandArgs[0])
+		}
+	case "bootscript":
+		err = requireArgs(commandArgs, 1, "bootscript <Corefile>")
+		if err == nil {
+			err = bootScript(stdout, commandArgs[0])
+		}
+	default:
+		fmt.Fprintf(stderr, "unknown command '%s'\n\n", command)
+		flags.Usage()
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// Returns an error with given usage, if args doesn't contain exactly count arguments.
+func requireArgs(args []string, count int, usage string) error {
+	if len(args) != count {
+		return fmt.Errorf("usage: ipdestinationguardctl %s", usage)
+	}
+
+	return nil
+}
+
+// Runs the add and revoke commands, which share the -scope flag.
+func runEdit(client *apiClient, command string, args []string, stdout io.Writer, stderr io.Writer) error {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	scope := flags.String("scope", "", "client address, uid, or cgroup id or path of a scoped entry")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if command == "add" {
+		if err := requireArgs(flags.Args(), 2, "add [-scope S] <ip> <ttl>"); err != nil {
+			return err
+		}
+		return client.add(stdout, flags.Arg(0), flags.Arg(1), *scope)
+	}
+
+	if err := requireArgs(flags.Args(), 1, "revoke [-scope S] <ip>"); err != nil {
+		return err
+	}
+	return client.revoke(stdout, flags.Arg(0), *scope)
+}
+
+// A client of the admin API.
+type apiClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// Sends a request to the admin API and decodes its JSON response into result, if result isn't nil.
+func (client *apiClient) do(method string, path string, body interface{}, result interface{}) error {
+	var bodyReader io.Reader
+	if body != nil {
+		encodedBody, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		bodyReader = bytes.NewReader(encodedBody)
+	}
+
+	request, err := http.NewRequest(method, client.baseURL+path, bodyReader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 400 {
+		var apiError struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(response.Body).Decode(&apiError) == nil && apiError.Error != "" {
+			return fmt.Errorf("%s (%s)", apiError.Error, response.Status)
+		}
+		return fmt.Errorf("admin API returned %s", response.Status)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	if text, ok := result.(*string); ok {
+		content, err := io.ReadAll(response.Body)
+		*text = string(content)
+		return err
+	}
+
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+func (client *apiClient) list(stdout io.Writer, domain string) error {
+	path := "/v1/entries"
+	if domain != "" {
+		path += "?domain=" + url.QueryEscape(domain)
+	}
+
+	var entries []ipdestinationguard.AllowListEntry
+	if err := client.do(http.MethodGet, path, nil, &entries); err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		fmt.Fprintln(stdout, "No entries")
+		return nil
+	}
+
+	writeEntries(stdout, entries)
+	return nil
+}
+
+func (client *apiClient) explain(stdout io.Writer, ip string) error {
+	var explanation ipdestinationguard.Explanation
+	if err := client.do(http.MethodGet, "/v1/explain?ip="+url.QueryEscape(ip), nil, &explanation); err != nil {
+		return err
+	}
+
+	writeExplanation(stdout, &explanation)
+	return nil
+}
+
+func (client *apiClient) add(stdout io.Writer, ip string, ttl string, scope string) error {
+	body := map[string]string{"ip": ip, "ttl": ttl, "scope": scope}
+
+	var explanation ipdestinationguard.Explanation
+	if err := client.do(http.MethodPost, "/v1/entries", body, &explanation); err != nil {
+		return err
+	}
+
+	writeExplanation(stdout, &explanation)
+	return nil
+}
+
+func (client *apiClient) revoke(stdout io.Writer, ip string, scope string) error {
+	query := url.Values{"ip": {ip}}
+	if scope != "" {
+		query.Set("scope", scope)
+	}
+
+	if err := client.do(http.MethodDelete, "/v1/entries?"+query.Encode(), nil, nil); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "Revoked %s\n", ip)
+	return nil
+}
+
+func (client *apiClient) ruleset(stdout io.Writer) error {
+	var ruleset string
+	if err := client.do(http.MethodGet, "/v1/ruleset", nil, &ruleset); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(stdout, ruleset)
+	return err
+}
+
+// Checks given Corefile offline and writes the result of each ipdestinationguard block.
+func check(stdout io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	checks, err := ipdestinationguard.CheckCorefile(path, file)
+	if err != nil {
+		return err
+	}
+
+	if len(checks) == 0 {
+		return fmt.Errorf("no ipdestinationguard block found in %s", path)
+	}
+
+	failed := 0
+	for i, configCheck := range checks {
+		if i > 0 {
+			fmt.Fprintln(stdout)
+		}
+		fmt.Fprintf(stdout, "Server block %s\n\n", strings.Join(configCheck.ServerKeys, " "))
+
+		if configCheck.Err != nil {
+			fmt.Fprintf(stdout, "Invalid configuration: %v\n", configCheck.Err)
+			failed++
+			continue
+		}
+
+		fmt.Fprintf(stdout, "%s\nChains: %s\n\n%s", configCheck.Summary, strings.Join(configCheck.Chains, ", "), configCheck.Ruleset)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d ipdestinationguard blocks are invalid", failed, len(checks))
+	}
+
+	return nil
+}
+
+// Writes the boot script of the ipdestinationguard blocks of the Corefile at given path. All blocks share one table,
+// so a Corefile with multiple blocks is accepted, as long as all of them render the same script.
+func bootScript(stdout io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	checks, err := ipdestinationguard.CheckCorefile(path, file)
+	if err != nil {
+		return err
+	}
+
+	if len(checks) == 0 {
+		return fmt.Errorf("expected an ipdestinationguard block in %s, found none", path)
+	}
+	for _, configCheck := range checks {
+		if configCheck.Err != nil {
+			return fmt.Errorf("invalid configuration of block %s: %w", strings.Join(configCheck.ServerKeys, " "), configCheck.Err)
+		}
+		if configCheck.BootScript != checks[0].BootScript {
+			return fmt.Errorf("block %s renders a different boot script than block %s", strings.Join(configCheck.ServerKeys, " "), strings.Join(checks[0].ServerKeys, " "))
+		}
+	}
+
+	_, err = io.WriteString(stdout, checks[0].BootScript)
+
+	return err
+}
+
+// Writes given entries as table.
+func writeEntries(stdout io.Writer, entries []ipdestinationguard.AllowListEntry) {
+	table := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "IP\tSCOPE\tDOMAIN\tCLIENT\tEXPIRES IN")
+
+	for _, entry := range entries {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%v\n", entry.IP, orDash(entry.Scope), orDash(entry.Domain), orDash(entry.Client),
+			time.Duration(entry.TTL)*time.Second)
+	}
+
+	table.Flush()
+}
+
+// Writes given explanation in human readable form.
+func writeExplanation(stdout io.Writer, explanation *ipdestinationguard.Explanation) {
+	if !explanation.Allowed {
+		fmt.Fprintf(stdout, "%s is rejected: no permanent range and no dynamic entry allows it\n", explanation.IP)
+		return
+	}
+
+	fmt.Fprintf(stdout, "%s is allowed by:\n", explanation.IP)
+	for _, match := range explanation.Permanent {
+		cgroup := ""
+		if match.Cgroup != "" {
+			cgroup = " for cgroup " + match.Cgroup
+		}
+		fmt.Fprintf(stdout, "  %s %s%s (chains: %s)\n", match.Directive, match.Range, cgroup, strings.Join(match.Chains, ", "))
+	}
+
+	if len(explanation.Entries) > 0 {
+		fmt.Fprintln(stdout, "  dynamic entries:")
+		writeEntries(&indentWriter{writer: stdout, indent: "    "}, explanation.Entries)
+	}
+}
+
+// Returns "-" for empty strings, so table columns stay aligned.
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return value
+}
+
+// A writer indenting every line written to it.
+type indentWriter struct {
+	writer    io.Writer
+	indent    string
+	midOfLine bool
+}
+
+func (writer *indentWriter) Write(content []byte) (int, error) {
+	var buffer bytes.Buffer
+	for _, char := range content {
+		if !writer.midOfLine {
+			buffer.WriteString(writer.indent)
+			writer.midOfLine = true
+		}
+		buffer.WriteByte(char)
+		if char == '\n' {
+			writer.midOfLine = false
+		}
+	}
+
+	if _, err := writer.writer.Write(buffer.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return len(content), nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ipdestinationguard "github.com/sateffen/coredns-ip-destination-guard"
+)
+
+func TestRun(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/entries", func(writer http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case http.MethodGet:
+			json.NewEncoder(writer).Encode([]ipdestinationguard.AllowListEntry{
+				{IP: "203.0.113.1", Domain: "example.com.", Client: "10.0.0.5", TTL: 90},
+			})
+		case http.MethodPost:
+			writer.WriteHeader(http.StatusCreated)
+			json.NewEncoder(writer).Encode(ipdestinationguard.Explanation{IP: "203.0.113.2", Allowed: true})
+		case http.MethodDelete:
+			writer.WriteHeader(http.StatusNotFound)
+			writer.Write([]byte(`{"error": "route not found in allowlist"}`))
+		}
+	})
+	mux.HandleFunc("/v1/explain", func(writer http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(writer).Encode(ipdestinationguard.Explanation{
+			IP:        request.URL.Query().Get("ip"),
+			Allowed:   true,
+			Permanent: []ipdestinationguard.PermanentMatch{{Directive: "allowedIPs", Range: "9.9.9.9-9.9.9.9", Chains: []string{"output"}}},
+		})
+	})
+	mux.HandleFunc("/v1/ruleset", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("table inet coredns-ip-destination-guard {\n}\n"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	corefile := filepath.Join(t.TempDir(), "Corefile")
+	if err := os.WriteFile(corefile, []byte(". {\n    ipdestinationguard nft-local 9.9.9.9\n}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	emptyCorefile := filepath.Join(t.TempDir(), "Corefile.empty")
+	if err := os.WriteFile(emptyCorefile, []byte(". {\n    whoami\n}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	multipleCorefile := filepath.Join(t.TempDir(), "Corefile.multiple")
+	if err := os.WriteFile(multipleCorefile, []byte(".:53 {\n    ipdestinationguard nft-local 9.9.9.9\n}\n.:5353 {\n    ipdestinationguard nft-local 9.9.9.9\n}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	differentCorefile := filepath.Join(t.TempDir(), "Corefile.different")
+	if err := os.WriteFile(differentCorefile, []byte(".:53 {\n    ipdestinationguard nft-local 9.9.9.9\n}\n.:5353 {\n    ipdestinationguard nft-local 1.1.1.1\n}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedCode   int
+		expectedStdout string
+		expectedStderr string
+	}{
+		{"list", []string{"list"}, 0, "203.0.113.1  -      example.com.  10.0.0.5  1m30s", ""},
+		{"lookup ip", []string{"lookup", "9.9.9.9"}, 0, "9.9.9.9 is allowed by:\n  allowedIPs 9.9.9.9-9.9.9.9 (chains: output)", ""},
+		{"lookup domain", []string{"lookup", "example.com"}, 0, "example.com.", ""},
+		{"explain", []string{"explain", "9.9.9.9"}, 0, "allowedIPs", ""},
+		{"add", []string{"add", "-scope", "10.0.0.5", "203.0.113.2", "5m"}, 0, "203.0.113.2 is allowed by:", ""},
+		{"add without ttl", []string{"add", "203.0.113.2"}, 1, "", "usage: ipdestinationguardctl add"},
+		{"revoke missing entry", []string{"revoke", "203.0.113.2"}, 1, "", "route not found in allowlist"},
+		{"ruleset", []string{"ruleset"}, 0, "table inet coredns-ip-destination-guard", ""},
+		{"check", []string{"check", corefile}, 0, "Chains: output", ""},
+		{"check missing file", []string{"check", corefile + ".missing"}, 1, "", "no such file"},
+		{"bootscript", []string{"bootscript", corefile}, 0, "flush table inet coredns-ip-destination-guard\n\ntable inet", ""},
+		{"bootscript without block", []string{"bootscript", emptyCorefile}, 1, "", "expected an ipdestinationguard block"},
+		{"bootscript of multiple blocks", []string{"bootscript", multipleCorefile}, 0, "flush table inet coredns-ip-destination-guard\n\ntable inet", ""},
+		{"bootscript of different blocks", []string{"bootscript", differentCorefile}, 1, "", "invalid configuration of block .:5353"},
+		{"unknown command", []string{"frobnicate"}, 2, "", "unknown command 'frobnicate'"},
+		{"no command", []string{}, 2, "", "Usage:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := run(append([]string{"-api", server.URL}, tt.args...), &stdout, &stderr)
+
+			if code != tt.expectedCode {
+				t.Errorf("Expected exit code %d, got %d (stderr: %s)", tt.expectedCode, code, stderr.String())
+			}
+			if !strings.Contains(stdout.String(), tt.expectedStdout) {
+				t.Errorf("Expected stdout to contain %q, got:\n%s", tt.expectedStdout, stdout.String())
+			}
+			if !strings.Contains(stderr.String(), tt.expectedStderr) {
+				t.Errorf("Expected stderr to contain %q, got:\n%s", tt.expectedStderr, stderr.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package ipdestinationguard
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+)
+
+// ConfigCheck is the result of checking one ipdestinationguard block of a Corefile offline.
+type ConfigCheck struct {
+	ServerKeys []string // Keys of the server block, like ".:53"
+	Summary    string   // The parsed configuration in human readable form, empty if it couldn't be parsed
+	Chains     []string // Chains the plugin would create
+	Ruleset    string   // Ruleset the plugin would create, in nft syntax
+	BootScript string   // Ruleset as standalone "nft -f" script, to be loaded at boot before CoreDNS starts
+	Err        error    // Error of parseConfig or validateConfig
+}
+
+// CheckCorefile parses given Corefile and runs parseConfig and validateConfig on every ipdestinationguard block, and
+// checks that all of them create the same ruleset, without touching nftables. An error is only returned, if the Corefile itself can't be parsed.
+func CheckCorefile(filename string, input io.Reader) ([]ConfigCheck, error) {
+	serverBlocks, err := caddyfile.Parse(filename, input, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like the instance of a real start, it records the ruleset of the first valid block, that the others must match
+	tableClaims := caddy.NewTestController("dns", "")
+
+	var checks []ConfigCheck
+	for _, serverBlock := range serverBlocks {
+		tokens, found := serverBlock.Tokens[pluginName]
+		if !found {
+			continue
+		}
+
+		check := ConfigCheck{ServerKeys: serverBlock.Keys}
+
+		// The controller of the dns server type, so parseConfig can look up the server config like during setup
+		c := caddy.NewTestController("dns", "")
+		c.Dispenser = caddyfile.NewDispenserTokens(filename, tokens)
+
+		// All tokens of the plugin are grouped, so a block might contain the plugin multiple times
+		for c.Next() {
+			config, err := parseConfig(c)
+			if err == nil {
+				err = validateConfig(config)
+			}
+			if err == nil {
+				err = claimSharedTable(tableClaims, config)
+			}
+			if err != nil {
+				check.Err = err
+				break
+			}
+
+			check.Summary = describeConfig(config)
+			check.Chains = chainsForMode(config.mode)
+			check.Ruleset = renderRuleset(config)
+			check.BootScript = renderBootScript(config)
+		}
+
+		checks = append(checks, check)
+	}
+
+	return checks, nil
+}
+
+// Returns given config in human readable form, one setting per line.
+func describeConfig(config *parsedConfig) string {
+	var builder strings.Builder
+
+	line := func(name string, format string, args ...interface{}) {
+		fmt.Fprintf(&builder, "%-20s %s\n", name, fmt.Sprintf(format, args...))
+	}
+	ranges := func(ips []net.IP) string {
+		all := append(renderIPRanges(ips, false), renderIPRanges(ips, true)...)
+		if len(all) == 0 {
+			return "-"
+		}
+		return strings.Join(all, ", ")
+	}
+
+	line("mode", "%s", config.mode)
+	line("enforcement", "%s", config.enforcement)
+	line("scope", "%s", config.scope)
+	if config.scope == ScopeCgroup {
+		line("cgroupLevel", "%d", config.cgroupLevel)
+	}
+	line("allowedIPs", "%s", ranges(config.allowedIPs))
+	line("allowedLocalIPs", "%s", ranges(config.allowedLocalIPs))
+	line("allowedGatewayIPs", "%s", ranges(config.allowedGatewayIPs))
+	for _, allowance := range config.allowedCgroupIPs {
+		line("allowedCgroupIPs", "%s: %s", allowance.path, ranges(allowance.allowedIPs))
+	}
+
+	line("commitMode", "%s", config.commitMode)
+	if config.commitMode == CommitModeSync {
+		line("commitTimeout", "%v", config.commitTimeout)
+	}
+	line("onFirewallError", "%s", config.onFirewallError)
+	line("queue", "%d %s", config.queueSize, config.queueOverflow)
+
+	hintTypes := make([]string, 0, len(config.hintRecordTypes))
+	for _, recordType := range config.hintRecordTypes {
+		hintTypes = append(hintTypes, dns.TypeToString[recordType])
+	}
+	if len(hintTypes) == 0 {
+		hintTypes = append(hintTypes, "none")
+	}
+	line("svcbHints", "%s", strings.Join(hintTypes, " "))
+	line("additionalSection", "%v", config.additionalSection)
+
+	if config.domainPolicy != nil {
+		for i := range config.domainPolicy.patterns {
+			pattern := &config.domainPolicy.patterns[i]
+			directive := "denyDomains"
+			if pattern.allow {
+				directive = "allowDomains"
+			}
+			line(directive, "%s", pattern)
+		}
+		line("requireDomainMatch", "%v", config.domainPolicy.requireMatch)
+	}
+
+	if config.ttlPolicy != nil {
+		line("gracePeriod", "%v", config.ttlPolicy.gracePeriod)
+		if config.ttlPolicy.minLifetime > 0 {
+			line("minLifetime", "%v", config.ttlPolicy.minLifetime)
+		}
+		if config.ttlPolicy.maxLifetime > 0 {
+			line("maxLifetime", "%v", config.ttlPolicy.maxLifetime)
+		}
+		for i := range config.ttlPolicy.overrides {
+			override := &config.ttlPolicy.overrides[i]
+			line("domainLifetime", "%v %s", override.lifetime, &override.pattern)
+		}
+	}
+	line("recoveryLifetime", "%v", config.recoveryLifetime)
+
+	if config.nflogGroup != 0 {
+		line("nflogGroup", "%d", config.nflogGroup)
+	}
+
+	if config.learnFile != "" {
+		line("learn", "%s %v", config.learnFile, config.learnDuration)
+	}
+
+	if config.stateFile != "" {
+		line("stateFile", "%s %v", config.stateFile, config.stateInterval)
+	}
+
+	line("onShutdown", "%s", config.onShutdown)
+	line("ownedTable", "%v", config.ownedTable)
+	line("reconcileInterval", "%v", config.reconcileInterval)
+
+	if config.adminInsecure {
+		line("adminListen", "%s insecure", config.adminListen)
+	} else if config.adminListen != "" {
+		line("adminListen", "%s", config.adminListen)
+	}
+
+	return builder.String()
+}
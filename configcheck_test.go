@@ -0,0 +1,124 @@
+package ipdestinationguard
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckCorefile(t *testing.T) {
+	corefile := `
+. {
+    forward . 9.9.9.9
+    ipdestinationguard {
+        mode nft-local
+        allowedIPs 9.9.9.9
+        scope user
+        allowDomains example.com
+    }
+}
+
+example.org:5353 {
+    ipdestinationguard {
+        mode nft-gateway
+        scope user
+    }
+}
+
+internal.lan {
+    whoami
+}
+`
+
+	checks, err := CheckCorefile("Corefile", strings.NewReader(corefile))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(checks) != 2 {
+		t.Fatalf("Expected 2 checks, got %d: %+v", len(checks), checks)
+	}
+
+	valid := checks[0]
+	if valid.Err != nil {
+		t.Fatalf("Expected first block to be valid, got %v", valid.Err)
+	}
+	if !reflect.DeepEqual(valid.ServerKeys, []string{"."}) {
+		t.Errorf("Unexpected server keys %v", valid.ServerKeys)
+	}
+	if !reflect.DeepEqual(valid.Chains, []string{"output"}) {
+		t.Errorf("Expected chains [output], got %v", valid.Chains)
+	}
+	for _, expected := range []string{"mode                 nft-local\n", "scope                user\n", "allowDomains         example.com.\n"} {
+		if !strings.Contains(valid.Summary, expected) {
+			t.Errorf("Expected summary to contain %q, got:\n%s", expected, valid.Summary)
+		}
+	}
+	if !strings.Contains(valid.Ruleset, "meta skuid . ip daddr @ipv4userallowlist accept") {
+		t.Errorf("Expected user scoped ruleset, got:\n%s", valid.Ruleset)
+	}
+
+	if !strings.HasSuffix(valid.BootScript, valid.Ruleset) {
+		t.Errorf("Expected boot script ending with the ruleset, got:\n%s", valid.BootScript)
+	}
+
+	invalid := checks[1]
+	if invalid.Err == nil {
+		t.Errorf("Expected second block to be invalid")
+	}
+	if !reflect.DeepEqual(invalid.ServerKeys, []string{"example.org:5353"}) {
+		t.Errorf("Unexpected server keys %v", invalid.ServerKeys)
+	}
+	if invalid.Ruleset != "" {
+		t.Errorf("Expected no ruleset for an invalid block, got:\n%s", invalid.Ruleset)
+	}
+}
+
+func TestCheckCorefileDifferentRulesets(t *testing.T) {
+	corefile := `
+. {
+    ipdestinationguard {
+        mode nft-local
+        allowedIPs 9.9.9.9
+    }
+}
+
+example.org:5353 {
+    ipdestinationguard {
+        allowedIPs 9.9.9.9
+        mode nft-local
+    }
+}
+
+example.net:5353 {
+    ipdestinationguard {
+        mode nft-local
+        allowedIPs 1.1.1.1
+    }
+}
+`
+
+	checks, err := CheckCorefile("Corefile", strings.NewReader(corefile))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(checks) != 3 {
+		t.Fatalf("Expected 3 checks, got %d: %+v", len(checks), checks)
+	}
+
+	// The order of the directives doesn't matter, only the resulting ruleset
+	for _, check := range checks[:2] {
+		if check.Err != nil {
+			t.Errorf("Expected block %v to be valid, got %v", check.ServerKeys, check.Err)
+		}
+	}
+	if checks[2].Err == nil || !strings.Contains(checks[2].Err.Error(), "must configure the same ruleset") {
+		t.Errorf("Expected the block with other allowedIPs to be rejected, got %v", checks[2].Err)
+	}
+}
+
+func TestCheckCorefileSyntaxError(t *testing.T) {
+	if _, err := CheckCorefile("Corefile", strings.NewReader(". {\n    ipdestinationguard {\n        mode nft-local\n")); err == nil {
+		t.Errorf("Expected error for unterminated block")
+	}
+}
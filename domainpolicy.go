@@ -0,0 +1,167 @@
+package ipdestinationguard
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// A single allowDomains or denyDomains entry. "example.com" matches the domain and all its subdomains,
+// "*.example.com" matches only the subdomains.
+type domainPattern struct {
+	suffix   string // Canonical name the pattern is anchored at, like "example.com."
+	wildcard bool   // Whether the suffix itself is excluded
+	allow    bool   // Whether matching names are allowed or denied
+}
+
+// DomainPolicy decides, whether the addresses of an answer may open the firewall, based on the queried names.
+type DomainPolicy struct {
+	patterns     []domainPattern
+	requireMatch bool // Whether names matching no pattern are denied
+}
+
+// Parses given allowDomains/denyDomains entry.
+func parseDomainPattern(str string, allow bool) (domainPattern, error) {
+	pattern := domainPattern{allow: allow}
+
+	name := str
+	if strings.HasPrefix(name, "*.") {
+		pattern.wildcard = true
+		name = name[2:]
+	}
+
+	if name == "" || strings.Contains(name, "*") {
+		return pattern, fmt.Errorf("invalid domain pattern '%s'", str)
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return pattern, fmt.Errorf("invalid domain pattern '%s'", str)
+	}
+
+	pattern.suffix = dns.CanonicalName(name)
+
+	return pattern, nil
+}
+
+// Returns the pattern like it's configured.
+func (pattern *domainPattern) String() string {
+	if pattern.wildcard {
+		return "*." + pattern.suffix
+	}
+
+	return pattern.suffix
+}
+
+// Returns whether given canonical name matches the pattern.
+func (pattern *domainPattern) matches(name string) bool {
+	if name == pattern.suffix {
+		return !pattern.wildcard
+	}
+
+	return pattern.suffix == "." || strings.HasSuffix(name, "."+pattern.suffix)
+}
+
+// Returns how specific the pattern is. Longer suffixes are more specific, and a wildcard is more specific than
+// the plain pattern with the same suffix.
+func (pattern *domainPattern) specificity() int {
+	specificity := 2 * dns.CountLabel(pattern.suffix)
+	if pattern.wildcard {
+		specificity++
+	}
+
+	return specificity
+}
+
+// Adds given pattern to the policy.
+func (policy *DomainPolicy) add(pattern domainPattern) {
+	policy.patterns = append(policy.patterns, pattern)
+}
+
+// Returns whether the policy contains any allow pattern.
+func (policy *DomainPolicy) hasAllowPatterns() bool {
+	for _, pattern := range policy.patterns {
+		if pattern.allow {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the verdict of the most specific pattern matching given name, and whether any pattern matched at all.
+// If an allow and a deny pattern are equally specific, deny wins.
+func (policy *DomainPolicy) verdict(name string) (allowed bool, matched bool) {
+	name = dns.CanonicalName(name)
+	bestSpecificity := -1
+
+	for i := range policy.patterns {
+		pattern := &policy.patterns[i]
+		if !pattern.matches(name) {
+			continue
+		}
+
+		specificity := pattern.specificity()
+		if specificity > bestSpecificity || (specificity == bestSpecificity && !pattern.allow) {
+			bestSpecificity = specificity
+			allowed = pattern.allow
+		}
+	}
+
+	return allowed, bestSpecificity >= 0
+}
+
+// Allows returns whether the addresses of the answer for given query may open the firewall. The queried name and
+// all names of its CNAME chain are checked: a single denied name denies the answer, and with requireMatch at least
+// one name has to be allowed explicitly.
+func (policy *DomainPolicy) Allows(query *QueryInfo) bool {
+	if policy == nil {
+		return true
+	}
+
+	names := make([]string, 0, 1+len(query.CNAMEChain))
+	names = append(names, query.Name)
+	names = append(names, query.CNAMEChain...)
+
+	anyAllowed := false
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+
+		allowed, matched := policy.verdict(name)
+		if matched && !allowed {
+			return false
+		}
+		anyAllowed = anyAllowed || matched
+	}
+
+	return anyAllowed || !policy.requireMatch
+}
+
+// Reads a domain list file with one pattern per line. Empty lines and lines starting with # are ignored.
+func readDomainListFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var domains []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		domains = append(domains, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return domains, nil
+}
@@ -0,0 +1,218 @@
+package ipdestinationguard
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Returns a policy with given allow and deny patterns, failing the test on invalid patterns.
+func testDomainPolicy(t *testing.T, allow []string, deny []string, requireMatch bool) *DomainPolicy {
+	t.Helper()
+
+	policy := &DomainPolicy{requireMatch: requireMatch}
+	for _, domain := range allow {
+		pattern, err := parseDomainPattern(domain, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		policy.add(pattern)
+	}
+	for _, domain := range deny {
+		pattern, err := parseDomainPattern(domain, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		policy.add(pattern)
+	}
+
+	return policy
+}
+
+func TestParseDomainPattern(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedSuffix   string
+		expectedWildcard bool
+		shouldError      bool
+	}{
+		{input: "example.com", expectedSuffix: "example.com."},
+		{input: "Example.COM.", expectedSuffix: "example.com."},
+		{input: "*.example.com", expectedSuffix: "example.com.", expectedWildcard: true},
+		{input: ".", expectedSuffix: "."},
+		{input: "*.", shouldError: true},
+		{input: "foo.*.example.com", shouldError: true},
+		{input: "*example.com", shouldError: true},
+		{input: "", shouldError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			pattern, err := parseDomainPattern(tt.input, true)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if pattern.suffix != tt.expectedSuffix {
+				t.Errorf("Expected suffix '%s', got '%s'", tt.expectedSuffix, pattern.suffix)
+			}
+
+			if pattern.wildcard != tt.expectedWildcard {
+				t.Errorf("Expected wildcard %v, got %v", tt.expectedWildcard, pattern.wildcard)
+			}
+		})
+	}
+}
+
+func TestDomainPolicyAllows(t *testing.T) {
+	tests := []struct {
+		name         string
+		allow        []string
+		deny         []string
+		requireMatch bool
+		query        *QueryInfo
+		expected     bool
+	}{
+		{
+			name:     "no patterns",
+			query:    &QueryInfo{Name: "example.com."},
+			expected: true,
+		},
+		{
+			name:     "denied suffix",
+			deny:     []string{"ads.example"},
+			query:    &QueryInfo{Name: "tracker.ads.example."},
+			expected: false,
+		},
+		{
+			name:     "denied apex",
+			deny:     []string{"ads.example"},
+			query:    &QueryInfo{Name: "ADS.example."},
+			expected: false,
+		},
+		{
+			name:     "suffix doesn't match partial labels",
+			deny:     []string{"ads.example"},
+			query:    &QueryInfo{Name: "badads.example."},
+			expected: true,
+		},
+		{
+			name:     "wildcard doesn't match apex",
+			deny:     []string{"*.example.com"},
+			query:    &QueryInfo{Name: "example.com."},
+			expected: true,
+		},
+		{
+			name:     "wildcard matches subdomain",
+			deny:     []string{"*.example.com"},
+			query:    &QueryInfo{Name: "www.example.com."},
+			expected: false,
+		},
+		{
+			name:     "more specific allow overrides deny",
+			allow:    []string{"api.example.com"},
+			deny:     []string{"example.com"},
+			query:    &QueryInfo{Name: "v1.api.example.com."},
+			expected: true,
+		},
+		{
+			name:         "more specific deny overrides allow",
+			allow:        []string{"example.com"},
+			deny:         []string{"ads.example.com"},
+			requireMatch: true,
+			query:        &QueryInfo{Name: "ads.example.com."},
+			expected:     false,
+		},
+		{
+			name:     "deny wins on equal specificity",
+			allow:    []string{"example.com"},
+			deny:     []string{"example.com"},
+			query:    &QueryInfo{Name: "example.com."},
+			expected: false,
+		},
+		{
+			name:         "required match without match",
+			allow:        []string{"example.com"},
+			requireMatch: true,
+			query:        &QueryInfo{Name: "example.org."},
+			expected:     false,
+		},
+		{
+			name:         "required match with match",
+			allow:        []string{"example.com"},
+			requireMatch: true,
+			query:        &QueryInfo{Name: "www.example.com."},
+			expected:     true,
+		},
+		{
+			name:         "required match satisfied by cname target",
+			allow:        []string{"cdn.example"},
+			requireMatch: true,
+			query:        &QueryInfo{Name: "www.example.com.", CNAMEChain: []string{"edge.cdn.example."}},
+			expected:     true,
+		},
+		{
+			name:     "denied cname target",
+			deny:     []string{"tracker.example"},
+			query:    &QueryInfo{Name: "metrics.example.com.", CNAMEChain: []string{"a.tracker.example."}},
+			expected: false,
+		},
+		{
+			name:         "root allows everything",
+			allow:        []string{"."},
+			deny:         []string{"ads.example"},
+			requireMatch: true,
+			query:        &QueryInfo{Name: "example.org."},
+			expected:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := testDomainPolicy(t, tt.allow, tt.deny, tt.requireMatch)
+
+			if result := policy.Allows(tt.query); result != tt.expected {
+				t.Errorf("Expected Allows to return %v, got %v", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestDomainPolicyAllowsNil(t *testing.T) {
+	var policy *DomainPolicy
+
+	if !policy.Allows(&QueryInfo{Name: "example.com."}) {
+		t.Error("Expected nil policy to allow everything")
+	}
+}
+
+func TestReadDomainListFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "domains.txt")
+	content := "# ad networks\nads.example\n\n  *.tracker.example  \n# end\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	domains, err := readDomainListFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []string{"ads.example", "*.tracker.example"}
+	if !reflect.DeepEqual(domains, expected) {
+		t.Errorf("Expected domains %v, got %v", expected, domains)
+	}
+
+	if _, err := readDomainListFile(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
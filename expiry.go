@@ -0,0 +1,142 @@
+package ipdestinationguard
+
+import (
+	"container/heap"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// Entries expiring within this resolution are removed together, so a busy allowList doesn't wake the manager
+// goroutine for every single entry.
+const expiryResolution = time.Second
+
+// Key of a route within the NFTablesManager.allowList and routeQueue. Unlike the string form of the address, building
+// it doesn't allocate.
+type routeKey struct {
+	scope string // scopeLabel of the route, empty for the global sets
+	addr  netip.Addr
+}
+
+// Returns a readable form of this key, like "10.0.0.5/192.0.2.1" for scoped routes.
+func (key routeKey) String() string {
+	if key.scope == "" {
+		return key.addr.String()
+	}
+
+	return key.scope + "/" + key.addr.String()
+}
+
+// Returns the key of given address within given scope label, empty for the global sets.
+func newRouteKey(scopeLabel string, ip net.IP) routeKey {
+	addr, _ := netip.AddrFromSlice(ip)
+	return routeKey{scope: scopeLabel, addr: addr}
+}
+
+// Entries of the allowList ordered by their expiry, the next one to expire first. Each route knows its position, so
+// it can be moved or removed without searching for it.
+type expiryHeap []*allowRoute
+
+func (expiries expiryHeap) Len() int { return len(expiries) }
+
+func (expiries expiryHeap) Less(i, j int) bool {
+	return expiries[i].validUnitl.Before(expiries[j].validUnitl)
+}
+
+func (expiries expiryHeap) Swap(i, j int) {
+	expiries[i], expiries[j] = expiries[j], expiries[i]
+	expiries[i].expiryIndex = i
+	expiries[j].expiryIndex = j
+}
+
+func (expiries *expiryHeap) Push(x any) {
+	route := x.(*allowRoute)
+	route.expiryIndex = len(*expiries)
+	*expiries = append(*expiries, route)
+}
+
+func (expiries *expiryHeap) Pop() any {
+	old := *expiries
+	route := old[len(old)-1]
+	old[len(old)-1] = nil
+	route.expiryIndex = -1
+	*expiries = old[:len(old)-1]
+	return route
+}
+
+// Adds given route to the allowList, replacing an existing entry of the same key. This must only be called by the
+// manager goroutine, or before it started.
+func (manager *NFTablesManager) storeRoute(route *allowRoute) {
+	key := route.key()
+	if existingRoute, exists := manager.allowList[key]; exists {
+		heap.Remove(&manager.expiries, existingRoute.expiryIndex)
+	}
+
+	manager.allowList[key] = route
+	heap.Push(&manager.expiries, route)
+}
+
+// Removes given route from the allowList. This must only be called by the manager goroutine.
+func (manager *NFTablesManager) removeRoute(route *allowRoute) {
+	delete(manager.allowList, route.key())
+	heap.Remove(&manager.expiries, route.expiryIndex)
+}
+
+// Changes the expiry of given route of the allowList. This must only be called by the manager goroutine.
+func (manager *NFTablesManager) setExpiry(route *allowRoute, validUntil time.Time) {
+	route.validUnitl = validUntil
+	heap.Fix(&manager.expiries, route.expiryIndex)
+}
+
+// Removes all entries, that expired before given time, from the allowList. The kernel removes their elements on its
+// own, so only the local state is updated. This must only be called by the manager goroutine.
+func (manager *NFTablesManager) expireRoutes(now time.Time) {
+	var ipv4ExpiredCount, ipv6ExpiredCount int
+
+	for len(manager.expiries) > 0 && now.After(manager.expiries[0].validUnitl) {
+		route := heap.Pop(&manager.expiries).(*allowRoute)
+		delete(manager.allowList, route.key())
+
+		if len(route.ipAddress) == net.IPv4len {
+			ipv4ExpiredCount++
+		} else {
+			ipv6ExpiredCount++
+		}
+
+		manager.domainHistory.record(route.ipAddress, route.domain)
+		manager.allowRoutePool.Put(route)
+	}
+
+	ipv4AllowListEntries.Sub(float64(ipv4ExpiredCount))
+	ipv6AllowListEntries.Sub(float64(ipv6ExpiredCount))
+	ipv4AllowListExpiredTotal.Add(float64(ipv4ExpiredCount))
+	ipv6AllowListExpiredTotal.Add(float64(ipv6ExpiredCount))
+}
+
+// Schedules the expiry timer for the entry expiring next, unless it's scheduled early enough already. This must only
+// be called by the manager goroutine.
+func (manager *NFTablesManager) scheduleExpiry(now time.Time) {
+	if len(manager.expiries) == 0 {
+		return
+	}
+
+	expiresAt := manager.expiries[0].validUnitl.Add(expiryResolution)
+	if manager.expiryTimer != nil && !expiresAt.Before(manager.expiryAt) {
+		return
+	}
+
+	if manager.expiryTimer != nil {
+		manager.expiryTimer.Stop()
+	}
+	manager.expiryAt = expiresAt
+	manager.expiryTimer = time.NewTimer(max(expiresAt.Sub(now), 0))
+}
+
+// Returns the channel of the scheduled expiry, or nil, which never fires, if none is scheduled.
+func (manager *NFTablesManager) expiryChannel() <-chan time.Time {
+	if manager.expiryTimer == nil {
+		return nil
+	}
+
+	return manager.expiryTimer.C
+}
@@ -0,0 +1,126 @@
+package ipdestinationguard
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns the allowList key for given readable form, like "10.0.0.5/192.0.2.1".
+func parseRouteKey(key string) routeKey {
+	scope, addr := "", key
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		scope, addr = key[:i], key[i+1:]
+	}
+
+	return routeKey{scope: scope, addr: netip.MustParseAddr(addr)}
+}
+
+// Verifies, that each route knows its position in the heap, and no route expires before its parent.
+func checkExpiryHeap(t *testing.T, manager *NFTablesManager) {
+	t.Helper()
+
+	if len(manager.expiries) != len(manager.allowList) {
+		t.Fatalf("Expected %d heap entries, got %d", len(manager.allowList), len(manager.expiries))
+	}
+	for i, route := range manager.expiries {
+		if route.expiryIndex != i {
+			t.Errorf("Expected %v at index %d, got %d", route.ipAddress, i, route.expiryIndex)
+		}
+		if i > 0 && route.validUnitl.Before(manager.expiries[(i-1)/2].validUnitl) {
+			t.Errorf("Expected %v to expire after its parent", route.ipAddress)
+		}
+		if manager.allowList[route.key()] != route {
+			t.Errorf("Expected %v in the allowList", route.ipAddress)
+		}
+	}
+}
+
+func TestRouteKey(t *testing.T) {
+	ipv4 := net.ParseIP("192.0.2.1").To4()
+
+	if newRouteKey("", ipv4) != parseRouteKey("192.0.2.1") {
+		t.Errorf("Expected equal keys for the same address")
+	}
+	if newRouteKey("10.0.0.5", ipv4) == newRouteKey("", ipv4) {
+		t.Errorf("Expected scoped and global keys to differ")
+	}
+	if key := newRouteKey("1000", net.ParseIP("2001:db8::1")); key.String() != "1000/2001:db8::1" {
+		t.Errorf("Expected key '1000/2001:db8::1', got '%s'", key)
+	}
+}
+
+func TestExpireRoutes(t *testing.T) {
+	manager := newStoppedTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+	now := time.Now()
+
+	routes := make([]*allowRoute, 10)
+	for i := range routes {
+		routes[i] = &allowRoute{ipAddress: net.IPv4(192, 0, 2, byte(i)).To4(), validUnitl: now.Add(time.Duration(i-5) * time.Minute)}
+		manager.storeRoute(routes[i])
+	}
+	checkExpiryHeap(t, manager)
+
+	// Refreshed and revoked entries move within or leave the heap
+	manager.setExpiry(routes[0], now.Add(time.Hour))
+	manager.setExpiry(routes[9], now.Add(-time.Second))
+	manager.removeRoute(routes[1])
+	checkExpiryHeap(t, manager)
+
+	manager.expireRoutes(now)
+	checkExpiryHeap(t, manager)
+
+	// Entries 2 to 4 and 9 expired, 5 expires right now, but isn't past its expiry yet
+	expectedRemaining := []int{0, 5, 6, 7, 8}
+	if len(manager.allowList) != len(expectedRemaining) {
+		t.Fatalf("Expected %d remaining entries, got %d", len(expectedRemaining), len(manager.allowList))
+	}
+	for _, i := range expectedRemaining {
+		if _, exists := manager.allowList[routes[i].key()]; !exists {
+			t.Errorf("Expected %v to remain", routes[i].ipAddress)
+		}
+	}
+}
+
+func TestScheduleExpiry(t *testing.T) {
+	manager := newStoppedTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+	now := time.Now()
+
+	manager.scheduleExpiry(now)
+	if manager.expiryChannel() != nil {
+		t.Fatal("Expected no expiry to be scheduled for an empty allowList")
+	}
+
+	manager.storeRoute(&allowRoute{ipAddress: net.ParseIP("192.0.2.1").To4(), validUnitl: now.Add(time.Hour)})
+	manager.scheduleExpiry(now)
+	if !manager.expiryAt.Equal(now.Add(time.Hour + expiryResolution)) {
+		t.Errorf("Expected the expiry scheduled after the first entry, got %v", manager.expiryAt.Sub(now))
+	}
+
+	// Entries expiring later don't reschedule it, entries expiring earlier do
+	manager.storeRoute(&allowRoute{ipAddress: net.ParseIP("192.0.2.2").To4(), validUnitl: now.Add(2 * time.Hour)})
+	manager.scheduleExpiry(now)
+	if !manager.expiryAt.Equal(now.Add(time.Hour + expiryResolution)) {
+		t.Errorf("Expected the expiry to stay, got %v", manager.expiryAt.Sub(now))
+	}
+
+	manager.storeRoute(&allowRoute{ipAddress: net.ParseIP("192.0.2.3").To4(), validUnitl: now.Add(-time.Second)})
+	manager.scheduleExpiry(now)
+	if !manager.expiryAt.Equal(now.Add(-time.Second + expiryResolution)) {
+		t.Errorf("Expected the expiry to move to the earlier entry, got %v", manager.expiryAt.Sub(now))
+	}
+
+	select {
+	case <-manager.expiryChannel():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the expiry timer to fire right away")
+	}
+	manager.expiryTimer = nil
+	manager.expireRoutes(time.Now())
+
+	if len(manager.allowList) != 2 {
+		t.Errorf("Expected the expired entry to be removed, got %v", manager.allowList)
+	}
+}
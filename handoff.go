@@ -0,0 +1,259 @@
+package ipdestinationguard
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+// Returned for batches sent to a manager, that was shut down.
+var errManagerStopped = errors.New("nftables manager is stopped")
+
+// Managers of instances being restarted, in the order of their setup. The managers created by the restart take them
+// over in the same order, so each server block continues with the state of its predecessor.
+var (
+	handoffMutex sync.Mutex
+	handoffQueue []*NFTablesManager
+)
+
+// Asks the manager goroutine to prepare the table for given successor and hand its allowList over. Afterwards it
+// forwards all batches to the successor, as the old server keeps answering queries until the restart completed.
+type handoffRequest struct {
+	successor *NFTablesManager
+	prepare   func() error
+	result    chan handoffResult
+}
+
+type handoffResult struct {
+	allowList map[routeKey]*allowRoute
+	err       error
+}
+
+// Offers given manager to the manager created by the upcoming restart. Registered as OnRestart callback.
+func offerHandoff(manager *NFTablesManager) {
+	handoffMutex.Lock()
+	defer handoffMutex.Unlock()
+
+	handoffQueue = append(handoffQueue, manager)
+}
+
+// Withdraws the offer of given manager, if it wasn't taken. Returns whether it was still offered.
+func withdrawHandoff(manager *NFTablesManager) bool {
+	handoffMutex.Lock()
+	defer handoffMutex.Unlock()
+
+	for i, offered := range handoffQueue {
+		if offered == manager {
+			handoffQueue = append(handoffQueue[:i], handoffQueue[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Withdraws the offer of given manager after a failed restart. If the manager created by the restart took the offer,
+// the allowList is taken back from it, as caddy never shuts it down, and this manager continues as before. Registered
+// as OnRestartFailed callback.
+func reclaimHandoff(manager *NFTablesManager) error {
+	if withdrawHandoff(manager) {
+		return nil
+	}
+
+	result := make(chan error, 1)
+	select {
+	case manager.reclaim <- result:
+	case <-manager.stopped:
+		return errManagerStopped
+	}
+
+	return <-result
+}
+
+// Returns the next offered manager, or nil if there is none.
+func takeHandoff() *NFTablesManager {
+	handoffMutex.Lock()
+	defer handoffMutex.Unlock()
+
+	if len(handoffQueue) == 0 {
+		return nil
+	}
+
+	previous := handoffQueue[0]
+	handoffQueue = handoffQueue[1:]
+
+	return previous
+}
+
+// Runs given prepare function on the goroutine of given previous manager, so nothing else uses its netlink connection
+// meanwhile, and takes over its allowList. If the preparation fails, the previous manager continues as before.
+// Returns whether the previous manager was still running.
+func (manager *NFTablesManager) requestHandoff(previous *NFTablesManager, prepare func() error) (map[routeKey]*allowRoute, bool, error) {
+	request := &handoffRequest{successor: manager, prepare: prepare, result: make(chan handoffResult, 1)}
+
+	select {
+	case previous.syncChannel <- &allowBatch{handoff: request}:
+	case <-previous.stopped:
+		return nil, false, nil
+	}
+
+	result := <-request.result
+
+	return result.allowList, true, result.err
+}
+
+// Takes over the dynamic state of given previous manager: its allowList with the real expiry times, domains and
+// clients, the domain history and the learner. Entries, that don't fit the sets of this manager anymore (as the scope
+// changed), are dropped and expire in the kernel on their own.
+func (manager *NFTablesManager) adoptState(previous *NFTablesManager, allowList map[routeKey]*allowRoute, config *parsedConfig) error {
+	if config.nflogGroup != 0 && previous.domainHistory != nil {
+		manager.domainHistory = previous.domainHistory
+	}
+	if previous.learner != nil && previous.learner.path == config.learnFile {
+		previous.learner.reconfigure(config)
+		manager.learner = previous.learner
+		previous.learner = nil
+	}
+
+	now := time.Now()
+	elementsToAdd := make(map[*nftables.Set][]nftables.SetElement)
+	var ipv4DroppedCount, ipv6DroppedCount int
+
+	for _, route := range allowList {
+		fits := route.scopeKey == nil || (previous.scope == manager.scope && manager.ipv4ScopedAllowSet != nil)
+		if !fits || !route.validUnitl.After(now) {
+			if len(route.ipAddress) == net.IPv4len {
+				ipv4DroppedCount++
+			} else {
+				ipv6DroppedCount++
+			}
+			continue
+		}
+
+		// The elements usually exist already, but sets might have been recreated, and adding existing elements is fine
+		targetSet := manager.allowSetFor(route)
+		elementsToAdd[targetSet] = append(elementsToAdd[targetSet], nftables.SetElement{
+			Key:     route.elementKey(),
+			Timeout: elementTimeout(route.validUnitl, now),
+		})
+		manager.storeRoute(route)
+	}
+
+	ipv4AllowListEntries.Sub(float64(ipv4DroppedCount))
+	ipv6AllowListEntries.Sub(float64(ipv6DroppedCount))
+
+	if len(elementsToAdd) > 0 {
+		for targetSet, elements := range elementsToAdd {
+			if err := manager.nlInterface.SetAddElements(targetSet, elements); err != nil {
+				return err
+			}
+		}
+
+		if err := manager.nlInterface.Flush(); err != nil {
+			nftablesFlushErrorsTotal.Inc()
+			return err
+		}
+	}
+
+	log.Infof("Took over %d entries of the previous configuration, dropped %d", len(manager.allowList), ipv4DroppedCount+ipv6DroppedCount)
+
+	return nil
+}
+
+// Forwards all batches sent to this manager to given successor, until this manager is shut down, or takes the allowList
+// back after a failed restart. Entries waiting for a retry are forwarded as well, the successor retries them right
+// away. Queued routes move to the queue of the successor with their waiters, regardless of its size, as they were
+// accepted already. Returns true, if the allowList was taken back, and this manager continues.
+func (manager *NFTablesManager) forwardBatches(successor *NFTablesManager) bool {
+	// A nil channel blocks, so the select only sends the retries, if there are any
+	var retryChannel chan *allowBatch
+	retryBatch := &allowBatch{routes: manager.retryQueue}
+	if len(manager.retryQueue) > 0 {
+		retryChannel = successor.syncChannel
+		retryQueueEntries.Sub(float64(len(manager.retryQueue)))
+		manager.retryQueue = nil
+	}
+
+	for {
+		select {
+		case retryChannel <- retryBatch:
+			retryChannel = nil
+		case <-manager.routeQueue.ready:
+			successor.routeQueue.pushAll(manager.routeQueue.take())
+		case result := <-manager.reclaim:
+			err := manager.reclaimFrom(successor)
+			result <- err
+			if err != nil {
+				log.Errorf("Taking the allowlist back after the failed reload failed, forwarding to its successor: %v", err)
+				continue
+			}
+
+			if retryChannel != nil {
+				manager.queueRetry(retryBatch.routes)
+			}
+			return true
+		case batch := <-manager.syncChannel:
+			select {
+			case successor.syncChannel <- batch:
+			case <-successor.stopped:
+				if batch.done != nil {
+					batch.done <- errManagerStopped
+				}
+			}
+		case <-manager.quit:
+			return false
+		}
+	}
+}
+
+// Takes the allowList back from given successor, whose restart failed, and prepares the table for the configuration of
+// this manager again. The successor forwards to this manager afterwards, until it's stopped right away. A successor,
+// whose setup failed after the handoff, never ran, so its allowList is taken over directly.
+func (manager *NFTablesManager) reclaimFrom(successor *NFTablesManager) error {
+	allowList, running, err := manager.requestHandoff(successor, manager.rebuild)
+	if err != nil {
+		return err
+	}
+
+	if running {
+		successor.quitOnce.Do(func() { close(successor.quit) })
+	} else {
+		if err := manager.rebuild(); err != nil {
+			return err
+		}
+		allowList = successor.allowList
+	}
+
+	if err := manager.adoptState(successor, allowList, manager.config); err != nil {
+		return err
+	}
+	log.Infof("Took the allowlist back after the failed reload")
+
+	return nil
+}
+
+// Shutdown stops the manager goroutine and saves the allowList to the state file. Batches sent afterwards are rejected
+// with errManagerStopped.
+// Registered as OnShutdown callback, so it's called on every restart and the final shutdown.
+func (manager *NFTablesManager) Shutdown() error {
+	withdrawHandoff(manager)
+
+	manager.quitOnce.Do(func() { close(manager.quit) })
+	<-manager.stopped
+
+	// After a handover, the successor saves the entries
+	if manager.stateFile != "" && !manager.handedOver {
+		if err := manager.saveState(time.Now()); err != nil {
+			log.Errorf("Saving the allowlist to %s failed: %v", manager.stateFile, err)
+		}
+	}
+
+	if manager.learner != nil {
+		return manager.learner.stop()
+	}
+
+	return nil
+}
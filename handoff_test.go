@@ -0,0 +1,262 @@
+package ipdestinationguard
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandoffQueue(t *testing.T) {
+	first := &NFTablesManager{}
+	second := &NFTablesManager{}
+	third := &NFTablesManager{}
+
+	offerHandoff(first)
+	offerHandoff(second)
+	offerHandoff(third)
+	withdrawHandoff(second)
+
+	for i, expected := range []*NFTablesManager{first, third, nil} {
+		if previous := takeHandoff(); previous != expected {
+			t.Errorf("Expected take %d to return %p, got %p", i, expected, previous)
+		}
+	}
+}
+
+func TestAdoptState(t *testing.T) {
+	tests := []struct {
+		name            string
+		successorScope  Scope
+		expectedEntries []string
+	}{
+		{
+			name:            "same scope keeps all entries",
+			successorScope:  ScopeClient,
+			expectedEntries: []string{"/192.0.2.1", "10.0.0.5/192.0.2.2"},
+		},
+		{
+			name:            "changed scope drops scoped entries",
+			successorScope:  ScopeGlobal,
+			expectedEntries: []string{"/192.0.2.1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := newTestNFTablesManager(t, testAdminConfig(t, ScopeClient))
+			learnFile := filepath.Join(t.TempDir(), "learned.conf")
+			previous.learner = newLearner(learnFile, time.Hour, nil)
+
+			if err := previous.AddTemporaryRoute(net.ParseIP("192.0.2.1"), time.Hour, ""); err != nil {
+				t.Fatal(err)
+			}
+			if err := previous.AddTemporaryRoute(net.ParseIP("192.0.2.2"), time.Hour, "10.0.0.5"); err != nil {
+				t.Fatal(err)
+			}
+			expires := mustEntries(t, previous)[0].Expires
+
+			config := testAdminConfig(t, tt.successorScope)
+			config.learnFile = learnFile
+			successor := newIdleTestNFTablesManager(t, config)
+
+			allowList, running, err := successor.requestHandoff(previous, func() error { return nil })
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !running {
+				t.Fatal("Expected the previous manager to hand over")
+			}
+			if err := successor.adoptState(previous, allowList, config); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			go successor.manageAllowList()
+			t.Cleanup(func() { successor.Shutdown() })
+
+			entries := mustEntries(t, successor)
+			if len(entries) != len(tt.expectedEntries) {
+				t.Fatalf("Expected %d entries, got %v", len(tt.expectedEntries), entries)
+			}
+			for i, entry := range entries {
+				if key := entry.Scope + "/" + entry.IP; key != tt.expectedEntries[i] {
+					t.Errorf("Expected entry '%s', got '%s'", tt.expectedEntries[i], key)
+				}
+			}
+			if !entries[0].Expires.Equal(expires) {
+				t.Errorf("Expected the expiry %v to be kept, got %v", expires, entries[0].Expires)
+			}
+
+			if successor.learner == nil || previous.learner != nil {
+				t.Error("Expected the learner to be taken over")
+			}
+
+			// The previous manager keeps serving queries until the reload completed, its batches go to the successor
+			if err := previous.AddTemporaryRoute(net.ParseIP("192.0.2.3"), time.Hour, ""); err != nil {
+				t.Fatal(err)
+			}
+			if explanation := mustExplain(t, successor, "192.0.2.3"); len(explanation.Entries) != 1 {
+				t.Errorf("Expected the forwarded entry on the successor, got %v", explanation.Entries)
+			}
+			if entries := mustEntries(t, previous); len(entries) != len(tt.expectedEntries)+1 {
+				t.Errorf("Expected the previous manager to list the entries of the successor, got %v", entries)
+			}
+		})
+	}
+}
+
+func TestReclaimHandoffAfterFailedReload(t *testing.T) {
+	tests := []struct {
+		name          string
+		successorRuns bool
+	}{
+		{name: "successor running", successorRuns: true},
+		{name: "successor setup failed", successorRuns: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := newTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+			rebuilt := false
+			previous.rebuild = func() error {
+				rebuilt = true
+				return nil
+			}
+			if err := previous.AddTemporaryRoute(net.ParseIP("192.0.2.1"), time.Hour, ""); err != nil {
+				t.Fatal(err)
+			}
+			offerHandoff(previous)
+
+			config := testAdminConfig(t, ScopeGlobal)
+			successor := newIdleTestNFTablesManager(t, config)
+			if takeHandoff() != previous {
+				t.Fatal("Expected the previous manager to be offered")
+			}
+			allowList, running, err := successor.requestHandoff(previous, func() error { return nil })
+			if err != nil || !running {
+				t.Fatalf("Expected the previous manager to hand over, got %v", err)
+			}
+
+			if tt.successorRuns {
+				if err := successor.adoptState(previous, allowList, config); err != nil {
+					t.Fatal(err)
+				}
+				go successor.manageAllowList()
+				t.Cleanup(func() { successor.Shutdown() })
+
+				// The previous manager still serves queries until the reload failed
+				if err := previous.AddTemporaryRoute(net.ParseIP("192.0.2.2"), time.Hour, ""); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				successor.allowList = allowList
+				close(successor.stopped)
+			}
+
+			if err := reclaimHandoff(previous); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !rebuilt {
+				t.Error("Expected the table to be prepared for the previous configuration again")
+			}
+			expectedEntries := 1
+			if tt.successorRuns {
+				expectedEntries = 2
+				select {
+				case <-successor.stopped:
+				case <-time.After(time.Second):
+					t.Error("Expected the successor to be stopped")
+				}
+			}
+			if entries := mustEntries(t, previous); len(entries) != expectedEntries {
+				t.Errorf("Expected %d entries back on the previous manager, got %v", expectedEntries, entries)
+			}
+
+			// The previous manager runs its own loop again, so it saves its state and reports its heartbeat
+			if previous.handedOver {
+				t.Error("Expected the previous manager to own its allowList again")
+			}
+			if !previous.Ready() {
+				t.Errorf("Expected the previous manager to be ready, got %+v", previous.Health(time.Now()))
+			}
+		})
+	}
+}
+
+func TestReclaimHandoffNotTaken(t *testing.T) {
+	manager := newTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+	offerHandoff(manager)
+
+	if err := reclaimHandoff(manager); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if previous := takeHandoff(); previous != nil {
+		t.Error("Expected the offer to be withdrawn")
+	}
+}
+
+func TestRequestHandoffOfStoppedManager(t *testing.T) {
+	previous := newTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+	if err := previous.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	successor := newTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+
+	prepared := false
+	_, running, err := successor.requestHandoff(previous, func() error {
+		prepared = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if running || prepared {
+		t.Error("Expected a stopped manager to neither prepare nor hand over")
+	}
+}
+
+func TestRequestHandoffWithFailingPreparation(t *testing.T) {
+	previous := newTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+	if err := previous.AddTemporaryRoute(net.ParseIP("192.0.2.1"), time.Hour, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	successor := newTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+
+	prepareErr := errors.New("table busy")
+	_, _, err := successor.requestHandoff(previous, func() error { return prepareErr })
+	if !errors.Is(err, prepareErr) {
+		t.Fatalf("Expected the preparation error, got %v", err)
+	}
+
+	// The failed reload leaves the previous manager as it was
+	if entries := mustEntries(t, previous); len(entries) != 1 {
+		t.Errorf("Expected the previous manager to keep its entry, got %v", entries)
+	}
+	if entries := mustEntries(t, successor); len(entries) != 0 {
+		t.Errorf("Expected the successor to have no entries, got %v", entries)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	manager := newTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+	offerHandoff(manager)
+
+	if err := manager.Shutdown(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if previous := takeHandoff(); previous != nil {
+		t.Error("Expected the offer to be withdrawn on shutdown")
+	}
+
+	err := manager.AddTemporaryRoute(net.ParseIP("192.0.2.1"), time.Hour, "")
+	if !errors.Is(err, errManagerStopped) {
+		t.Errorf("Expected errManagerStopped, got %v", err)
+	}
+
+	// The async path must not block either
+	manager.AddRoutes(&QueryInfo{Name: "example.com."}, []RouteEntry{{IP: net.ParseIP("192.0.2.1").To4(), TTL: 60}})
+}
@@ -0,0 +1,54 @@
+package ipdestinationguard
+
+import (
+	"fmt"
+	"time"
+)
+
+// Time the flushes to nftables may fail in a row, before the manager reports itself unhealthy, unless they failed
+// flushFailureEscalation times already. A single failure, like of a concurrent change of the ruleset, shouldn't take
+// the server out of rotation.
+const flushFailureWindow = 30 * time.Second
+
+// Time the manager goroutine may not run its loop, before it counts as stuck. Its counter ticker runs it every 30
+// seconds.
+const heartbeatTimeout = 2 * time.Minute
+
+// The health of a NFTablesManager, as returned by the admin API.
+type HealthStatus struct {
+	Healthy  bool     `json:"healthy"`
+	Problems []string `json:"problems,omitempty"` // Why the manager is unhealthy, empty if it's healthy
+}
+
+// Ready reports whether the manager can open the firewall for new DNS answers. The ready plugin stops asking, once the
+// server was ready, so the admin API provides the same status continuously at /v1/health.
+func (manager *NFTablesManager) Ready() bool {
+	return manager.Health(time.Now()).Healthy
+}
+
+// Health returns whether the manager goroutine is alive, the last flushes to nftables succeeded, and the table with
+// its chains matched the expected one, when the reconciler checked it last.
+func (manager *NFTablesManager) Health(now time.Time) HealthStatus {
+	var problems []string
+
+	select {
+	case <-manager.stopped:
+		problems = append(problems, "the allowlist manager stopped")
+	default:
+		// Without heartbeat, the goroutine is just starting
+		if heartbeat := manager.heartbeat.Load(); heartbeat != 0 && now.Sub(time.Unix(0, heartbeat)) > heartbeatTimeout {
+			problems = append(problems, fmt.Sprintf("the allowlist manager is stuck since %s", time.Unix(0, heartbeat).Format(time.RFC3339)))
+		}
+	}
+
+	failingSince, failures := manager.flushFailingSince.Load(), manager.flushFailures.Load()
+	if failingSince != 0 && (now.Sub(time.Unix(0, failingSince)) >= flushFailureWindow || failures >= flushFailureEscalation) {
+		problems = append(problems, fmt.Sprintf("writing to nftables fails since %s (%d times in a row)", time.Unix(0, failingSince).Format(time.RFC3339), failures))
+	}
+
+	if !manager.rulesetHealthy.Load() {
+		problems = append(problems, fmt.Sprintf("table %s doesn't match the expected ruleset", tableName))
+	}
+
+	return HealthStatus{Healthy: len(problems) == 0, Problems: problems}
+}
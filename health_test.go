@@ -0,0 +1,117 @@
+package ipdestinationguard
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name              string
+		stopped           bool
+		heartbeat         time.Time
+		flushFailingSince time.Time
+		flushFailures     int32
+		rulesetBroken     bool
+		expectedProblems  []string
+	}{
+		{
+			name:      "healthy",
+			heartbeat: now.Add(-30 * time.Second),
+		},
+		{
+			name: "starting",
+		},
+		{
+			name:              "single failed flush",
+			heartbeat:         now,
+			flushFailingSince: now.Add(-5 * time.Second),
+		},
+		{
+			name:              "flushes failing longer than the window",
+			heartbeat:         now,
+			flushFailingSince: now.Add(-flushFailureWindow),
+			expectedProblems:  []string{"writing to nftables fails since"},
+		},
+		{
+			name:              "repeatedly failed flushes",
+			heartbeat:         now,
+			flushFailingSince: now.Add(-5 * time.Second),
+			flushFailures:     flushFailureEscalation,
+			expectedProblems:  []string{"writing to nftables fails since"},
+		},
+		{
+			name:             "stuck manager",
+			heartbeat:        now.Add(-heartbeatTimeout - time.Second),
+			expectedProblems: []string{"the allowlist manager is stuck since"},
+		},
+		{
+			name:             "stopped manager",
+			stopped:          true,
+			heartbeat:        now.Add(-time.Hour),
+			expectedProblems: []string{"the allowlist manager stopped"},
+		},
+		{
+			name:             "broken ruleset",
+			heartbeat:        now,
+			rulesetBroken:    true,
+			expectedProblems: []string{"doesn't match the expected ruleset"},
+		},
+		{
+			name:              "everything broken",
+			stopped:           true,
+			flushFailingSince: now.Add(-time.Minute),
+			rulesetBroken:     true,
+			expectedProblems:  []string{"the allowlist manager stopped", "writing to nftables fails since", "doesn't match the expected ruleset"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := &NFTablesManager{stopped: make(chan struct{})}
+			if tt.stopped {
+				close(manager.stopped)
+			}
+			if !tt.heartbeat.IsZero() {
+				manager.heartbeat.Store(tt.heartbeat.UnixNano())
+			}
+			if !tt.flushFailingSince.IsZero() {
+				manager.flushFailingSince.Store(tt.flushFailingSince.UnixNano())
+			}
+			manager.flushFailures.Store(tt.flushFailures)
+			manager.rulesetHealthy.Store(!tt.rulesetBroken)
+
+			health := manager.Health(now)
+
+			if health.Healthy != (len(tt.expectedProblems) == 0) {
+				t.Errorf("Expected healthy %v, got %+v", len(tt.expectedProblems) == 0, health)
+			}
+			if len(health.Problems) != len(tt.expectedProblems) {
+				t.Fatalf("Expected problems %v, got %v", tt.expectedProblems, health.Problems)
+			}
+			for i, expectedProblem := range tt.expectedProblems {
+				if !strings.Contains(health.Problems[i], expectedProblem) {
+					t.Errorf("Expected problem containing '%s', got '%s'", expectedProblem, health.Problems[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHealthAfterShutdown(t *testing.T) {
+	manager := newTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+	if !manager.Ready() {
+		t.Fatalf("Expected a running manager to be ready, got %+v", manager.Health(time.Now()))
+	}
+
+	if err := manager.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	if manager.Ready() {
+		t.Error("Expected a stopped manager not to be ready")
+	}
+}
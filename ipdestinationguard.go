@@ -2,6 +2,7 @@ package ipdestinationguard
 
 import (
 	"context"
+	"fmt"
 	"net"
 
 	"github.com/coredns/coredns/plugin"
@@ -9,22 +10,63 @@ import (
 	"github.com/miekg/dns"
 )
 
+// A single address returned by a DNS answer, which should be allowed for the given TTL.
+type RouteEntry struct {
+	IP  net.IP
+	TTL uint32
+}
+
+// Metadata about the DNS query, that led to a list of RouteEntries.
+type QueryInfo struct {
+	Name       string   // The queried name, fully qualified
+	QType      uint16   // The queried type, like dns.TypeA
+	CNAMEChain []string // The CNAME targets followed to reach the addresses, in the order of the answer
+	Client     net.Addr // The address of the client, that sent the query
+	Zone       string   // The zone of the server block, that handled the query
+}
+
+// Returned by DestinationGuardManager.AddRoutes, if entries of an answer couldn't be allowed.
+type AllowError struct {
+	Entries []RouteEntry // The entries, that aren't allowed
+	Err     error        // Why they aren't allowed
+}
+
+func (allowErr *AllowError) Error() string {
+	return fmt.Sprintf("%d addresses couldn't be allowed: %v", len(allowErr.Entries), allowErr.Err)
+}
+
+func (allowErr *AllowError) Unwrap() error { return allowErr.Err }
+
 // A basic interface that allows abstraction for different destination-guard-managers,
 // like IPTables or BGP based ones
 type DestinationGuardManager interface {
-	AddRoutes(ips []net.IP, ttl uint32)
+	// Allows given entries, and returns an *AllowError for the entries, that couldn't be allowed. Managers, that don't
+	// wait for the firewall, only report the errors known right away.
+	AddRoutes(query *QueryInfo, entries []RouteEntry) error
+	Ready() bool // Whether the manager guards as configured, reported by the ready plugin
 }
 
 // The actual destination guard struct for this plugin.
 // It has no real usecase, other than intercepting DNS requests and applying the ResponseParser to it.
 type IPDestinationGuard struct {
-	Next      plugin.Handler
-	DGManager DestinationGuardManager
+	Next          plugin.Handler
+	DGManager     DestinationGuardManager
+	ParserOptions *ParserOptions
+	Zone          string
 }
 
 func (dg IPDestinationGuard) Name() string { return "ipdestinationguard" }
-func (dg IPDestinationGuard) Ready() bool  { return true }
+func (dg IPDestinationGuard) Ready() bool  { return dg.DGManager.Ready() }
 
 func (dg IPDestinationGuard) ServeDNS(ctx context.Context, writer dns.ResponseWriter, request *dns.Msg) (int, error) {
-	return plugin.NextOrFailure(dg.Name(), dg.Next, ctx, NewResponseParser(writer, dg.DGManager), request)
+	query := &QueryInfo{
+		Client: writer.RemoteAddr(),
+		Zone:   dg.Zone,
+	}
+	if len(request.Question) > 0 {
+		query.Name = request.Question[0].Name
+		query.QType = request.Question[0].Qtype
+	}
+
+	return plugin.NextOrFailure(dg.Name(), dg.Next, ctx, NewResponseParser(writer, dg.DGManager, query, dg.ParserOptions), request)
 }
@@ -0,0 +1,326 @@
+package ipdestinationguard
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default time learn mode observes traffic, before it writes the suggested configuration.
+const defaultLearnDuration = 24 * time.Hour
+
+// Minimum number of learned addresses within a /24 (IPv4) or /64 (IPv6), so the whole network gets suggested.
+const learnAggregateThreshold = 4
+
+// Maximum number of learned destinations and domains, so a scan can't exhaust the memory.
+const learnMaxEntries = 65536
+
+// Maximum number of addresses per directive line of the suggested configuration.
+const learnEntriesPerLine = 8
+
+// Chains, a learned destination was contacted through.
+const (
+	learnedOutput uint8 = 1 << iota
+	learnedForward
+)
+
+// Records the destinations, that enforcement monitor would reject, and the domains resolved meanwhile, and writes a
+// suggested configuration once the learn duration passed, or on shutdown.
+type learner struct {
+	mutex        sync.Mutex
+	path         string
+	duration     time.Duration
+	config       *parsedConfig
+	startedAt    time.Time
+	destinations map[netip.Addr]uint8 // Chains of each destination, see learnedOutput and learnedForward
+	domains      map[string]struct{}
+	timer        *time.Timer
+	finished     bool // Whether the suggestion was written, after which nothing gets recorded anymore
+}
+
+func newLearner(path string, duration time.Duration, config *parsedConfig) *learner {
+	return &learner{
+		path:         path,
+		duration:     duration,
+		config:       config,
+		destinations: make(map[netip.Addr]uint8),
+		domains:      make(map[string]struct{}),
+	}
+}
+
+// Records given destination, that given chain would reject. Does nothing on a nil learner.
+func (learner *learner) recordDestination(chain string, ip net.IP) {
+	if learner == nil {
+		return
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return
+	}
+	// Multicast, link-local and similar destinations don't belong into an allowlist
+	if addr = addr.Unmap(); !addr.IsGlobalUnicast() {
+		return
+	}
+
+	chainFlag := learnedOutput
+	if chain == "forward" {
+		chainFlag = learnedForward
+	}
+
+	learner.mutex.Lock()
+	defer learner.mutex.Unlock()
+
+	if learner.finished {
+		return
+	}
+	if _, exists := learner.destinations[addr]; !exists && len(learner.destinations) >= learnMaxEntries {
+		return
+	}
+	learner.destinations[addr] |= chainFlag
+}
+
+// Records given resolved domain. Does nothing on a nil learner.
+func (learner *learner) recordDomain(name string) {
+	if learner == nil || name == "" {
+		return
+	}
+
+	learner.mutex.Lock()
+	defer learner.mutex.Unlock()
+
+	if learner.finished || len(learner.domains) >= learnMaxEntries {
+		return
+	}
+	learner.domains[name] = struct{}{}
+}
+
+// Starts learning, and schedules writing the suggestion once the learn duration passed. Does nothing, if it was started
+// already, as a learner taken over on a reload keeps its schedule.
+func (learner *learner) start() error {
+	learner.mutex.Lock()
+	defer learner.mutex.Unlock()
+
+	if learner.timer != nil {
+		return nil
+	}
+
+	learner.startedAt = time.Now()
+	learner.timer = time.AfterFunc(learner.duration, func() {
+		if err := learner.finish(); err != nil {
+			log.Errorf("Writing learned configuration to %s failed: %v", learner.path, err)
+		}
+	})
+
+	log.Infof("Learning destinations for %v, the suggested configuration will be written to %s", learner.duration, learner.path)
+
+	return nil
+}
+
+// Switches to given config of a reload, which the suggestion builds on. The learn duration keeps counting from the start.
+func (learner *learner) reconfigure(config *parsedConfig) {
+	learner.mutex.Lock()
+	defer learner.mutex.Unlock()
+
+	learner.config = config
+	if learner.timer != nil && config.learnDuration != learner.duration {
+		learner.duration = config.learnDuration
+		learner.timer.Reset(max(time.Until(learner.startedAt.Add(learner.duration)), 0))
+	}
+}
+
+// Writes what was learned so far, if the learn duration didn't pass yet.
+func (learner *learner) stop() error {
+	learner.mutex.Lock()
+	if learner.timer != nil {
+		learner.timer.Stop()
+	}
+	learner.mutex.Unlock()
+
+	return learner.finish()
+}
+
+// Writes the suggested configuration and stops recording. Does nothing, if it was written already.
+func (learner *learner) finish() error {
+	learner.mutex.Lock()
+	defer learner.mutex.Unlock()
+
+	if learner.finished {
+		return nil
+	}
+	learner.finished = true
+
+	suggestion := learner.suggest(time.Now())
+
+	if err := writeFileAtomically(learner.path, []byte(suggestion)); err != nil {
+		return err
+	}
+
+	log.Infof("Learned %d destinations and %d domains, the suggested configuration was written to %s",
+		len(learner.destinations), len(learner.domains), learner.path)
+
+	return nil
+}
+
+// Returns the suggested ipdestinationguard block, containing the configured ranges and the learned destinations.
+// The caller has to hold the mutex.
+func (learner *learner) suggest(now time.Time) string {
+	config := learner.config
+	bothChains := config.mode == ModeNFTBoth
+
+	allowedIPs := configuredPrefixes(config.allowedIPs)
+	allowedLocalIPs := configuredPrefixes(config.allowedLocalIPs)
+	allowedGatewayIPs := configuredPrefixes(config.allowedGatewayIPs)
+
+	var learnedIPs, learnedLocalIPs, learnedGatewayIPs []netip.Addr
+	for addr, chains := range learner.destinations {
+		switch {
+		case !bothChains || chains == learnedOutput|learnedForward:
+			learnedIPs = append(learnedIPs, addr)
+		case chains == learnedOutput:
+			learnedLocalIPs = append(learnedLocalIPs, addr)
+		default:
+			learnedGatewayIPs = append(learnedGatewayIPs, addr)
+		}
+	}
+
+	allowedIPs = aggregatePrefixes(append(allowedIPs, aggregateAddresses(learnedIPs)...))
+	allowedLocalIPs = aggregatePrefixes(append(allowedLocalIPs, aggregateAddresses(learnedLocalIPs)...))
+	allowedGatewayIPs = aggregatePrefixes(append(allowedGatewayIPs, aggregateAddresses(learnedGatewayIPs)...))
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "# Suggested by the learn mode of %s, observed from %s to %s\n", pluginName,
+		learner.startedAt.Format(time.RFC3339), now.Format(time.RFC3339))
+	fmt.Fprintf(&builder, "%s {\n", pluginName)
+	fmt.Fprintf(&builder, "  mode %s\n", config.mode)
+
+	writeDirective := func(directive string, prefixes []netip.Prefix) {
+		for start := 0; start < len(prefixes); start += learnEntriesPerLine {
+			end := min(start+learnEntriesPerLine, len(prefixes))
+
+			entries := make([]string, 0, end-start)
+			for _, prefix := range prefixes[start:end] {
+				if prefix.IsSingleIP() {
+					entries = append(entries, prefix.Addr().String())
+				} else {
+					entries = append(entries, prefix.String())
+				}
+			}
+			fmt.Fprintf(&builder, "  %s %s\n", directive, strings.Join(entries, " "))
+		}
+	}
+	writeDirective("allowedIPs", allowedIPs)
+	writeDirective("allowedLocalIPs", allowedLocalIPs)
+	writeDirective("allowedGatewayIPs", allowedGatewayIPs)
+
+	if len(learner.domains) > 0 {
+		domains := make([]string, 0, len(learner.domains))
+		for domain := range learner.domains {
+			domains = append(domains, domain)
+		}
+		sort.Strings(domains)
+
+		builder.WriteString("  # Domains resolved while learning, which are allowed through their DNS answers:\n")
+		for _, domain := range domains {
+			fmt.Fprintf(&builder, "  #   %s\n", domain)
+		}
+	}
+
+	builder.WriteString("}\n")
+
+	return builder.String()
+}
+
+// Returns the prefixes of given start and end pairs (like parsedConfig.allowedIPs). The ranges of getIPRange are always
+// a single prefix, so its length follows from the size of the range.
+func configuredPrefixes(ips []net.IP) []netip.Prefix {
+	var prefixes []netip.Prefix
+
+	for i := 0; i+1 < len(ips); i += 2 {
+		addr, ok := netip.AddrFromSlice(ips[i])
+		if !ok {
+			continue
+		}
+
+		size := new(big.Int).Sub(new(big.Int).SetBytes(ips[i+1]), new(big.Int).SetBytes(ips[i]))
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()-(size.BitLen()-1)))
+	}
+
+	return prefixes
+}
+
+// Returns given addresses as prefixes, replacing the addresses of each /24 (IPv4) or /64 (IPv6) with the whole
+// network, if it contains at least learnAggregateThreshold of them.
+func aggregateAddresses(addrs []netip.Addr) []netip.Prefix {
+	networks := make(map[netip.Prefix][]netip.Addr)
+	for _, addr := range addrs {
+		bits := 24
+		if addr.Is6() {
+			bits = 64
+		}
+		network, _ := addr.Prefix(bits)
+		networks[network] = append(networks[network], addr)
+	}
+
+	var prefixes []netip.Prefix
+	for network, networkAddrs := range networks {
+		if len(networkAddrs) >= learnAggregateThreshold {
+			prefixes = append(prefixes, network)
+			continue
+		}
+		for _, addr := range networkAddrs {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+
+	return prefixes
+}
+
+// Returns given prefixes sorted, without prefixes contained in others, and with sibling prefixes merged into their
+// parent, so the result covers exactly the same addresses.
+func aggregatePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	for {
+		sort.Slice(prefixes, func(i, j int) bool {
+			if prefixes[i].Addr() != prefixes[j].Addr() {
+				return prefixes[i].Addr().Less(prefixes[j].Addr())
+			}
+			return prefixes[i].Bits() < prefixes[j].Bits()
+		})
+
+		merged := make([]netip.Prefix, 0, len(prefixes))
+		changed := false
+		for _, prefix := range prefixes {
+			if len(merged) == 0 {
+				merged = append(merged, prefix)
+				continue
+			}
+
+			last := merged[len(merged)-1]
+			if last.Contains(prefix.Addr()) && last.Bits() <= prefix.Bits() {
+				changed = changed || last != prefix
+				continue
+			}
+
+			if last.Bits() == prefix.Bits() && last.Bits() > 0 {
+				parent, _ := last.Addr().Prefix(last.Bits() - 1)
+				if parent.Contains(prefix.Addr()) {
+					merged[len(merged)-1] = parent
+					changed = true
+					continue
+				}
+			}
+
+			merged = append(merged, prefix)
+		}
+
+		prefixes = merged
+		if !changed {
+			return prefixes
+		}
+	}
+}
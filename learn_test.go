@@ -0,0 +1,181 @@
+package ipdestinationguard
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+func TestAggregatePrefixes(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes []string
+		expected []string
+	}{
+		{
+			name:     "sorted and deduplicated",
+			prefixes: []string{"192.0.2.9/32", "10.0.0.1/32", "192.0.2.9/32"},
+			expected: []string{"10.0.0.1/32", "192.0.2.9/32"},
+		},
+		{
+			name:     "contained prefixes are dropped",
+			prefixes: []string{"10.1.2.3/32", "10.0.0.0/8", "10.200.0.0/16"},
+			expected: []string{"10.0.0.0/8"},
+		},
+		{
+			name:     "siblings are merged repeatedly",
+			prefixes: []string{"192.0.2.0/26", "192.0.2.64/26", "192.0.2.128/25"},
+			expected: []string{"192.0.2.0/24"},
+		},
+		{
+			name:     "neighbors of different parents stay apart",
+			prefixes: []string{"192.0.2.1/32", "192.0.2.2/32"},
+			expected: []string{"192.0.2.1/32", "192.0.2.2/32"},
+		},
+		{
+			name:     "mixed address families",
+			prefixes: []string{"2001:db8::/64", "2001:db8:0:1::/64", "9.9.9.9/32"},
+			expected: []string{"9.9.9.9/32", "2001:db8::/63"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var prefixes []netip.Prefix
+			for _, prefix := range tt.prefixes {
+				prefixes = append(prefixes, netip.MustParsePrefix(prefix))
+			}
+
+			var actual []string
+			for _, prefix := range aggregatePrefixes(prefixes) {
+				actual = append(actual, prefix.String())
+			}
+
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestAggregateAddresses(t *testing.T) {
+	var addrs []netip.Addr
+	for _, addr := range []string{"192.0.2.1", "192.0.2.7", "192.0.2.30", "192.0.2.200", "198.51.100.1", "198.51.100.2", "2001:db8::1"} {
+		addrs = append(addrs, netip.MustParseAddr(addr))
+	}
+
+	var actual []string
+	for _, prefix := range aggregatePrefixes(aggregateAddresses(addrs)) {
+		actual = append(actual, prefix.String())
+	}
+
+	expected := []string{"192.0.2.0/24", "198.51.100.1/32", "198.51.100.2/32", "2001:db8::1/128"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestConfiguredPrefixes(t *testing.T) {
+	var ips []net.IP
+	for _, cidr := range []string{"9.9.9.9", "10.88.0.0/16", "2001:db8::/32"} {
+		startIP, endIP, err := getIPRange(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ips = append(ips, startIP, endIP)
+	}
+
+	var actual []string
+	for _, prefix := range configuredPrefixes(ips) {
+		actual = append(actual, prefix.String())
+	}
+
+	expected := []string{"9.9.9.9/32", "10.88.0.0/16", "2001:db8::/32"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestLearnerSuggestion(t *testing.T) {
+	config := testAdminConfig(t, ScopeGlobal)
+	path := filepath.Join(t.TempDir(), "learned.conf")
+	learner := newLearner(path, time.Hour, config)
+	if err := learner.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Seen through both chains, so allowed everywhere
+	learner.recordDestination("output", net.ParseIP("203.0.113.10"))
+	learner.recordDestination("forward", net.ParseIP("203.0.113.10").To4())
+	// Four addresses of a /24 get aggregated
+	for _, ip := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3", "198.51.100.4"} {
+		learner.recordDestination("forward", net.ParseIP(ip))
+	}
+	learner.recordDestination("output", net.ParseIP("2001:db8::53"))
+	// Already covered by allowedLocalIPs
+	learner.recordDestination("output", net.ParseIP("10.88.1.1"))
+	// Not suitable for an allowlist
+	learner.recordDestination("output", net.ParseIP("ff02::1"))
+	learner.recordDestination("output", net.ParseIP("fe80::1"))
+	learner.recordDomain("example.com.")
+
+	if err := learner.stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	suggestion := string(content)
+
+	for _, expected := range []string{
+		"  mode nft-both\n",
+		"  allowedIPs 9.9.9.9 203.0.113.10\n",
+		"  allowedLocalIPs 10.88.0.0/16 2001:db8::53\n",
+		"  allowedGatewayIPs 192.168.100.0/24 198.51.100.0/24\n",
+		"  #   example.com.\n",
+	} {
+		if !strings.Contains(suggestion, expected) {
+			t.Errorf("Expected suggestion to contain %q, got:\n%s", expected, suggestion)
+		}
+	}
+	for _, notExpected := range []string{"ff02::1", "fe80::1", "10.88.1.1"} {
+		if strings.Contains(suggestion, notExpected) {
+			t.Errorf("Expected suggestion not to contain %q, got:\n%s", notExpected, suggestion)
+		}
+	}
+
+	// The suggestion has to be accepted by parseConfig as is
+	c := caddy.NewTestController("dns", suggestion)
+	c.Next() // consume plugin name
+	parsedSuggestion, err := parseConfig(c)
+	if err != nil {
+		t.Fatalf("Expected suggestion to be parsable, got %v", err)
+	}
+	if err := validateConfig(parsedSuggestion); err != nil {
+		t.Fatalf("Expected suggestion to be valid, got %v", err)
+	}
+	if len(parsedSuggestion.allowedGatewayIPs) != 4 {
+		t.Errorf("Expected 2 ranges in allowedGatewayIPs, got %v", parsedSuggestion.allowedGatewayIPs)
+	}
+
+	// Nothing gets recorded after the suggestion was written
+	learner.recordDestination("output", net.ParseIP("192.0.2.1"))
+	if len(learner.destinations) != 7 {
+		t.Errorf("Expected 7 destinations, got %d", len(learner.destinations))
+	}
+}
+
+func TestLearnerIgnoresNil(t *testing.T) {
+	var learner *learner
+	learner.recordDestination("output", net.ParseIP("192.0.2.1"))
+	learner.recordDomain("example.com.")
+}
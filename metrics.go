@@ -50,4 +50,108 @@ var (
 		Name:      "nftables_flush_errors_total",
 		Help:      "Total number of nftables flush errors encountered when writing allowlist changes.",
 	})
+	nftablesPathFlushErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "nftables_path_flush_errors_total",
+		Help:      "Total number of nftables flush errors by path (prepare, add, revoke or repair).",
+	}, []string{"path"})
+	retryQueueEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "retry_queue_entries",
+		Help:      "Current number of addresses waiting for a retry, after writing them to nftables failed.",
+	})
+	retryDroppedEntriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "retry_dropped_entries_total",
+		Help:      "Total number of addresses never written to nftables, as they expired or the retry queue was full.",
+	})
+	netlinkReopensTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "netlink_reopens_total",
+		Help:      "Total number of netlink connections reopened, after flushes to nftables failed repeatedly.",
+	})
+	queueEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "queue_entries",
+		Help:      "Current number of addresses of DNS answers waiting for the allowlist manager.",
+	})
+	queueMergedEntriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "queue_merged_entries_total",
+		Help:      "Total number of addresses merged with the same address already waiting for the allowlist manager.",
+	})
+	queueWaitDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "queue_wait_duration_seconds",
+		Help:      "Time DNS answers waited to queue their addresses for the allowlist manager.",
+		Buckets:   []float64{.00001, .0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+	})
+	queueOverflowsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "queue_overflows_total",
+		Help:      "Total number of DNS answers, whose addresses didn't fit into the full queue, by queueOverflow policy (block, drop or servfail).",
+	}, []string{"policy"})
+	answerHoldDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "answer_hold_duration_seconds",
+		Help:      "Time DNS answers were held back until their IPs were written to nftables (commit mode sync).",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	})
+	scopeFamilyMismatchesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "scope_family_mismatches_total",
+		Help:      "Total number of addresses not allowed, because their family didn't match the address family of the client (scope client).",
+	})
+	domainPolicyDeniedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "domain_policy_denied_total",
+		Help:      "Total number of DNS answers not allowed, because their names are denied by the domain policy.",
+	})
+	scopeAttributionFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "scope_attribution_failures_total",
+		Help:      "Total number of DNS answers not allowed, because they couldn't be attributed to their scope.",
+	})
+	wouldRejectPacketsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "would_reject_packets_total",
+		Help:      "Total number of packets per chain, that would have been rejected, if enforcement monitor wasn't active.",
+	}, []string{"chain"})
+	rejectedPacketsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "rejected_packets_total",
+		Help:      "Total number of packets read from the NFLOG group, that were rejected (or would have been in enforcement monitor), by chain and protocol.",
+	}, []string{"chain", "protocol"})
+	commitTimeoutsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "commit_timeouts_total",
+		Help:      "Total number of DNS answers released after the commit timeout, before their IPs were written to nftables.",
+	})
+	firewallErrorAnswersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "firewall_error_answers_total",
+		Help:      "Total number of DNS answers changed, as their addresses couldn't be allowed, by onFirewallError action (servfail or strip).",
+	}, []string{"action"})
+	driftEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "drift_events_total",
+		Help:      "Total number of changes of the table made outside of the plugin, that were detected and repaired, by kind (table, chain, rules or elements).",
+	}, []string{"kind"})
 )
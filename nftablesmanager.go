@@ -1,87 +1,492 @@
 package ipdestinationguard
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
 )
 
+// Returned in commit mode sync, if the flush of an answer's entries didn't finish within the commit timeout.
+var errCommitTimeout = errors.New("commit timeout passed")
+
+// Entries expiring within this margin might already be gone in the kernel, so they aren't deleted on refresh.
+const refreshSafetyMargin = 2 * time.Second
+
 // This local struct represents data of an route to allow in NFTables.
-// This is only used locally by the NFTablesManager.syncChannel for transmitting data in a structured way.
+// This is only used locally by the NFTablesManager.routeQueue and syncChannel for transmitting data in a structured
+// way.
 type allowRoute struct {
 	validUnitl time.Time
 	ipAddress  net.IP
+	scopeKey   []byte // Prefix of the concatenated set key (like the client address), nil for the global sets
+	scopeLabel string // Human readable form of scopeKey
+	domain     string // Queried name, that allowed this route last, empty if unknown
+	client     string // Address of the client, that queried domain
+
+	expiryIndex int // Position within NFTablesManager.expiries, only valid while the route is part of the allowList
+}
+
+// Returns the key of this route within the NFTablesManager.allowList.
+func (route *allowRoute) key() routeKey {
+	if route.scopeKey == nil {
+		return newRouteKey("", route.ipAddress)
+	}
+
+	return newRouteKey(route.scopeLabel, route.ipAddress)
+}
+
+// Returns the key of this route within its nftables set.
+func (route *allowRoute) elementKey() []byte {
+	if route.scopeKey == nil {
+		return route.ipAddress
+	}
+
+	elementKey := make([]byte, 0, len(route.scopeKey)+len(route.ipAddress))
+	elementKey = append(elementKey, route.scopeKey...)
+	return append(elementKey, route.ipAddress...)
+}
+
+// This local struct represents a batch of routes sent through the NFTablesManager.syncChannel.
+// If done is set, the manager reports the result of the nftables flush containing the routes to it.
+// Batches with revoke set remove their routes instead, and batches with inspect set only call it with the allowList
+// from within the manager goroutine, so admin requests are serialized with the DNS driven updates.
+type allowBatch struct {
+	routes  []*allowRoute
+	revoke  bool
+	inspect func(allowList map[routeKey]*allowRoute)
+	handoff *handoffRequest
+	done    chan error
 }
 
 // An destination-guard manager that implements guarding with NFTables.
 type NFTablesManager struct {
-	nlInterface    *nftables.Conn
-	ipv4AllowSet   *nftables.Set
-	ipv6AllowSet   *nftables.Set
-	syncChannel    chan []*allowRoute
-	allowList      map[string]*allowRoute
-	allowRoutePool sync.Pool
+	nlInterface        *nftables.Conn
+	ipv4AllowSet       *nftables.Set
+	ipv6AllowSet       *nftables.Set
+	ipv4ScopedAllowSet *nftables.Set // Only set, if scope isn't global
+	ipv6ScopedAllowSet *nftables.Set // Only set, if scope isn't global
+	ipv4CgroupAllowSet *nftables.Set // Static allowedCgroupIPs, only set in scope cgroup
+	ipv6CgroupAllowSet *nftables.Set // Static allowedCgroupIPs, only set in scope cgroup
+	netlinkConn        *netlink.Conn // Socket of nlInterface, which owns the table with ownedTable
+	syncChannel        chan *allowBatch
+	routeQueue         *routeQueue   // Routes of DNS answers waiting for the manager goroutine
+	quit               chan struct{} // Closed by Shutdown to stop the manager goroutine
+	quitOnce           sync.Once
+	stopped            chan struct{} // Closed, when the manager goroutine returned
+	allowList          map[routeKey]*allowRoute
+	expiries           expiryHeap  // Entries of the allowList, the next one to expire first
+	expiryTimer        *time.Timer // Fires, when the next entries expired, nil if none is scheduled
+	expiryAt           time.Time   // Time expiryTimer fires at
+	allowRoutePool     sync.Pool
+	commitMode         CommitMode
+	commitTimeout      time.Duration
+	queueOverflow      QueueOverflowPolicy
+	scope              Scope
+	cgroupLevel        int
+	ttlPolicy          *TTLPolicy
+	recoveryLifetime   time.Duration
+	enforcement        Enforcement
+	wouldRejectCounts  map[string]uint64 // Last read packet count of each would-reject counter (enforcement monitor)
+	domainHistory      *domainHistory    // Domains of expired and revoked entries, only set with nflogGroup
+	learner            *learner          // Only set in learn mode
+	onShutdown         ShutdownAction
+	ownedTable         bool
+	stateFile          string // File the allowList is saved to, empty if disabled
+	stateInterval      time.Duration
+	handedOver         bool                        // Whether the allowList was handed over on a reload, set by the manager goroutine
+	config             *parsedConfig               // Config the table was last prepared with, used to repair it
+	expectedRules      map[string][]*nftables.Rule // Rules of each chain, as read back after preparing the table
+	reconcileInterval  time.Duration               // Interval the table is checked for drift in, 0 if disabled
+	rulesetHealthy     atomic.Bool                 // Whether the table in the kernel matched the expected one last
+	flushFailingSince  atomic.Int64                // Unix nanoseconds of the first flush failing in a row, 0 if the last succeeded
+	heartbeat          atomic.Int64                // Unix nanoseconds the manager goroutine last ran its loop
+	flushFailures      atomic.Int32                // Number of flushes failed in a row
+	retryQueue         []*allowRoute               // Routes, whose flush failed, waiting for retryTimer
+	retryTimer         *time.Timer                 // Fires, when retryQueue is retried, nil if no retry is scheduled
+	retryBackoff       time.Duration               // Delay of the last scheduled retry, 0 after a successful flush
+	permanentRanges    []permanentRange            // Configured ranges, only used to explain why an address is allowed
+	ruleset            string                      // The created ruleset in nft syntax, only used by the admin API
+
+	// Opens a new netlink connection, after flushes failed repeatedly, nil if it can't be reopened
+	openNetlink func() (*nftables.Conn, *netlink.Conn, error)
+
+	// Prepares the table for the configuration of this manager again, when it takes its allowList back after a failed
+	// reload, which sends it to reclaim
+	rebuild func() error
+	reclaim chan chan error
 }
 
-// Add given IPs for ttl+30 seconds to the allow traffic to them.
-func (manager *NFTablesManager) AddRoutes(ips []net.IP, ttl uint32) {
-	if len(ips) == 0 {
-		return
+// Add given entries for the lifetime determined by the TTL policy (ttl+30 seconds by default) to allow traffic to them.
+// In commit mode sync this blocks until the entries are written to nftables, or the commit timeout passed. Entries,
+// that couldn't be allowed, are returned as *AllowError. In commit mode async, only errors known before queueing them
+// are returned, and it only waits for the manager goroutine, if the queue is full and queueOverflow is block.
+func (manager *NFTablesManager) AddRoutes(query *QueryInfo, entries []RouteEntry) error {
+	if len(entries) == 0 {
+		return nil
 	}
 
-	validUntil := time.Now().Add(time.Duration(ttl+30) * time.Second)
-	batch := make([]*allowRoute, 0, len(ips))
+	startedAt := time.Now()
+	routes := make([]*allowRoute, 0, len(entries))
+	scopeKey, scopeLabel, err := manager.resolveScope(query)
+	if err != nil {
+		log.Warningf("Not allowing answer for %s, as it can't be attributed to its %s scope: %v", query.Name, manager.scope, err)
+		scopeAttributionFailuresTotal.Inc()
+		return &AllowError{Entries: entries, Err: fmt.Errorf("attributing the answer to its %s scope: %w", manager.scope, err)}
+	}
+
+	clientLabel := ""
+	if clientIP := addrIP(query.Client); clientIP != nil {
+		clientLabel = clientIP.String()
+	}
+
+	// Entries skipped for their address family aren't failures, the client can't use them either way
+	batchEntries := make([]RouteEntry, 0, len(entries))
+	for _, entry := range entries {
+		// A client can only be scoped to destinations of the address family it sent its query with
+		if manager.scope == ScopeClient && scopeKey != nil && len(scopeKey) != len(entry.IP) {
+			log.Debugf("Skipping %v for client %s, as client scoped entries need matching address families", entry.IP, scopeLabel)
+			scopeFamilyMismatchesTotal.Inc()
+			continue
+		}
 
-	for _, ip := range ips {
 		newEntry := manager.allowRoutePool.Get().(*allowRoute)
-		newEntry.ipAddress = ip
-		newEntry.validUnitl = validUntil
+		newEntry.ipAddress = entry.IP
+		newEntry.validUnitl = startedAt.Add(manager.ttlPolicy.Lifetime(query, entry.TTL))
+		newEntry.scopeKey = scopeKey
+		newEntry.scopeLabel = scopeLabel
+		newEntry.domain = query.Name
+		newEntry.client = clientLabel
+
+		routes = append(routes, newEntry)
+		batchEntries = append(batchEntries, entry)
+	}
+
+	if len(routes) == 0 {
+		return nil
+	}
+
+	manager.learner.recordDomain(query.Name)
+
+	// The channel is buffered, so the manager never blocks on reporting a result nobody waits for anymore.
+	var done chan error
+	if manager.commitMode == CommitModeSync {
+		done = make(chan error, 1)
+	}
+
+	if err := manager.queueRoutes(routes, done); err != nil {
+		if errors.Is(err, errQueueFull) {
+			log.Debugf("Not allowing answer for %s, as the queue is full", query.Name)
+		} else {
+			log.Warningf("Not allowing answer for %s, as the nftables manager is stopped", query.Name)
+		}
+		return &AllowError{Entries: batchEntries, Err: err}
+	}
+
+	if done == nil {
+		return nil
+	}
+
+	timeoutTimer := time.NewTimer(manager.commitTimeout)
+	defer timeoutTimer.Stop()
+
+	var commitErr error
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Warningf("Releasing DNS answer although its IPs couldn't be written to NFTables: %v", err)
+			commitErr = &AllowError{Entries: batchEntries, Err: err}
+		}
+	case <-timeoutTimer.C:
+		log.Warningf("Releasing DNS answer after commit timeout of %v, its IPs might not be allowed yet", manager.commitTimeout)
+		commitTimeoutsTotal.Inc()
+		commitErr = &AllowError{Entries: batchEntries, Err: fmt.Errorf("%w of %v", errCommitTimeout, manager.commitTimeout)}
+	}
+
+	answerHoldDuration.Observe(time.Since(startedAt).Seconds())
+
+	return commitErr
+}
+
+// Sends given batch to the manager goroutine. Returns false, if the manager was shut down.
+func (manager *NFTablesManager) enqueue(batch *allowBatch) bool {
+	select {
+	case manager.syncChannel <- batch:
+		return true
+	case <-manager.stopped:
+		return false
+	}
+}
+
+// Returns the scope key and its label for the routes of given query. A nil key means the routes go to the global sets.
+// If the query can't be attributed to its scope, an error is returned, and the routes must not be allowed at all.
+func (manager *NFTablesManager) resolveScope(query *QueryInfo) ([]byte, string, error) {
+	if manager.scope == ScopeGlobal || manager.scope == "" || query == nil {
+		return nil, "", nil
+	}
+
+	clientIP := addrIP(query.Client)
+
+	switch manager.scope {
+	case ScopeClient:
+		// Queries of the host itself are handled by the OUTPUT chain, which uses the global sets. They might arrive from
+		// any of its addresses, like when CoreDNS listens on a LAN address
+		if clientIP == nil {
+			return nil, "", nil
+		}
+		local, err := isLocalAddress(clientIP)
+		if err != nil {
+			return nil, "", fmt.Errorf("listing local addresses: %w", err)
+		}
+		if local {
+			return nil, "", nil
+		}
+
+		return clientIP, clientIP.String(), nil
+
+	case ScopeUser:
+		if clientIP == nil {
+			return nil, "", fmt.Errorf("query without client address")
+		}
 
-		batch = append(batch, newEntry)
+		owner, err := findSocketOwner(query.Client)
+		if err != nil {
+			return nil, "", fmt.Errorf("looking up socket of %v: %w", query.Client, err)
+		}
+
+		if owner == nil {
+			// Queries of other hosts are handled by the FORWARD chain, which uses the global sets
+			if !clientIP.IsLoopback() {
+				return nil, "", nil
+			}
+			return nil, "", fmt.Errorf("no local socket found for %v", query.Client)
+		}
+
+		return binaryutil.NativeEndian.PutUint32(owner.uid), strconv.FormatUint(uint64(owner.uid), 10), nil
+
+	case ScopeCgroup:
+		if clientIP == nil {
+			return nil, "", fmt.Errorf("query without client address")
+		}
+
+		owner, err := findSocketOwner(query.Client)
+		if err != nil {
+			return nil, "", fmt.Errorf("looking up socket of %v: %w", query.Client, err)
+		}
+
+		if owner == nil {
+			// Queries of other hosts are handled by the FORWARD chain, which uses the global sets
+			if !clientIP.IsLoopback() {
+				return nil, "", nil
+			}
+			return nil, "", fmt.Errorf("no local socket found for %v", query.Client)
+		}
+
+		cgroupPath, err := socketCgroupPath(owner)
+		if err != nil {
+			return nil, "", fmt.Errorf("looking up cgroup of %v: %w", query.Client, err)
+		}
+
+		cgroupPath, err = cgroupAncestor(cgroupPath, manager.cgroupLevel)
+		if err != nil {
+			return nil, "", err
+		}
+
+		id, err := cgroupID(cgroupPath)
+		if err != nil {
+			return nil, "", fmt.Errorf("looking up id of cgroup '%s': %w", cgroupPath, err)
+		}
+
+		return binaryutil.NativeEndian.PutUint64(id), strconv.FormatUint(id, 10), nil
 	}
 
-	manager.syncChannel <- batch
+	return nil, "", fmt.Errorf("unsupported scope '%s'", manager.scope)
+}
+
+// Returns the IP of given address, normalized to 4 bytes for IPv4 addresses, or nil if there is none.
+func addrIP(addr net.Addr) net.IP {
+	var ip net.IP
+
+	switch typedAddr := addr.(type) {
+	case *net.UDPAddr:
+		ip = typedAddr.IP
+	case *net.TCPAddr:
+		ip = typedAddr.IP
+	case *net.IPAddr:
+		ip = typedAddr.IP
+	default:
+		return nil
+	}
+
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4
+	}
+
+	return ip.To16()
+}
+
+// Returns the nftables set given route belongs to.
+func (manager *NFTablesManager) allowSetFor(route *allowRoute) *nftables.Set {
+	if route.scopeKey != nil {
+		if len(route.ipAddress) == net.IPv4len {
+			return manager.ipv4ScopedAllowSet
+		}
+		return manager.ipv6ScopedAllowSet
+	}
+
+	if len(route.ipAddress) == net.IPv4len {
+		return manager.ipv4AllowSet
+	}
+	return manager.ipv6AllowSet
+}
+
+// Returns the human readable label for given scope key, as used by allowRoute.scopeLabel.
+func (manager *NFTablesManager) scopeLabelFor(scopeKey []byte) string {
+	if manager.scope == ScopeUser && len(scopeKey) == 4 {
+		return strconv.FormatUint(uint64(binaryutil.NativeEndian.Uint32(scopeKey)), 10)
+	}
+
+	if manager.scope == ScopeCgroup && len(scopeKey) == 8 {
+		return strconv.FormatUint(binaryutil.NativeEndian.Uint64(scopeKey), 10)
+	}
+
+	return net.IP(scopeKey).String()
 }
 
 // prepareNFTables does what the name says, prepares the nftables stack with all necessary chains and rules in a custom table.
 // Errors returned by this function are considered fatal, as this plugin can't work without nftables.
 func (manager *NFTablesManager) prepareNFTables(config *parsedConfig) error {
 	targetTable := nftables.Table{
-		Name:   "coredns-ip-destination-guard",
+		Name:   tableName,
 		Family: nftables.TableFamilyINet,
 	}
 
 	// Create the table and flush it
-	manager.nlInterface.AddTable(&targetTable)
+	if err := manager.prepareTable(&targetTable, config.ownedTable); err != nil {
+		return err
+	}
 	manager.nlInterface.FlushTable(&targetTable)
 
-	// Create shared IPv4/IPv6 sets
+	// Recreate sets of older plugin versions, which don't support element timeouts
+	ipv4MigratedElements, err := manager.dropLegacyAllowSet(&targetTable, "ipv4allowlist")
+	if err != nil {
+		return err
+	}
+	ipv6MigratedElements, err := manager.dropLegacyAllowSet(&targetTable, "ipv6allowlist")
+	if err != nil {
+		return err
+	}
+
+	// Create shared IPv4/IPv6 sets, each element expires on its own timeout
 	manager.ipv4AllowSet = &nftables.Set{
-		Name:    "ipv4allowlist",
-		Table:   &targetTable,
-		Dynamic: true,
-		KeyType: nftables.TypeIPAddr,
+		Name:       "ipv4allowlist",
+		Table:      &targetTable,
+		Dynamic:    true,
+		HasTimeout: true,
+		KeyType:    nftables.TypeIPAddr,
 	}
 
 	manager.ipv6AllowSet = &nftables.Set{
-		Name:    "ipv6allowlist",
-		Table:   &targetTable,
-		Dynamic: true,
-		KeyType: nftables.TypeIP6Addr,
+		Name:       "ipv6allowlist",
+		Table:      &targetTable,
+		Dynamic:    true,
+		HasTimeout: true,
+		KeyType:    nftables.TypeIP6Addr,
 	}
 
-	if err := manager.nlInterface.AddSet(manager.ipv4AllowSet, []nftables.SetElement{}); err != nil {
+	if err := manager.nlInterface.AddSet(manager.ipv4AllowSet, ipv4MigratedElements); err != nil {
 		return err
 	}
-	if err := manager.nlInterface.AddSet(manager.ipv6AllowSet, []nftables.SetElement{}); err != nil {
+	if err := manager.nlInterface.AddSet(manager.ipv6AllowSet, ipv6MigratedElements); err != nil {
 		return err
 	}
 
+	// Create the scoped sets, that concatenate the scope with the destination address
+	if config.scope == ScopeClient {
+		manager.ipv4ScopedAllowSet = &nftables.Set{
+			Name:          "ipv4clientallowlist",
+			Table:         &targetTable,
+			Dynamic:       true,
+			HasTimeout:    true,
+			Concatenation: true,
+			KeyType:       nftables.MustConcatSetType(nftables.TypeIPAddr, nftables.TypeIPAddr),
+		}
+
+		manager.ipv6ScopedAllowSet = &nftables.Set{
+			Name:          "ipv6clientallowlist",
+			Table:         &targetTable,
+			Dynamic:       true,
+			HasTimeout:    true,
+			Concatenation: true,
+			KeyType:       nftables.MustConcatSetType(nftables.TypeIP6Addr, nftables.TypeIP6Addr),
+		}
+	}
+
+	if config.scope == ScopeUser {
+		manager.ipv4ScopedAllowSet = &nftables.Set{
+			Name:          "ipv4userallowlist",
+			Table:         &targetTable,
+			Dynamic:       true,
+			HasTimeout:    true,
+			Concatenation: true,
+			KeyType:       nftables.MustConcatSetType(nftables.TypeUID, nftables.TypeIPAddr),
+		}
+
+		manager.ipv6ScopedAllowSet = &nftables.Set{
+			Name:          "ipv6userallowlist",
+			Table:         &targetTable,
+			Dynamic:       true,
+			HasTimeout:    true,
+			Concatenation: true,
+			KeyType:       nftables.MustConcatSetType(nftables.TypeUID, nftables.TypeIP6Addr),
+		}
+	}
+
+	if config.scope == ScopeCgroup {
+		manager.ipv4ScopedAllowSet = &nftables.Set{
+			Name:          "ipv4cgroupallowlist",
+			Table:         &targetTable,
+			Dynamic:       true,
+			HasTimeout:    true,
+			Concatenation: true,
+			KeyType:       nftables.MustConcatSetType(nftables.TypeCGroupV2, nftables.TypeIPAddr),
+		}
+
+		manager.ipv6ScopedAllowSet = &nftables.Set{
+			Name:          "ipv6cgroupallowlist",
+			Table:         &targetTable,
+			Dynamic:       true,
+			HasTimeout:    true,
+			Concatenation: true,
+			KeyType:       nftables.MustConcatSetType(nftables.TypeCGroupV2, nftables.TypeIP6Addr),
+		}
+	}
+
+	if manager.ipv4ScopedAllowSet != nil {
+		if err := manager.nlInterface.AddSet(manager.ipv4ScopedAllowSet, []nftables.SetElement{}); err != nil {
+			return err
+		}
+		if err := manager.nlInterface.AddSet(manager.ipv6ScopedAllowSet, []nftables.SetElement{}); err != nil {
+			return err
+		}
+	}
+
+	if config.scope == ScopeCgroup {
+		if err := manager.prepareCgroupAllowSets(&targetTable, config); err != nil {
+			return err
+		}
+	}
+
 	// Determine which chains to create based on mode
 	var chainsToCreate []struct {
 		name      string
@@ -113,8 +518,24 @@ func (manager *NFTablesManager) prepareNFTables(config *parsedConfig) error {
 		}
 	}
 
+	// Delete chains of a previous mode, as a base chain without rules would drop all of its traffic
+	existingChains, err := manager.nlInterface.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return err
+	}
+	for _, existingChain := range existingChains {
+		if existingChain.Table.Name == tableName && !slices.Contains(chainsForMode(config.mode), existingChain.Name) {
+			manager.nlInterface.DelChain(existingChain)
+		}
+	}
+
 	// Create all required chains and add rules
 	for _, chainSpec := range chainsToCreate {
+		// In enforcement monitor the traffic, that would be rejected, gets counted per chain
+		if config.enforcement == EnforcementMonitor {
+			manager.nlInterface.AddObj(&nftables.CounterObj{Table: &targetTable, Name: wouldRejectCounterName(chainSpec.name)})
+		}
+
 		targetChainPolicy := nftables.ChainPolicyDrop
 		targetChain := nftables.Chain{
 			Name:     chainSpec.name,
@@ -132,12 +553,21 @@ func (manager *NFTablesManager) prepareNFTables(config *parsedConfig) error {
 		}
 	}
 
-	if err := manager.nlInterface.Flush(); err != nil {
+	if err := manager.flush(flushPathPrepare, time.Now()); err != nil {
 		log.Errorf("Writing to NFTables failed: %v", err)
 		nftablesFlushErrorsTotal.Inc()
 		return err
 	}
 
+	// The kernel reports the rules in its own encoding, so drift is detected against the rules read back
+	expectedRules, err := manager.readRules(chainsForMode(config.mode))
+	if err != nil {
+		return err
+	}
+	manager.config = config
+	manager.expectedRules = expectedRules
+	manager.rulesetHealthy.Store(true)
+
 	return nil
 }
 
@@ -398,6 +828,147 @@ func (manager *NFTablesManager) addChainRules(targetTable *nftables.Table, targe
 	}
 	// endregion
 
+	// region allow permanent allowlisted cgroup traffic
+	if chainName == "output" && manager.ipv4CgroupAllowSet != nil {
+		manager.addScopedAllowRules(targetTable, targetChain, manager.ipv4CgroupAllowSet, manager.ipv6CgroupAllowSet)
+	}
+	// endregion
+
+	// region allow temporary allowlisted traffic
+	if (chainName == "forward" && config.scope == ScopeClient) || (chainName == "output" && (config.scope == ScopeUser || config.scope == ScopeCgroup)) {
+		manager.addScopedAllowRules(targetTable, targetChain, manager.ipv4ScopedAllowSet, manager.ipv6ScopedAllowSet)
+	} else {
+		manager.addGlobalAllowRules(targetTable, targetChain)
+	}
+	// endregion
+
+	// region reject all other traffic
+	if config.enforcement == EnforcementMonitor {
+		manager.addMonitorRules(targetTable, targetChain, chainName, config.nflogGroup)
+		return nil
+	}
+
+	var rejectExprs []expr.Any
+	if config.nflogGroup != 0 {
+		rejectExprs = append(rejectExprs, rejectLogExpr(chainName, config.enforcement, config.nflogGroup))
+	}
+	rejectExprs = append(rejectExprs, &expr.Reject{
+		Type: 0x2, // icmpx
+		Code: 0x3, // admin-prohibited
+	})
+
+	manager.nlInterface.AddRule(&nftables.Rule{
+		Table: targetTable,
+		Chain: targetChain,
+		Exprs: rejectExprs,
+	})
+	// endregion
+
+	return nil
+}
+
+// addMonitorRules ends the chain of enforcement monitor: all traffic, that would be rejected, is counted, logged
+// (rate-limited to the kernel log, or to given NFLOG group if it isn't 0), and accepted.
+func (manager *NFTablesManager) addMonitorRules(targetTable *nftables.Table, targetChain *nftables.Chain, chainName string, nflogGroup uint16) {
+	// region count and log traffic, that would be rejected
+	monitorExprs := []expr.Any{
+		&expr.Objref{
+			Type: unix.NFT_OBJECT_COUNTER,
+			Name: wouldRejectCounterName(chainName),
+		},
+	}
+
+	if nflogGroup != 0 {
+		// The reader of the group limits its log lines itself
+		monitorExprs = append(monitorExprs, rejectLogExpr(chainName, EnforcementMonitor, nflogGroup))
+	} else {
+		monitorExprs = append(monitorExprs,
+			// The limit stops evaluating the rule when exceeded, so it has to come after the counter
+			&expr.Limit{
+				Type:  expr.LimitTypePkts,
+				Rate:  monitorLogRate,
+				Unit:  expr.LimitTimeSecond,
+				Burst: monitorLogBurst,
+			},
+			&expr.Log{
+				Key:   1<<unix.NFTA_LOG_PREFIX | 1<<unix.NFTA_LOG_LEVEL,
+				Level: expr.LogLevelWarning,
+				Data:  []byte(rejectLogPrefix(chainName, EnforcementMonitor)),
+			},
+		)
+	}
+
+	manager.nlInterface.AddRule(&nftables.Rule{
+		Table: targetTable,
+		Chain: targetChain,
+		Exprs: monitorExprs,
+	})
+	// endregion
+
+	// region accept all other traffic
+	manager.nlInterface.AddRule(&nftables.Rule{
+		Table: targetTable,
+		Chain: targetChain,
+		Exprs: []expr.Any{
+			&expr.Verdict{
+				Kind: expr.VerdictAccept,
+			},
+		},
+	})
+	// endregion
+}
+
+// Returns the expression sending packets, that given chain rejects, to given NFLOG group.
+func rejectLogExpr(chainName string, enforcement Enforcement, nflogGroup uint16) *expr.Log {
+	return &expr.Log{
+		Key:   1<<unix.NFTA_LOG_GROUP | 1<<unix.NFTA_LOG_PREFIX,
+		Group: nflogGroup,
+		Data:  []byte(rejectLogPrefix(chainName, enforcement)),
+	}
+}
+
+// Reads the would-reject counters of enforcement monitor and adds the packets counted since the last read to the
+// would_reject_packets_total metric.
+func (manager *NFTablesManager) collectWouldRejectCounts() {
+	for chainName, lastCount := range manager.wouldRejectCounts {
+		count, err := manager.readWouldRejectCount(chainName)
+		if err != nil {
+			log.Warningf("Reading would-reject counter of chain %s failed: %v", chainName, err)
+			continue
+		}
+
+		wouldRejectPacketsTotal.WithLabelValues(chainName).Add(float64(counterDelta(lastCount, count)))
+		manager.wouldRejectCounts[chainName] = count
+	}
+}
+
+// Returns the packet count of the would-reject counter of given chain.
+func (manager *NFTablesManager) readWouldRejectCount(chainName string) (uint64, error) {
+	obj, err := manager.nlInterface.GetObject(&nftables.CounterObj{Table: manager.ipv4AllowSet.Table, Name: wouldRejectCounterName(chainName)})
+	if err != nil {
+		return 0, err
+	}
+
+	counter, ok := obj.(*nftables.CounterObj)
+	if !ok {
+		return 0, fmt.Errorf("unexpected object type %T", obj)
+	}
+
+	return counter.Packets, nil
+}
+
+// Returns the packets counted between given last and current value of a kernel counter. A current value lower than
+// the last one means the counter got recreated, so all its packets are new.
+func counterDelta(last uint64, current uint64) uint64 {
+	if current < last {
+		return current
+	}
+
+	return current - last
+}
+
+// addGlobalAllowRules adds the rules allowing traffic to all destinations of the dynamic allowlists.
+func (manager *NFTablesManager) addGlobalAllowRules(targetTable *nftables.Table, targetChain *nftables.Chain) {
 	// region allow temporary allowlisted ipv4 traffic
 	manager.nlInterface.AddRule(&nftables.Rule{
 		Table: targetTable,
@@ -463,187 +1034,722 @@ func (manager *NFTablesManager) addChainRules(targetTable *nftables.Table, targe
 		},
 	})
 	// endregion
+}
 
-	// region reject all other traffic
+// addScopedAllowRules adds the rules allowing traffic to the destinations, that are listed for the same scope in given sets.
+func (manager *NFTablesManager) addScopedAllowRules(targetTable *nftables.Table, targetChain *nftables.Chain, ipv4Set *nftables.Set, ipv6Set *nftables.Set) {
+	// region allow scoped ipv4 traffic
+	ipv4Exprs := []expr.Any{
+		&expr.Meta{
+			Key:      expr.MetaKeyNFPROTO,
+			Register: 0x1,
+		},
+		&expr.Cmp{
+			Register: 0x1,
+			Op:       expr.CmpOpEq,
+			Data:     binaryutil.NativeEndian.PutUint32(0x2),
+		},
+	}
+	ipv4Exprs = append(ipv4Exprs, manager.scopeKeyExprs(false)...)
+	ipv4Exprs = append(ipv4Exprs,
+		&expr.Lookup{
+			SourceRegister: 0x1,
+			SetID:          ipv4Set.ID,
+			SetName:        ipv4Set.Name,
+		},
+		&expr.Verdict{
+			Kind: expr.VerdictAccept,
+		},
+	)
 	manager.nlInterface.AddRule(&nftables.Rule{
 		Table: targetTable,
 		Chain: targetChain,
-		Exprs: []expr.Any{
-			&expr.Reject{
-				Type: 0x2, // icmpx
-				Code: 0x3, // admin-prohibited
-			},
+		Exprs: ipv4Exprs,
+	})
+	// endregion
+
+	// region allow scoped ipv6 traffic
+	ipv6Exprs := []expr.Any{
+		&expr.Meta{
+			Key:      expr.MetaKeyNFPROTO,
+			Register: 0x1,
+		},
+		&expr.Cmp{
+			Register: 0x1,
+			Op:       expr.CmpOpEq,
+			Data:     binaryutil.NativeEndian.PutUint32(0xa),
+		},
+	}
+	ipv6Exprs = append(ipv6Exprs, manager.scopeKeyExprs(true)...)
+	ipv6Exprs = append(ipv6Exprs,
+		&expr.Lookup{
+			SourceRegister: 0x1,
+			SetID:          ipv6Set.ID,
+			SetName:        ipv6Set.Name,
 		},
+		&expr.Verdict{
+			Kind: expr.VerdictAccept,
+		},
+	)
+	manager.nlInterface.AddRule(&nftables.Rule{
+		Table: targetTable,
+		Chain: targetChain,
+		Exprs: ipv6Exprs,
 	})
 	// endregion
+}
+
+// scopeKeyExprs returns the expressions loading the concatenated key of the scoped sets (scope . daddr) into the
+// registers, starting at register 1. The 32 bit registers of concatenated fields follow each other, so the
+// destination address starts at register 9 after a 4 byte field, register 10 after an 8 byte field (or register 2
+// in 128 bit addressing after a 16 byte field).
+func (manager *NFTablesManager) scopeKeyExprs(ipv6 bool) []expr.Any {
+	daddrExpr := &expr.Payload{
+		OperationType: expr.PayloadLoad,
+		Base:          expr.PayloadBaseNetworkHeader,
+		Offset:        16,
+		Len:           4,
+		DestRegister:  0x9,
+	}
+	if ipv6 {
+		daddrExpr.Offset = 24
+		daddrExpr.Len = 16
+	}
+
+	switch manager.scope {
+	case ScopeClient:
+		// ip saddr . ip daddr / ip6 saddr . ip6 daddr
+		saddrExpr := &expr.Payload{
+			OperationType: expr.PayloadLoad,
+			Base:          expr.PayloadBaseNetworkHeader,
+			Offset:        12,
+			Len:           4,
+			DestRegister:  0x1,
+		}
+		if ipv6 {
+			saddrExpr.Offset = 8
+			saddrExpr.Len = 16
+			daddrExpr.DestRegister = 0x2
+		}
+		return []expr.Any{saddrExpr, daddrExpr}
+
+	case ScopeUser:
+		// meta skuid . ip daddr / meta skuid . ip6 daddr
+		return []expr.Any{
+			&expr.Meta{
+				Key:      expr.MetaKeySKUID,
+				Register: 0x1,
+			},
+			daddrExpr,
+		}
+
+	case ScopeCgroup:
+		// socket cgroupv2 level N . ip daddr / socket cgroupv2 level N . ip6 daddr
+		daddrExpr.DestRegister = 0xa
+		return []expr.Any{
+			&expr.Socket{
+				Key:      expr.SocketKeyCgroupv2,
+				Level:    uint32(manager.cgroupLevel),
+				Register: 0x1,
+			},
+			daddrExpr,
+		}
+	}
+
+	return nil
+}
+
+// prepareCgroupAllowSets creates the sets of the static allowedCgroupIPs and replaces their elements. The cgroup ids
+// are resolved now, so cgroups that don't exist yet (like units not started yet) are skipped.
+func (manager *NFTablesManager) prepareCgroupAllowSets(targetTable *nftables.Table, config *parsedConfig) error {
+	manager.ipv4CgroupAllowSet = &nftables.Set{
+		Name:          "ipv4cgroupstaticallowlist",
+		Table:         targetTable,
+		Interval:      true,
+		Concatenation: true,
+		KeyType:       nftables.MustConcatSetType(nftables.TypeCGroupV2, nftables.TypeIPAddr),
+	}
+
+	manager.ipv6CgroupAllowSet = &nftables.Set{
+		Name:          "ipv6cgroupstaticallowlist",
+		Table:         targetTable,
+		Interval:      true,
+		Concatenation: true,
+		KeyType:       nftables.MustConcatSetType(nftables.TypeCGroupV2, nftables.TypeIP6Addr),
+	}
+
+	ipv4Elements := []nftables.SetElement{}
+	ipv6Elements := []nftables.SetElement{}
+
+	for _, allowance := range config.allowedCgroupIPs {
+		id, err := cgroupID(allowance.path)
+		if err != nil {
+			log.Warningf("Skipping allowedCgroupIPs for cgroup '%s', as its id can't be determined: %v", allowance.path, err)
+			continue
+		}
+		idBytes := binaryutil.NativeEndian.PutUint64(id)
+
+		for i := 0; i < len(allowance.allowedIPs); i += 2 {
+			// Concatenated ranges use an inclusive end, unlike the interval end of the permanent sets
+			element := nftables.SetElement{
+				Key:    append(append([]byte{}, idBytes...), allowance.allowedIPs[i]...),
+				KeyEnd: append(append([]byte{}, idBytes...), previousIP(allowance.allowedIPs[i+1])...),
+			}
+
+			if len(allowance.allowedIPs[i]) == net.IPv4len {
+				ipv4Elements = append(ipv4Elements, element)
+			} else {
+				ipv6Elements = append(ipv6Elements, element)
+			}
+		}
+	}
+
+	for _, cgroupSet := range []struct {
+		set      *nftables.Set
+		elements []nftables.SetElement
+	}{
+		{manager.ipv4CgroupAllowSet, ipv4Elements},
+		{manager.ipv6CgroupAllowSet, ipv6Elements},
+	} {
+		if err := manager.nlInterface.AddSet(cgroupSet.set, []nftables.SetElement{}); err != nil {
+			return err
+		}
+		manager.nlInterface.FlushSet(cgroupSet.set)
+		if len(cgroupSet.elements) > 0 {
+			if err := manager.nlInterface.SetAddElements(cgroupSet.set, cgroupSet.elements); err != nil {
+				return err
+			}
+		}
+	}
 
 	return nil
 }
 
 // Reads all SetElements for given set and adds them to the local allowList.
-func (manager *NFTablesManager) recoverExistingSetEntries(nftSet *nftables.Set) (int, error) {
+// The expiry times are taken from the kernel, elements without timeout get the legacy recovery lifetime assigned.
+func (manager *NFTablesManager) recoverExistingSetEntries(nftSet *nftables.Set, ipLen int) (int, error) {
 	existingEntries, err := manager.nlInterface.GetSetElements(nftSet)
 	if err != nil {
 		return 0, err
 	}
 
+	now := time.Now()
+	var elementsWithoutTimeout []nftables.SetElement
+
 	for _, setEntry := range existingEntries {
+		if len(setEntry.Key) < ipLen {
+			continue
+		}
+
 		allowListEntry := manager.allowRoutePool.Get().(*allowRoute)
 
-		allowListEntry.ipAddress = net.IP(setEntry.Key)
-		allowListEntry.validUnitl = time.Now().Add(330 * time.Second)
+		// Keys of scoped sets are the scope concatenated with the destination address
+		scopeLen := len(setEntry.Key) - ipLen
+		allowListEntry.ipAddress = net.IP(setEntry.Key[scopeLen:])
+		allowListEntry.scopeKey = nil
+		allowListEntry.scopeLabel = ""
+		allowListEntry.domain = ""
+		allowListEntry.client = ""
+		if scopeLen > 0 {
+			allowListEntry.scopeKey = setEntry.Key[:scopeLen]
+			allowListEntry.scopeLabel = manager.scopeLabelFor(allowListEntry.scopeKey)
+		}
+
+		if setEntry.Expires > 0 {
+			allowListEntry.validUnitl = now.Add(setEntry.Expires)
+		} else {
+			allowListEntry.validUnitl = now.Add(manager.recoveryLifetime)
+			elementsWithoutTimeout = append(elementsWithoutTimeout, nftables.SetElement{Key: setEntry.Key})
+		}
+
+		manager.storeRoute(allowListEntry)
+	}
+
+	// Elements without timeout would never expire, so we replace them with elements using the assigned lifetime.
+	if len(elementsWithoutTimeout) > 0 {
+		elementsToAdd := make([]nftables.SetElement, 0, len(elementsWithoutTimeout))
+		for _, element := range elementsWithoutTimeout {
+			elementsToAdd = append(elementsToAdd, nftables.SetElement{Key: element.Key, Timeout: manager.recoveryLifetime})
+		}
 
-		manager.allowList[allowListEntry.ipAddress.String()] = allowListEntry
+		if err := manager.nlInterface.SetDeleteElements(nftSet, elementsWithoutTimeout); err != nil {
+			return 0, err
+		}
+		if err := manager.nlInterface.SetAddElements(nftSet, elementsToAdd); err != nil {
+			return 0, err
+		}
+		if err := manager.nlInterface.Flush(); err != nil {
+			nftablesFlushErrorsTotal.Inc()
+			return 0, err
+		}
 	}
 
 	return len(existingEntries), nil
 }
 
+// Returns the elements of given set, if it exists in the kernel without timeout support, and queues its deletion.
+// Sets created by older versions of this plugin have no timeout flag, and the kernel can't change flags of
+// existing sets, so they have to be recreated. The returned elements get carried over to the new set.
+func (manager *NFTablesManager) dropLegacyAllowSet(table *nftables.Table, setName string) ([]nftables.SetElement, error) {
+	existingSet, err := manager.nlInterface.GetSetByName(table, setName)
+	if err != nil {
+		// The set (or the whole table) doesn't exist yet, so there is nothing to migrate
+		return nil, nil
+	}
+
+	if existingSet.HasTimeout {
+		return nil, nil
+	}
+
+	existingElements, err := manager.nlInterface.GetSetElements(existingSet)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Recreating set %s with timeout support, carrying over %d entries", setName, len(existingElements))
+	manager.nlInterface.DelSet(existingSet)
+
+	migratedElements := make([]nftables.SetElement, 0, len(existingElements))
+	for _, element := range existingElements {
+		migratedElements = append(migratedElements, nftables.SetElement{Key: element.Key, Timeout: manager.recoveryLifetime})
+	}
+
+	return migratedElements, nil
+}
+
+// Removes the existing entries of given routes from the allowList and their sets. This must only be called by
+// the manager goroutine. If none of the routes is allowed, errRouteNotFound is returned.
+func (manager *NFTablesManager) revokeRoutes(routes []*allowRoute) error {
+	elementsToDelete := make(map[*nftables.Set][]nftables.SetElement)
+	var entriesRevoked []*allowRoute
+	now := time.Now()
+
+	for _, route := range routes {
+		existingRoute, exists := manager.allowList[route.key()]
+		if !exists {
+			continue
+		}
+
+		// Elements about to expire might be gone already, and deleting those would fail the whole batch
+		if existingRoute.validUnitl.After(now.Add(refreshSafetyMargin)) {
+			targetSet := manager.allowSetFor(existingRoute)
+			elementsToDelete[targetSet] = append(elementsToDelete[targetSet], nftables.SetElement{Key: existingRoute.elementKey()})
+		}
+		entriesRevoked = append(entriesRevoked, existingRoute)
+	}
+
+	if len(entriesRevoked) == 0 {
+		return errRouteNotFound
+	}
+
+	if len(elementsToDelete) > 0 {
+		for targetSet, elements := range elementsToDelete {
+			manager.nlInterface.SetDeleteElements(targetSet, elements)
+		}
+
+		if err := manager.flush(flushPathRevoke, now); err != nil {
+			log.Errorf("Writing to NFTables failed: %v", err)
+			nftablesFlushErrorsTotal.Inc()
+			return err
+		}
+	}
+
+	for _, revokedRoute := range entriesRevoked {
+		if len(revokedRoute.ipAddress) == net.IPv4len {
+			ipv4AllowListEntries.Dec()
+		} else {
+			ipv6AllowListEntries.Dec()
+		}
+
+		manager.domainHistory.record(revokedRoute.ipAddress, revokedRoute.domain)
+		manager.removeRoute(revokedRoute)
+		manager.allowRoutePool.Put(revokedRoute)
+	}
+
+	return nil
+}
+
+// Adds given routes to the allowList and their sets, or extends the existing entries. If the flush fails, the routes
+// are queued for a retry. This must only be called by the manager goroutine.
+func (manager *NFTablesManager) allowRoutes(routes []*allowRoute, now time.Time) error {
+	elementsToAdd := make(map[*nftables.Set][]nftables.SetElement)
+	elementsToRefresh := make(map[*nftables.Set][]nftables.SetElement)
+	var entriesAdded []*allowRoute
+	var entriesRefreshed []*allowRoute
+	var previousValidUntil []time.Time
+	var ipv4AddedCount, ipv6AddedCount int
+
+	for _, newEntry := range routes {
+		if len(newEntry.ipAddress) != net.IPv4len && len(newEntry.ipAddress) != net.IPv6len {
+			log.Errorf("Received invalid ip address: %v", newEntry.ipAddress)
+			manager.allowRoutePool.Put(newEntry)
+			continue
+		}
+
+		targetSet := manager.allowSetFor(newEntry)
+		existingRoute, exists := manager.allowList[newEntry.key()]
+
+		if exists {
+			if existingRoute.validUnitl.Before(newEntry.validUnitl) {
+				// The kernel keeps the timeout of elements that get added again, so we replace them. Elements
+				// might have expired in the kernel already, and deleting those would fail the whole batch. So
+				// they're added first, which doesn't fail for existing elements, then deleted and added again
+				// with the new timeout, all within the same transaction.
+				element := nftables.SetElement{Key: existingRoute.elementKey(), Timeout: elementTimeout(newEntry.validUnitl, now)}
+				elementsToRefresh[targetSet] = append(elementsToRefresh[targetSet], element)
+				elementsToAdd[targetSet] = append(elementsToAdd[targetSet], element)
+
+				entriesRefreshed = append(entriesRefreshed, existingRoute)
+				previousValidUntil = append(previousValidUntil, existingRoute.validUnitl)
+				manager.setExpiry(existingRoute, newEntry.validUnitl)
+			}
+			if newEntry.domain != "" {
+				existingRoute.domain = newEntry.domain
+				existingRoute.client = newEntry.client
+			}
+			manager.allowRoutePool.Put(newEntry)
+			continue
+		}
+
+		elementsToAdd[targetSet] = append(elementsToAdd[targetSet], nftables.SetElement{
+			Key:     newEntry.elementKey(),
+			Timeout: elementTimeout(newEntry.validUnitl, now),
+		})
+
+		if len(newEntry.ipAddress) == net.IPv4len {
+			ipv4AddedCount++
+		} else {
+			ipv6AddedCount++
+		}
+
+		manager.storeRoute(newEntry)
+		entriesAdded = append(entriesAdded, newEntry)
+	}
+
+	for targetSet, elements := range elementsToRefresh {
+		manager.nlInterface.SetAddElements(targetSet, elements)
+		manager.nlInterface.SetDeleteElements(targetSet, elements)
+	}
+
+	for targetSet, elements := range elementsToAdd {
+		manager.nlInterface.SetAddElements(targetSet, elements)
+	}
+
+	if len(elementsToAdd) == 0 {
+		return nil
+	}
+
+	if err := manager.flush(flushPathAdd, now); err != nil {
+		log.Errorf("Writing to NFTables failed, queueing the entries for a retry: %v", err)
+		nftablesFlushErrorsTotal.Inc()
+
+		// As the flush failed, the entries that we couldn't flush are removed again, and retried later on.
+		// The nftables sets are only buffers, which get flushed either way, so nothing to do here.
+		retryRoutes := make([]*allowRoute, 0, len(entriesAdded)+len(entriesRefreshed))
+		for _, entryToRemove := range entriesAdded {
+			manager.removeRoute(entryToRemove)
+			retryRoutes = append(retryRoutes, entryToRemove)
+		}
+
+		// The refreshed entries still have their old timeout in the kernel
+		for i, entryToRestore := range entriesRefreshed {
+			retryRoute := manager.allowRoutePool.Get().(*allowRoute)
+			*retryRoute = *entryToRestore
+			retryRoutes = append(retryRoutes, retryRoute)
+
+			manager.setExpiry(entryToRestore, previousValidUntil[i])
+		}
+
+		manager.queueRetry(retryRoutes)
+		return err
+	}
+
+	ipv4AllowListEntries.Add(float64(ipv4AddedCount))
+	ipv4AllowListAddedTotal.Add(float64(ipv4AddedCount))
+	ipv6AllowListEntries.Add(float64(ipv6AddedCount))
+	ipv6AllowListAddedTotal.Add(float64(ipv6AddedCount))
+
+	return nil
+}
+
+// Returns the timeout to write to nftables for an element, that should be valid until given time.
+func elementTimeout(validUntil time.Time, now time.Time) time.Duration {
+	timeout := validUntil.Sub(now)
+	if timeout < time.Second {
+		return time.Second
+	}
+
+	return timeout
+}
+
 // This function is a special handler function managing the current allowed entries
 // in nftables. This function expects to run as singleton go-routine.
+// The kernel removes expired elements by itself, so the expiry timer only keeps the local allowList in sync with it.
 func (manager *NFTablesManager) manageAllowList() {
-	gcTicker := time.NewTicker(30 * time.Second)
+	defer close(manager.stopped)
+	defer manager.routeQueue.close()
+
+	// Reads the would-reject counters of enforcement monitor, the allowList expires on its own timer
+	counterTicker := time.NewTicker(30 * time.Second)
+	defer counterTicker.Stop()
+
+	// A nil channel never fires, so without state file nothing is saved
+	var stateTick <-chan time.Time
+	if manager.stateFile != "" {
+		stateTicker := time.NewTicker(manager.stateInterval)
+		defer stateTicker.Stop()
+		stateTick = stateTicker.C
+	}
+
+	defer func() {
+		if manager.retryTimer != nil {
+			manager.retryTimer.Stop()
+		}
+		if manager.expiryTimer != nil {
+			manager.expiryTimer.Stop()
+			manager.expiryTimer = nil
+		}
+	}()
+
+	var reconcileTick <-chan time.Time
+	if manager.reconcileInterval > 0 {
+		reconcileTicker := time.NewTicker(manager.reconcileInterval)
+		defer reconcileTicker.Stop()
+		reconcileTick = reconcileTicker.C
+	}
 
 	for {
+		now := time.Now()
+		manager.heartbeat.Store(now.UnixNano())
+		manager.scheduleExpiry(now)
+
 		select {
+		case <-manager.quit:
+			return
+
+		case result := <-manager.reclaim:
+			// The handoff failed already, so this manager kept its allowList
+			result <- nil
+
 		case newBatch := <-manager.syncChannel:
-			var ipv4ToAdd []nftables.SetElement
-			var ipv6ToAdd []nftables.SetElement
-			var entriesAdded []*allowRoute
-
-			for _, newEntry := range newBatch {
-				ipAsString := newEntry.ipAddress.String()
-				existingRoute, exists := manager.allowList[ipAsString]
-
-				if exists {
-					if existingRoute.validUnitl.Before(newEntry.validUnitl) {
-						existingRoute.validUnitl = newEntry.validUnitl
-					}
-					manager.allowRoutePool.Put(newEntry)
-					continue
-				}
+			// Routes queued before are handled first, so admin requests see the answers they were sent after
+			manager.allowQueuedRoutes()
 
-				if len(newEntry.ipAddress) == net.IPv4len {
-					ipv4ToAdd = append(ipv4ToAdd, nftables.SetElement{Key: newEntry.ipAddress})
-				} else if len(newEntry.ipAddress) == net.IPv6len {
-					ipv6ToAdd = append(ipv6ToAdd, nftables.SetElement{Key: newEntry.ipAddress})
-				} else {
-					log.Errorf("Received invalid ip address: %v", newEntry.ipAddress)
-					manager.allowRoutePool.Put(newEntry)
+			if newBatch.handoff != nil {
+				if err := newBatch.handoff.prepare(); err != nil {
+					newBatch.handoff.result <- handoffResult{err: err}
 					continue
 				}
 
-				manager.allowList[ipAsString] = newEntry
-				entriesAdded = append(entriesAdded, newEntry)
-			}
-
-			if len(ipv4ToAdd) > 0 {
-				manager.nlInterface.SetAddElements(manager.ipv4AllowSet, ipv4ToAdd)
-			}
-
-			if len(ipv6ToAdd) > 0 {
-				manager.nlInterface.SetAddElements(manager.ipv6AllowSet, ipv6ToAdd)
+				// The successor owns the entries from now on
+				newBatch.handoff.result <- handoffResult{allowList: manager.allowList}
+				manager.allowList = make(map[routeKey]*allowRoute)
+				manager.expiries = nil
+				manager.handedOver = true
+				if !manager.forwardBatches(newBatch.handoff.successor) {
+					return
+				}
+				manager.handedOver = false
+				continue
 			}
 
-			if len(ipv4ToAdd) > 0 || len(ipv6ToAdd) > 0 {
-				if err := manager.nlInterface.Flush(); err != nil {
-					log.Errorf("Writing to NFTables failed: %v", err)
-					nftablesFlushErrorsTotal.Inc()
-
-					// As the flush failed, we have to remove the entries that we couldn't flush again.
-					// The manager.ipv4AllowSet/ipv6AllowSet are only buffers, which get flushed either way, so nothing to do here.
-					for _, entryToRemove := range entriesAdded {
-						delete(manager.allowList, entryToRemove.ipAddress.String())
-						manager.allowRoutePool.Put(entryToRemove)
-					}
-				} else {
-					ipv4AllowListEntries.Add(float64(len(ipv4ToAdd)))
-					ipv4AllowListAddedTotal.Add(float64(len(ipv4ToAdd)))
-					ipv6AllowListEntries.Add(float64(len(ipv6ToAdd)))
-					ipv6AllowListAddedTotal.Add(float64(len(ipv6ToAdd)))
+			if newBatch.inspect != nil {
+				newBatch.inspect(manager.allowList)
+				if newBatch.done != nil {
+					newBatch.done <- nil
 				}
+				continue
 			}
 
-		case <-gcTicker.C:
-			var ipv4ToDelete []nftables.SetElement
-			var ipv6ToDelete []nftables.SetElement
-			var entriesToDelete []*allowRoute
-			now := time.Now()
-			log.Debug("Executing NFTables GC")
-
-			for _, listEntry := range manager.allowList {
-				if now.After(listEntry.validUnitl) {
-					if len(listEntry.ipAddress) == net.IPv4len {
-						ipv4ToDelete = append(ipv4ToDelete, nftables.SetElement{Key: listEntry.ipAddress})
-					} else if len(listEntry.ipAddress) == net.IPv6len {
-						ipv6ToDelete = append(ipv6ToDelete, nftables.SetElement{Key: listEntry.ipAddress})
-					}
-
-					// we delete those entries after the flush, else we might get out of sync with the lists.
-					entriesToDelete = append(entriesToDelete, listEntry)
+			if newBatch.revoke {
+				err := manager.revokeRoutes(newBatch.routes)
+				if newBatch.done != nil {
+					newBatch.done <- err
 				}
+				continue
 			}
 
-			if len(ipv4ToDelete) > 0 {
-				manager.nlInterface.SetDeleteElements(manager.ipv4AllowSet, ipv4ToDelete)
-			}
+			err := manager.allowRoutes(newBatch.routes, time.Now())
 
-			if len(ipv6ToDelete) > 0 {
-				manager.nlInterface.SetDeleteElements(manager.ipv6AllowSet, ipv6ToDelete)
+			// Entries that already existed are allowed already, so a batch without anything to flush succeeded as well.
+			if newBatch.done != nil {
+				newBatch.done <- err
 			}
 
-			if len(ipv4ToDelete) > 0 || len(ipv6ToDelete) > 0 {
-				if err := manager.nlInterface.Flush(); err != nil {
-					log.Errorf("Writing to NFTables failed (lists might be out of sync): %v", err)
-					nftablesFlushErrorsTotal.Inc()
-				} else {
-					for _, entryToDelete := range entriesToDelete {
-						delete(manager.allowList, entryToDelete.ipAddress.String())
-						manager.allowRoutePool.Put(entryToDelete)
-					}
-
-					ipv4AllowListEntries.Sub(float64(len(ipv4ToDelete)))
-					ipv6AllowListEntries.Sub(float64(len(ipv6ToDelete)))
-					ipv4AllowListExpiredTotal.Add(float64(len(ipv4ToDelete)))
-					ipv6AllowListExpiredTotal.Add(float64(len(ipv6ToDelete)))
-				}
+		case <-manager.routeQueue.ready:
+			manager.allowQueuedRoutes()
+
+		case <-manager.retryChannel():
+			manager.retryQueuedRoutes(time.Now())
+
+		case <-reconcileTick:
+			manager.reconcile(time.Now())
+
+		case <-stateTick:
+			if err := manager.saveState(time.Now()); err != nil {
+				log.Errorf("Saving the allowlist to %s failed: %v", manager.stateFile, err)
 			}
+
+		case <-manager.expiryChannel():
+			manager.expiryTimer = nil
+			manager.expireRoutes(time.Now())
+
+		case <-counterTicker.C:
+			manager.collectWouldRejectCounts()
 		}
 	}
 }
 
 func NewNFTablesManager(config *parsedConfig) (*NFTablesManager, error) {
-	nlInterface, err := nftables.New(
-		nftables.AsLasting(),
-	)
-
-	if err != nil {
-		return nil, fmt.Errorf("error creating nftables netlink interface: %w", err)
+	// On a reload, the manager of the previous configuration hands over its state
+	previous := takeHandoff()
+
+	var nlInterface *nftables.Conn
+	var netlinkConn *netlink.Conn
+	if previous != nil && previous.ownedTable {
+		// Only the socket, that created an owned table, may change it, so the connection has to be taken over as well
+		nlInterface, netlinkConn = previous.nlInterface, previous.netlinkConn
+	} else {
+		var err error
+		nlInterface, netlinkConn, err = openNetlink()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	manager := &NFTablesManager{
-		nlInterface:    nlInterface,
-		ipv4AllowSet:   nil,
-		ipv6AllowSet:   nil,
-		syncChannel:    make(chan []*allowRoute),
-		allowList:      make(map[string]*allowRoute),
-		allowRoutePool: sync.Pool{New: func() interface{} { return &allowRoute{} }},
+		nlInterface:        nlInterface,
+		netlinkConn:        netlinkConn,
+		ipv4AllowSet:       nil,
+		ipv6AllowSet:       nil,
+		ipv4ScopedAllowSet: nil,
+		ipv6ScopedAllowSet: nil,
+		syncChannel:        make(chan *allowBatch),
+		quit:               make(chan struct{}),
+		stopped:            make(chan struct{}),
+		allowList:          make(map[routeKey]*allowRoute),
+		allowRoutePool:     sync.Pool{New: func() interface{} { return &allowRoute{} }},
+		commitMode:         config.commitMode,
+		commitTimeout:      config.commitTimeout,
+		queueOverflow:      config.queueOverflow,
+		scope:              config.scope,
+		cgroupLevel:        config.cgroupLevel,
+		ttlPolicy:          config.ttlPolicy,
+		recoveryLifetime:   config.recoveryLifetime,
+		enforcement:        config.enforcement,
+		wouldRejectCounts:  make(map[string]uint64),
+		permanentRanges:    buildPermanentRanges(config),
+		ruleset:            renderRuleset(config),
+		onShutdown:         config.onShutdown,
+		ownedTable:         config.ownedTable,
+		stateFile:          config.stateFile,
+		stateInterval:      config.stateInterval,
+		reconcileInterval:  config.reconcileInterval,
+		openNetlink:        openNetlink,
+		reclaim:            make(chan chan error),
+	}
+
+	manager.routeQueue = newRouteQueue(config.queueSize, &manager.allowRoutePool)
+
+	// The table is rebuilt in a single transaction, so the permanent allowlist changes atomically, and the dynamic
+	// entries survive in their sets.
+	prepare := func() error {
+		if err := manager.prepareNFTables(config); err != nil {
+			return fmt.Errorf("error flushing necessary table and chain to nftables: %w", err)
+		}
+		return nil
+	}
+
+	manager.rebuild = prepare
+
+	adopted := false
+	if previous != nil {
+		allowList, running, err := manager.requestHandoff(previous, prepare)
+		if err != nil {
+			return nil, err
+		}
+
+		if running {
+			if err := manager.adoptState(previous, allowList, config); err != nil {
+				// The previous manager takes the allowList back, once the failed reload is reported to it
+				manager.allowList = allowList
+				close(manager.stopped)
+				return nil, fmt.Errorf("error taking over the previous allowlist: %w", err)
+			}
+			adopted = true
+		}
 	}
 
-	if err := manager.prepareNFTables(config); err != nil {
-		return nil, fmt.Errorf("error flushing necessary table and chain to nftables: %w", err)
+	if !adopted {
+		if err := prepare(); err != nil {
+			return nil, err
+		}
 	}
 
-	ipv4RecoveredEntriesCount, err := manager.recoverExistingSetEntries(manager.ipv4AllowSet)
+	if config.nflogGroup != 0 && manager.domainHistory == nil {
+		manager.domainHistory = newDomainHistory(domainHistorySize)
+	}
+	if config.learnFile != "" && manager.learner == nil {
+		manager.learner = newLearner(config.learnFile, config.learnDuration, config)
+	}
+
+	if config.enforcement == EnforcementMonitor {
+		// The counters survive restarts, so the first read only sets the baseline
+		for _, chainName := range chainsForMode(config.mode) {
+			count, err := manager.readWouldRejectCount(chainName)
+			if err != nil {
+				log.Warningf("Reading would-reject counter of chain %s failed: %v", chainName, err)
+			}
+			manager.wouldRejectCounts[chainName] = count
+		}
+
+		log.Warningf("Enforcement monitor is active: traffic, that isn't allowed, is only counted and logged, but not rejected")
+	}
+
+	if adopted {
+		go manager.manageAllowList()
+
+		return manager, nil
+	}
+
+	ipv4RecoveredEntriesCount, err := manager.recoverExistingSetEntries(manager.ipv4AllowSet, net.IPv4len)
 	if err != nil {
 		return nil, fmt.Errorf("error recovering ipv4 set entries: %w", err)
 	}
 
-	ipv6RecoveredEntriesCount, err := manager.recoverExistingSetEntries(manager.ipv6AllowSet)
+	ipv6RecoveredEntriesCount, err := manager.recoverExistingSetEntries(manager.ipv6AllowSet, net.IPv6len)
 	if err != nil {
 		return nil, fmt.Errorf("error recovering ipv6 set entries: %w", err)
 	}
 
+	if manager.ipv4ScopedAllowSet != nil {
+		ipv4ScopedRecoveredEntriesCount, err := manager.recoverExistingSetEntries(manager.ipv4ScopedAllowSet, net.IPv4len)
+		if err != nil {
+			return nil, fmt.Errorf("error recovering scoped ipv4 set entries: %w", err)
+		}
+
+		ipv6ScopedRecoveredEntriesCount, err := manager.recoverExistingSetEntries(manager.ipv6ScopedAllowSet, net.IPv6len)
+		if err != nil {
+			return nil, fmt.Errorf("error recovering scoped ipv6 set entries: %w", err)
+		}
+
+		ipv4RecoveredEntriesCount += ipv4ScopedRecoveredEntriesCount
+		ipv6RecoveredEntriesCount += ipv6ScopedRecoveredEntriesCount
+	}
+
+	// The state file restores the entries, that got lost with a reboot, and the domains of the recovered ones
+	if manager.stateFile != "" {
+		ipv4RestoredCount, ipv6RestoredCount, err := manager.restoreState(time.Now())
+		if err != nil {
+			log.Warningf("Restoring the allowlist from %s failed: %v", manager.stateFile, err)
+		} else {
+			log.Infof("Restored %d entries from %s", ipv4RestoredCount+ipv6RestoredCount, manager.stateFile)
+		}
+
+		ipv4RecoveredEntriesCount += ipv4RestoredCount
+		ipv6RecoveredEntriesCount += ipv6RestoredCount
+	}
+
 	ipv4AllowListEntries.Add(float64(ipv4RecoveredEntriesCount))
 	ipv4AllowListAddedTotal.Add(float64(ipv4RecoveredEntriesCount))
 	ipv6AllowListEntries.Add(float64(ipv6RecoveredEntriesCount))
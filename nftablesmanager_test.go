@@ -0,0 +1,580 @@
+package ipdestinationguard
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/mdlayher/netlink"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+func TestElementTimeout(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name            string
+		validUntil      time.Time
+		expectedTimeout time.Duration
+	}{
+		{
+			name:            "future expiry",
+			validUntil:      now.Add(330 * time.Second),
+			expectedTimeout: 330 * time.Second,
+		},
+		{
+			name:            "expiry within a second",
+			validUntil:      now.Add(200 * time.Millisecond),
+			expectedTimeout: time.Second,
+		},
+		{
+			name:            "already expired",
+			validUntil:      now.Add(-10 * time.Second),
+			expectedTimeout: time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeout := elementTimeout(tt.validUntil, now)
+
+			if timeout != tt.expectedTimeout {
+				t.Errorf("Expected timeout %v, got %v", tt.expectedTimeout, timeout)
+			}
+		})
+	}
+}
+
+func TestAllowRouteKeys(t *testing.T) {
+	tests := []struct {
+		name               string
+		route              *allowRoute
+		expectedKey        string
+		expectedElementKey []byte
+	}{
+		{
+			name:               "global ipv4",
+			route:              &allowRoute{ipAddress: net.ParseIP("192.168.1.1").To4()},
+			expectedKey:        "192.168.1.1",
+			expectedElementKey: []byte{192, 168, 1, 1},
+		},
+		{
+			name: "client scoped ipv4",
+			route: &allowRoute{
+				ipAddress:  net.ParseIP("192.168.1.1").To4(),
+				scopeKey:   net.ParseIP("10.0.0.5").To4(),
+				scopeLabel: "10.0.0.5",
+			},
+			expectedKey:        "10.0.0.5/192.168.1.1",
+			expectedElementKey: []byte{10, 0, 0, 5, 192, 168, 1, 1},
+		},
+		{
+			name: "client scoped ipv6",
+			route: &allowRoute{
+				ipAddress:  net.ParseIP("2001:db8::1"),
+				scopeKey:   net.ParseIP("fd00::5"),
+				scopeLabel: "fd00::5",
+			},
+			expectedKey:        "fd00::5/2001:db8::1",
+			expectedElementKey: append(append([]byte{}, net.ParseIP("fd00::5")...), net.ParseIP("2001:db8::1")...),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if key := tt.route.key(); key.String() != tt.expectedKey {
+				t.Errorf("Expected key '%s', got '%s'", tt.expectedKey, key)
+			}
+
+			if elementKey := tt.route.elementKey(); !bytes.Equal(elementKey, tt.expectedElementKey) {
+				t.Errorf("Expected element key %v, got %v", tt.expectedElementKey, elementKey)
+			}
+		})
+	}
+}
+
+func TestResolveScope(t *testing.T) {
+	previous := interfaceAddrs
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{&net.IPNet{IP: net.ParseIP("192.168.1.2").To4(), Mask: net.CIDRMask(24, 32)}}, nil
+	}
+	t.Cleanup(func() { interfaceAddrs = previous })
+
+	tests := []struct {
+		name          string
+		scope         Scope
+		client        net.Addr
+		expectedKey   []byte
+		expectedLabel string
+	}{
+		{
+			name:          "global scope ignores client",
+			scope:         ScopeGlobal,
+			client:        &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 5353},
+			expectedKey:   nil,
+			expectedLabel: "",
+		},
+		{
+			name:          "client scope with ipv4 client",
+			scope:         ScopeClient,
+			client:        &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 5353},
+			expectedKey:   []byte{10, 0, 0, 5},
+			expectedLabel: "10.0.0.5",
+		},
+		{
+			name:          "client scope with ipv6 client over tcp",
+			scope:         ScopeClient,
+			client:        &net.TCPAddr{IP: net.ParseIP("fd00::5"), Port: 5353},
+			expectedKey:   net.ParseIP("fd00::5"),
+			expectedLabel: "fd00::5",
+		},
+		{
+			name:          "client scope with loopback client",
+			scope:         ScopeClient,
+			client:        &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353},
+			expectedKey:   nil,
+			expectedLabel: "",
+		},
+		{
+			name:          "client scope with a local address of the host",
+			scope:         ScopeClient,
+			client:        &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5353},
+			expectedKey:   nil,
+			expectedLabel: "",
+		},
+		{
+			name:          "client scope without client",
+			scope:         ScopeClient,
+			client:        nil,
+			expectedKey:   nil,
+			expectedLabel: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := &NFTablesManager{scope: tt.scope}
+
+			scopeKey, scopeLabel, err := manager.resolveScope(&QueryInfo{Client: tt.client})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !bytes.Equal(scopeKey, tt.expectedKey) {
+				t.Errorf("Expected scope key %v, got %v", tt.expectedKey, scopeKey)
+			}
+
+			if scopeLabel != tt.expectedLabel {
+				t.Errorf("Expected scope label '%s', got '%s'", tt.expectedLabel, scopeLabel)
+			}
+		})
+	}
+}
+
+func TestResolveUserScope(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "net"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	udpTable := procNetTable(
+		procNetAddress("127.0.0.1", 40000)+" 1000 1234",
+		procNetAddress("0.0.0.0", 40001)+" 0 1235",
+	)
+	if err := os.WriteFile(filepath.Join(root, "net", "udp"), []byte(udpTable), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	originalProcRoot := procRoot
+	procRoot = root
+	withoutSockDiag(t)
+	defer func() { procRoot = originalProcRoot }()
+
+	tests := []struct {
+		name          string
+		client        net.Addr
+		expectedKey   []byte
+		expectedLabel string
+		shouldError   bool
+	}{
+		{
+			name:          "local socket of a user",
+			client:        &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000},
+			expectedKey:   binaryutil.NativeEndian.PutUint32(1000),
+			expectedLabel: "1000",
+		},
+		{
+			name:          "local socket bound to the wildcard address",
+			client:        &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40001},
+			expectedKey:   binaryutil.NativeEndian.PutUint32(0),
+			expectedLabel: "0",
+		},
+		{
+			name:          "remote client uses the global sets",
+			client:        &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 40002},
+			expectedKey:   nil,
+			expectedLabel: "",
+		},
+		{
+			name:        "local client without socket",
+			client:      &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40002},
+			shouldError: true,
+		},
+		{
+			name:        "no client",
+			client:      nil,
+			shouldError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := &NFTablesManager{scope: ScopeUser}
+
+			scopeKey, scopeLabel, err := manager.resolveScope(&QueryInfo{Client: tt.client})
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !bytes.Equal(scopeKey, tt.expectedKey) {
+				t.Errorf("Expected scope key %v, got %v", tt.expectedKey, scopeKey)
+			}
+
+			if scopeLabel != tt.expectedLabel {
+				t.Errorf("Expected scope label '%s', got '%s'", tt.expectedLabel, scopeLabel)
+			}
+
+			if scopeKey != nil && manager.scopeLabelFor(scopeKey) != tt.expectedLabel {
+				t.Errorf("Expected scopeLabelFor to return '%s', got '%s'", tt.expectedLabel, manager.scopeLabelFor(scopeKey))
+			}
+		})
+	}
+}
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		name          string
+		last          uint64
+		current       uint64
+		expectedDelta uint64
+	}{
+		{"unchanged", 10, 10, 0},
+		{"increased", 10, 25, 15},
+		{"recreated counter", 10, 4, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if delta := counterDelta(tt.last, tt.current); delta != tt.expectedDelta {
+				t.Errorf("Expected delta %d, got %d", tt.expectedDelta, delta)
+			}
+		})
+	}
+}
+
+// Returns a running manager for given config, whose netlink connection acknowledges every message without a kernel.
+func newTestNFTablesManager(t *testing.T, config *parsedConfig) *NFTablesManager {
+	t.Helper()
+
+	manager := newIdleTestNFTablesManager(t, config)
+	go manager.manageAllowList()
+	t.Cleanup(func() { manager.Shutdown() })
+
+	return manager
+}
+
+// Returns a manager for given config, whose goroutine isn't started yet, like before OnStartup.
+func newIdleTestNFTablesManager(t *testing.T, config *parsedConfig) *NFTablesManager {
+	t.Helper()
+
+	nlInterface, err := nftables.New(nftables.WithTestDial(func(req []netlink.Message) ([]netlink.Message, error) {
+		return req, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := &nftables.Table{Name: tableName, Family: nftables.TableFamilyINet}
+	manager := &NFTablesManager{
+		nlInterface:      nlInterface,
+		ipv4AllowSet:     &nftables.Set{Name: "ipv4allowlist", Table: table, KeyType: nftables.TypeIPAddr},
+		ipv6AllowSet:     &nftables.Set{Name: "ipv6allowlist", Table: table, KeyType: nftables.TypeIP6Addr},
+		syncChannel:      make(chan *allowBatch),
+		quit:             make(chan struct{}),
+		stopped:          make(chan struct{}),
+		allowList:        make(map[routeKey]*allowRoute),
+		allowRoutePool:   sync.Pool{New: func() interface{} { return &allowRoute{} }},
+		commitMode:       config.commitMode,
+		commitTimeout:    config.commitTimeout,
+		scope:            config.scope,
+		cgroupLevel:      config.cgroupLevel,
+		ttlPolicy:        config.ttlPolicy,
+		recoveryLifetime: config.recoveryLifetime,
+		permanentRanges:  buildPermanentRanges(config),
+		ruleset:          renderRuleset(config),
+		stateFile:        config.stateFile,
+		stateInterval:    config.stateInterval,
+		config:           config,
+		rebuild:          func() error { return nil },
+		reclaim:          make(chan chan error),
+	}
+
+	if config.scope == ScopeClient {
+		manager.ipv4ScopedAllowSet = &nftables.Set{Name: "ipv4clientallowlist", Table: table, KeyType: nftables.MustConcatSetType(nftables.TypeIPAddr, nftables.TypeIPAddr)}
+		manager.ipv6ScopedAllowSet = &nftables.Set{Name: "ipv6clientallowlist", Table: table, KeyType: nftables.MustConcatSetType(nftables.TypeIP6Addr, nftables.TypeIP6Addr)}
+	}
+
+	manager.routeQueue = newRouteQueue(defaultQueueSize, &manager.allowRoutePool)
+	manager.rulesetHealthy.Store(true)
+
+	return manager
+}
+
+func TestAddRoutesReportsErrors(t *testing.T) {
+	ipv4Entry := RouteEntry{IP: net.ParseIP("192.0.2.1").To4(), TTL: 60}
+	ipv6Entry := RouteEntry{IP: net.ParseIP("2001:db8::1"), TTL: 60}
+	ipv4Client := &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 53000}
+
+	tests := []struct {
+		name          string
+		scope         Scope
+		stopped       bool
+		query         *QueryInfo
+		entries       []RouteEntry
+		expectedErr   error
+		expectedCount int // Number of entries of the AllowError
+	}{
+		{
+			name:    "allowed",
+			scope:   ScopeGlobal,
+			query:   &QueryInfo{Name: "example.com."},
+			entries: []RouteEntry{ipv4Entry, ipv6Entry},
+		},
+		{
+			name:          "stopped manager",
+			scope:         ScopeGlobal,
+			stopped:       true,
+			query:         &QueryInfo{Name: "example.com."},
+			entries:       []RouteEntry{ipv4Entry, ipv6Entry},
+			expectedErr:   errManagerStopped,
+			expectedCount: 2,
+		},
+		{
+			name:          "stopped manager skips other address families",
+			scope:         ScopeClient,
+			stopped:       true,
+			query:         &QueryInfo{Name: "example.com.", Client: ipv4Client},
+			entries:       []RouteEntry{ipv4Entry, ipv6Entry},
+			expectedErr:   errManagerStopped,
+			expectedCount: 1,
+		},
+		{
+			name:    "only other address families",
+			scope:   ScopeClient,
+			query:   &QueryInfo{Name: "example.com.", Client: ipv4Client},
+			entries: []RouteEntry{ipv6Entry},
+		},
+		{
+			name:          "unattributable scope",
+			scope:         ScopeUser,
+			query:         &QueryInfo{Name: "example.com."},
+			entries:       []RouteEntry{ipv4Entry},
+			expectedCount: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testAdminConfig(t, tt.scope)
+			config.commitMode = CommitModeSync
+			config.commitTimeout = time.Second
+
+			manager := newTestNFTablesManager(t, config)
+			if tt.stopped {
+				if err := manager.Shutdown(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := manager.AddRoutes(tt.query, tt.entries)
+			if tt.expectedCount == 0 {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+
+			var allowErr *AllowError
+			if !errors.As(err, &allowErr) {
+				t.Fatalf("Expected an AllowError, got %v", err)
+			}
+			if len(allowErr.Entries) != tt.expectedCount {
+				t.Errorf("Expected %d entries, got %v", tt.expectedCount, allowErr.Entries)
+			}
+			if tt.expectedErr != nil && !errors.Is(err, tt.expectedErr) {
+				t.Errorf("Expected %v, got %v", tt.expectedErr, err)
+			}
+		})
+	}
+}
+
+// Counts the increments of a counter, whose value the registry doesn't expose to tests.
+type recordingCounter struct {
+	prometheus.Counter
+	count atomic.Int64
+}
+
+func (counter *recordingCounter) Inc() { counter.count.Add(1) }
+
+// Counts the observations of a histogram.
+type recordingHistogram struct {
+	prometheus.Histogram
+	count atomic.Int64
+}
+
+func (histogram *recordingHistogram) Observe(float64) { histogram.count.Add(1) }
+
+func TestAddRoutesHoldsAnswer(t *testing.T) {
+	tests := []struct {
+		name             string
+		flushDelay       time.Duration // Time the kernel takes to write the elements
+		expectedErr      error
+		expectedHold     time.Duration // Minimum time the answer is held
+		expectedTimeouts int64
+	}{
+		{
+			name:         "flush within commitTimeout",
+			flushDelay:   50 * time.Millisecond,
+			expectedHold: 50 * time.Millisecond,
+		},
+		{
+			name:             "flush beyond commitTimeout",
+			flushDelay:       time.Hour,
+			expectedErr:      errCommitTimeout,
+			expectedHold:     200 * time.Millisecond,
+			expectedTimeouts: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeouts := &recordingCounter{Counter: commitTimeoutsTotal}
+			holds := &recordingHistogram{Histogram: answerHoldDuration}
+			previousTimeouts, previousHolds := commitTimeoutsTotal, answerHoldDuration
+			commitTimeoutsTotal, answerHoldDuration = timeouts, holds
+			t.Cleanup(func() { commitTimeoutsTotal, answerHoldDuration = previousTimeouts, previousHolds })
+
+			// Writing elements blocks until the flush delay passed, or the test ended
+			release := make(chan struct{})
+			nlInterface, err := nftables.New(nftables.WithTestDial(func(req []netlink.Message) ([]netlink.Message, error) {
+				addsElements := slices.ContainsFunc(req, func(message netlink.Message) bool {
+					return message.Header.Type&0xff == unix.NFT_MSG_NEWSETELEM
+				})
+				if addsElements {
+					select {
+					case <-time.After(tt.flushDelay):
+					case <-release:
+					}
+				}
+				return req, nil
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config := testAdminConfig(t, ScopeGlobal)
+			config.commitMode = CommitModeSync
+			config.commitTimeout = 200 * time.Millisecond
+
+			manager := newIdleTestNFTablesManager(t, config)
+			manager.nlInterface = nlInterface
+			go manager.manageAllowList()
+			// Cleanups run in reverse order, so the flush is released before shutting down
+			t.Cleanup(func() { manager.Shutdown() })
+			t.Cleanup(func() { close(release) })
+
+			startedAt := time.Now()
+			err = manager.AddRoutes(&QueryInfo{Name: "example.com."}, []RouteEntry{{IP: net.ParseIP("192.0.2.1").To4(), TTL: 60}})
+			held := time.Since(startedAt)
+
+			if tt.expectedErr == nil && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if tt.expectedErr != nil && !errors.Is(err, tt.expectedErr) {
+				t.Errorf("Expected %v, got %v", tt.expectedErr, err)
+			}
+			if held < tt.expectedHold {
+				t.Errorf("Expected the answer to be held for at least %v, got %v", tt.expectedHold, held)
+			}
+			if held > config.commitTimeout+time.Second {
+				t.Errorf("Expected the answer to be released after commitTimeout %v, got %v", config.commitTimeout, held)
+			}
+			if count := timeouts.count.Load(); count != tt.expectedTimeouts {
+				t.Errorf("Expected %d commit timeouts, got %d", tt.expectedTimeouts, count)
+			}
+			if count := holds.count.Load(); count != 1 {
+				t.Errorf("Expected 1 observed hold duration, got %d", count)
+			}
+		})
+	}
+}
+
+func TestRefreshWithinSafetyMargin(t *testing.T) {
+	var mutex sync.Mutex
+	var elementMessages []string
+	nlInterface, err := nftables.New(nftables.WithTestDial(func(req []netlink.Message) ([]netlink.Message, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, message := range req {
+			switch message.Header.Type & 0xff {
+			case unix.NFT_MSG_NEWSETELEM:
+				elementMessages = append(elementMessages, "add")
+			case unix.NFT_MSG_DELSETELEM:
+				elementMessages = append(elementMessages, "delete")
+			}
+		}
+		return req, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager := newStoppedTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+	manager.nlInterface = nlInterface
+
+	now := time.Now()
+	ip := net.ParseIP("192.0.2.1").To4()
+	if err := manager.allowRoutes([]*allowRoute{{ipAddress: ip, validUnitl: now.Add(time.Second)}}, now); err != nil {
+		t.Fatal(err)
+	}
+	elementMessages = nil
+
+	// The element might be gone in the kernel already, so it's added before deleting it, and added with the new timeout
+	if err := manager.allowRoutes([]*allowRoute{{ipAddress: ip, validUnitl: now.Add(time.Hour)}}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"add", "delete", "add"}; !slices.Equal(elementMessages, expected) {
+		t.Errorf("Expected element messages %v, got %v", expected, elementMessages)
+	}
+	if validUntil := manager.allowList[newRouteKey("", ip)].validUnitl; !validUntil.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expected the refreshed expiry, got %v", validUntil)
+	}
+}
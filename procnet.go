@@ -0,0 +1,180 @@
+package ipdestinationguard
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Root of the proc filesystem, only changed by tests.
+var procRoot = "/proc"
+
+// Returns the addresses of the host's interfaces, only changed by tests.
+var interfaceAddrs = net.InterfaceAddrs
+
+// The owner of a local socket, as reported by sock_diag or /proc/net/{udp,tcp}[6].
+type socketOwner struct {
+	uid      uint32
+	inode    uint64
+	cgroupID uint64 // Id of the cgroup of the socket, 0 if unknown (like from /proc)
+}
+
+// Returns the owner of the local socket, that uses given address as its local address.
+// If no local socket uses the address (like for queries from other hosts), nil is returned without error.
+// Sockets bound to the wildcard address only match addresses of the host itself, otherwise a remote client would be
+// attributed to a local service listening on the same port.
+// The kernel is asked via sock_diag, which only reports the sockets of the port. If that's unavailable, the tables of
+// all sockets in /proc/net are parsed instead.
+func findSocketOwner(addr net.Addr) (*socketOwner, error) {
+	var ip net.IP
+	var port int
+	var protocol uint8
+	var tables []string
+
+	switch typedAddr := addr.(type) {
+	case *net.UDPAddr:
+		ip, port, protocol, tables = typedAddr.IP, typedAddr.Port, unix.IPPROTO_UDP, []string{"udp", "udp6"}
+	case *net.TCPAddr:
+		ip, port, protocol, tables = typedAddr.IP, typedAddr.Port, unix.IPPROTO_TCP, []string{"tcp", "tcp6"}
+	default:
+		return nil, fmt.Errorf("unsupported address type %T", addr)
+	}
+
+	local, err := isLocalAddress(ip)
+	if err != nil {
+		return nil, fmt.Errorf("listing local addresses: %w", err)
+	}
+
+	owner, err := querySocketOwner(protocol, ip, port, local)
+	if !errors.Is(err, errSockDiagUnavailable) {
+		return owner, err
+	}
+	log.Debugf("Falling back to /proc/net: %v", err)
+
+	for _, table := range tables {
+		file, err := os.Open(procRoot + "/net/" + table)
+		if err != nil {
+			// IPv6 might be disabled, so missing tables are fine
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		owner, err := parseProcNetSockets(file, ip, port, local)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", table, err)
+		}
+		if owner != nil {
+			return owner, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Returns whether given address is a loopback address, or one of the addresses of the host's interfaces.
+func isLocalAddress(ip net.IP) (bool, error) {
+	if ip.IsLoopback() {
+		return true, nil
+	}
+
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return false, err
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Parses a /proc/net/{udp,tcp}[6] table and returns the owner of the socket bound to given ip and port.
+// If local is set, sockets bound to the wildcard address match as well, as unconnected sockets don't report the
+// address used. Addresses of other hosts never match them.
+func parseProcNetSockets(reader io.Reader, ip net.IP, port int, local bool) (*socketOwner, error) {
+	scanner := bufio.NewScanner(reader)
+	var wildcardOwner *socketOwner
+
+	// The first line is the header
+	scanner.Scan()
+
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		localIP, localPort, err := parseProcNetAddress(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		if localPort != port {
+			continue
+		}
+
+		uid, err := strconv.ParseUint(fields[7], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid %q: %w", fields[7], err)
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid inode %q: %w", fields[9], err)
+		}
+
+		owner := &socketOwner{uid: uint32(uid), inode: inode}
+		if localIP.Equal(ip) {
+			return owner, nil
+		}
+		if local && localIP.IsUnspecified() && wildcardOwner == nil {
+			wildcardOwner = owner
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return wildcardOwner, nil
+}
+
+// Parses an address like "0100007F:D431" of /proc/net/{udp,tcp}[6]. The address is printed as
+// 32 bit words in host byte order, the port in hex.
+func parseProcNetAddress(str string) (net.IP, int, error) {
+	hexIP, hexPort, found := strings.Cut(str, ":")
+	if !found {
+		return nil, 0, fmt.Errorf("invalid address %q", str)
+	}
+
+	rawIP, err := hex.DecodeString(hexIP)
+	if err != nil || (len(rawIP) != net.IPv4len && len(rawIP) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid address %q", str)
+	}
+
+	ip := make(net.IP, len(rawIP))
+	for i := 0; i < len(rawIP); i += 4 {
+		binary.NativeEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(rawIP[i:]))
+	}
+
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port in address %q", str)
+	}
+
+	return ip, int(port), nil
+}
@@ -0,0 +1,206 @@
+package ipdestinationguard
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Returns given address formatted like /proc/net/{udp,tcp}[6] on this host does.
+func procNetAddress(ip string, port int) string {
+	raw := net.ParseIP(ip)
+	if ipv4 := raw.To4(); ipv4 != nil {
+		raw = ipv4
+	}
+
+	var hexIP strings.Builder
+	for i := 0; i < len(raw); i += 4 {
+		fmt.Fprintf(&hexIP, "%08X", binary.NativeEndian.Uint32(raw[i:]))
+	}
+
+	return fmt.Sprintf("%s:%04X", hexIP.String(), port)
+}
+
+// Returns a /proc/net/udp like table with one line per given local address, uid and inode.
+func procNetTable(lines ...string) string {
+	table := "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops\n"
+	for i, line := range lines {
+		var localAddress string
+		var uid, inode int
+		fmt.Sscanf(line, "%s %d %d", &localAddress, &uid, &inode)
+		table += fmt.Sprintf("%4d: %s 00000000:0000 07 00000000:00000000 00:00000000 00000000 %5d        0 %d 2 0000000000000000 0\n", i, localAddress, uid, inode)
+	}
+
+	return table
+}
+
+func TestParseProcNetAddress(t *testing.T) {
+	tests := []struct {
+		address      string
+		expectedIP   net.IP
+		expectedPort int
+		shouldError  bool
+	}{
+		{
+			address:      procNetAddress("127.0.0.1", 54321),
+			expectedIP:   net.ParseIP("127.0.0.1"),
+			expectedPort: 54321,
+		},
+		{
+			address:      procNetAddress("::1", 53),
+			expectedIP:   net.ParseIP("::1"),
+			expectedPort: 53,
+		},
+		{
+			address:      procNetAddress("2001:db8::1234", 443),
+			expectedIP:   net.ParseIP("2001:db8::1234"),
+			expectedPort: 443,
+		},
+		{
+			address:     "0100007F",
+			shouldError: true,
+		},
+		{
+			address:     "0100007:0035",
+			shouldError: true,
+		},
+		{
+			address:     "0100007F:XYZ",
+			shouldError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			ip, port, err := parseProcNetAddress(tt.address)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error, got %v:%d", ip, port)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !ip.Equal(tt.expectedIP) || port != tt.expectedPort {
+				t.Errorf("Expected %v:%d, got %v:%d", tt.expectedIP, tt.expectedPort, ip, port)
+			}
+		})
+	}
+}
+
+func TestParseProcNetSockets(t *testing.T) {
+	table := procNetTable(
+		procNetAddress("127.0.0.53", 53)+" 0 1000",
+		procNetAddress("127.0.0.1", 40001)+" 1001 2001",
+		procNetAddress("0.0.0.0", 40002)+" 1002 2002",
+		procNetAddress("10.0.0.5", 40002)+" 1003 2003",
+	)
+
+	tests := []struct {
+		name          string
+		ip            string
+		port          int
+		remote        bool
+		expectedOwner *socketOwner
+	}{
+		{
+			name:          "exact match",
+			ip:            "127.0.0.1",
+			port:          40001,
+			expectedOwner: &socketOwner{uid: 1001, inode: 2001},
+		},
+		{
+			name:          "exact match preferred over wildcard",
+			ip:            "10.0.0.5",
+			port:          40002,
+			expectedOwner: &socketOwner{uid: 1003, inode: 2003},
+		},
+		{
+			name:          "wildcard match",
+			ip:            "127.0.0.1",
+			port:          40002,
+			expectedOwner: &socketOwner{uid: 1002, inode: 2002},
+		},
+		{
+			name:          "remote client colliding with wildcard listener",
+			ip:            "192.168.1.50",
+			port:          40002,
+			remote:        true,
+			expectedOwner: nil,
+		},
+		{
+			name:          "no local socket",
+			ip:            "192.168.1.50",
+			port:          40003,
+			expectedOwner: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owner, err := parseProcNetSockets(strings.NewReader(table), net.ParseIP(tt.ip), tt.port, !tt.remote)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if tt.expectedOwner == nil {
+				if owner != nil {
+					t.Errorf("Expected no owner, got %+v", owner)
+				}
+				return
+			}
+
+			if owner == nil || *owner != *tt.expectedOwner {
+				t.Errorf("Expected owner %+v, got %+v", tt.expectedOwner, owner)
+			}
+		})
+	}
+}
+
+// Makes findSocketOwner fall back to /proc, like without sock_diag.
+func withoutSockDiag(t *testing.T) {
+	t.Helper()
+
+	previous := querySocketOwner
+	querySocketOwner = func(uint8, net.IP, int, bool) (*socketOwner, error) {
+		return nil, errSockDiagUnavailable
+	}
+	t.Cleanup(func() { querySocketOwner = previous })
+}
+
+func TestIsLocalAddress(t *testing.T) {
+	previous := interfaceAddrs
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{&net.IPNet{IP: net.ParseIP("10.0.0.1").To4(), Mask: net.CIDRMask(24, 32)}}, nil
+	}
+	t.Cleanup(func() { interfaceAddrs = previous })
+
+	tests := []struct {
+		ip            string
+		expectedLocal bool
+	}{
+		{ip: "127.0.0.1", expectedLocal: true},
+		{ip: "::1", expectedLocal: true},
+		{ip: "10.0.0.1", expectedLocal: true},
+		{ip: "10.0.0.5", expectedLocal: false},
+		{ip: "192.168.1.50", expectedLocal: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			local, err := isLocalAddress(net.ParseIP(tt.ip))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if local != tt.expectedLocal {
+				t.Errorf("Expected local %v, got %v", tt.expectedLocal, local)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package ipdestinationguard
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Returned for answers, whose routes don't fit into the full queue (queueOverflow drop or servfail).
+var errQueueFull = errors.New("allowlist queue is full")
+
+// Default maximum number of distinct routes waiting for the manager goroutine.
+const defaultQueueSize = 10000
+
+// Routes of DNS answers waiting for the manager goroutine. Pushing them never waits for the manager, unless the queue
+// is full. Routes of the same address and scope are merged, so a name answered to many clients at once is only written
+// once per flush. The manager takes all queued routes at once, and reports the result of their flush to each waiter.
+type routeQueue struct {
+	mutex   sync.Mutex
+	routes  map[routeKey]*allowRoute
+	waiters []chan error
+	limit   int
+	closed  bool
+	ready   chan struct{} // Signaled, when routes were pushed. Buffered, so pushing never blocks on it
+	space   chan struct{} // Closed and replaced, when the routes were taken, so blocked pushes try again
+	pool    *sync.Pool    // Pool merged routes are returned to
+}
+
+func newRouteQueue(limit int, pool *sync.Pool) *routeQueue {
+	return &routeQueue{
+		routes: make(map[routeKey]*allowRoute),
+		limit:  limit,
+		ready:  make(chan struct{}, 1),
+		space:  make(chan struct{}),
+		pool:   pool,
+	}
+}
+
+// Queues given routes, and done to report the result of their flush to, if it isn't nil. If the routes don't fit, as
+// the queue would hold more than its limit of distinct routes, nothing is queued, and a channel is returned, which is
+// closed once there is space again. Routes always fit into an empty queue, so a large answer can't block forever.
+// Returns errManagerStopped, if the queue was closed.
+func (queue *routeQueue) push(routes []*allowRoute, done chan error) (<-chan struct{}, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.closed {
+		return nil, errManagerStopped
+	}
+
+	if len(queue.routes) > 0 {
+		newRoutes := 0
+		for _, route := range routes {
+			if _, exists := queue.routes[route.key()]; !exists {
+				newRoutes++
+			}
+		}
+		if len(queue.routes)+newRoutes > queue.limit {
+			return queue.space, nil
+		}
+	}
+
+	queue.add(routes, done)
+
+	return nil, nil
+}
+
+// Queues given routes and waiters regardless of the limit, as they were accepted by another queue already.
+func (queue *routeQueue) pushAll(routes []*allowRoute, waiters []chan error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.closed {
+		for _, done := range waiters {
+			done <- errManagerStopped
+		}
+		return
+	}
+
+	queue.add(routes, nil)
+	queue.waiters = append(queue.waiters, waiters...)
+}
+
+// Merges given routes into the queue, keeping the later expiry and the last known domain of each. The lock must be
+// held.
+func (queue *routeQueue) add(routes []*allowRoute, done chan error) {
+	queuedCount := len(queue.routes)
+	for _, route := range routes {
+		key := route.key()
+		queuedRoute, exists := queue.routes[key]
+		if !exists {
+			queue.routes[key] = route
+			continue
+		}
+
+		if queuedRoute.validUnitl.Before(route.validUnitl) {
+			queuedRoute.validUnitl = route.validUnitl
+		}
+		if route.domain != "" {
+			queuedRoute.domain = route.domain
+			queuedRoute.client = route.client
+		}
+		queue.pool.Put(route)
+		queueMergedEntriesTotal.Inc()
+	}
+
+	if done != nil {
+		queue.waiters = append(queue.waiters, done)
+	}
+	queueEntries.Add(float64(len(queue.routes) - queuedCount))
+
+	select {
+	case queue.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Takes all queued routes and their waiters, and wakes up blocked pushes.
+func (queue *routeQueue) take() ([]*allowRoute, []chan error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	routes := make([]*allowRoute, 0, len(queue.routes))
+	for _, route := range queue.routes {
+		routes = append(routes, route)
+	}
+	waiters := queue.waiters
+
+	queue.routes = make(map[routeKey]*allowRoute)
+	queue.waiters = nil
+	queueEntries.Sub(float64(len(routes)))
+
+	close(queue.space)
+	queue.space = make(chan struct{})
+
+	return routes, waiters
+}
+
+// Closes the queue, as the manager goroutine stopped. Queued routes are dropped, and their waiters as well as later
+// pushes get errManagerStopped.
+func (queue *routeQueue) close() {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.closed {
+		return
+	}
+	queue.closed = true
+
+	for _, done := range queue.waiters {
+		done <- errManagerStopped
+	}
+	queueEntries.Sub(float64(len(queue.routes)))
+	queue.routes = nil
+	queue.waiters = nil
+
+	close(queue.space)
+}
+
+// Allows all queued routes in a single flush, and reports its result to their waiters. This must only be called by the
+// manager goroutine.
+func (manager *NFTablesManager) allowQueuedRoutes() {
+	routes, waiters := manager.routeQueue.take()
+
+	var err error
+	if len(routes) > 0 {
+		err = manager.allowRoutes(routes, time.Now())
+	}
+
+	for _, done := range waiters {
+		done <- err
+	}
+}
+
+// Queues given routes for the manager goroutine, applying the queueOverflow policy, if the queue is full: block waits
+// for space, drop and servfail return errQueueFull. done gets the result of the flush, if it isn't nil.
+func (manager *NFTablesManager) queueRoutes(routes []*allowRoute, done chan error) error {
+	startedAt := time.Now()
+	defer func() { queueWaitDuration.Observe(time.Since(startedAt).Seconds()) }()
+
+	overflowed := false
+	for {
+		space, err := manager.routeQueue.push(routes, done)
+		if err != nil || space == nil {
+			return err
+		}
+
+		if !overflowed {
+			queueOverflowsTotal.WithLabelValues(string(manager.queueOverflow)).Inc()
+			overflowed = true
+		}
+		if manager.queueOverflow == QueueOverflowDrop || manager.queueOverflow == QueueOverflowServfail {
+			for _, route := range routes {
+				manager.allowRoutePool.Put(route)
+			}
+			return errQueueFull
+		}
+
+		<-space
+	}
+}
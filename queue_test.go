@@ -0,0 +1,119 @@
+package ipdestinationguard
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRouteQueueMergesRoutes(t *testing.T) {
+	manager := newStoppedTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+	queue := newRouteQueue(defaultQueueSize, &manager.allowRoutePool)
+
+	now := time.Now()
+	ip := net.ParseIP("192.0.2.1").To4()
+	queue.push([]*allowRoute{{ipAddress: ip, validUnitl: now.Add(time.Hour), domain: "first.example."}}, nil)
+	queue.push([]*allowRoute{
+		{ipAddress: ip, validUnitl: now.Add(time.Minute), domain: "second.example."},
+		{ipAddress: net.ParseIP("2001:db8::1"), validUnitl: now.Add(time.Minute)},
+	}, make(chan error, 1))
+
+	routes, waiters := queue.take()
+	if len(routes) != 2 || len(waiters) != 1 {
+		t.Fatalf("Expected 2 routes and 1 waiter, got %d and %d", len(routes), len(waiters))
+	}
+
+	for _, route := range routes {
+		if !route.ipAddress.Equal(ip) {
+			continue
+		}
+		if !route.validUnitl.Equal(now.Add(time.Hour)) || route.domain != "second.example." {
+			t.Errorf("Expected the later expiry and the last domain, got %v and %s", route.validUnitl, route.domain)
+		}
+	}
+
+	if routes, _ := queue.take(); len(routes) != 0 {
+		t.Errorf("Expected an empty queue after taking it, got %d routes", len(routes))
+	}
+}
+
+func TestQueueOverflow(t *testing.T) {
+	tests := []struct {
+		name          string
+		queueOverflow QueueOverflowPolicy
+		expectedErr   error
+	}{
+		{name: "drop", queueOverflow: QueueOverflowDrop, expectedErr: errQueueFull},
+		{name: "servfail", queueOverflow: QueueOverflowServfail, expectedErr: errQueueFull},
+		{name: "block", queueOverflow: QueueOverflowBlock},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newStoppedTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+			manager.routeQueue = newRouteQueue(1, &manager.allowRoutePool)
+			manager.queueOverflow = tt.queueOverflow
+
+			validUntil := time.Now().Add(time.Hour)
+			first := &allowRoute{ipAddress: net.ParseIP("192.0.2.1").To4(), validUnitl: validUntil}
+			if err := manager.queueRoutes([]*allowRoute{first}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			// The same address is merged, so it still fits
+			if err := manager.queueRoutes([]*allowRoute{{ipAddress: first.ipAddress, validUnitl: validUntil}}, nil); err != nil {
+				t.Fatalf("Expected a known address to fit, got %v", err)
+			}
+
+			result := make(chan error, 1)
+			go func() {
+				result <- manager.queueRoutes([]*allowRoute{{ipAddress: net.ParseIP("192.0.2.2").To4(), validUnitl: validUntil}}, nil)
+			}()
+
+			if tt.expectedErr == nil {
+				select {
+				case err := <-result:
+					t.Fatalf("Expected the push to block, got %v", err)
+				case <-time.After(50 * time.Millisecond):
+				}
+
+				manager.allowQueuedRoutes()
+			}
+
+			select {
+			case err := <-result:
+				if !errors.Is(err, tt.expectedErr) {
+					t.Errorf("Expected error %v, got %v", tt.expectedErr, err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Expected the push to return")
+			}
+
+			manager.allowQueuedRoutes()
+			expectedEntries := 2
+			if tt.expectedErr != nil {
+				expectedEntries = 1
+			}
+			if len(manager.allowList) != expectedEntries {
+				t.Errorf("Expected %d entries, got %v", expectedEntries, manager.allowList)
+			}
+		})
+	}
+}
+
+func TestRouteQueueClose(t *testing.T) {
+	manager := newStoppedTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+	queue := newRouteQueue(defaultQueueSize, &manager.allowRoutePool)
+
+	done := make(chan error, 1)
+	queue.push([]*allowRoute{{ipAddress: net.ParseIP("192.0.2.1").To4(), validUnitl: time.Now().Add(time.Hour)}}, done)
+	queue.close()
+
+	if err := <-done; !errors.Is(err, errManagerStopped) {
+		t.Errorf("Expected waiting answers to get %v, got %v", errManagerStopped, err)
+	}
+	if _, err := queue.push([]*allowRoute{{ipAddress: net.ParseIP("192.0.2.2").To4()}}, nil); !errors.Is(err, errManagerStopped) {
+		t.Errorf("Expected pushes to a closed queue to fail with %v, got %v", errManagerStopped, err)
+	}
+}
@@ -0,0 +1,260 @@
+package ipdestinationguard
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// Default interval the reconciler compares the table in the kernel with the expected one in.
+const defaultReconcileInterval = time.Minute
+
+// Kinds of drift, as used by the drift_events_total metric.
+const (
+	driftTable    = "table"
+	driftChain    = "chain"
+	driftRules    = "rules"
+	driftElements = "elements"
+)
+
+// The parts of the table read from the kernel, that the reconciler compares.
+type tableSnapshot struct {
+	exists   bool
+	chains   map[string]*nftables.Chain
+	rules    map[string][]*nftables.Rule
+	elements map[*nftables.Set]map[string]struct{} // Keys of the elements of each dynamic set, nil if the set is missing
+}
+
+// Returns the hook of given chain, as created by prepareNFTables.
+func chainHookFor(chainName string) *nftables.ChainHook {
+	if chainName == "forward" {
+		return nftables.ChainHookForward
+	}
+	return nftables.ChainHookOutput
+}
+
+// Returns the dynamic sets of this manager, whose elements follow the allowList.
+func (manager *NFTablesManager) dynamicSets() []*nftables.Set {
+	sets := []*nftables.Set{manager.ipv4AllowSet, manager.ipv6AllowSet}
+	if manager.ipv4ScopedAllowSet != nil {
+		sets = append(sets, manager.ipv4ScopedAllowSet, manager.ipv6ScopedAllowSet)
+	}
+
+	return sets
+}
+
+// Reads the rules of given chains from the kernel.
+func (manager *NFTablesManager) readRules(chainNames []string) (map[string][]*nftables.Rule, error) {
+	targetTable := &nftables.Table{Name: tableName, Family: nftables.TableFamilyINet}
+	rules := make(map[string][]*nftables.Rule, len(chainNames))
+
+	for _, chainName := range chainNames {
+		chainRules, err := manager.nlInterface.GetRules(targetTable, &nftables.Chain{Name: chainName, Table: targetTable})
+		if err != nil {
+			return nil, err
+		}
+		rules[chainName] = chainRules
+	}
+
+	return rules, nil
+}
+
+// Reads the table, its chains, their rules and the elements of the dynamic sets from the kernel.
+func (manager *NFTablesManager) readTableSnapshot(chainNames []string) (*tableSnapshot, error) {
+	snapshot := &tableSnapshot{
+		chains:   make(map[string]*nftables.Chain),
+		elements: make(map[*nftables.Set]map[string]struct{}),
+	}
+
+	tables, err := manager.nlInterface.ListTablesOfFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range tables {
+		snapshot.exists = snapshot.exists || table.Name == tableName
+	}
+	if !snapshot.exists {
+		return snapshot, nil
+	}
+
+	chains, err := manager.nlInterface.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return nil, err
+	}
+	var existingChainNames []string
+	for _, chain := range chains {
+		if chain.Table.Name == tableName {
+			snapshot.chains[chain.Name] = chain
+			existingChainNames = append(existingChainNames, chain.Name)
+		}
+	}
+
+	if snapshot.rules, err = manager.readRules(existingChainNames); err != nil {
+		return nil, err
+	}
+
+	for _, dynamicSet := range manager.dynamicSets() {
+		elements, err := manager.nlInterface.GetSetElements(dynamicSet)
+		if err != nil {
+			// The set was deleted
+			snapshot.elements[dynamicSet] = nil
+			continue
+		}
+
+		keys := make(map[string]struct{}, len(elements))
+		for _, element := range elements {
+			keys[string(element.Key)] = struct{}{}
+		}
+		snapshot.elements[dynamicSet] = keys
+	}
+
+	return snapshot, nil
+}
+
+// Returns the kinds of drift between given snapshot and the expected table of this manager. Elements only count as
+// drift, if entries of the allowList are missing, as other server blocks might add elements to the shared sets.
+func (manager *NFTablesManager) findDrift(snapshot *tableSnapshot, chainNames []string, now time.Time) []string {
+	if !snapshot.exists {
+		return []string{driftTable}
+	}
+
+	var drift []string
+
+	for _, chainName := range chainNames {
+		chain, exists := snapshot.chains[chainName]
+		if !exists || chain.Type != nftables.ChainTypeFilter || chain.Policy == nil || *chain.Policy != nftables.ChainPolicyDrop ||
+			chain.Hooknum == nil || *chain.Hooknum != *chainHookFor(chainName) {
+			drift = append(drift, driftChain)
+			break
+		}
+	}
+
+	for _, chainName := range chainNames {
+		if !sameRules(manager.expectedRules[chainName], snapshot.rules[chainName]) {
+			drift = append(drift, driftRules)
+			break
+		}
+	}
+
+	if len(manager.missingElements(snapshot, now)) > 0 {
+		drift = append(drift, driftElements)
+	}
+
+	return drift
+}
+
+// Returns whether given rules have the same expressions in the same order.
+func sameRules(expected []*nftables.Rule, actual []*nftables.Rule) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+
+	for i := range expected {
+		if !reflect.DeepEqual(comparableExprs(expected[i].Exprs), comparableExprs(actual[i].Exprs)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns a copy of given expressions without the names and ids of anonymous sets, as the kernel names them on its own
+// whenever the rules are rebuilt.
+func comparableExprs(exprs []expr.Any) []expr.Any {
+	comparable := make([]expr.Any, len(exprs))
+
+	for i, expression := range exprs {
+		lookup, isLookup := expression.(*expr.Lookup)
+		if !isLookup || !strings.HasPrefix(lookup.SetName, "__set") {
+			comparable[i] = expression
+			continue
+		}
+
+		anonymousLookup := *lookup
+		anonymousLookup.SetName = ""
+		anonymousLookup.SetID = 0
+		comparable[i] = &anonymousLookup
+	}
+
+	return comparable
+}
+
+// Returns the elements of the allowList entries, that are missing in the sets of given snapshot. Entries expiring
+// within a second might have been removed by the kernel already, so they are skipped.
+func (manager *NFTablesManager) missingElements(snapshot *tableSnapshot, now time.Time) map[*nftables.Set][]nftables.SetElement {
+	missing := make(map[*nftables.Set][]nftables.SetElement)
+
+	for _, route := range manager.allowList {
+		if !route.validUnitl.After(now.Add(time.Second)) {
+			continue
+		}
+
+		targetSet := manager.allowSetFor(route)
+		key := route.elementKey()
+		if _, exists := snapshot.elements[targetSet][string(key)]; exists {
+			continue
+		}
+
+		missing[targetSet] = append(missing[targetSet], nftables.SetElement{Key: key, Timeout: elementTimeout(route.validUnitl, now)})
+	}
+
+	return missing
+}
+
+// Compares the table in the kernel with the expected one, and repairs any drift: a deleted table, changed chains or
+// rules are rebuilt, missing elements are added again. Runs on the manager goroutine.
+func (manager *NFTablesManager) reconcile(now time.Time) {
+	chainNames := chainsForMode(manager.config.mode)
+
+	snapshot, err := manager.readTableSnapshot(chainNames)
+	if err != nil {
+		log.Errorf("Reading table %s for reconciliation failed: %v", tableName, err)
+		return
+	}
+
+	drift := manager.findDrift(snapshot, chainNames, now)
+	if len(drift) == 0 {
+		manager.rulesetHealthy.Store(true)
+		return
+	}
+
+	manager.rulesetHealthy.Store(false)
+	for _, kind := range drift {
+		log.Warningf("Detected drift of table %s: %s changed outside of the plugin, repairing it", tableName, kind)
+		driftEventsTotal.WithLabelValues(kind).Inc()
+	}
+
+	// Rebuilding replaces the rules in a single transaction, but keeps the elements of existing sets
+	if drift[0] != driftElements {
+		if err := manager.prepareNFTables(manager.config); err != nil {
+			log.Errorf("Repairing table %s failed: %v", tableName, err)
+			return
+		}
+
+		if snapshot, err = manager.readTableSnapshot(chainNames); err != nil {
+			log.Errorf("Reading table %s for reconciliation failed: %v", tableName, err)
+			return
+		}
+	}
+
+	if missing := manager.missingElements(snapshot, now); len(missing) > 0 {
+		for targetSet, elements := range missing {
+			if err := manager.nlInterface.SetAddElements(targetSet, elements); err != nil {
+				log.Errorf("Repairing the elements of set %s failed: %v", targetSet.Name, err)
+				return
+			}
+		}
+
+		if err := manager.flush(flushPathRepair, now); err != nil {
+			log.Errorf("Repairing the elements of table %s failed: %v", tableName, err)
+			nftablesFlushErrorsTotal.Inc()
+			return
+		}
+	}
+
+	manager.rulesetHealthy.Store(true)
+	log.Infof("Repaired table %s", tableName)
+}
@@ -0,0 +1,186 @@
+package ipdestinationguard
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+func TestFindDrift(t *testing.T) {
+	now := time.Now()
+	table := &nftables.Table{Name: tableName, Family: nftables.TableFamilyINet}
+	ipv4AllowSet := &nftables.Set{Name: "ipv4allowlist", Table: table, KeyType: nftables.TypeIPAddr}
+	ipv6AllowSet := &nftables.Set{Name: "ipv6allowlist", Table: table, KeyType: nftables.TypeIP6Addr}
+
+	acceptRule := func() *nftables.Rule {
+		return &nftables.Rule{Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}}
+	}
+	outputChain := func(policy nftables.ChainPolicy, hook *nftables.ChainHook) *nftables.Chain {
+		return &nftables.Chain{Name: "output", Table: table, Type: nftables.ChainTypeFilter, Hooknum: hook, Policy: &policy}
+	}
+
+	allowedIP := net.ParseIP("192.0.2.1").To4()
+	healthySnapshot := func() *tableSnapshot {
+		return &tableSnapshot{
+			exists: true,
+			chains: map[string]*nftables.Chain{"output": outputChain(nftables.ChainPolicyDrop, nftables.ChainHookOutput)},
+			rules:  map[string][]*nftables.Rule{"output": {acceptRule()}},
+			elements: map[*nftables.Set]map[string]struct{}{
+				ipv4AllowSet: {string(allowedIP): {}},
+				ipv6AllowSet: {},
+			},
+		}
+	}
+
+	tests := []struct {
+		name          string
+		modify        func(snapshot *tableSnapshot)
+		expectedDrift []string
+	}{
+		{
+			name:   "matching table",
+			modify: func(snapshot *tableSnapshot) {},
+		},
+		{
+			name: "additional elements of other server blocks",
+			modify: func(snapshot *tableSnapshot) {
+				snapshot.elements[ipv4AllowSet][string(net.ParseIP("192.0.2.99").To4())] = struct{}{}
+			},
+		},
+		{
+			name:          "deleted table",
+			modify:        func(snapshot *tableSnapshot) { *snapshot = tableSnapshot{} },
+			expectedDrift: []string{driftTable},
+		},
+		{
+			name: "deleted chain",
+			modify: func(snapshot *tableSnapshot) {
+				delete(snapshot.chains, "output")
+				delete(snapshot.rules, "output")
+			},
+			expectedDrift: []string{driftChain, driftRules},
+		},
+		{
+			name: "changed policy",
+			modify: func(snapshot *tableSnapshot) {
+				snapshot.chains["output"] = outputChain(nftables.ChainPolicyAccept, nftables.ChainHookOutput)
+			},
+			expectedDrift: []string{driftChain},
+		},
+		{
+			name: "changed hook",
+			modify: func(snapshot *tableSnapshot) {
+				snapshot.chains["output"] = outputChain(nftables.ChainPolicyDrop, nftables.ChainHookForward)
+			},
+			expectedDrift: []string{driftChain},
+		},
+		{
+			name: "inserted rule",
+			modify: func(snapshot *tableSnapshot) {
+				snapshot.rules["output"] = append([]*nftables.Rule{acceptRule()}, snapshot.rules["output"]...)
+			},
+			expectedDrift: []string{driftRules},
+		},
+		{
+			name: "changed rule",
+			modify: func(snapshot *tableSnapshot) {
+				snapshot.rules["output"] = []*nftables.Rule{{Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}}}}
+			},
+			expectedDrift: []string{driftRules},
+		},
+		{
+			name:          "deleted element",
+			modify:        func(snapshot *tableSnapshot) { delete(snapshot.elements[ipv4AllowSet], string(allowedIP)) },
+			expectedDrift: []string{driftElements},
+		},
+		{
+			name:          "deleted set",
+			modify:        func(snapshot *tableSnapshot) { snapshot.elements[ipv4AllowSet] = nil },
+			expectedDrift: []string{driftElements},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := &NFTablesManager{
+				ipv4AllowSet:  ipv4AllowSet,
+				ipv6AllowSet:  ipv6AllowSet,
+				expectedRules: map[string][]*nftables.Rule{"output": {acceptRule()}},
+				allowList: map[routeKey]*allowRoute{
+					newRouteKey("", allowedIP): {ipAddress: allowedIP, validUnitl: now.Add(time.Hour)},
+					// Expired entries might be gone from the kernel already
+					parseRouteKey("192.0.2.2"): {ipAddress: net.ParseIP("192.0.2.2").To4(), validUnitl: now.Add(time.Millisecond)},
+				},
+			}
+
+			snapshot := healthySnapshot()
+			tt.modify(snapshot)
+
+			drift := manager.findDrift(snapshot, []string{"output"}, now)
+			if !slices.Equal(drift, tt.expectedDrift) {
+				t.Errorf("Expected drift %v, got %v", tt.expectedDrift, drift)
+			}
+		})
+	}
+}
+
+func TestMissingElements(t *testing.T) {
+	now := time.Now()
+	manager := newTestNFTablesManager(t, testAdminConfig(t, ScopeClient))
+	if err := manager.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	presentRoute := &allowRoute{ipAddress: net.ParseIP("192.0.2.1").To4(), validUnitl: now.Add(time.Hour)}
+	missingRoute := &allowRoute{ipAddress: net.ParseIP("2001:db8::1"), validUnitl: now.Add(time.Minute)}
+	missingScopedRoute := &allowRoute{
+		ipAddress:  net.ParseIP("192.0.2.2").To4(),
+		scopeKey:   net.ParseIP("10.0.0.5").To4(),
+		scopeLabel: "10.0.0.5",
+		validUnitl: now.Add(time.Hour),
+	}
+	for _, route := range []*allowRoute{presentRoute, missingRoute, missingScopedRoute} {
+		manager.storeRoute(route)
+	}
+
+	snapshot := &tableSnapshot{
+		exists:   true,
+		elements: map[*nftables.Set]map[string]struct{}{manager.ipv4AllowSet: {string(presentRoute.elementKey()): {}}},
+	}
+
+	missing := manager.missingElements(snapshot, now)
+	if len(missing) != 2 {
+		t.Fatalf("Expected missing elements in 2 sets, got %v", missing)
+	}
+
+	ipv6Elements := missing[manager.ipv6AllowSet]
+	if len(ipv6Elements) != 1 || !net.IP(ipv6Elements[0].Key).Equal(missingRoute.ipAddress) || ipv6Elements[0].Timeout != time.Minute {
+		t.Errorf("Expected %v with a timeout of 1m, got %v", missingRoute.ipAddress, ipv6Elements)
+	}
+
+	scopedElements := missing[manager.ipv4ScopedAllowSet]
+	if len(scopedElements) != 1 || string(scopedElements[0].Key) != string(missingScopedRoute.elementKey()) {
+		t.Errorf("Expected the scoped element of %v, got %v", missingScopedRoute.ipAddress, scopedElements)
+	}
+}
+
+func TestSameRulesIgnoresAnonymousSetNames(t *testing.T) {
+	lookupRule := func(setName string, setID uint32) *nftables.Rule {
+		return &nftables.Rule{Exprs: []expr.Any{
+			&expr.Lookup{SourceRegister: 1, SetName: setName, SetID: setID},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		}}
+	}
+
+	if !sameRules([]*nftables.Rule{lookupRule("__set0", 1)}, []*nftables.Rule{lookupRule("__set3", 7)}) {
+		t.Error("Expected rules only differing in anonymous set names to match")
+	}
+
+	if sameRules([]*nftables.Rule{lookupRule("ipv4allowlist", 0)}, []*nftables.Rule{lookupRule("ipv6allowlist", 0)}) {
+		t.Error("Expected rules looking up different named sets to differ")
+	}
+}
@@ -0,0 +1,424 @@
+package ipdestinationguard
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Message types and attributes of nfnetlink_log, see linux/netfilter/nfnetlink_log.h.
+const (
+	nfulnlMsgPacket = 0
+	nfulnlMsgConfig = 1
+
+	nfulaPacketHdr = 1
+	nfulaPayload   = 9
+	nfulaPrefix    = 10
+	nfulaUID       = 11
+
+	nfulaCfgCmd  = 1
+	nfulaCfgMode = 2
+
+	nfulnlCfgCmdBind   = 1
+	nfulnlCfgCmdUnbind = 2
+
+	nfulnlCopyPacket = 2
+)
+
+// Bytes of each packet copied to the reader, enough for the IP and transport headers.
+const rejectLogCopyRange = 128
+
+// Maximum number of log lines written per second. Metrics still count every packet.
+const rejectLogLinesPerSecond = 10
+
+// Number of expired or revoked entries, whose domain is remembered for the reject log.
+const domainHistorySize = 4096
+
+// A bounded history of the domains, that allowed addresses before their entries expired or got revoked. When full,
+// the oldest address is forgotten first.
+type domainHistory struct {
+	mutex   sync.Mutex
+	domains map[string]string // Domain by address
+	order   []string          // Addresses in insertion order, used as ring buffer
+	next    int               // Index in order, that gets overwritten next
+}
+
+func newDomainHistory(size int) *domainHistory {
+	return &domainHistory{
+		domains: make(map[string]string, size),
+		order:   make([]string, 0, size),
+	}
+}
+
+// Remembers given domain for given address. Does nothing on a nil history or without domain.
+func (history *domainHistory) record(ip net.IP, domain string) {
+	if history == nil || domain == "" {
+		return
+	}
+
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	key := ip.String()
+	if _, exists := history.domains[key]; exists {
+		history.domains[key] = domain
+		return
+	}
+
+	if len(history.order) < cap(history.order) {
+		history.order = append(history.order, key)
+	} else {
+		delete(history.domains, history.order[history.next])
+		history.order[history.next] = key
+		history.next = (history.next + 1) % len(history.order)
+	}
+	history.domains[key] = domain
+}
+
+// Returns the last domain remembered for given address, or an empty string.
+func (history *domainHistory) lookup(ip net.IP) string {
+	if history == nil {
+		return ""
+	}
+
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	return history.domains[ip.String()]
+}
+
+// A packet of the reject log.
+type rejectedPacket struct {
+	chain       string
+	monitor     bool // Whether the packet was only logged, but not rejected (enforcement monitor)
+	protocol    string
+	source      net.IP
+	destination net.IP
+	port        uint16 // Destination port, 0 for protocols without ports
+	uid         int    // Owner of the local socket, -1 if unknown
+}
+
+// Returns the kernel log prefix of packets, that given chain rejects (or would reject in enforcement monitor).
+func rejectLogPrefix(chainName string, enforcement Enforcement) string {
+	if enforcement == EnforcementMonitor {
+		return pluginName + " would reject (" + chainName + "): "
+	}
+
+	return pluginName + " reject (" + chainName + "): "
+}
+
+// Parses a prefix created by rejectLogPrefix, returning the chain and whether it's the prefix of enforcement monitor.
+func parseRejectLogPrefix(prefix string) (string, bool, bool) {
+	rest, found := strings.CutPrefix(prefix, pluginName+" ")
+	if !found {
+		return "", false, false
+	}
+
+	monitor := false
+	if rest, found = strings.CutPrefix(rest, "would "); found {
+		monitor = true
+	}
+
+	rest, found = strings.CutPrefix(rest, "reject (")
+	if !found {
+		return "", false, false
+	}
+
+	chain, _, found := strings.Cut(rest, ")")
+	if !found || chain == "" {
+		return "", false, false
+	}
+
+	return chain, monitor, true
+}
+
+// Parses the IP and transport headers of given packet, which starts at its network header.
+func parsePacketHeaders(payload []byte, packet *rejectedPacket) error {
+	if len(payload) < 1 {
+		return errors.New("empty payload")
+	}
+
+	var protocol byte
+	var transportHeader []byte
+
+	switch payload[0] >> 4 {
+	case 4:
+		headerLength := int(payload[0]&0x0f) * 4
+		if len(payload) < 20 || headerLength < 20 || len(payload) < headerLength {
+			return errors.New("truncated ipv4 header")
+		}
+		protocol = payload[9]
+		packet.source = net.IP(append([]byte{}, payload[12:16]...))
+		packet.destination = net.IP(append([]byte{}, payload[16:20]...))
+		transportHeader = payload[headerLength:]
+
+	case 6:
+		if len(payload) < 40 {
+			return errors.New("truncated ipv6 header")
+		}
+		// Extension headers aren't followed, as rejected packets rarely carry them
+		protocol = payload[6]
+		packet.source = net.IP(append([]byte{}, payload[8:24]...))
+		packet.destination = net.IP(append([]byte{}, payload[24:40]...))
+		transportHeader = payload[40:]
+
+	default:
+		return fmt.Errorf("unknown ip version %d", payload[0]>>4)
+	}
+
+	switch protocol {
+	case unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_SCTP, unix.IPPROTO_UDPLITE:
+		if len(transportHeader) >= 4 {
+			packet.port = binary.BigEndian.Uint16(transportHeader[2:4])
+		}
+	}
+
+	packet.protocol = protocolName(protocol)
+
+	return nil
+}
+
+// Returns the name of given IP protocol number, like nft prints it.
+func protocolName(protocol byte) string {
+	switch protocol {
+	case unix.IPPROTO_TCP:
+		return "tcp"
+	case unix.IPPROTO_UDP:
+		return "udp"
+	case unix.IPPROTO_ICMP:
+		return "icmp"
+	case unix.IPPROTO_ICMPV6:
+		return "ipv6-icmp"
+	case unix.IPPROTO_SCTP:
+		return "sctp"
+	case unix.IPPROTO_UDPLITE:
+		return "udplite"
+	}
+
+	return strconv.Itoa(int(protocol))
+}
+
+// Parses the attributes of a NFULNL_MSG_PACKET message, without its nfgenmsg header. Packets without a prefix of
+// this plugin are reported as not ok.
+func parseRejectLogMessage(data []byte) (*rejectedPacket, bool, error) {
+	decoder, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return nil, false, err
+	}
+	decoder.ByteOrder = binary.BigEndian
+
+	packet := &rejectedPacket{uid: -1}
+	var prefix string
+	var payload []byte
+
+	for decoder.Next() {
+		switch decoder.Type() {
+		case nfulaPrefix:
+			prefix = decoder.String()
+		case nfulaPayload:
+			payload = decoder.Bytes()
+		case nfulaUID:
+			packet.uid = int(decoder.Uint32())
+		}
+	}
+	if err := decoder.Err(); err != nil {
+		return nil, false, err
+	}
+
+	chain, monitor, ok := parseRejectLogPrefix(prefix)
+	if !ok {
+		return nil, false, nil
+	}
+	packet.chain = chain
+	packet.monitor = monitor
+
+	if err := parsePacketHeaders(payload, packet); err != nil {
+		return nil, false, err
+	}
+
+	return packet, true, nil
+}
+
+// Reads the packets, that the chains send to the configured NFLOG group, and logs and counts them with the domain,
+// that allowed their destination last.
+type rejectLogReader struct {
+	group    uint16
+	history  *domainHistory
+	learner  *learner // Only set in learn mode
+	conn     *netlink.Conn
+	stopping chan struct{} // Closed, when the reader gets stopped
+	done     chan struct{} // Closed, when the reading goroutine returned
+
+	// Only used by the reading goroutine to limit the log lines per second
+	logWindow      time.Time
+	logLines       int
+	suppressedLogs int
+}
+
+func newRejectLogReader(group uint16, history *domainHistory, learner *learner) *rejectLogReader {
+	return &rejectLogReader{group: group, history: history, learner: learner}
+}
+
+// Returns a nfnetlink_log config message for the group of the reader with given attributes.
+func (reader *rejectLogReader) configMessage(attributes []netlink.Attribute) (netlink.Message, error) {
+	data, err := netlink.MarshalAttributes(attributes)
+	if err != nil {
+		return netlink.Message{}, err
+	}
+
+	// The nfgenmsg header: family, version and the group as resource id
+	header := []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], reader.group)
+
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_ULOG<<8 | nfulnlMsgConfig),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append(header, data...),
+	}, nil
+}
+
+// Binds to the NFLOG group and starts reading it.
+func (reader *rejectLogReader) start() error {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return fmt.Errorf("error opening nfnetlink_log socket: %w", err)
+	}
+
+	copyMode := make([]byte, 6)
+	binary.BigEndian.PutUint32(copyMode, rejectLogCopyRange)
+	copyMode[4] = nfulnlCopyPacket
+
+	for _, attributes := range [][]netlink.Attribute{
+		{{Type: nfulaCfgCmd, Data: []byte{nfulnlCfgCmdBind}}},
+		{{Type: nfulaCfgMode, Data: copyMode}},
+	} {
+		message, err := reader.configMessage(attributes)
+		if err == nil {
+			_, err = conn.Execute(message)
+		}
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("error binding to NFLOG group %d: %w", reader.group, err)
+		}
+	}
+
+	reader.conn = conn
+	reader.stopping = make(chan struct{})
+	reader.done = make(chan struct{})
+	go reader.run(conn, reader.stopping, reader.done)
+
+	log.Infof("Reading rejected packets from NFLOG group %d", reader.group)
+
+	return nil
+}
+
+// Unbinds from the NFLOG group and stops reading it, if the reader was started.
+func (reader *rejectLogReader) stop() error {
+	if reader.conn == nil {
+		return nil
+	}
+
+	if message, err := reader.configMessage([]netlink.Attribute{{Type: nfulaCfgCmd, Data: []byte{nfulnlCfgCmdUnbind}}}); err == nil {
+		// Unbinding fails, if the kernel already dropped the group, which doesn't matter as the socket gets closed anyway
+		reader.conn.Send(message)
+	}
+
+	close(reader.stopping)
+	err := reader.conn.Close()
+	<-reader.done
+	reader.conn = nil
+
+	return err
+}
+
+func (reader *rejectLogReader) run(conn *netlink.Conn, stopping chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	for {
+		messages, err := conn.Receive()
+		if err != nil {
+			select {
+			case <-stopping:
+				return
+			default:
+			}
+			// The kernel drops packets, if the socket buffer is full (ENOBUFS), reading just continues
+			log.Warningf("Reading NFLOG group %d failed: %v", reader.group, err)
+			continue
+		}
+
+		for _, message := range messages {
+			if message.Header.Type != netlink.HeaderType(unix.NFNL_SUBSYS_ULOG<<8|nfulnlMsgPacket) || len(message.Data) < 4 {
+				continue
+			}
+
+			packet, ok, err := parseRejectLogMessage(message.Data[4:])
+			if err != nil {
+				log.Debugf("Parsing NFLOG packet failed: %v", err)
+				continue
+			}
+			if ok {
+				reader.handlePacket(packet, time.Now())
+			}
+		}
+	}
+}
+
+// Counts given packet, and logs it unless the log limit is reached.
+func (reader *rejectLogReader) handlePacket(packet *rejectedPacket, now time.Time) {
+	// Ports and domains are only logged, as each of them would add time series without bound
+	rejectedPacketsTotal.WithLabelValues(packet.chain, packet.protocol).Inc()
+
+	if packet.monitor {
+		reader.learner.recordDestination(packet.chain, packet.destination)
+	}
+
+	if now.Sub(reader.logWindow) >= time.Second {
+		if reader.suppressedLogs > 0 {
+			log.Infof("Suppressed %d reject log lines", reader.suppressedLogs)
+		}
+		reader.logWindow = now
+		reader.logLines = 0
+		reader.suppressedLogs = 0
+	}
+	if reader.logLines >= rejectLogLinesPerSecond {
+		reader.suppressedLogs++
+		return
+	}
+	reader.logLines++
+
+	log.Info(formatRejectedPacket(packet, reader.history.lookup(packet.destination)))
+}
+
+// Returns the log line of given packet, as key=value pairs.
+func formatRejectedPacket(packet *rejectedPacket, domain string) string {
+	var builder strings.Builder
+
+	action := "rejected"
+	if packet.monitor {
+		action = "would reject"
+	}
+	fmt.Fprintf(&builder, "%s chain=%s proto=%s src=%s dst=%s", action, packet.chain, packet.protocol, packet.source, packet.destination)
+
+	if packet.port != 0 {
+		fmt.Fprintf(&builder, " dport=%d", packet.port)
+	}
+	if packet.uid >= 0 {
+		fmt.Fprintf(&builder, " uid=%d", packet.uid)
+	}
+	if domain != "" {
+		fmt.Fprintf(&builder, " domain=%s", domain)
+	}
+
+	return builder.String()
+}
@@ -0,0 +1,264 @@
+package ipdestinationguard
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+)
+
+// Returns an IPv4 packet from given source to given destination with the first bytes of a transport header.
+func testIPv4Packet(protocol byte, source string, destination string, port uint16) []byte {
+	packet := make([]byte, 24)
+	packet[0] = 0x45 // Version 4, header length 20 bytes
+	packet[9] = protocol
+	copy(packet[12:16], net.ParseIP(source).To4())
+	copy(packet[16:20], net.ParseIP(destination).To4())
+	packet[22], packet[23] = byte(port>>8), byte(port)
+
+	return packet
+}
+
+// Returns an IPv6 packet from given source to given destination with the first bytes of a transport header.
+func testIPv6Packet(protocol byte, source string, destination string, port uint16) []byte {
+	packet := make([]byte, 44)
+	packet[0] = 0x60
+	packet[6] = protocol
+	copy(packet[8:24], net.ParseIP(source))
+	copy(packet[24:40], net.ParseIP(destination))
+	packet[42], packet[43] = byte(port>>8), byte(port)
+
+	return packet
+}
+
+func TestDomainHistory(t *testing.T) {
+	history := newDomainHistory(2)
+
+	history.record(net.ParseIP("192.0.2.1").To4(), "one.example.com.")
+	history.record(net.ParseIP("192.0.2.2").To4(), "two.example.com.")
+	history.record(net.ParseIP("192.0.2.3"), "")
+	history.record(net.ParseIP("192.0.2.1").To4(), "first.example.com.")
+
+	if domain := history.lookup(net.ParseIP("192.0.2.1")); domain != "first.example.com." {
+		t.Errorf("Expected updated domain, got '%s'", domain)
+	}
+	if domain := history.lookup(net.ParseIP("192.0.2.3")); domain != "" {
+		t.Errorf("Expected entries without domain to be ignored, got '%s'", domain)
+	}
+
+	// The history is full, so the oldest address gets forgotten
+	history.record(net.ParseIP("2001:db8::1"), "six.example.com.")
+
+	if domain := history.lookup(net.ParseIP("192.0.2.1")); domain != "" {
+		t.Errorf("Expected oldest address to be forgotten, got '%s'", domain)
+	}
+	if domain := history.lookup(net.ParseIP("192.0.2.2")); domain != "two.example.com." {
+		t.Errorf("Expected 'two.example.com.', got '%s'", domain)
+	}
+	if domain := history.lookup(net.ParseIP("2001:db8::1")); domain != "six.example.com." {
+		t.Errorf("Expected 'six.example.com.', got '%s'", domain)
+	}
+
+	var nilHistory *domainHistory
+	nilHistory.record(net.ParseIP("192.0.2.1"), "example.com.")
+	if domain := nilHistory.lookup(net.ParseIP("192.0.2.1")); domain != "" {
+		t.Errorf("Expected nil history to know nothing, got '%s'", domain)
+	}
+}
+
+func TestParseRejectLogPrefix(t *testing.T) {
+	tests := []struct {
+		name            string
+		prefix          string
+		expectedChain   string
+		expectedMonitor bool
+		expectedOk      bool
+	}{
+		{"reject", rejectLogPrefix("output", EnforcementEnforce), "output", false, true},
+		{"would reject", rejectLogPrefix("forward", EnforcementMonitor), "forward", true, true},
+		{"foreign prefix", "DROP INPUT: ", "", false, false},
+		{"missing chain", pluginName + " reject (): ", "", false, false},
+		{"unterminated chain", pluginName + " reject (output", "", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain, monitor, ok := parseRejectLogPrefix(tt.prefix)
+
+			if chain != tt.expectedChain || monitor != tt.expectedMonitor || ok != tt.expectedOk {
+				t.Errorf("Expected (%s, %v, %v), got (%s, %v, %v)", tt.expectedChain, tt.expectedMonitor, tt.expectedOk, chain, monitor, ok)
+			}
+		})
+	}
+}
+
+func TestParsePacketHeaders(t *testing.T) {
+	tests := []struct {
+		name                string
+		payload             []byte
+		expectedProtocol    string
+		expectedSource      string
+		expectedDestination string
+		expectedPort        uint16
+		shouldError         bool
+	}{
+		{
+			name:                "ipv4 tcp",
+			payload:             testIPv4Packet(6, "10.0.0.5", "203.0.113.1", 443),
+			expectedProtocol:    "tcp",
+			expectedSource:      "10.0.0.5",
+			expectedDestination: "203.0.113.1",
+			expectedPort:        443,
+		},
+		{
+			name:                "ipv4 icmp has no port",
+			payload:             testIPv4Packet(1, "10.0.0.5", "203.0.113.1", 443),
+			expectedProtocol:    "icmp",
+			expectedSource:      "10.0.0.5",
+			expectedDestination: "203.0.113.1",
+		},
+		{
+			name:                "ipv6 udp",
+			payload:             testIPv6Packet(17, "fd00::5", "2001:db8::1", 53),
+			expectedProtocol:    "udp",
+			expectedSource:      "fd00::5",
+			expectedDestination: "2001:db8::1",
+			expectedPort:        53,
+		},
+		{
+			name:                "unknown protocol",
+			payload:             testIPv6Packet(47, "fd00::5", "2001:db8::1", 0),
+			expectedProtocol:    "47",
+			expectedSource:      "fd00::5",
+			expectedDestination: "2001:db8::1",
+		},
+		{
+			name:        "truncated ipv4 header",
+			payload:     testIPv4Packet(6, "10.0.0.5", "203.0.113.1", 443)[:12],
+			shouldError: true,
+		},
+		{
+			name:        "truncated ipv6 header",
+			payload:     testIPv6Packet(6, "fd00::5", "2001:db8::1", 443)[:30],
+			shouldError: true,
+		},
+		{
+			name:        "empty payload",
+			payload:     nil,
+			shouldError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := &rejectedPacket{}
+			err := parsePacketHeaders(tt.payload, packet)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if packet.protocol != tt.expectedProtocol {
+				t.Errorf("Expected protocol '%s', got '%s'", tt.expectedProtocol, packet.protocol)
+			}
+			if !packet.source.Equal(net.ParseIP(tt.expectedSource)) {
+				t.Errorf("Expected source %s, got %v", tt.expectedSource, packet.source)
+			}
+			if !packet.destination.Equal(net.ParseIP(tt.expectedDestination)) {
+				t.Errorf("Expected destination %s, got %v", tt.expectedDestination, packet.destination)
+			}
+			if packet.port != tt.expectedPort {
+				t.Errorf("Expected port %d, got %d", tt.expectedPort, packet.port)
+			}
+		})
+	}
+}
+
+func TestParseRejectLogMessage(t *testing.T) {
+	encoder := netlink.NewAttributeEncoder()
+	encoder.ByteOrder = binary.BigEndian // Like the kernel encodes NFLOG attributes
+	encoder.String(nfulaPrefix, rejectLogPrefix("output", EnforcementEnforce))
+	encoder.Uint32(nfulaUID, 1000)
+	encoder.Bytes(nfulaPayload, testIPv4Packet(6, "10.0.0.5", "203.0.113.1", 443))
+	data, err := encoder.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet, ok, err := parseRejectLogMessage(data)
+	if err != nil || !ok {
+		t.Fatalf("Expected packet, got ok %v and error %v", ok, err)
+	}
+
+	history := newDomainHistory(domainHistorySize)
+	history.record(net.ParseIP("203.0.113.1").To4(), "example.com.")
+
+	expectedLine := "rejected chain=output proto=tcp src=10.0.0.5 dst=203.0.113.1 dport=443 uid=1000 domain=example.com."
+	if line := formatRejectedPacket(packet, history.lookup(packet.destination)); line != expectedLine {
+		t.Errorf("Expected log line '%s', got '%s'", expectedLine, line)
+	}
+
+	// Packets logged by other rules of the same group are ignored
+	encoder = netlink.NewAttributeEncoder()
+	encoder.String(nfulaPrefix, "DROP INPUT: ")
+	encoder.Bytes(nfulaPayload, testIPv4Packet(6, "10.0.0.5", "203.0.113.1", 443))
+	data, err = encoder.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := parseRejectLogMessage(data); ok || err != nil {
+		t.Errorf("Expected foreign packet to be ignored, got ok %v and error %v", ok, err)
+	}
+}
+
+func TestRejectLogReaderLimitsLogLines(t *testing.T) {
+	reader := newRejectLogReader(100, nil, nil)
+	packet := &rejectedPacket{chain: "output", protocol: "tcp", source: net.ParseIP("10.0.0.5"), destination: net.ParseIP("203.0.113.1"), port: 443, uid: -1}
+	now := reader.logWindow.Add(time.Hour)
+
+	for i := 0; i < rejectLogLinesPerSecond+5; i++ {
+		reader.handlePacket(packet, now)
+	}
+
+	if reader.logLines != rejectLogLinesPerSecond || reader.suppressedLogs != 5 {
+		t.Errorf("Expected %d log lines and 5 suppressed, got %d and %d", rejectLogLinesPerSecond, reader.logLines, reader.suppressedLogs)
+	}
+
+	reader.handlePacket(packet, now.Add(time.Second))
+	if reader.logLines != 1 || reader.suppressedLogs != 0 {
+		t.Errorf("Expected a new log window, got %d log lines and %d suppressed", reader.logLines, reader.suppressedLogs)
+	}
+}
+
+func TestManagerRecordsRevokedDomains(t *testing.T) {
+	manager := newTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+	manager.domainHistory = newDomainHistory(domainHistorySize)
+
+	ip := net.ParseIP("203.0.113.9").To4()
+	routes := []*allowRoute{{ipAddress: ip, validUnitl: time.Now().Add(time.Hour), domain: "api.example.com."}}
+	if err := manager.sendBatch(&allowBatch{routes: routes}); err != nil {
+		t.Fatal(err)
+	}
+
+	if domain := manager.domainHistory.lookup(ip); domain != "" {
+		t.Errorf("Expected active entries not to be in the history, got '%s'", domain)
+	}
+
+	if err := manager.RevokeRoute(ip, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if domain := manager.domainHistory.lookup(ip); domain != "api.example.com." {
+		t.Errorf("Expected revoked entry to be in the history, got '%s'", domain)
+	}
+}
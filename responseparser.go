@@ -1,48 +1,307 @@
 package ipdestinationguard
 
 import (
+	"errors"
 	"net"
 
 	"github.com/miekg/dns"
 )
 
-func NewResponseParser(writer dns.ResponseWriter, dgManager DestinationGuardManager) *ResponseParser {
+// Options controlling, which parts of a DNS response allow traffic to their addresses.
+type ParserOptions struct {
+	HintRecordTypes   []uint16            // SVCB-like record types, whose ipv4hint/ipv6hint addresses get allowed
+	AdditionalSection bool                // Whether A/AAAA records of the additional section, that are SRV/MX/NS targets, get allowed
+	DomainPolicy      *DomainPolicy       // Which queried names may open the firewall, nil allows all
+	OnFirewallError   FirewallErrorAction // What happens to an answer, whose addresses couldn't be allowed, pass by default
+	QueueOverflow     QueueOverflowPolicy // What happens to an answer, whose addresses don't fit into the full queue
+}
+
+func NewResponseParser(writer dns.ResponseWriter, dgManager DestinationGuardManager, query *QueryInfo, options *ParserOptions) *ResponseParser {
+	if options == nil {
+		options = &ParserOptions{}
+	}
+
 	return &ResponseParser{
 		ResponseWriter: writer,
 		DGManager:      dgManager,
+		Query:          query,
+		Options:        options,
 	}
 }
 
 type ResponseParser struct {
 	dns.ResponseWriter
 	DGManager DestinationGuardManager
+	Query     *QueryInfo
+	Options   *ParserOptions
+}
+
+// Returns whether the ipv4hint/ipv6hint addresses of given record type should be allowed.
+func (parser *ResponseParser) allowsHints(rrtype uint16) bool {
+	for _, hintRecordType := range parser.Options.HintRecordTypes {
+		if hintRecordType == rrtype {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the addresses of the ipv4hint and ipv6hint parameters of given SVCB record as RouteEntries.
+func svcbHintEntries(record *dns.SVCB) []RouteEntry {
+	var entries []RouteEntry
+
+	for _, keyValue := range record.Value {
+		switch hint := keyValue.(type) {
+		case *dns.SVCBIPv4Hint:
+			for _, hintIP := range hint.Hint {
+				if ip := hintIP.To4(); ip != nil {
+					entries = append(entries, RouteEntry{IP: ip, TTL: record.Hdr.Ttl})
+				}
+			}
+		case *dns.SVCBIPv6Hint:
+			for _, hintIP := range hint.Hint {
+				if ip := hintIP.To16(); ip != nil {
+					entries = append(entries, RouteEntry{IP: ip, TTL: record.Hdr.Ttl})
+				}
+			}
+		}
+	}
+
+	return entries
+}
+
+// Returns the A/AAAA records of the additional section as RouteEntries, if their owner name is the target
+// of a SRV, MX or NS record of the answer section. Other glue records don't allow anything.
+func additionalSectionEntries(response *dns.Msg) []RouteEntry {
+	if len(response.Extra) == 0 {
+		return nil
+	}
+
+	targets := make(map[string]bool)
+	for _, answer := range response.Answer {
+		switch record := answer.(type) {
+		case *dns.SRV:
+			targets[dns.CanonicalName(record.Target)] = true
+		case *dns.MX:
+			targets[dns.CanonicalName(record.Mx)] = true
+		case *dns.NS:
+			targets[dns.CanonicalName(record.Ns)] = true
+		}
+	}
+
+	if len(targets) == 0 {
+		return nil
+	}
+
+	var entries []RouteEntry
+	for _, extra := range response.Extra {
+		if !targets[dns.CanonicalName(extra.Header().Name)] {
+			continue
+		}
+
+		switch record := extra.(type) {
+		case *dns.A:
+			if ip := record.A.To4(); ip != nil {
+				entries = append(entries, RouteEntry{IP: ip, TTL: record.Hdr.Ttl})
+			}
+		case *dns.AAAA:
+			if ip := record.AAAA.To16(); ip != nil {
+				entries = append(entries, RouteEntry{IP: ip, TTL: record.Hdr.Ttl})
+			}
+		}
+	}
+
+	return entries
 }
 
 func (parser *ResponseParser) WriteMsg(response *dns.Msg) error {
-	var ips []net.IP
-	var ttl uint32
+	var entries []RouteEntry
+	var cnameChain []string
 
 	for _, answer := range response.Answer {
 		switch answer.Header().Rrtype {
 		case dns.TypeA:
 			dnsEntry := answer.(*dns.A)
 			if ip := dnsEntry.A.To4(); ip != nil {
-				ips = append(ips, ip)
+				entries = append(entries, RouteEntry{IP: ip, TTL: dnsEntry.Hdr.Ttl})
 			}
-			ttl = dnsEntry.Hdr.Ttl
 		case dns.TypeAAAA:
 			dnsEntry := answer.(*dns.AAAA)
 			if ip := dnsEntry.AAAA.To16(); ip != nil {
-				ips = append(ips, ip)
+				entries = append(entries, RouteEntry{IP: ip, TTL: dnsEntry.Hdr.Ttl})
+			}
+		case dns.TypeCNAME:
+			cnameChain = append(cnameChain, answer.(*dns.CNAME).Target)
+		case dns.TypeHTTPS:
+			if parser.allowsHints(dns.TypeHTTPS) {
+				entries = append(entries, svcbHintEntries(&answer.(*dns.HTTPS).SVCB)...)
+			}
+		case dns.TypeSVCB:
+			if parser.allowsHints(dns.TypeSVCB) {
+				entries = append(entries, svcbHintEntries(answer.(*dns.SVCB))...)
 			}
-			ttl = dnsEntry.Hdr.Ttl
 		}
 		// other DNS types can't contain IPs, so we skip them
 	}
 
-	if len(ips) > 0 {
-		parser.DGManager.AddRoutes(ips, ttl)
+	if parser.Options.AdditionalSection {
+		entries = append(entries, additionalSectionEntries(response)...)
+	}
+
+	if len(entries) > 0 {
+		query := parser.Query
+		if query == nil {
+			query = &QueryInfo{}
+		}
+		if query.Name == "" && len(response.Question) > 0 {
+			query.Name = response.Question[0].Name
+			query.QType = response.Question[0].Qtype
+		}
+		query.CNAMEChain = cnameChain
+
+		// Denied answers are still returned to the client, they just don't open the firewall
+		if parser.Options.DomainPolicy.Allows(query) {
+			if err := parser.DGManager.AddRoutes(query, entries); err != nil {
+				return parser.writeFirewallError(response, err)
+			}
+		} else {
+			log.Debugf("Not allowing answer for %s, as it's denied by the domain policy", query.Name)
+			domainPolicyDeniedTotal.Inc()
+		}
+	}
+
+	return parser.ResponseWriter.WriteMsg(response)
+}
+
+// Writes given response, whose addresses couldn't all be allowed, as configured by onFirewallError: unchanged (pass),
+// replaced with SERVFAIL (servfail), or without the addresses, that aren't allowed (strip). Both of the latter explain
+// the reason with an Extended DNS Error, if the client supports EDNS. Answers, that didn't fit into the full queue, are
+// replaced with SERVFAIL in queue overflow policy servfail, regardless of onFirewallError. The Extended DNS Error only
+// carries a fixed text, as the error might name internals like the table or the kernel's reply, so it's logged here.
+func (parser *ResponseParser) writeFirewallError(response *dns.Msg, err error) error {
+	action := parser.Options.OnFirewallError
+	if parser.Options.QueueOverflow == QueueOverflowServfail && errors.Is(err, errQueueFull) {
+		action = FirewallErrorServfail
+	}
+
+	if action == FirewallErrorServfail || action == FirewallErrorStrip {
+		// A full queue happens under load, so it's not worth a warning per answer
+		if errors.Is(err, errQueueFull) {
+			log.Debugf("Answering with onFirewallError %s, as the firewall couldn't be opened: %v", action, err)
+		} else {
+			log.Warningf("Answering with onFirewallError %s, as the firewall couldn't be opened: %v", action, err)
+		}
+	}
+
+	switch action {
+	case FirewallErrorServfail:
+		firewallErrorAnswersTotal.WithLabelValues(string(FirewallErrorServfail)).Inc()
+
+		servfail := new(dns.Msg)
+		servfail.SetRcode(response, dns.RcodeServerFailure)
+		servfail.Id = response.Id
+		servfail.RecursionAvailable = response.RecursionAvailable
+		if opt := response.IsEdns0(); opt != nil {
+			servfail.SetEdns0(opt.UDPSize(), opt.Do())
+		}
+		addExtendedError(servfail)
+
+		return parser.ResponseWriter.WriteMsg(servfail)
+
+	case FirewallErrorStrip:
+		firewallErrorAnswersTotal.WithLabelValues(string(FirewallErrorStrip)).Inc()
+
+		var allowErr *AllowError
+		if errors.As(err, &allowErr) {
+			stripEntries(response, allowErr.Entries)
+		}
+		addExtendedError(response)
 	}
 
 	return parser.ResponseWriter.WriteMsg(response)
 }
+
+// Adds an Extended DNS Error to given response, if it has an OPT record.
+func addExtendedError(response *dns.Msg) {
+	opt := response.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+		InfoCode:  dns.ExtendedErrorCodeOther,
+		ExtraText: pluginName + ": firewall update failed",
+	})
+}
+
+// Removes the A/AAAA records of the answer and additional section, and the address hints of HTTPS/SVCB records, whose
+// addresses are part of given entries.
+func stripEntries(response *dns.Msg, entries []RouteEntry) {
+	stripped := func(ip net.IP) bool {
+		for _, entry := range entries {
+			if entry.IP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	stripRecords := func(records []dns.RR) []dns.RR {
+		kept := records[:0]
+		for _, record := range records {
+			switch typedRecord := record.(type) {
+			case *dns.A:
+				if stripped(typedRecord.A) {
+					continue
+				}
+			case *dns.AAAA:
+				if stripped(typedRecord.AAAA) {
+					continue
+				}
+			case *dns.HTTPS:
+				stripHints(&typedRecord.SVCB, stripped)
+			case *dns.SVCB:
+				stripHints(typedRecord, stripped)
+			}
+			kept = append(kept, record)
+		}
+		return kept
+	}
+
+	response.Answer = stripRecords(response.Answer)
+	response.Extra = stripRecords(response.Extra)
+}
+
+// Removes the addresses, for which stripped returns true, from the ipv4hint and ipv6hint parameters of given record.
+// Parameters without any address left are removed completely.
+func stripHints(record *dns.SVCB, stripped func(ip net.IP) bool) {
+	keptValues := record.Value[:0]
+
+	for _, keyValue := range record.Value {
+		var hints *[]net.IP
+		switch hint := keyValue.(type) {
+		case *dns.SVCBIPv4Hint:
+			hints = &hint.Hint
+		case *dns.SVCBIPv6Hint:
+			hints = &hint.Hint
+		default:
+			keptValues = append(keptValues, keyValue)
+			continue
+		}
+
+		keptHints := (*hints)[:0]
+		for _, hintIP := range *hints {
+			if !stripped(hintIP) {
+				keptHints = append(keptHints, hintIP)
+			}
+		}
+		*hints = keptHints
+
+		if len(keptHints) > 0 {
+			keptValues = append(keptValues, keyValue)
+		}
+	}
+
+	record.Value = keptValues
+}
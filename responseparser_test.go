@@ -1,6 +1,7 @@
 package ipdestinationguard
 
 import (
+	"errors"
 	"net"
 	"testing"
 
@@ -9,17 +10,21 @@ import (
 
 // MockDestinationGuardManager is a mock implementation of DestinationGuardManager for testing
 type MockDestinationGuardManager struct {
-	capturedIPs []net.IP
-	capturedTTL uint32
-	callCount   int
+	capturedEntries []RouteEntry
+	capturedQuery   *QueryInfo
+	callCount       int
+	err             error // Returned by AddRoutes
 }
 
-func (m *MockDestinationGuardManager) AddRoutes(ips []net.IP, ttl uint32) {
-	m.capturedIPs = append(m.capturedIPs, ips...)
-	m.capturedTTL = ttl
+func (m *MockDestinationGuardManager) AddRoutes(query *QueryInfo, entries []RouteEntry) error {
+	m.capturedEntries = append(m.capturedEntries, entries...)
+	m.capturedQuery = query
 	m.callCount++
+	return m.err
 }
 
+func (m *MockDestinationGuardManager) Ready() bool { return true }
+
 // MockResponseWriter is a mock implementation of dns.ResponseWriter for testing
 type MockResponseWriter struct {
 	writtenMsg *dns.Msg
@@ -39,7 +44,7 @@ func TestWriteMsg_WithARecords(t *testing.T) {
 	// Setup
 	mockManager := &MockDestinationGuardManager{}
 	mockWriter := &MockResponseWriter{}
-	parser := NewResponseParser(mockWriter, mockManager)
+	parser := NewResponseParser(mockWriter, mockManager, nil, nil)
 
 	// Create DNS response with A record
 	msg := new(dns.Msg)
@@ -67,17 +72,17 @@ func TestWriteMsg_WithARecords(t *testing.T) {
 		t.Errorf("Expected AddRoutes to be called 1 time, got %d", mockManager.callCount)
 	}
 
-	if len(mockManager.capturedIPs) != 1 {
-		t.Fatalf("Expected 1 IP, got %d", len(mockManager.capturedIPs))
+	if len(mockManager.capturedEntries) != 1 {
+		t.Fatalf("Expected 1 IP, got %d", len(mockManager.capturedEntries))
 	}
 
 	expectedIP := net.ParseIP("192.168.1.1").To4()
-	if !mockManager.capturedIPs[0].Equal(expectedIP) {
-		t.Errorf("Expected IP %v, got %v", expectedIP, mockManager.capturedIPs[0])
+	if !mockManager.capturedEntries[0].IP.Equal(expectedIP) {
+		t.Errorf("Expected IP %v, got %v", expectedIP, mockManager.capturedEntries[0].IP)
 	}
 
-	if mockManager.capturedTTL != 300 {
-		t.Errorf("Expected TTL 300, got %d", mockManager.capturedTTL)
+	if mockManager.capturedEntries[0].TTL != 300 {
+		t.Errorf("Expected TTL 300, got %d", mockManager.capturedEntries[0].TTL)
 	}
 
 	if mockWriter.writtenMsg != msg {
@@ -89,7 +94,7 @@ func TestWriteMsg_WithAAAARecords(t *testing.T) {
 	// Setup
 	mockManager := &MockDestinationGuardManager{}
 	mockWriter := &MockResponseWriter{}
-	parser := NewResponseParser(mockWriter, mockManager)
+	parser := NewResponseParser(mockWriter, mockManager, nil, nil)
 
 	// Create DNS response with AAAA record
 	msg := new(dns.Msg)
@@ -117,17 +122,17 @@ func TestWriteMsg_WithAAAARecords(t *testing.T) {
 		t.Errorf("Expected AddRoutes to be called 1 time, got %d", mockManager.callCount)
 	}
 
-	if len(mockManager.capturedIPs) != 1 {
-		t.Fatalf("Expected 1 IP, got %d", len(mockManager.capturedIPs))
+	if len(mockManager.capturedEntries) != 1 {
+		t.Fatalf("Expected 1 IP, got %d", len(mockManager.capturedEntries))
 	}
 
 	expectedIP := net.ParseIP("2001:db8::1").To16()
-	if !mockManager.capturedIPs[0].Equal(expectedIP) {
-		t.Errorf("Expected IP %v, got %v", expectedIP, mockManager.capturedIPs[0])
+	if !mockManager.capturedEntries[0].IP.Equal(expectedIP) {
+		t.Errorf("Expected IP %v, got %v", expectedIP, mockManager.capturedEntries[0].IP)
 	}
 
-	if mockManager.capturedTTL != 600 {
-		t.Errorf("Expected TTL 600, got %d", mockManager.capturedTTL)
+	if mockManager.capturedEntries[0].TTL != 600 {
+		t.Errorf("Expected TTL 600, got %d", mockManager.capturedEntries[0].TTL)
 	}
 }
 
@@ -135,7 +140,7 @@ func TestWriteMsg_WithMixedAandAAAA(t *testing.T) {
 	// Setup
 	mockManager := &MockDestinationGuardManager{}
 	mockWriter := &MockResponseWriter{}
-	parser := NewResponseParser(mockWriter, mockManager)
+	parser := NewResponseParser(mockWriter, mockManager, nil, nil)
 
 	// Create DNS response with both A and AAAA records
 	msg := new(dns.Msg)
@@ -172,13 +177,17 @@ func TestWriteMsg_WithMixedAandAAAA(t *testing.T) {
 		t.Errorf("Expected AddRoutes to be called 1 time, got %d", mockManager.callCount)
 	}
 
-	if len(mockManager.capturedIPs) != 2 {
-		t.Fatalf("Expected 2 IPs, got %d", len(mockManager.capturedIPs))
+	if len(mockManager.capturedEntries) != 2 {
+		t.Fatalf("Expected 2 IPs, got %d", len(mockManager.capturedEntries))
+	}
+
+	// Each address keeps the TTL of its own record
+	if mockManager.capturedEntries[0].TTL != 300 {
+		t.Errorf("Expected TTL 300 (from A record), got %d", mockManager.capturedEntries[0].TTL)
 	}
 
-	// Note: TTL is taken from last record (AAAA in this case)
-	if mockManager.capturedTTL != 600 {
-		t.Errorf("Expected TTL 600 (from AAAA record), got %d", mockManager.capturedTTL)
+	if mockManager.capturedEntries[1].TTL != 600 {
+		t.Errorf("Expected TTL 600 (from AAAA record), got %d", mockManager.capturedEntries[1].TTL)
 	}
 }
 
@@ -186,7 +195,7 @@ func TestWriteMsg_WithMultipleARecords(t *testing.T) {
 	// Setup
 	mockManager := &MockDestinationGuardManager{}
 	mockWriter := &MockResponseWriter{}
-	parser := NewResponseParser(mockWriter, mockManager)
+	parser := NewResponseParser(mockWriter, mockManager, nil, nil)
 
 	// Create DNS response with multiple A records
 	msg := new(dns.Msg)
@@ -213,15 +222,15 @@ func TestWriteMsg_WithMultipleARecords(t *testing.T) {
 		t.Errorf("Unexpected error: %v", err)
 	}
 
-	if len(mockManager.capturedIPs) != 3 {
-		t.Fatalf("Expected 3 IPs, got %d", len(mockManager.capturedIPs))
+	if len(mockManager.capturedEntries) != 3 {
+		t.Fatalf("Expected 3 IPs, got %d", len(mockManager.capturedEntries))
 	}
 
 	expectedIPs := []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}
 	for i, expectedIPStr := range expectedIPs {
 		expectedIP := net.ParseIP(expectedIPStr).To4()
-		if !mockManager.capturedIPs[i].Equal(expectedIP) {
-			t.Errorf("Expected IP[%d] %v, got %v", i, expectedIP, mockManager.capturedIPs[i])
+		if !mockManager.capturedEntries[i].IP.Equal(expectedIP) {
+			t.Errorf("Expected IP[%d] %v, got %v", i, expectedIP, mockManager.capturedEntries[i].IP)
 		}
 	}
 }
@@ -230,7 +239,7 @@ func TestWriteMsg_WithNoAnswers(t *testing.T) {
 	// Setup
 	mockManager := &MockDestinationGuardManager{}
 	mockWriter := &MockResponseWriter{}
-	parser := NewResponseParser(mockWriter, mockManager)
+	parser := NewResponseParser(mockWriter, mockManager, nil, nil)
 
 	// Create DNS response with no answers
 	msg := new(dns.Msg)
@@ -248,8 +257,8 @@ func TestWriteMsg_WithNoAnswers(t *testing.T) {
 		t.Errorf("Expected AddRoutes to not be called, but was called %d times", mockManager.callCount)
 	}
 
-	if len(mockManager.capturedIPs) != 0 {
-		t.Errorf("Expected no IPs captured, got %d", len(mockManager.capturedIPs))
+	if len(mockManager.capturedEntries) != 0 {
+		t.Errorf("Expected no IPs captured, got %d", len(mockManager.capturedEntries))
 	}
 }
 
@@ -257,7 +266,7 @@ func TestWriteMsg_WithCNAMEOnly(t *testing.T) {
 	// Setup
 	mockManager := &MockDestinationGuardManager{}
 	mockWriter := &MockResponseWriter{}
-	parser := NewResponseParser(mockWriter, mockManager)
+	parser := NewResponseParser(mockWriter, mockManager, nil, nil)
 
 	// Create DNS response with only CNAME record (no A/AAAA)
 	msg := new(dns.Msg)
@@ -285,8 +294,8 @@ func TestWriteMsg_WithCNAMEOnly(t *testing.T) {
 		t.Errorf("Expected AddRoutes to not be called, but was called %d times", mockManager.callCount)
 	}
 
-	if len(mockManager.capturedIPs) != 0 {
-		t.Errorf("Expected no IPs captured from CNAME, got %d", len(mockManager.capturedIPs))
+	if len(mockManager.capturedEntries) != 0 {
+		t.Errorf("Expected no IPs captured from CNAME, got %d", len(mockManager.capturedEntries))
 	}
 }
 
@@ -294,7 +303,7 @@ func TestWriteMsg_WithMixedRecordTypes(t *testing.T) {
 	// Setup
 	mockManager := &MockDestinationGuardManager{}
 	mockWriter := &MockResponseWriter{}
-	parser := NewResponseParser(mockWriter, mockManager)
+	parser := NewResponseParser(mockWriter, mockManager, nil, nil)
 
 	// Create DNS response with A record, CNAME, and MX record
 	msg := new(dns.Msg)
@@ -323,13 +332,13 @@ func TestWriteMsg_WithMixedRecordTypes(t *testing.T) {
 	}
 
 	// Should only capture the A record, not CNAME or MX
-	if len(mockManager.capturedIPs) != 1 {
-		t.Fatalf("Expected 1 IP (from A record only), got %d", len(mockManager.capturedIPs))
+	if len(mockManager.capturedEntries) != 1 {
+		t.Fatalf("Expected 1 IP (from A record only), got %d", len(mockManager.capturedEntries))
 	}
 
 	expectedIP := net.ParseIP("192.168.1.1").To4()
-	if !mockManager.capturedIPs[0].Equal(expectedIP) {
-		t.Errorf("Expected IP %v, got %v", expectedIP, mockManager.capturedIPs[0])
+	if !mockManager.capturedEntries[0].IP.Equal(expectedIP) {
+		t.Errorf("Expected IP %v, got %v", expectedIP, mockManager.capturedEntries[0].IP)
 	}
 }
 
@@ -365,7 +374,7 @@ func TestWriteMsg_TTLHandling(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			mockManager := &MockDestinationGuardManager{}
 			mockWriter := &MockResponseWriter{}
-			parser := NewResponseParser(mockWriter, mockManager)
+			parser := NewResponseParser(mockWriter, mockManager, nil, nil)
 
 			msg := new(dns.Msg)
 			msg.Answer = []dns.RR{
@@ -386,8 +395,8 @@ func TestWriteMsg_TTLHandling(t *testing.T) {
 				t.Errorf("Unexpected error: %v", err)
 			}
 
-			if mockManager.capturedTTL != tt.expectedTTL {
-				t.Errorf("Expected TTL %d, got %d", tt.expectedTTL, mockManager.capturedTTL)
+			if mockManager.capturedEntries[0].TTL != tt.expectedTTL {
+				t.Errorf("Expected TTL %d, got %d", tt.expectedTTL, mockManager.capturedEntries[0].TTL)
 			}
 		})
 	}
@@ -397,7 +406,7 @@ func TestWriteMsg_NilAnswerSection(t *testing.T) {
 	// Setup
 	mockManager := &MockDestinationGuardManager{}
 	mockWriter := &MockResponseWriter{}
-	parser := NewResponseParser(mockWriter, mockManager)
+	parser := NewResponseParser(mockWriter, mockManager, nil, nil)
 
 	// Create DNS response with nil answer section
 	msg := new(dns.Msg)
@@ -421,8 +430,10 @@ func TestNewResponseParser(t *testing.T) {
 	mockManager := &MockDestinationGuardManager{}
 	mockWriter := &MockResponseWriter{}
 
+	query := &QueryInfo{Name: "example.com.", QType: dns.TypeA}
+
 	// Execute
-	parser := NewResponseParser(mockWriter, mockManager)
+	parser := NewResponseParser(mockWriter, mockManager, query, nil)
 
 	// Assert
 	if parser == nil {
@@ -436,4 +447,440 @@ func TestNewResponseParser(t *testing.T) {
 	if parser.DGManager != mockManager {
 		t.Error("DGManager not set correctly")
 	}
+
+	if parser.Query != query {
+		t.Error("Query not set correctly")
+	}
+}
+
+func TestWriteMsg_QueryInfo(t *testing.T) {
+	// Setup
+	mockManager := &MockDestinationGuardManager{}
+	mockWriter := &MockResponseWriter{}
+	clientAddr := &net.UDPAddr{IP: net.ParseIP("192.168.1.50"), Port: 53123}
+	query := &QueryInfo{Name: "www.example.com.", QType: dns.TypeA, Client: clientAddr, Zone: "."}
+	parser := NewResponseParser(mockWriter, mockManager, query, nil)
+
+	// Create DNS response with a CNAME chain leading to an A record
+	msg := new(dns.Msg)
+	msg.Answer = []dns.RR{
+		&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+			Target: "cdn.example.net.",
+		},
+		&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: "cdn.example.net.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: "edge.example.net.",
+		},
+		&dns.A{
+			Hdr: dns.RR_Header{Name: "edge.example.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 20},
+			A:   net.ParseIP("192.168.1.1"),
+		},
+	}
+
+	// Execute
+	err := parser.WriteMsg(msg)
+
+	// Assert
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if mockManager.capturedQuery == nil {
+		t.Fatal("Expected query info to be passed to AddRoutes")
+	}
+
+	if mockManager.capturedQuery.Name != "www.example.com." || mockManager.capturedQuery.QType != dns.TypeA {
+		t.Errorf("Unexpected query name/type: %s/%d", mockManager.capturedQuery.Name, mockManager.capturedQuery.QType)
+	}
+
+	if mockManager.capturedQuery.Client != clientAddr {
+		t.Errorf("Expected client %v, got %v", clientAddr, mockManager.capturedQuery.Client)
+	}
+
+	if mockManager.capturedQuery.Zone != "." {
+		t.Errorf("Expected zone '.', got '%s'", mockManager.capturedQuery.Zone)
+	}
+
+	expectedChain := []string{"cdn.example.net.", "edge.example.net."}
+	if len(mockManager.capturedQuery.CNAMEChain) != len(expectedChain) {
+		t.Fatalf("Expected CNAME chain %v, got %v", expectedChain, mockManager.capturedQuery.CNAMEChain)
+	}
+	for i, name := range expectedChain {
+		if mockManager.capturedQuery.CNAMEChain[i] != name {
+			t.Errorf("Expected CNAME chain %v, got %v", expectedChain, mockManager.capturedQuery.CNAMEChain)
+		}
+	}
+
+	if len(mockManager.capturedEntries) != 1 || mockManager.capturedEntries[0].TTL != 20 {
+		t.Errorf("Expected one entry with TTL 20, got %+v", mockManager.capturedEntries)
+	}
+}
+
+func TestWriteMsg_QueryInfoFromQuestion(t *testing.T) {
+	// Setup
+	mockManager := &MockDestinationGuardManager{}
+	mockWriter := &MockResponseWriter{}
+	parser := NewResponseParser(mockWriter, mockManager, nil, nil)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeAAAA)
+	msg.Answer = []dns.RR{
+		&dns.AAAA{
+			Hdr:  dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 600},
+			AAAA: net.ParseIP("2001:db8::1"),
+		},
+	}
+
+	// Execute
+	err := parser.WriteMsg(msg)
+
+	// Assert
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if mockManager.capturedQuery == nil || mockManager.capturedQuery.Name != "example.com." || mockManager.capturedQuery.QType != dns.TypeAAAA {
+		t.Errorf("Expected query info from the question section, got %+v", mockManager.capturedQuery)
+	}
+}
+
+func TestWriteMsg_SVCBHints(t *testing.T) {
+	hints := []dns.SVCBKeyValue{
+		&dns.SVCBAlpn{Alpn: []string{"h2", "h3"}},
+		&dns.SVCBIPv4Hint{Hint: []net.IP{net.ParseIP("192.168.1.1"), net.ParseIP("192.168.1.2")}},
+		&dns.SVCBIPv6Hint{Hint: []net.IP{net.ParseIP("2001:db8::1")}},
+	}
+
+	tests := []struct {
+		name            string
+		record          dns.RR
+		hintRecordTypes []uint16
+		expectedIPs     []string
+	}{
+		{
+			name: "HTTPS hints allowed",
+			record: &dns.HTTPS{SVCB: dns.SVCB{
+				Hdr:      dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeHTTPS, Class: dns.ClassINET, Ttl: 300},
+				Priority: 1,
+				Target:   ".",
+				Value:    hints,
+			}},
+			hintRecordTypes: []uint16{dns.TypeHTTPS, dns.TypeSVCB},
+			expectedIPs:     []string{"192.168.1.1", "192.168.1.2", "2001:db8::1"},
+		},
+		{
+			name: "SVCB hints allowed",
+			record: &dns.SVCB{
+				Hdr:      dns.RR_Header{Name: "_dns.example.com.", Rrtype: dns.TypeSVCB, Class: dns.ClassINET, Ttl: 300},
+				Priority: 1,
+				Target:   "dns.example.com.",
+				Value:    hints,
+			},
+			hintRecordTypes: []uint16{dns.TypeSVCB},
+			expectedIPs:     []string{"192.168.1.1", "192.168.1.2", "2001:db8::1"},
+		},
+		{
+			name: "HTTPS hints not allowed",
+			record: &dns.HTTPS{SVCB: dns.SVCB{
+				Hdr:      dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeHTTPS, Class: dns.ClassINET, Ttl: 300},
+				Priority: 1,
+				Target:   ".",
+				Value:    hints,
+			}},
+			hintRecordTypes: []uint16{dns.TypeSVCB},
+			expectedIPs:     nil,
+		},
+		{
+			name: "hints disabled",
+			record: &dns.SVCB{
+				Hdr:      dns.RR_Header{Name: "_dns.example.com.", Rrtype: dns.TypeSVCB, Class: dns.ClassINET, Ttl: 300},
+				Priority: 1,
+				Target:   "dns.example.com.",
+				Value:    hints,
+			},
+			hintRecordTypes: nil,
+			expectedIPs:     nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockManager := &MockDestinationGuardManager{}
+			mockWriter := &MockResponseWriter{}
+			parser := NewResponseParser(mockWriter, mockManager, nil, &ParserOptions{HintRecordTypes: tt.hintRecordTypes})
+
+			msg := new(dns.Msg)
+			msg.Answer = []dns.RR{tt.record}
+
+			err := parser.WriteMsg(msg)
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if len(mockManager.capturedEntries) != len(tt.expectedIPs) {
+				t.Fatalf("Expected %d IPs, got %d", len(tt.expectedIPs), len(mockManager.capturedEntries))
+			}
+
+			for i, expectedIPStr := range tt.expectedIPs {
+				if !mockManager.capturedEntries[i].IP.Equal(net.ParseIP(expectedIPStr)) {
+					t.Errorf("Expected IP[%d] %v, got %v", i, expectedIPStr, mockManager.capturedEntries[i].IP)
+				}
+
+				if mockManager.capturedEntries[i].TTL != 300 {
+					t.Errorf("Expected TTL 300, got %d", mockManager.capturedEntries[i].TTL)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteMsg_AdditionalSection(t *testing.T) {
+	srvAnswer := &dns.SRV{
+		Hdr:    dns.RR_Header{Name: "_xmpp._tcp.example.com.", Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 300},
+		Port:   5222,
+		Target: "xmpp.example.com.",
+	}
+	mxAnswer := &dns.MX{
+		Hdr:        dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: 300},
+		Preference: 10,
+		Mx:         "Mail.Example.com.",
+	}
+	targetGlue := &dns.A{
+		Hdr: dns.RR_Header{Name: "xmpp.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+		A:   net.ParseIP("192.168.1.1"),
+	}
+	mailGlue := &dns.AAAA{
+		Hdr:  dns.RR_Header{Name: "mail.example.com.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+		AAAA: net.ParseIP("2001:db8::25"),
+	}
+	unrelatedGlue := &dns.A{
+		Hdr: dns.RR_Header{Name: "evil.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("10.66.66.66"),
+	}
+
+	tests := []struct {
+		name              string
+		answer            []dns.RR
+		extra             []dns.RR
+		additionalSection bool
+		expectedIPs       []string
+	}{
+		{
+			name:              "SRV target glue allowed",
+			answer:            []dns.RR{srvAnswer},
+			extra:             []dns.RR{targetGlue, unrelatedGlue},
+			additionalSection: true,
+			expectedIPs:       []string{"192.168.1.1"},
+		},
+		{
+			name:              "MX target glue matched case insensitive",
+			answer:            []dns.RR{mxAnswer},
+			extra:             []dns.RR{mailGlue, targetGlue},
+			additionalSection: true,
+			expectedIPs:       []string{"2001:db8::25"},
+		},
+		{
+			name:              "unrelated glue only",
+			answer:            []dns.RR{srvAnswer},
+			extra:             []dns.RR{unrelatedGlue},
+			additionalSection: true,
+			expectedIPs:       nil,
+		},
+		{
+			name:              "glue without referencing answer",
+			answer:            nil,
+			extra:             []dns.RR{targetGlue},
+			additionalSection: true,
+			expectedIPs:       nil,
+		},
+		{
+			name:              "option disabled",
+			answer:            []dns.RR{srvAnswer},
+			extra:             []dns.RR{targetGlue},
+			additionalSection: false,
+			expectedIPs:       nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockManager := &MockDestinationGuardManager{}
+			mockWriter := &MockResponseWriter{}
+			parser := NewResponseParser(mockWriter, mockManager, nil, &ParserOptions{AdditionalSection: tt.additionalSection})
+
+			msg := new(dns.Msg)
+			msg.Answer = tt.answer
+			msg.Extra = tt.extra
+
+			err := parser.WriteMsg(msg)
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if len(mockManager.capturedEntries) != len(tt.expectedIPs) {
+				t.Fatalf("Expected %d IPs, got %d", len(tt.expectedIPs), len(mockManager.capturedEntries))
+			}
+
+			for i, expectedIPStr := range tt.expectedIPs {
+				if !mockManager.capturedEntries[i].IP.Equal(net.ParseIP(expectedIPStr)) {
+					t.Errorf("Expected IP[%d] %v, got %v", i, expectedIPStr, mockManager.capturedEntries[i].IP)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteMsg_DomainPolicy(t *testing.T) {
+	policy := testDomainPolicy(t, nil, []string{"ads.example"}, false)
+
+	tests := []struct {
+		name          string
+		queryName     string
+		expectedCalls int
+	}{
+		{name: "allowed name", queryName: "www.example.com.", expectedCalls: 1},
+		{name: "denied name", queryName: "tracker.ads.example.", expectedCalls: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockManager := &MockDestinationGuardManager{}
+			mockWriter := &MockResponseWriter{}
+			parser := NewResponseParser(mockWriter, mockManager, nil, &ParserOptions{DomainPolicy: policy})
+
+			msg := new(dns.Msg)
+			msg.SetQuestion(tt.queryName, dns.TypeA)
+			msg.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{Name: tt.queryName, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+					A:   net.ParseIP("192.0.2.1"),
+				},
+			}
+
+			err := parser.WriteMsg(msg)
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if mockManager.callCount != tt.expectedCalls {
+				t.Errorf("Expected AddRoutes to be called %d times, got %d", tt.expectedCalls, mockManager.callCount)
+			}
+
+			// Denied answers are still returned to the client
+			if mockWriter.writtenMsg != msg {
+				t.Error("Message was not written to underlying writer")
+			}
+		})
+	}
+}
+
+func TestWriteMsg_OnFirewallError(t *testing.T) {
+	allowErr := &AllowError{
+		Entries: []RouteEntry{{IP: net.ParseIP("192.0.2.1").To4(), TTL: 300}, {IP: net.ParseIP("192.0.2.3").To4(), TTL: 300}},
+		Err:     errors.New("no buffer space available"),
+	}
+
+	newResponse := func(edns bool) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.Response = true
+		msg.Answer = []dns.RR{
+			&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("192.0.2.1").To4()},
+			&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("192.0.2.2").To4()},
+			&dns.HTTPS{SVCB: dns.SVCB{
+				Hdr:      dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeHTTPS, Class: dns.ClassINET, Ttl: 300},
+				Priority: 1,
+				Target:   ".",
+				Value:    []dns.SVCBKeyValue{&dns.SVCBIPv4Hint{Hint: []net.IP{net.ParseIP("192.0.2.3").To4()}}},
+			}},
+		}
+		if edns {
+			msg.SetEdns0(1232, false)
+		}
+		return msg
+	}
+
+	tests := []struct {
+		name              string
+		action            FirewallErrorAction
+		edns              bool
+		expectedRcode     int
+		expectedAnswers   int
+		expectedHintCount int
+		expectedEDE       bool
+		queueOverflow     QueueOverflowPolicy
+		queueFull         bool
+	}{
+		{name: "pass", action: FirewallErrorPass, edns: true, expectedRcode: dns.RcodeSuccess, expectedAnswers: 3, expectedHintCount: 1},
+		{name: "pass by default", edns: true, expectedRcode: dns.RcodeSuccess, expectedAnswers: 3, expectedHintCount: 1},
+		{name: "servfail", action: FirewallErrorServfail, edns: true, expectedRcode: dns.RcodeServerFailure, expectedEDE: true},
+		{name: "servfail without EDNS", action: FirewallErrorServfail, expectedRcode: dns.RcodeServerFailure},
+		{name: "strip", action: FirewallErrorStrip, edns: true, expectedRcode: dns.RcodeSuccess, expectedAnswers: 2, expectedEDE: true},
+		{name: "full queue with overflow servfail", edns: true, queueOverflow: QueueOverflowServfail, queueFull: true, expectedRcode: dns.RcodeServerFailure, expectedEDE: true},
+		{name: "full queue with overflow drop", edns: true, queueOverflow: QueueOverflowDrop, queueFull: true, expectedRcode: dns.RcodeSuccess, expectedAnswers: 3, expectedHintCount: 1},
+		{name: "other error with overflow servfail", edns: true, queueOverflow: QueueOverflowServfail, expectedRcode: dns.RcodeSuccess, expectedAnswers: 3, expectedHintCount: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockManager := &MockDestinationGuardManager{err: allowErr}
+			if tt.queueFull {
+				mockManager.err = &AllowError{Entries: allowErr.Entries, Err: errQueueFull}
+			}
+			mockWriter := &MockResponseWriter{}
+			parser := NewResponseParser(mockWriter, mockManager, nil, &ParserOptions{
+				HintRecordTypes: []uint16{dns.TypeHTTPS},
+				OnFirewallError: tt.action,
+				QueueOverflow:   tt.queueOverflow,
+			})
+
+			msg := newResponse(tt.edns)
+			if err := parser.WriteMsg(msg); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			written := mockWriter.writtenMsg
+			if written == nil {
+				t.Fatal("Message was not written to underlying writer")
+			}
+			if written.Rcode != tt.expectedRcode {
+				t.Errorf("Expected rcode %s, got %s", dns.RcodeToString[tt.expectedRcode], dns.RcodeToString[written.Rcode])
+			}
+			if written.Id != msg.Id || len(written.Question) != 1 {
+				t.Errorf("Expected the reply to keep id and question, got %v", written)
+			}
+			if len(written.Answer) != tt.expectedAnswers {
+				t.Fatalf("Expected %d answers, got %v", tt.expectedAnswers, written.Answer)
+			}
+
+			for _, answer := range written.Answer {
+				if a, isA := answer.(*dns.A); isA && tt.action == FirewallErrorStrip && a.A.Equal(net.ParseIP("192.0.2.1")) {
+					t.Errorf("Expected the address, that couldn't be allowed, to be stripped")
+				}
+				if https, isHTTPS := answer.(*dns.HTTPS); isHTTPS && len(https.Value) != tt.expectedHintCount {
+					t.Errorf("Expected %d hints, got %v", tt.expectedHintCount, https.Value)
+				}
+			}
+
+			var ede *dns.EDNS0_EDE
+			if opt := written.IsEdns0(); opt != nil {
+				for _, option := range opt.Option {
+					if typedOption, isEDE := option.(*dns.EDNS0_EDE); isEDE {
+						ede = typedOption
+					}
+				}
+			}
+			if (ede != nil) != tt.expectedEDE {
+				t.Fatalf("Expected Extended DNS Error %v, got %v", tt.expectedEDE, ede)
+			}
+			// The reason is only logged, as it might name internals of the host
+			if ede != nil && ede.ExtraText != pluginName+": firewall update failed" {
+				t.Errorf("Expected a fixed text in the Extended DNS Error, got '%s'", ede.ExtraText)
+			}
+		})
+	}
 }
@@ -0,0 +1,160 @@
+package ipdestinationguard
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+)
+
+// Bounds of the exponential backoff, entries of a failed flush are retried with.
+const (
+	retryInitialBackoff = time.Second
+	retryMaxBackoff     = 30 * time.Second
+)
+
+// Maximum number of entries waiting for a retry. If more flushes fail, the oldest entries are dropped.
+const retryQueueLimit = 10000
+
+// Number of flushes failing in a row, after which the manager reports itself unhealthy right away, and reopens its
+// netlink connection.
+const flushFailureEscalation = 5
+
+// Paths writing to nftables, as used by the nftables_path_flush_errors_total metric.
+const (
+	flushPathPrepare = "prepare" // Creating or rebuilding the table
+	flushPathAdd     = "add"     // Adding the entries of DNS answers
+	flushPathRevoke  = "revoke"  // Revoking entries through the admin API
+	flushPathRepair  = "repair"  // Adding missing entries again, after drift was detected
+)
+
+// Opens a lasting nftables connection, and returns its underlying netlink socket as well.
+func openNetlink() (*nftables.Conn, *netlink.Conn, error) {
+	var netlinkConn *netlink.Conn
+
+	nlInterface, err := nftables.New(
+		nftables.AsLasting(),
+		nftables.WithSockOptions(func(conn *netlink.Conn) error {
+			netlinkConn = conn
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating nftables netlink interface: %w", err)
+	}
+
+	return nlInterface, netlinkConn, nil
+}
+
+// Flushes the queued nftables changes of given path, and records the result for the health status and the retry
+// backoff. This must only be called by the manager goroutine, or before it started.
+func (manager *NFTablesManager) flush(path string, now time.Time) error {
+	err := manager.nlInterface.Flush()
+	if err == nil {
+		manager.flushFailingSince.Store(0)
+		manager.flushFailures.Store(0)
+		manager.retryBackoff = 0
+		return nil
+	}
+
+	nftablesPathFlushErrorsTotal.WithLabelValues(path).Inc()
+	manager.flushFailingSince.CompareAndSwap(0, now.UnixNano())
+	if manager.flushFailures.Add(1) == flushFailureEscalation {
+		manager.escalateFlushFailures()
+	}
+
+	return err
+}
+
+// Reopens the netlink connection, as a broken socket (like after it ran out of buffer space) doesn't recover on its
+// own. The socket of an owned table can't be replaced, as the kernel would remove the table with it.
+func (manager *NFTablesManager) escalateFlushFailures() {
+	log.Errorf("Writing to NFTables failed %d times in a row, reporting not ready until it succeeds again", flushFailureEscalation)
+
+	if manager.ownedTable || manager.openNetlink == nil {
+		return
+	}
+
+	nlInterface, netlinkConn, err := manager.openNetlink()
+	if err != nil {
+		log.Errorf("Reopening the netlink connection failed: %v", err)
+		return
+	}
+
+	if err := manager.nlInterface.CloseLasting(); err != nil {
+		log.Warningf("Closing the previous netlink connection failed: %v", err)
+	}
+	manager.nlInterface, manager.netlinkConn = nlInterface, netlinkConn
+	netlinkReopensTotal.Inc()
+	log.Warningf("Reopened the netlink connection")
+}
+
+// Returns the delay of the next retry, doubling the delay of the last one up to retryMaxBackoff.
+func (manager *NFTablesManager) nextRetryBackoff() time.Duration {
+	if manager.retryBackoff == 0 {
+		return retryInitialBackoff
+	}
+
+	return min(2*manager.retryBackoff, retryMaxBackoff)
+}
+
+// Queues given routes, whose flush failed, for a retry, and schedules it, if it isn't yet. This must only be called by
+// the manager goroutine.
+func (manager *NFTablesManager) queueRetry(routes []*allowRoute) {
+	manager.retryQueue = append(manager.retryQueue, routes...)
+	retryQueueEntries.Add(float64(len(routes)))
+
+	if overflow := len(manager.retryQueue) - retryQueueLimit; overflow > 0 {
+		for _, droppedRoute := range manager.retryQueue[:overflow] {
+			manager.allowRoutePool.Put(droppedRoute)
+		}
+		manager.retryQueue = append([]*allowRoute(nil), manager.retryQueue[overflow:]...)
+
+		log.Warningf("Dropped %d entries waiting for a retry, as more than %d are waiting", overflow, retryQueueLimit)
+		retryQueueEntries.Sub(float64(overflow))
+		retryDroppedEntriesTotal.Add(float64(overflow))
+	}
+
+	if manager.retryTimer == nil {
+		manager.retryBackoff = manager.nextRetryBackoff()
+		manager.retryTimer = time.NewTimer(manager.retryBackoff)
+	}
+}
+
+// Returns the channel of the scheduled retry, or nil, which never fires, if none is scheduled.
+func (manager *NFTablesManager) retryChannel() <-chan time.Time {
+	if manager.retryTimer == nil {
+		return nil
+	}
+
+	return manager.retryTimer.C
+}
+
+// Adds the queued routes again. Routes, that expire in the meantime, are dropped. If the flush fails again, the routes
+// get queued with a longer backoff. This must only be called by the manager goroutine.
+func (manager *NFTablesManager) retryQueuedRoutes(now time.Time) {
+	routes := manager.retryQueue
+	manager.retryQueue = nil
+	manager.retryTimer = nil
+	retryQueueEntries.Sub(float64(len(routes)))
+
+	validRoutes := routes[:0]
+	for _, route := range routes {
+		if route.validUnitl.After(now.Add(refreshSafetyMargin)) {
+			validRoutes = append(validRoutes, route)
+			continue
+		}
+
+		retryDroppedEntriesTotal.Inc()
+		manager.allowRoutePool.Put(route)
+	}
+
+	if len(validRoutes) == 0 {
+		return
+	}
+
+	if err := manager.allowRoutes(validRoutes, now); err == nil {
+		log.Infof("Retried writing %d entries to NFTables successfully", len(validRoutes))
+	}
+}
@@ -0,0 +1,146 @@
+package ipdestinationguard
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+)
+
+// Returns a test connection, whose flushes fail while failing is set.
+func newFailingTestConn(t *testing.T, failing *atomic.Bool) *nftables.Conn {
+	t.Helper()
+
+	nlInterface, err := nftables.New(nftables.WithTestDial(func(req []netlink.Message) ([]netlink.Message, error) {
+		if failing.Load() {
+			return nil, errors.New("no buffer space available")
+		}
+		return req, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return nlInterface
+}
+
+func TestRetryFailedFlush(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+
+	manager := newStoppedTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+	manager.nlInterface = newFailingTestConn(t, &failing)
+
+	reopenCount := 0
+	manager.openNetlink = func() (*nftables.Conn, *netlink.Conn, error) {
+		reopenCount++
+		return newFailingTestConn(t, &failing), nil, nil
+	}
+
+	now := time.Now()
+	route := &allowRoute{ipAddress: net.ParseIP("192.0.2.1").To4(), validUnitl: now.Add(time.Hour), domain: "example.com."}
+	if err := manager.allowRoutes([]*allowRoute{route}, now); err == nil {
+		t.Fatal("Expected the flush to fail")
+	}
+
+	if len(manager.allowList) != 0 {
+		t.Errorf("Expected the failed entry to be removed from the allowList, got %v", manager.allowList)
+	}
+	if len(manager.retryQueue) != 1 || manager.retryTimer == nil {
+		t.Fatalf("Expected the entry to be queued for a retry, got %v", manager.retryQueue)
+	}
+
+	// The backoff doubles up to its maximum, while the flushes keep failing
+	expectedBackoffs := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second}
+	for i, expectedBackoff := range expectedBackoffs {
+		if manager.retryBackoff != expectedBackoff {
+			t.Errorf("Expected backoff %v after %d failures, got %v", expectedBackoff, i+1, manager.retryBackoff)
+		}
+		manager.retryQueuedRoutes(now)
+	}
+
+	if reopenCount != 1 {
+		t.Errorf("Expected the netlink connection to be reopened once, got %d", reopenCount)
+	}
+	if health := manager.Health(now); len(health.Problems) != 2 {
+		// The manager goroutine is stopped, so it reports that as well
+		t.Errorf("Expected the failing flushes to be reported, got %+v", health)
+	}
+
+	failing.Store(false)
+	manager.retryQueuedRoutes(now)
+
+	if _, exists := manager.allowList[route.key()]; !exists {
+		t.Errorf("Expected the retried entry in the allowList, got %v", manager.allowList)
+	}
+	if len(manager.retryQueue) != 0 || manager.retryTimer != nil || manager.retryBackoff != 0 {
+		t.Errorf("Expected the retry to finish, got %d queued entries and backoff %v", len(manager.retryQueue), manager.retryBackoff)
+	}
+	if manager.flushFailures.Load() != 0 || manager.flushFailingSince.Load() != 0 {
+		t.Error("Expected the successful flush to reset the failures")
+	}
+}
+
+func TestRetryFailedRefresh(t *testing.T) {
+	var failing atomic.Bool
+
+	manager := newStoppedTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+	manager.nlInterface = newFailingTestConn(t, &failing)
+
+	now := time.Now()
+	ip := net.ParseIP("192.0.2.1").To4()
+	if err := manager.allowRoutes([]*allowRoute{{ipAddress: ip, validUnitl: now.Add(time.Minute)}}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	failing.Store(true)
+	if err := manager.allowRoutes([]*allowRoute{{ipAddress: ip, validUnitl: now.Add(time.Hour)}}, now); err == nil {
+		t.Fatal("Expected the flush to fail")
+	}
+
+	// The kernel still has the old timeout, so the entry keeps it until the retry succeeds
+	if validUntil := manager.allowList[newRouteKey("", ip)].validUnitl; !validUntil.Equal(now.Add(time.Minute)) {
+		t.Errorf("Expected the entry to keep its expiry, got %v", validUntil)
+	}
+
+	failing.Store(false)
+	manager.retryQueuedRoutes(now)
+
+	if validUntil := manager.allowList[newRouteKey("", ip)].validUnitl; !validUntil.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expected the retry to extend the entry, got %v", validUntil)
+	}
+}
+
+func TestRetryDropsExpiredRoutes(t *testing.T) {
+	manager := newStoppedTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+
+	now := time.Now()
+	manager.queueRetry([]*allowRoute{{ipAddress: net.ParseIP("192.0.2.1").To4(), validUnitl: now.Add(time.Second)}})
+	manager.retryQueuedRoutes(now)
+
+	if len(manager.allowList) != 0 || len(manager.retryQueue) != 0 {
+		t.Errorf("Expected the expired entry to be dropped, got %v and %v", manager.allowList, manager.retryQueue)
+	}
+}
+
+func TestRetryQueueLimit(t *testing.T) {
+	manager := newStoppedTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+
+	validUntil := time.Now().Add(time.Hour)
+	routes := make([]*allowRoute, retryQueueLimit+5)
+	for i := range routes {
+		routes[i] = &allowRoute{ipAddress: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).To4(), validUnitl: validUntil}
+	}
+	manager.queueRetry(routes)
+
+	if len(manager.retryQueue) != retryQueueLimit {
+		t.Fatalf("Expected %d queued entries, got %d", retryQueueLimit, len(manager.retryQueue))
+	}
+	if !manager.retryQueue[0].ipAddress.Equal(routes[5].ipAddress) {
+		t.Errorf("Expected the oldest entries to be dropped, got %v first", manager.retryQueue[0].ipAddress)
+	}
+}
@@ -0,0 +1,219 @@
+package ipdestinationguard
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Name of the nftables table managed by this plugin.
+const tableName = "coredns-ip-destination-guard"
+
+// Rate and burst of the kernel log of traffic, that would be rejected (enforcement monitor), in packets per second.
+const (
+	monitorLogRate  = 10
+	monitorLogBurst = 5
+)
+
+// Returns the name of the counter object of given chain, that counts the traffic it would reject (enforcement monitor).
+func wouldRejectCounterName(chainName string) string {
+	return chainName + "_would_reject"
+}
+
+// Returns the chains created for given mode, in the order prepareNFTables creates them.
+func chainsForMode(mode Mode) []string {
+	switch mode {
+	case ModeNFTLocal:
+		return []string{"output"}
+	case ModeNFTGateway:
+		return []string{"forward"}
+	case ModeNFTBoth:
+		return []string{"output", "forward"}
+	}
+
+	return nil
+}
+
+// Returns the ruleset prepareNFTables creates for given config in nft syntax, to be read by humans or "nft -f".
+// Dynamic set elements aren't part of it, as they only exist at runtime.
+func renderRuleset(config *parsedConfig) string {
+	return renderTable(config, true)
+}
+
+// Returns the ruleset of given config in nft syntax. Without cgroupElements, the static cgroup sets are left empty, as
+// nft resolves their cgroup paths on load, which fails for units that didn't start yet.
+func renderTable(config *parsedConfig, cgroupElements bool) string {
+	var builder strings.Builder
+
+	fmt.Fprintf(&builder, "table inet %s {\n", tableName)
+	builder.WriteString("\tset ipv4allowlist {\n\t\ttype ipv4_addr\n\t\tflags dynamic,timeout\n\t}\n\n")
+	builder.WriteString("\tset ipv6allowlist {\n\t\ttype ipv6_addr\n\t\tflags dynamic,timeout\n\t}\n\n")
+
+	scopeType, scopeSetName := scopeSetNaming(config.scope)
+	if scopeType != "" {
+		for _, family := range []string{"ipv4", "ipv6"} {
+			keyType := scopeType
+			if keyType == "ip_addr" {
+				keyType = family + "_addr"
+			}
+			fmt.Fprintf(&builder, "\tset %s%sallowlist {\n\t\ttype %s . %s_addr\n\t\tflags dynamic,timeout\n\t}\n\n", family, scopeSetName, keyType, family)
+		}
+	}
+
+	if config.scope == ScopeCgroup {
+		for _, family := range []string{"ipv4", "ipv6"} {
+			fmt.Fprintf(&builder, "\tset %scgroupstaticallowlist {\n\t\ttype cgroupsv2 . %s_addr\n\t\tflags interval\n", family, family)
+
+			var elements []string
+			for _, allowance := range config.allowedCgroupIPs {
+				for _, ipRange := range renderIPRanges(allowance.allowedIPs, family == "ipv6") {
+					elements = append(elements, fmt.Sprintf("%q . %s", allowance.path, ipRange))
+				}
+			}
+			if cgroupElements && len(elements) > 0 {
+				fmt.Fprintf(&builder, "\t\telements = { %s }\n", strings.Join(elements, ",\n\t\t\t     "))
+			}
+			builder.WriteString("\t}\n\n")
+		}
+	}
+
+	if config.enforcement == EnforcementMonitor {
+		for _, chainName := range chainsForMode(config.mode) {
+			fmt.Fprintf(&builder, "\tcounter %s {\n\t}\n\n", wouldRejectCounterName(chainName))
+		}
+	}
+
+	for i, chainName := range chainsForMode(config.mode) {
+		if i > 0 {
+			builder.WriteString("\n")
+		}
+		renderChain(&builder, chainName, config)
+	}
+
+	builder.WriteString("}\n")
+
+	return builder.String()
+}
+
+// Returns a standalone "nft -f" script, that creates the ruleset of given config with empty dynamic sets. Loaded at boot
+// (like by nftables.service), the host is guarded until CoreDNS starts, which takes the table over and keeps its sets.
+// The static cgroup sets stay empty, as their cgroups usually don't exist that early, and a single missing one would
+// fail the whole script. prepareCgroupAllowSets fills them on start.
+func renderBootScript(config *parsedConfig) string {
+	var builder strings.Builder
+
+	builder.WriteString("#!/usr/sbin/nft -f\n")
+	fmt.Fprintf(&builder, "# Default-deny ruleset of %s, to be loaded at boot before CoreDNS starts.\n", pluginName)
+	builder.WriteString("# Regenerate it, whenever the configuration of the plugin changes.\n")
+	if config.ownedTable {
+		builder.WriteString("# ownedTable is set, so CoreDNS replaces this table with one it owns on start.\n")
+	}
+	builder.WriteString("\n")
+
+	// Creating the table first makes flushing it work on the first load as well
+	fmt.Fprintf(&builder, "add table inet %s\n", tableName)
+	fmt.Fprintf(&builder, "flush table inet %s\n\n", tableName)
+	builder.WriteString(renderTable(config, false))
+
+	return builder.String()
+}
+
+// Returns the nft type of the scope part of the scoped set keys, and the infix of their names.
+// For the client scope, "ip_addr" stands for the address type of the set's family.
+func scopeSetNaming(scope Scope) (string, string) {
+	switch scope {
+	case ScopeClient:
+		return "ip_addr", "client"
+	case ScopeUser:
+		return "uid", "user"
+	case ScopeCgroup:
+		return "cgroupsv2", "cgroup"
+	}
+
+	return "", ""
+}
+
+// Writes the chain with given name, like addChainRules creates it, to given builder.
+func renderChain(builder *strings.Builder, chainName string, config *parsedConfig) {
+	fmt.Fprintf(builder, "\tchain %s {\n", chainName)
+	fmt.Fprintf(builder, "\t\ttype filter hook %s priority filter; policy drop;\n\n", chainName)
+	builder.WriteString("\t\tct state invalid drop\n")
+	builder.WriteString("\t\tct state established,related accept\n")
+	builder.WriteString("\t\toif \"lo\" accept\n")
+	builder.WriteString("\t\tmeta l4proto ipv6-icmp icmpv6 type { nd-router-solicit, nd-router-advert, nd-neighbor-solicit, nd-neighbor-advert } accept\n")
+
+	permanentIPs := append([]net.IP{}, config.allowedIPs...)
+	if chainName == "output" {
+		permanentIPs = append(permanentIPs, config.allowedLocalIPs...)
+	} else {
+		permanentIPs = append(permanentIPs, config.allowedGatewayIPs...)
+	}
+
+	if ranges := renderIPRanges(permanentIPs, false); len(ranges) > 0 {
+		fmt.Fprintf(builder, "\t\tmeta nfproto ipv4 ip daddr { %s } accept\n", strings.Join(ranges, ", "))
+	}
+	if ranges := renderIPRanges(permanentIPs, true); len(ranges) > 0 {
+		fmt.Fprintf(builder, "\t\tmeta nfproto ipv6 ip6 daddr { %s } accept\n", strings.Join(ranges, ", "))
+	}
+
+	scoped := (chainName == "forward" && config.scope == ScopeClient) ||
+		(chainName == "output" && (config.scope == ScopeUser || config.scope == ScopeCgroup))
+
+	if chainName == "output" && config.scope == ScopeCgroup {
+		fmt.Fprintf(builder, "\t\tmeta nfproto ipv4 socket cgroupv2 level %d . ip daddr @ipv4cgroupstaticallowlist accept\n", config.cgroupLevel)
+		fmt.Fprintf(builder, "\t\tmeta nfproto ipv6 socket cgroupv2 level %d . ip6 daddr @ipv6cgroupstaticallowlist accept\n", config.cgroupLevel)
+	}
+
+	if scoped {
+		_, scopeSetName := scopeSetNaming(config.scope)
+		ipv4Key, ipv6Key := "ip saddr", "ip6 saddr"
+		switch config.scope {
+		case ScopeUser:
+			ipv4Key, ipv6Key = "meta skuid", "meta skuid"
+		case ScopeCgroup:
+			ipv4Key = fmt.Sprintf("socket cgroupv2 level %d", config.cgroupLevel)
+			ipv6Key = ipv4Key
+		}
+		fmt.Fprintf(builder, "\t\tmeta nfproto ipv4 %s . ip daddr @ipv4%sallowlist accept\n", ipv4Key, scopeSetName)
+		fmt.Fprintf(builder, "\t\tmeta nfproto ipv6 %s . ip6 daddr @ipv6%sallowlist accept\n", ipv6Key, scopeSetName)
+	} else {
+		builder.WriteString("\t\tmeta nfproto ipv4 ip daddr @ipv4allowlist accept\n")
+		builder.WriteString("\t\tmeta nfproto ipv6 ip6 daddr @ipv6allowlist accept\n")
+	}
+
+	prefix := rejectLogPrefix(chainName, config.enforcement)
+	switch {
+	case config.enforcement == EnforcementMonitor && config.nflogGroup != 0:
+		fmt.Fprintf(builder, "\t\tcounter name %q log prefix %q group %d\n", wouldRejectCounterName(chainName), prefix, config.nflogGroup)
+		builder.WriteString("\t\taccept\n")
+	case config.enforcement == EnforcementMonitor:
+		fmt.Fprintf(builder, "\t\tcounter name %q limit rate %d/second burst %d packets log prefix %q level warn\n",
+			wouldRejectCounterName(chainName), monitorLogRate, monitorLogBurst, prefix)
+		builder.WriteString("\t\taccept\n")
+	case config.nflogGroup != 0:
+		fmt.Fprintf(builder, "\t\tlog prefix %q group %d reject with icmpx admin-prohibited\n", prefix, config.nflogGroup)
+	default:
+		builder.WriteString("\t\treject with icmpx admin-prohibited\n")
+	}
+	builder.WriteString("\t}\n")
+}
+
+// Returns the ranges of given start and end pairs (like parsedConfig.allowedIPs) of one address family in nft syntax.
+func renderIPRanges(ips []net.IP, ipv6 bool) []string {
+	var ranges []string
+
+	for i := 0; i+1 < len(ips); i += 2 {
+		if (len(ips[i]) == net.IPv6len) != ipv6 {
+			continue
+		}
+
+		start, last := ips[i], previousIP(ips[i+1])
+		if start.Equal(last) {
+			ranges = append(ranges, start.String())
+		} else {
+			ranges = append(ranges, start.String()+"-"+last.String())
+		}
+	}
+
+	return ranges
+}
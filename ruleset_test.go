@@ -0,0 +1,219 @@
+package ipdestinationguard
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderRuleset(t *testing.T) {
+	cgroupConfig := testAdminConfig(t, ScopeCgroup)
+	cgroupConfig.mode = ModeNFTLocal
+	cgroupConfig.cgroupLevel = 2
+	startIP, endIP, err := getIPRange("203.0.113.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cgroupConfig.allowedCgroupIPs = []cgroupAllowance{{path: "system.slice/backup.service", allowedIPs: []net.IP{startIP, endIP}}}
+
+	monitorConfig := testAdminConfig(t, ScopeGlobal)
+	monitorConfig.enforcement = EnforcementMonitor
+
+	nflogConfig := testAdminConfig(t, ScopeGlobal)
+	nflogConfig.nflogGroup = 100
+
+	nflogMonitorConfig := testAdminConfig(t, ScopeGlobal)
+	nflogMonitorConfig.enforcement = EnforcementMonitor
+	nflogMonitorConfig.nflogGroup = 100
+
+	tests := []struct {
+		name          string
+		config        *parsedConfig
+		expected      []string
+		notExpected   []string
+		expectedCount map[string]int
+	}{
+		{
+			name:   "global scope in mode nft-both",
+			config: testAdminConfig(t, ScopeGlobal),
+			expected: []string{
+				"table inet coredns-ip-destination-guard {",
+				"set ipv4allowlist {",
+				"chain output {",
+				"chain forward {",
+				"ip daddr { 9.9.9.9, 10.88.0.0-10.88.255.255 } accept",
+				"ip daddr { 9.9.9.9, 192.168.100.0-192.168.100.255 } accept",
+				"ip daddr @ipv4allowlist accept",
+				"ip6 daddr @ipv6allowlist accept",
+			},
+			notExpected:   []string{"clientallowlist", "ip6 daddr {"},
+			expectedCount: map[string]int{"reject with icmpx admin-prohibited": 2},
+		},
+		{
+			name:   "client scope uses the scoped sets in the forward chain only",
+			config: testAdminConfig(t, ScopeClient),
+			expected: []string{
+				"set ipv4clientallowlist {\n\t\ttype ipv4_addr . ipv4_addr",
+				"set ipv6clientallowlist {\n\t\ttype ipv6_addr . ipv6_addr",
+				"ip saddr . ip daddr @ipv4clientallowlist accept",
+				"ip6 saddr . ip6 daddr @ipv6clientallowlist accept",
+			},
+			expectedCount: map[string]int{"ip daddr @ipv4allowlist accept": 1},
+		},
+		{
+			name:   "user scope uses the scoped sets in the output chain only",
+			config: testAdminConfig(t, ScopeUser),
+			expected: []string{
+				"type uid . ipv4_addr",
+				"meta skuid . ip daddr @ipv4userallowlist accept",
+				"meta skuid . ip6 daddr @ipv6userallowlist accept",
+			},
+			expectedCount: map[string]int{"ip daddr @ipv4allowlist accept": 1},
+		},
+		{
+			name:   "cgroup scope with static allowlist",
+			config: cgroupConfig,
+			expected: []string{
+				"type cgroupsv2 . ipv4_addr",
+				`elements = { "system.slice/backup.service" . 203.0.113.0-203.0.113.255 }`,
+				"socket cgroupv2 level 2 . ip daddr @ipv4cgroupstaticallowlist accept",
+				"socket cgroupv2 level 2 . ip daddr @ipv4cgroupallowlist accept",
+			},
+			notExpected: []string{"chain forward", "@ipv4allowlist"},
+		},
+		{
+			name:   "enforcement monitor counts, logs and accepts instead of rejecting",
+			config: monitorConfig,
+			expected: []string{
+				"counter output_would_reject {",
+				"counter forward_would_reject {",
+				`counter name "output_would_reject" limit rate 10/second burst 5 packets log prefix "ipdestinationguard would reject (output): " level warn`,
+				`counter name "forward_would_reject" limit rate 10/second burst 5 packets log prefix "ipdestinationguard would reject (forward): " level warn`,
+			},
+			notExpected:   []string{"reject with"},
+			expectedCount: map[string]int{"\t\taccept\n": 2},
+		},
+		{
+			name:   "nflogGroup logs rejected packets to the group",
+			config: nflogConfig,
+			expected: []string{
+				`log prefix "ipdestinationguard reject (output): " group 100 reject with icmpx admin-prohibited`,
+				`log prefix "ipdestinationguard reject (forward): " group 100 reject with icmpx admin-prohibited`,
+			},
+		},
+		{
+			name:   "nflogGroup replaces the kernel log of enforcement monitor",
+			config: nflogMonitorConfig,
+			expected: []string{
+				`counter name "output_would_reject" log prefix "ipdestinationguard would reject (output): " group 100`,
+			},
+			notExpected: []string{"limit rate", "reject with"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ruleset := renderRuleset(tt.config)
+
+			for _, expected := range tt.expected {
+				if !strings.Contains(ruleset, expected) {
+					t.Errorf("Expected ruleset to contain %q, got:\n%s", expected, ruleset)
+				}
+			}
+
+			for _, notExpected := range tt.notExpected {
+				if strings.Contains(ruleset, notExpected) {
+					t.Errorf("Expected ruleset not to contain %q, got:\n%s", notExpected, ruleset)
+				}
+			}
+
+			for expected, count := range tt.expectedCount {
+				if actualCount := strings.Count(ruleset, expected); actualCount != count {
+					t.Errorf("Expected ruleset to contain %q %d times, got %d times:\n%s", expected, count, actualCount, ruleset)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderBootScript(t *testing.T) {
+	tests := []struct {
+		name        string
+		ownedTable  bool
+		cgroup      bool
+		expected    []string
+		notExpected []string
+	}{
+		{
+			name: "default",
+			expected: []string{
+				"#!/usr/sbin/nft -f\n",
+				"add table inet coredns-ip-destination-guard\nflush table inet coredns-ip-destination-guard\n\ntable inet coredns-ip-destination-guard {\n",
+			},
+			notExpected: []string{"ownedTable"},
+		},
+		{
+			name:       "owned table",
+			ownedTable: true,
+			expected:   []string{"# ownedTable is set, so CoreDNS replaces this table"},
+		},
+		{
+			name:        "cgroup sets stay empty, as their cgroups might not exist at boot",
+			cgroup:      true,
+			expected:    []string{"set ipv4cgroupstaticallowlist {\n\t\ttype cgroupsv2 . ipv4_addr\n\t\tflags interval\n\t}"},
+			notExpected: []string{"elements", "system.slice/backup.service"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testAdminConfig(t, ScopeGlobal)
+			config.ownedTable = tt.ownedTable
+			if tt.cgroup {
+				config = testAdminConfig(t, ScopeCgroup)
+				startIP, endIP, err := getIPRange("203.0.113.0/24")
+				if err != nil {
+					t.Fatal(err)
+				}
+				config.allowedCgroupIPs = []cgroupAllowance{{path: "system.slice/backup.service", allowedIPs: []net.IP{startIP, endIP}}}
+			}
+
+			script := renderBootScript(config)
+
+			// Apart from the static cgroup elements, the script contains the ruleset of the plugin unchanged
+			if !tt.cgroup && !strings.HasSuffix(script, renderRuleset(config)) {
+				t.Errorf("Expected the script to end with the ruleset, got:\n%s", script)
+			}
+			for _, expected := range tt.expected {
+				if !strings.Contains(script, expected) {
+					t.Errorf("Expected script to contain %q, got:\n%s", expected, script)
+				}
+			}
+			for _, notExpected := range tt.notExpected {
+				if strings.Contains(script, notExpected) {
+					t.Errorf("Expected script not to contain %q, got:\n%s", notExpected, script)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderIPRanges(t *testing.T) {
+	var ips []net.IP
+	for _, cidr := range []string{"9.9.9.9", "10.0.0.0/8", "2001:db8::/32"} {
+		startIP, endIP, err := getIPRange(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ips = append(ips, startIP, endIP)
+	}
+
+	if ranges := renderIPRanges(ips, false); !reflect.DeepEqual(ranges, []string{"9.9.9.9", "10.0.0.0-10.255.255.255"}) {
+		t.Errorf("Unexpected ipv4 ranges %v", ranges)
+	}
+
+	if ranges := renderIPRanges(ips, true); !reflect.DeepEqual(ranges, []string{"2001:db8::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"}) {
+		t.Errorf("Unexpected ipv6 ranges %v", ranges)
+	}
+}
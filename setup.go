@@ -4,11 +4,17 @@ import (
 	"fmt"
 	"math/big"
 	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
+
+	"github.com/miekg/dns"
 )
 
 // Mode represents the operation mode of this plugin.
@@ -23,16 +29,112 @@ const (
 	ModeNFTBoth    Mode = "nft-both"
 )
 
+// Scope represents, who may reach the destinations of a DNS answer.
+type Scope string
+
+// Valid scope constants
+const (
+	ScopeGlobal Scope = "global"
+	ScopeClient Scope = "client"
+	ScopeUser   Scope = "user"
+	ScopeCgroup Scope = "cgroup"
+)
+
+// CommitMode represents how DNS answers wait for their firewall entries.
+type CommitMode string
+
+// Valid commit mode constants
+const (
+	CommitModeAsync CommitMode = "async"
+	CommitModeSync  CommitMode = "sync"
+)
+
+// FirewallErrorAction represents what happens to a DNS answer, whose addresses couldn't be allowed.
+type FirewallErrorAction string
+
+// Valid firewall error action constants
+const (
+	FirewallErrorPass     FirewallErrorAction = "pass"
+	FirewallErrorServfail FirewallErrorAction = "servfail"
+	FirewallErrorStrip    FirewallErrorAction = "strip"
+)
+
+// QueueOverflowPolicy represents what happens to a DNS answer, whose addresses don't fit into the full queue.
+type QueueOverflowPolicy string
+
+// Valid queue overflow policy constants
+const (
+	QueueOverflowBlock    QueueOverflowPolicy = "block"
+	QueueOverflowDrop     QueueOverflowPolicy = "drop"
+	QueueOverflowServfail QueueOverflowPolicy = "servfail"
+)
+
+// Enforcement represents what happens to traffic, that isn't allowed.
+type Enforcement string
+
+// Valid enforcement constants
+const (
+	EnforcementEnforce Enforcement = "enforce"
+	EnforcementMonitor Enforcement = "monitor"
+)
+
+// ShutdownAction represents what happens to the nftables table, when CoreDNS stops.
+type ShutdownAction string
+
+// Valid shutdown action constants
+const (
+	ShutdownKeep   ShutdownAction = "keep"
+	ShutdownRemove ShutdownAction = "remove"
+	ShutdownFreeze ShutdownAction = "freeze"
+)
+
+// Default time a DNS answer is held in commit mode sync, before it's sent anyway.
+const defaultCommitTimeout = 1 * time.Second
+
 type parsedConfig struct {
 	mode              Mode
-	allowedIPs        []net.IP // Applied to all chains
-	allowedLocalIPs   []net.IP // Applied only to OUTPUT chain (nft-local)
-	allowedGatewayIPs []net.IP // Applied only to FORWARD chain (nft-gateway)
+	enforcement       Enforcement         // Whether traffic, that isn't allowed, is rejected or only counted and logged
+	allowedIPs        []net.IP            // Applied to all chains
+	allowedLocalIPs   []net.IP            // Applied only to OUTPUT chain (nft-local)
+	allowedGatewayIPs []net.IP            // Applied only to FORWARD chain (nft-gateway)
+	commitMode        CommitMode          // Whether DNS answers wait for the nftables flush
+	commitTimeout     time.Duration       // Maximum time an answer is held in commit mode sync
+	onFirewallError   FirewallErrorAction // What happens to an answer, whose addresses couldn't be allowed
+	queueSize         int                 // Maximum number of distinct addresses waiting for the manager goroutine
+	queueOverflow     QueueOverflowPolicy // What happens to an answer, whose addresses don't fit into the full queue
+	hintRecordTypes   []uint16            // Record types (HTTPS/SVCB), whose address hints get allowed
+	additionalSection bool                // Whether SRV/MX/NS target addresses of the additional section get allowed
+	scope             Scope               // Who may reach the destinations of a DNS answer
+	cgroupLevel       int                 // Level of the cgroup hierarchy matched in scope cgroup
+	allowedCgroupIPs  []cgroupAllowance   // Applied only to OUTPUT chain for processes of the cgroup (scope cgroup)
+	domainPolicy      *DomainPolicy       // Which queried names may open the firewall, nil allows all
+	ttlPolicy         *TTLPolicy          // How long the addresses of an answer stay allowed
+	recoveryLifetime  time.Duration       // Lifetime of recovered entries without known expiry
+	adminListen       string              // Address of the admin HTTP API, empty if disabled
+	adminInsecure     bool                // Whether the admin HTTP API may listen on a non-loopback address
+	nflogGroup        uint16              // NFLOG group rejected packets are sent to and read from, 0 if disabled
+	learnFile         string              // File the suggested configuration of learn mode is written to, empty if disabled
+	learnDuration     time.Duration       // Time learn mode observes traffic
+	onShutdown        ShutdownAction      // What happens to the table, when CoreDNS stops
+	ownedTable        bool                // Whether the kernel removes the table, when the process dies
+	stateFile         string              // File the dynamic allowlist is saved to and restored from, empty if disabled
+	stateInterval     time.Duration       // Interval the dynamic allowlist is saved in
+	reconcileInterval time.Duration       // Interval the table is checked for and repaired from drift in, 0 if disabled
 }
 
 // define a named logger for nice logging.
 var log = clog.NewWithPlugin(pluginName)
 
+// Key of the sharedTable of the server blocks of a Corefile, within the storage of their caddy instance.
+type sharedTableKey struct{}
+
+// What the server blocks of a Corefile claimed of the table, and the resources next to it, they share.
+type sharedTable struct {
+	ruleset      string
+	adminListens map[string]bool
+	stateFiles   map[string]bool
+}
+
 func init() { plugin.Register(pluginName, setup) }
 
 func setup(c *caddy.Controller) error {
@@ -51,16 +153,69 @@ func setup(c *caddy.Controller) error {
 		return plugin.Error(pluginName, err)
 	}
 
+	// All server blocks share the table, so they must agree on its ruleset
+	if err := claimSharedTable(c, config); err != nil {
+		return plugin.Error(pluginName, err)
+	}
+
 	// The create the manager based on the validated config
-	var dgManager DestinationGuardManager
-	dgManager, err = NewNFTablesManager(config)
+	nftManager, err := NewNFTablesManager(config)
 	if err != nil {
 		return plugin.Error(pluginName, err)
 	}
+	var dgManager DestinationGuardManager = nftManager
+
+	// On a reload, the manager created for the new configuration takes over the allowList of this one. If the reload
+	// fails, this manager takes it back, and continues.
+	c.OnRestart(func() error {
+		offerHandoff(nftManager)
+		return nil
+	})
+	c.OnRestartFailed(func() error {
+		return reclaimHandoff(nftManager)
+	})
+
+	// Serve the admin API, if enabled. The new instance of a reload starts before this one shuts down, so the address
+	// is released on restart already.
+	if config.adminListen != "" {
+		admin := newAdminServer(config.adminListen, nftManager)
+		c.OnStartup(admin.start)
+		c.OnRestart(admin.stop)
+		c.OnRestartFailed(admin.start)
+		c.OnShutdown(admin.stop)
+	}
+
+	// Read the rejected packets, if enabled. Like the admin API, the NFLOG group is released on restart already.
+	if config.nflogGroup != 0 {
+		reader := newRejectLogReader(config.nflogGroup, nftManager.domainHistory, nftManager.learner)
+		c.OnStartup(reader.start)
+		c.OnRestart(reader.stop)
+		c.OnRestartFailed(reader.start)
+		c.OnShutdown(reader.stop)
+	}
+
+	// Stopping the manager writes the suggestion of learn mode after the reader stopped, so it contains all packets.
+	// A learner taken over on a reload keeps running.
+	if nftManager.learner != nil {
+		c.OnStartup(nftManager.learner.start)
+	}
+	c.OnShutdown(nftManager.Shutdown)
+
+	// Only applies when the process stops, a reload keeps the table
+	c.OnFinalShutdown(nftManager.FinalShutdown)
 
 	// And finally, register plugin with the dnsserver
-	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-		return IPDestinationGuard{Next: next, DGManager: dgManager}
+	parserOptions := &ParserOptions{
+		HintRecordTypes:   config.hintRecordTypes,
+		AdditionalSection: config.additionalSection,
+		DomainPolicy:      config.domainPolicy,
+		OnFirewallError:   config.onFirewallError,
+		QueueOverflow:     config.queueOverflow,
+	}
+
+	serverConfig := dnsserver.GetConfig(c)
+	serverConfig.AddPlugin(func(next plugin.Handler) plugin.Handler {
+		return IPDestinationGuard{Next: next, DGManager: dgManager, ParserOptions: parserOptions, Zone: serverConfig.Zone}
 	})
 
 	return nil
@@ -76,9 +231,21 @@ func setup(c *caddy.Controller) error {
 func parseConfig(c *caddy.Controller) (*parsedConfig, error) {
 	config := &parsedConfig{
 		mode:              "", // Empty string = invalid, will fail validation
+		enforcement:       EnforcementEnforce,
 		allowedIPs:        make([]net.IP, 0, 4),
 		allowedLocalIPs:   make([]net.IP, 0, 4),
 		allowedGatewayIPs: make([]net.IP, 0, 4),
+		commitMode:        CommitModeAsync,
+		commitTimeout:     defaultCommitTimeout,
+		onFirewallError:   FirewallErrorPass,
+		queueSize:         defaultQueueSize,
+		queueOverflow:     QueueOverflowBlock,
+		scope:             ScopeGlobal,
+		cgroupLevel:       defaultCgroupLevel,
+		ttlPolicy:         defaultTTLPolicy(),
+		recoveryLifetime:  defaultRecoveryLifetime,
+		onShutdown:        ShutdownKeep,
+		reconcileInterval: defaultReconcileInterval,
 	}
 
 	// Check for single-line format
@@ -160,6 +327,335 @@ func parseConfig(c *caddy.Controller) (*parsedConfig, error) {
 				config.allowedGatewayIPs = append(config.allowedGatewayIPs, endIP)
 			}
 
+		case "scope":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.Errf("scope directive expects exactly one argument, got %d", len(args))
+			}
+
+			scope := Scope(args[0])
+			if scope != ScopeGlobal && scope != ScopeClient && scope != ScopeUser && scope != ScopeCgroup {
+				return nil, c.Errf("invalid scope '%s': must be '%s', '%s', '%s' or '%s'", scope, ScopeGlobal, ScopeClient, ScopeUser, ScopeCgroup)
+			}
+			config.scope = scope
+
+		case "cgroupLevel":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.Errf("cgroupLevel directive expects exactly one argument, got %d", len(args))
+			}
+
+			level, err := strconv.Atoi(args[0])
+			if err != nil || level < 1 {
+				return nil, c.Errf("invalid cgroupLevel '%s': must be a positive number", args[0])
+			}
+			config.cgroupLevel = level
+
+		case "allowedCgroupIPs":
+			args := c.RemainingArgs()
+			if len(args) < 2 {
+				return nil, c.Errf("allowedCgroupIPs directive requires a cgroup path and at least one IP address or CIDR")
+			}
+
+			allowance := cgroupAllowance{
+				path:       strings.Join(cgroupPathComponents(args[0]), "/"),
+				allowedIPs: make([]net.IP, 0, 2*(len(args)-1)),
+			}
+			if allowance.path == "" {
+				return nil, c.Errf("invalid allowedCgroupIPs cgroup path '%s'", args[0])
+			}
+
+			for _, ipString := range args[1:] {
+				startIP, endIP, err := getIPRange(ipString)
+				if err != nil {
+					return nil, err
+				}
+
+				allowance.allowedIPs = append(allowance.allowedIPs, startIP)
+				allowance.allowedIPs = append(allowance.allowedIPs, endIP)
+			}
+
+			config.allowedCgroupIPs = append(config.allowedCgroupIPs, allowance)
+
+		case "enforcement":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.Errf("enforcement directive expects exactly one argument, got %d", len(args))
+			}
+
+			enforcement := Enforcement(args[0])
+			if enforcement != EnforcementEnforce && enforcement != EnforcementMonitor {
+				return nil, c.Errf("invalid enforcement '%s': must be '%s' or '%s'", enforcement, EnforcementEnforce, EnforcementMonitor)
+			}
+			config.enforcement = enforcement
+
+		case "commitMode":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.Errf("commitMode directive expects exactly one argument, got %d", len(args))
+			}
+
+			commitMode := CommitMode(args[0])
+			if commitMode != CommitModeAsync && commitMode != CommitModeSync {
+				return nil, c.Errf("invalid commitMode '%s': must be '%s' or '%s'", commitMode, CommitModeAsync, CommitModeSync)
+			}
+			config.commitMode = commitMode
+
+		case "commitTimeout":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.Errf("commitTimeout directive expects exactly one argument, got %d", len(args))
+			}
+
+			timeout, err := time.ParseDuration(args[0])
+			if err != nil {
+				return nil, c.Errf("invalid commitTimeout '%s': %v", args[0], err)
+			}
+			config.commitTimeout = timeout
+
+		case "onFirewallError":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.Errf("onFirewallError directive expects exactly one argument, got %d", len(args))
+			}
+
+			onFirewallError := FirewallErrorAction(args[0])
+			if onFirewallError != FirewallErrorPass && onFirewallError != FirewallErrorServfail && onFirewallError != FirewallErrorStrip {
+				return nil, c.Errf("invalid onFirewallError '%s': must be '%s', '%s' or '%s'", onFirewallError, FirewallErrorPass, FirewallErrorServfail, FirewallErrorStrip)
+			}
+			config.onFirewallError = onFirewallError
+
+		case "queue":
+			args := c.RemainingArgs()
+			if len(args) != 1 && len(args) != 2 {
+				return nil, c.Errf("queue directive expects a size and an optional overflow policy, got %d arguments", len(args))
+			}
+
+			size, err := strconv.Atoi(args[0])
+			if err != nil || size <= 0 {
+				return nil, c.Errf("invalid queue size '%s': must be a number greater than zero", args[0])
+			}
+			config.queueSize = size
+
+			if len(args) == 2 {
+				queueOverflow := QueueOverflowPolicy(args[1])
+				if queueOverflow != QueueOverflowBlock && queueOverflow != QueueOverflowDrop && queueOverflow != QueueOverflowServfail {
+					return nil, c.Errf("invalid queue overflow policy '%s': must be '%s', '%s' or '%s'", queueOverflow, QueueOverflowBlock, QueueOverflowDrop, QueueOverflowServfail)
+				}
+				config.queueOverflow = queueOverflow
+			}
+
+		case "svcbHints":
+			// Without record types, the hints of both are allowed
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				args = []string{"HTTPS", "SVCB"}
+			}
+
+			config.hintRecordTypes = make([]uint16, 0, len(args))
+			for _, recordType := range args {
+				switch recordType {
+				case "HTTPS":
+					config.hintRecordTypes = append(config.hintRecordTypes, dns.TypeHTTPS)
+				case "SVCB":
+					config.hintRecordTypes = append(config.hintRecordTypes, dns.TypeSVCB)
+				default:
+					return nil, c.Errf("invalid svcbHints record type '%s': must be 'HTTPS' or 'SVCB'", recordType)
+				}
+			}
+
+		case "allowDomains", "denyDomains":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.Errf("%s directive requires at least one domain", directive)
+			}
+
+			if err := addDomainPatterns(config, args, directive == "allowDomains"); err != nil {
+				return nil, c.Errf("%s: %v", directive, err)
+			}
+
+		case "allowDomainsFile", "denyDomainsFile":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.Errf("%s directive expects exactly one argument, got %d", directive, len(args))
+			}
+
+			path := args[0]
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dnsserver.GetConfig(c).Root, path)
+			}
+
+			domains, err := readDomainListFile(path)
+			if err != nil {
+				return nil, c.Errf("%s: reading '%s' failed: %v", directive, path, err)
+			}
+
+			if err := addDomainPatterns(config, domains, directive == "allowDomainsFile"); err != nil {
+				return nil, c.Errf("%s '%s': %v", directive, path, err)
+			}
+
+		case "requireDomainMatch":
+			if args := c.RemainingArgs(); len(args) != 0 {
+				return nil, c.Errf("requireDomainMatch directive expects no arguments, got %d", len(args))
+			}
+			if config.domainPolicy == nil {
+				config.domainPolicy = &DomainPolicy{}
+			}
+			config.domainPolicy.requireMatch = true
+
+		case "gracePeriod", "minLifetime", "maxLifetime":
+			lifetime, err := parseDurationDirective(c, directive)
+			if err != nil {
+				return nil, err
+			}
+
+			switch directive {
+			case "gracePeriod":
+				config.ttlPolicy.gracePeriod = lifetime
+			case "minLifetime":
+				config.ttlPolicy.minLifetime = lifetime
+			case "maxLifetime":
+				config.ttlPolicy.maxLifetime = lifetime
+			}
+
+		case "recoveryLifetime":
+			lifetime, err := parseDurationDirective(c, directive)
+			if err != nil {
+				return nil, err
+			}
+			if lifetime == 0 {
+				return nil, c.Errf("invalid recoveryLifetime '0s': must be greater than zero")
+			}
+			config.recoveryLifetime = lifetime
+
+		case "domainLifetime":
+			args := c.RemainingArgs()
+			if len(args) < 2 {
+				return nil, c.Errf("domainLifetime directive requires a lifetime and at least one domain")
+			}
+
+			lifetime, err := time.ParseDuration(args[0])
+			if err != nil || lifetime <= 0 {
+				return nil, c.Errf("invalid domainLifetime '%s': must be a duration greater than zero", args[0])
+			}
+
+			for _, domain := range args[1:] {
+				pattern, err := parseDomainPattern(domain, true)
+				if err != nil {
+					return nil, c.Errf("domainLifetime: %v", err)
+				}
+
+				config.ttlPolicy.overrides = append(config.ttlPolicy.overrides, lifetimeOverride{pattern: pattern, lifetime: lifetime})
+			}
+
+		case "adminListen":
+			args := c.RemainingArgs()
+			if len(args) != 1 && len(args) != 2 {
+				return nil, c.Errf("adminListen directive expects an address and an optional 'insecure', got %d arguments", len(args))
+			}
+
+			host, _, err := net.SplitHostPort(args[0])
+			if err != nil {
+				return nil, c.Errf("invalid adminListen address '%s': %v", args[0], err)
+			}
+			if len(args) == 2 {
+				if args[1] != "insecure" {
+					return nil, c.Errf("invalid adminListen option '%s': must be 'insecure'", args[1])
+				}
+				config.adminInsecure = true
+			}
+
+			// The API has no authentication, so anyone reaching it could allow any destination
+			ip := net.ParseIP(host)
+			loopback := host == "localhost" || (ip != nil && ip.IsLoopback())
+			if !loopback && !config.adminInsecure {
+				return nil, c.Errf("adminListen address '%s' isn't a loopback address: the admin API has no authentication, add 'insecure' to expose it anyway", args[0])
+			}
+			config.adminListen = args[0]
+
+		case "nflogGroup":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.Errf("nflogGroup directive expects exactly one argument, got %d", len(args))
+			}
+
+			group, err := strconv.ParseUint(args[0], 10, 16)
+			if err != nil || group == 0 {
+				return nil, c.Errf("invalid nflogGroup '%s': must be a number between 1 and 65535", args[0])
+			}
+			config.nflogGroup = uint16(group)
+
+		case "learn":
+			args := c.RemainingArgs()
+			if len(args) != 1 && len(args) != 2 {
+				return nil, c.Errf("learn directive expects a file and an optional duration, got %d arguments", len(args))
+			}
+
+			config.learnFile = args[0]
+			if !filepath.IsAbs(config.learnFile) {
+				config.learnFile = filepath.Join(dnsserver.GetConfig(c).Root, config.learnFile)
+			}
+
+			config.learnDuration = defaultLearnDuration
+			if len(args) == 2 {
+				duration, err := time.ParseDuration(args[1])
+				if err != nil || duration <= 0 {
+					return nil, c.Errf("invalid learn duration '%s': must be a duration greater than zero", args[1])
+				}
+				config.learnDuration = duration
+			}
+
+		case "stateFile":
+			args := c.RemainingArgs()
+			if len(args) != 1 && len(args) != 2 {
+				return nil, c.Errf("stateFile directive expects a file and an optional interval, got %d arguments", len(args))
+			}
+
+			config.stateFile = args[0]
+			if !filepath.IsAbs(config.stateFile) {
+				config.stateFile = filepath.Join(dnsserver.GetConfig(c).Root, config.stateFile)
+			}
+
+			config.stateInterval = defaultStateInterval
+			if len(args) == 2 {
+				interval, err := time.ParseDuration(args[1])
+				if err != nil || interval <= 0 {
+					return nil, c.Errf("invalid stateFile interval '%s': must be a duration greater than zero", args[1])
+				}
+				config.stateInterval = interval
+			}
+
+		case "reconcileInterval":
+			interval, err := parseDurationDirective(c, directive)
+			if err != nil {
+				return nil, err
+			}
+			config.reconcileInterval = interval
+
+		case "onShutdown":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.Errf("onShutdown directive expects exactly one argument, got %d", len(args))
+			}
+
+			onShutdown := ShutdownAction(args[0])
+			if onShutdown != ShutdownKeep && onShutdown != ShutdownRemove && onShutdown != ShutdownFreeze {
+				return nil, c.Errf("invalid onShutdown '%s': must be '%s', '%s' or '%s'", onShutdown, ShutdownKeep, ShutdownRemove, ShutdownFreeze)
+			}
+			config.onShutdown = onShutdown
+
+		case "ownedTable":
+			if args := c.RemainingArgs(); len(args) != 0 {
+				return nil, c.Errf("ownedTable directive expects no arguments, got %d", len(args))
+			}
+			config.ownedTable = true
+
+		case "additionalSection":
+			if args := c.RemainingArgs(); len(args) != 0 {
+				return nil, c.Errf("additionalSection directive expects no arguments, got %d", len(args))
+			}
+			config.additionalSection = true
+
 		default:
 			return nil, c.Errf("unknown directive '%s'", directive)
 		}
@@ -168,6 +664,39 @@ func parseConfig(c *caddy.Controller) (*parsedConfig, error) {
 	return config, nil
 }
 
+// Parses the single, non-negative duration argument of given directive.
+func parseDurationDirective(c *caddy.Controller, directive string) (time.Duration, error) {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return 0, c.Errf("%s directive expects exactly one argument, got %d", directive, len(args))
+	}
+
+	duration, err := time.ParseDuration(args[0])
+	if err != nil || duration < 0 {
+		return 0, c.Errf("invalid %s '%s': must be a duration like 30s or 5m", directive, args[0])
+	}
+
+	return duration, nil
+}
+
+// Parses given allowDomains/denyDomains entries and adds them to the domain policy of given config.
+func addDomainPatterns(config *parsedConfig, domains []string, allow bool) error {
+	if config.domainPolicy == nil {
+		config.domainPolicy = &DomainPolicy{}
+	}
+
+	for _, domain := range domains {
+		pattern, err := parseDomainPattern(domain, allow)
+		if err != nil {
+			return err
+		}
+
+		config.domainPolicy.add(pattern)
+	}
+
+	return nil
+}
+
 // validateConfig validates the parsed configuration for business logic rules.
 // It checks that the mode is one of the supported values and warns about mismatched directives.
 func validateConfig(config *parsedConfig) error {
@@ -179,6 +708,57 @@ func validateConfig(config *parsedConfig) error {
 		return fmt.Errorf("invalid mode '%s': must be '%s', '%s', or '%s'", config.mode, ModeNFTLocal, ModeNFTGateway, ModeNFTBoth)
 	}
 
+	if config.scope == ScopeClient && config.mode == ModeNFTLocal {
+		return fmt.Errorf("scope '%s' requires mode '%s' or '%s'", ScopeClient, ModeNFTGateway, ModeNFTBoth)
+	}
+
+	if config.scope == ScopeUser && config.mode == ModeNFTGateway {
+		return fmt.Errorf("scope '%s' requires mode '%s' or '%s'", ScopeUser, ModeNFTLocal, ModeNFTBoth)
+	}
+
+	if config.scope == ScopeCgroup && config.mode == ModeNFTGateway {
+		return fmt.Errorf("scope '%s' requires mode '%s' or '%s'", ScopeCgroup, ModeNFTLocal, ModeNFTBoth)
+	}
+
+	if len(config.allowedCgroupIPs) > 0 && config.scope != ScopeCgroup {
+		return fmt.Errorf("allowedCgroupIPs requires scope '%s'", ScopeCgroup)
+	}
+
+	for _, allowance := range config.allowedCgroupIPs {
+		if depth := len(cgroupPathComponents(allowance.path)); depth != config.cgroupLevel {
+			return fmt.Errorf("allowedCgroupIPs cgroup '%s' is at level %d, but cgroupLevel is %d", allowance.path, depth, config.cgroupLevel)
+		}
+	}
+
+	if config.domainPolicy != nil && config.domainPolicy.requireMatch && !config.domainPolicy.hasAllowPatterns() {
+		return fmt.Errorf("requireDomainMatch requires at least one allowDomains entry, otherwise no answer opens the firewall")
+	}
+
+	if config.ttlPolicy != nil && config.ttlPolicy.minLifetime > 0 && config.ttlPolicy.maxLifetime > 0 &&
+		config.ttlPolicy.minLifetime > config.ttlPolicy.maxLifetime {
+		return fmt.Errorf("minLifetime %v must not be greater than maxLifetime %v", config.ttlPolicy.minLifetime, config.ttlPolicy.maxLifetime)
+	}
+
+	if config.learnFile != "" && config.enforcement != EnforcementMonitor {
+		return fmt.Errorf("learn requires enforcement '%s', so the destinations to learn aren't rejected", EnforcementMonitor)
+	}
+
+	if config.learnFile != "" && config.nflogGroup == 0 {
+		return fmt.Errorf("learn requires nflogGroup, as the destinations to learn are read from it")
+	}
+
+	if config.ownedTable && config.onShutdown == ShutdownFreeze {
+		return fmt.Errorf("onShutdown '%s' requires the table to outlive the process, which ownedTable prevents", ShutdownFreeze)
+	}
+
+	if (config.onFirewallError == FirewallErrorServfail || config.onFirewallError == FirewallErrorStrip) && config.commitMode != CommitModeSync {
+		return fmt.Errorf("onFirewallError '%s' requires commitMode '%s', as answers are only checked, if they wait for the firewall", config.onFirewallError, CommitModeSync)
+	}
+
+	if config.commitMode == CommitModeSync && config.commitTimeout <= 0 {
+		return fmt.Errorf("commitTimeout must be greater than zero, got %v", config.commitTimeout)
+	}
+
 	// Warn about mismatched directives (not an error, just informational)
 	if config.mode == ModeNFTLocal && len(config.allowedGatewayIPs) > 0 {
 		log.Warningf("allowedGatewayIPs configured but mode is nft-local; these IPs will be ignored")
@@ -191,6 +771,47 @@ func validateConfig(config *parsedConfig) error {
 	return nil
 }
 
+// claimSharedTable records the ruleset of given config for the caddy instance of given controller, and returns an
+// error, if another server block of the same Corefile configured a different one. All blocks share the single table,
+// and drift detection repairs it to the ruleset of its own block, so blocks configured differently would keep
+// rebuilding each other's rules. Resources, that only one block can hold (the NFLOG group, the admin API address and
+// the state file), are refused for the other blocks.
+func claimSharedTable(c *caddy.Controller, config *parsedConfig) error {
+	ruleset := renderRuleset(config)
+
+	claimed, ok := c.Get(sharedTableKey{}).(*sharedTable)
+	if !ok {
+		claimed = &sharedTable{ruleset: ruleset, adminListens: make(map[string]bool), stateFiles: make(map[string]bool)}
+		c.Set(sharedTableKey{}, claimed)
+	} else {
+		if claimed.ruleset != ruleset {
+			return fmt.Errorf("all ipdestinationguard blocks share table %s, so they must configure the same ruleset (mode, scope, cgroupLevel, enforcement, nflogGroup and allowed IPs)", tableName)
+		}
+		// The kernel only lets a single socket read a NFLOG group
+		if config.nflogGroup != 0 {
+			return fmt.Errorf("nflogGroup can only be used with a single ipdestinationguard block, as only one reader can bind NFLOG group %d", config.nflogGroup)
+		}
+	}
+
+	if config.adminListen != "" {
+		if claimed.adminListens[config.adminListen] {
+			return fmt.Errorf("adminListen address '%s' is used by another ipdestinationguard block already", config.adminListen)
+		}
+		claimed.adminListens[config.adminListen] = true
+	}
+
+	// Each block saves its own allowlist, so blocks sharing a file would overwrite each other's state
+	if config.stateFile != "" {
+		stateFile := filepath.Clean(config.stateFile)
+		if claimed.stateFiles[stateFile] {
+			return fmt.Errorf("stateFile '%s' is used by another ipdestinationguard block already", stateFile)
+		}
+		claimed.stateFiles[stateFile] = true
+	}
+
+	return nil
+}
+
 // Returns the IP range end for given startIP with given subnet-mask bit count
 func getIPRangeEnd(startIP net.IP, maskedBits uint) net.IP {
 	startIPInt := big.NewInt(0)
@@ -204,6 +825,21 @@ func getIPRangeEnd(startIP net.IP, maskedBits uint) net.IP {
 	return net.IP(endIPBuffer)
 }
 
+// Returns the IP right before given IP, like the last IP of a range from getIPRange.
+func previousIP(ip net.IP) net.IP {
+	previous := make(net.IP, len(ip))
+	copy(previous, ip)
+
+	for i := len(previous) - 1; i >= 0; i-- {
+		previous[i]--
+		if previous[i] != 0xff {
+			break
+		}
+	}
+
+	return previous
+}
+
 // Parses given string and tries to determine the IP range it describes.
 func getIPRange(str string) (net.IP, net.IP, error) {
 	_, cidrNet, err := net.ParseCIDR(str)
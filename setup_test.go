@@ -2,10 +2,14 @@ package ipdestinationguard
 
 import (
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
 )
 
 func TestGetIPRangeEnd(t *testing.T) {
@@ -446,6 +450,207 @@ func TestValidateConfig(t *testing.T) {
 			shouldError:   true,
 			errorContains: "invalid mode",
 		},
+		{
+			name: "client scope in gateway mode",
+			config: &parsedConfig{
+				mode:       ModeNFTGateway,
+				allowedIPs: []net.IP{},
+				scope:      ScopeClient,
+			},
+			shouldError: false,
+		},
+		{
+			name: "client scope in local mode",
+			config: &parsedConfig{
+				mode:       ModeNFTLocal,
+				allowedIPs: []net.IP{},
+				scope:      ScopeClient,
+			},
+			shouldError:   true,
+			errorContains: "scope 'client' requires mode",
+		},
+		{
+			name: "user scope in local mode",
+			config: &parsedConfig{
+				mode:       ModeNFTLocal,
+				allowedIPs: []net.IP{},
+				scope:      ScopeUser,
+			},
+			shouldError: false,
+		},
+		{
+			name: "user scope in gateway mode",
+			config: &parsedConfig{
+				mode:       ModeNFTGateway,
+				allowedIPs: []net.IP{},
+				scope:      ScopeUser,
+			},
+			shouldError:   true,
+			errorContains: "scope 'user' requires mode",
+		},
+		{
+			name: "cgroup scope in gateway mode",
+			config: &parsedConfig{
+				mode:        ModeNFTGateway,
+				allowedIPs:  []net.IP{},
+				scope:       ScopeCgroup,
+				cgroupLevel: defaultCgroupLevel,
+			},
+			shouldError:   true,
+			errorContains: "scope 'cgroup' requires mode",
+		},
+		{
+			name: "allowedCgroupIPs without cgroup scope",
+			config: &parsedConfig{
+				mode:             ModeNFTLocal,
+				allowedIPs:       []net.IP{},
+				cgroupLevel:      defaultCgroupLevel,
+				allowedCgroupIPs: []cgroupAllowance{{path: "system.slice/nginx.service"}},
+			},
+			shouldError:   true,
+			errorContains: "allowedCgroupIPs requires scope 'cgroup'",
+		},
+		{
+			name: "allowedCgroupIPs at another level",
+			config: &parsedConfig{
+				mode:             ModeNFTLocal,
+				allowedIPs:       []net.IP{},
+				scope:            ScopeCgroup,
+				cgroupLevel:      defaultCgroupLevel,
+				allowedCgroupIPs: []cgroupAllowance{{path: "system.slice"}},
+			},
+			shouldError:   true,
+			errorContains: "is at level 1, but cgroupLevel is 2",
+		},
+		{
+			name: "allowedCgroupIPs at cgroup level",
+			config: &parsedConfig{
+				mode:             ModeNFTLocal,
+				allowedIPs:       []net.IP{},
+				scope:            ScopeCgroup,
+				cgroupLevel:      defaultCgroupLevel,
+				allowedCgroupIPs: []cgroupAllowance{{path: "system.slice/nginx.service"}},
+			},
+			shouldError: false,
+		},
+		{
+			name: "learn in enforcement monitor with nflogGroup",
+			config: &parsedConfig{
+				mode:        ModeNFTLocal,
+				allowedIPs:  []net.IP{},
+				enforcement: EnforcementMonitor,
+				nflogGroup:  100,
+				learnFile:   "/tmp/learned.conf",
+			},
+			shouldError: false,
+		},
+		{
+			name: "learn without enforcement monitor",
+			config: &parsedConfig{
+				mode:        ModeNFTLocal,
+				allowedIPs:  []net.IP{},
+				enforcement: EnforcementEnforce,
+				nflogGroup:  100,
+				learnFile:   "/tmp/learned.conf",
+			},
+			shouldError:   true,
+			errorContains: "learn requires enforcement 'monitor'",
+		},
+		{
+			name: "learn without nflogGroup",
+			config: &parsedConfig{
+				mode:        ModeNFTLocal,
+				allowedIPs:  []net.IP{},
+				enforcement: EnforcementMonitor,
+				learnFile:   "/tmp/learned.conf",
+			},
+			shouldError:   true,
+			errorContains: "learn requires nflogGroup",
+		},
+		{
+			name: "freeze with owned table",
+			config: &parsedConfig{
+				mode:       ModeNFTLocal,
+				allowedIPs: []net.IP{},
+				onShutdown: ShutdownFreeze,
+				ownedTable: true,
+			},
+			shouldError:   true,
+			errorContains: "onShutdown 'freeze' requires the table to outlive the process",
+		},
+		{
+			name: "remove with owned table",
+			config: &parsedConfig{
+				mode:       ModeNFTLocal,
+				allowedIPs: []net.IP{},
+				onShutdown: ShutdownRemove,
+				ownedTable: true,
+			},
+			shouldError: false,
+		},
+		{
+			name: "servfail on firewall errors in commit mode async",
+			config: &parsedConfig{
+				mode:            ModeNFTLocal,
+				allowedIPs:      []net.IP{},
+				commitMode:      CommitModeAsync,
+				onFirewallError: FirewallErrorServfail,
+			},
+			shouldError:   true,
+			errorContains: "onFirewallError 'servfail' requires commitMode 'sync'",
+		},
+		{
+			name: "strip on firewall errors in commit mode sync",
+			config: &parsedConfig{
+				mode:            ModeNFTLocal,
+				allowedIPs:      []net.IP{},
+				commitMode:      CommitModeSync,
+				commitTimeout:   time.Second,
+				onFirewallError: FirewallErrorStrip,
+			},
+			shouldError: false,
+		},
+		{
+			name: "pass on firewall errors in commit mode async",
+			config: &parsedConfig{
+				mode:            ModeNFTLocal,
+				allowedIPs:      []net.IP{},
+				commitMode:      CommitModeAsync,
+				onFirewallError: FirewallErrorPass,
+			},
+			shouldError: false,
+		},
+		{
+			name: "required domain match without allowed domains",
+			config: &parsedConfig{
+				mode:         ModeNFTLocal,
+				allowedIPs:   []net.IP{},
+				domainPolicy: &DomainPolicy{requireMatch: true},
+			},
+			shouldError:   true,
+			errorContains: "requireDomainMatch requires at least one allowDomains entry",
+		},
+		{
+			name: "minLifetime greater than maxLifetime",
+			config: &parsedConfig{
+				mode:       ModeNFTLocal,
+				allowedIPs: []net.IP{},
+				ttlPolicy:  &TTLPolicy{minLifetime: time.Hour, maxLifetime: time.Minute},
+			},
+			shouldError:   true,
+			errorContains: "minLifetime 1h0m0s must not be greater than maxLifetime 1m0s",
+		},
+		{
+			name: "sync commit mode without timeout",
+			config: &parsedConfig{
+				mode:          ModeNFTLocal,
+				allowedIPs:    []net.IP{},
+				commitMode:    CommitModeSync,
+				commitTimeout: 0,
+			},
+			shouldError:   true,
+			errorContains: "commitTimeout must be greater than zero",
+		},
 		{
 			name: "invalid mode - local instead of nft-local",
 			config: &parsedConfig{
@@ -478,3 +683,1721 @@ func TestValidateConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestParseConfigCommitMode(t *testing.T) {
+	tests := []struct {
+		name                  string
+		input                 string
+		expectedCommitMode    CommitMode
+		expectedCommitTimeout time.Duration
+		shouldError           bool
+		errorContains         string
+	}{
+		{
+			name: "defaults to async",
+			input: `ipdestinationguard {
+				mode nft-local
+			}`,
+			expectedCommitMode:    CommitModeAsync,
+			expectedCommitTimeout: defaultCommitTimeout,
+		},
+		{
+			name:                  "single-line format uses defaults",
+			input:                 "ipdestinationguard nft-local 9.9.9.9",
+			expectedCommitMode:    CommitModeAsync,
+			expectedCommitTimeout: defaultCommitTimeout,
+		},
+		{
+			name: "sync with default timeout",
+			input: `ipdestinationguard {
+				mode nft-local
+				commitMode sync
+			}`,
+			expectedCommitMode:    CommitModeSync,
+			expectedCommitTimeout: defaultCommitTimeout,
+		},
+		{
+			name: "sync with custom timeout",
+			input: `ipdestinationguard {
+				mode nft-local
+				commitMode sync
+				commitTimeout 250ms
+			}`,
+			expectedCommitMode:    CommitModeSync,
+			expectedCommitTimeout: 250 * time.Millisecond,
+		},
+		{
+			name: "invalid commitMode",
+			input: `ipdestinationguard {
+				mode nft-local
+				commitMode later
+			}`,
+			shouldError:   true,
+			errorContains: "invalid commitMode",
+		},
+		{
+			name: "commitMode without value",
+			input: `ipdestinationguard {
+				mode nft-local
+				commitMode
+			}`,
+			shouldError:   true,
+			errorContains: "commitMode directive expects exactly one argument",
+		},
+		{
+			name: "invalid commitTimeout",
+			input: `ipdestinationguard {
+				mode nft-local
+				commitTimeout soon
+			}`,
+			shouldError:   true,
+			errorContains: "invalid commitTimeout",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tt.input)
+			c.Next() // consume plugin name
+
+			config, err := parseConfig(c)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error containing '%s', but got no error", tt.errorContains)
+					return
+				}
+				if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', but got: %v", tt.errorContains, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			if config.commitMode != tt.expectedCommitMode {
+				t.Errorf("Expected commitMode '%s', got '%s'", tt.expectedCommitMode, config.commitMode)
+			}
+
+			if config.commitTimeout != tt.expectedCommitTimeout {
+				t.Errorf("Expected commitTimeout %v, got %v", tt.expectedCommitTimeout, config.commitTimeout)
+			}
+		})
+	}
+}
+
+func TestParseConfigSVCBHints(t *testing.T) {
+	tests := []struct {
+		name                    string
+		input                   string
+		expectedHintRecordTypes []uint16
+		shouldError             bool
+		errorContains           string
+	}{
+		{
+			name: "disabled by default",
+			input: `ipdestinationguard {
+				mode nft-local
+			}`,
+			expectedHintRecordTypes: nil,
+		},
+		{
+			name: "HTTPS and SVCB without record types",
+			input: `ipdestinationguard {
+				mode nft-local
+				svcbHints
+			}`,
+			expectedHintRecordTypes: []uint16{dns.TypeHTTPS, dns.TypeSVCB},
+		},
+		{
+			name: "only HTTPS",
+			input: `ipdestinationguard {
+				mode nft-local
+				svcbHints HTTPS
+			}`,
+			expectedHintRecordTypes: []uint16{dns.TypeHTTPS},
+		},
+		{
+			name: "invalid record type",
+			input: `ipdestinationguard {
+				mode nft-local
+				svcbHints MX
+			}`,
+			shouldError:   true,
+			errorContains: "invalid svcbHints record type",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tt.input)
+			c.Next() // consume plugin name
+
+			config, err := parseConfig(c)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error containing '%s', but got no error", tt.errorContains)
+					return
+				}
+				if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', but got: %v", tt.errorContains, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			if len(config.hintRecordTypes) != len(tt.expectedHintRecordTypes) {
+				t.Fatalf("Expected hint record types %v, got %v", tt.expectedHintRecordTypes, config.hintRecordTypes)
+			}
+
+			for i, recordType := range tt.expectedHintRecordTypes {
+				if config.hintRecordTypes[i] != recordType {
+					t.Errorf("Expected hint record types %v, got %v", tt.expectedHintRecordTypes, config.hintRecordTypes)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConfigAdditionalSection(t *testing.T) {
+	c := caddy.NewTestController("dns", `ipdestinationguard {
+		mode nft-local
+	}`)
+	c.Next() // consume plugin name
+
+	config, err := parseConfig(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.additionalSection {
+		t.Error("Expected additionalSection to be disabled by default")
+	}
+
+	c = caddy.NewTestController("dns", `ipdestinationguard {
+		mode nft-local
+		additionalSection
+	}`)
+	c.Next() // consume plugin name
+
+	config, err = parseConfig(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !config.additionalSection {
+		t.Error("Expected additionalSection to be enabled")
+	}
+
+	c = caddy.NewTestController("dns", `ipdestinationguard {
+		mode nft-local
+		additionalSection yes
+	}`)
+	c.Next() // consume plugin name
+
+	_, err = parseConfig(c)
+	if err == nil || !strings.Contains(err.Error(), "additionalSection directive expects no arguments") {
+		t.Errorf("Expected argument error, got: %v", err)
+	}
+}
+
+func TestParseConfigScope(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		expectedScope Scope
+		shouldError   bool
+		errorContains string
+	}{
+		{
+			name: "defaults to global",
+			input: `ipdestinationguard {
+				mode nft-gateway
+			}`,
+			expectedScope: ScopeGlobal,
+		},
+		{
+			name: "client scope",
+			input: `ipdestinationguard {
+				mode nft-gateway
+				scope client
+			}`,
+			expectedScope: ScopeClient,
+		},
+		{
+			name: "user scope",
+			input: `ipdestinationguard {
+				mode nft-local
+				scope user
+			}`,
+			expectedScope: ScopeUser,
+		},
+		{
+			name: "invalid scope",
+			input: `ipdestinationguard {
+				mode nft-gateway
+				scope everyone
+			}`,
+			shouldError:   true,
+			errorContains: "invalid scope",
+		},
+		{
+			name: "scope without value",
+			input: `ipdestinationguard {
+				mode nft-gateway
+				scope
+			}`,
+			shouldError:   true,
+			errorContains: "scope directive expects exactly one argument",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tt.input)
+			c.Next() // consume plugin name
+
+			config, err := parseConfig(c)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error containing '%s', but got no error", tt.errorContains)
+					return
+				}
+				if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', but got: %v", tt.errorContains, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			if config.scope != tt.expectedScope {
+				t.Errorf("Expected scope '%s', got '%s'", tt.expectedScope, config.scope)
+			}
+		})
+	}
+}
+
+func TestParseConfigCgroupScope(t *testing.T) {
+	tests := []struct {
+		name               string
+		input              string
+		expectedLevel      int
+		expectedAllowances []string // cgroup paths of allowedCgroupIPs
+		expectedIPCounts   []int    // number of IPs per allowance (including start/end pairs)
+		shouldError        bool
+		errorContains      string
+	}{
+		{
+			name: "default level",
+			input: `ipdestinationguard {
+				mode nft-local
+				scope cgroup
+			}`,
+			expectedLevel: defaultCgroupLevel,
+		},
+		{
+			name: "custom level",
+			input: `ipdestinationguard {
+				mode nft-local
+				scope cgroup
+				cgroupLevel 3
+			}`,
+			expectedLevel: 3,
+		},
+		{
+			name: "static allowlists",
+			input: `ipdestinationguard {
+				mode nft-local
+				scope cgroup
+				allowedCgroupIPs /system.slice/nginx.service/ 10.0.0.0/8 fd00::/8
+				allowedCgroupIPs system.slice/backup.service 192.0.2.10
+			}`,
+			expectedLevel:      defaultCgroupLevel,
+			expectedAllowances: []string{"system.slice/nginx.service", "system.slice/backup.service"},
+			expectedIPCounts:   []int{4, 2},
+		},
+		{
+			name: "invalid level",
+			input: `ipdestinationguard {
+				mode nft-local
+				cgroupLevel 0
+			}`,
+			shouldError:   true,
+			errorContains: "invalid cgroupLevel",
+		},
+		{
+			name: "level without value",
+			input: `ipdestinationguard {
+				mode nft-local
+				cgroupLevel
+			}`,
+			shouldError:   true,
+			errorContains: "cgroupLevel directive expects exactly one argument",
+		},
+		{
+			name: "static allowlist without IPs",
+			input: `ipdestinationguard {
+				mode nft-local
+				allowedCgroupIPs system.slice/nginx.service
+			}`,
+			shouldError:   true,
+			errorContains: "allowedCgroupIPs directive requires a cgroup path",
+		},
+		{
+			name: "static allowlist with root cgroup",
+			input: `ipdestinationguard {
+				mode nft-local
+				allowedCgroupIPs / 10.0.0.0/8
+			}`,
+			shouldError:   true,
+			errorContains: "invalid allowedCgroupIPs cgroup path",
+		},
+		{
+			name: "static allowlist with invalid IP",
+			input: `ipdestinationguard {
+				mode nft-local
+				allowedCgroupIPs system.slice/nginx.service not-an-ip
+			}`,
+			shouldError:   true,
+			errorContains: "can't extract ip range",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tt.input)
+			c.Next() // consume plugin name
+
+			config, err := parseConfig(c)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error containing '%s', but got no error", tt.errorContains)
+					return
+				}
+				if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', but got: %v", tt.errorContains, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			if config.cgroupLevel != tt.expectedLevel {
+				t.Errorf("Expected cgroupLevel %d, got %d", tt.expectedLevel, config.cgroupLevel)
+			}
+
+			if len(config.allowedCgroupIPs) != len(tt.expectedAllowances) {
+				t.Fatalf("Expected %d allowedCgroupIPs, got %d", len(tt.expectedAllowances), len(config.allowedCgroupIPs))
+			}
+
+			for i, allowance := range config.allowedCgroupIPs {
+				if allowance.path != tt.expectedAllowances[i] {
+					t.Errorf("Expected cgroup path '%s', got '%s'", tt.expectedAllowances[i], allowance.path)
+				}
+				if len(allowance.allowedIPs) != tt.expectedIPCounts[i] {
+					t.Errorf("Expected %d IPs for '%s', got %d", tt.expectedIPCounts[i], allowance.path, len(allowance.allowedIPs))
+				}
+			}
+		})
+	}
+}
+
+func TestPreviousIP(t *testing.T) {
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"10.0.1.0", "10.0.0.255"},
+		{"10.0.0.5", "10.0.0.4"},
+		{"11.0.0.0", "10.255.255.255"},
+		{"fd00::1:0", "fd00::ffff"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			ip := net.ParseIP(tt.ip)
+			if ipv4 := ip.To4(); ipv4 != nil {
+				ip = ipv4
+			}
+
+			result := previousIP(ip)
+			if !result.Equal(net.ParseIP(tt.expected)) {
+				t.Errorf("Expected %s, got %s", tt.expected, result)
+			}
+			if len(result) != len(ip) {
+				t.Errorf("Expected %d bytes, got %d", len(ip), len(result))
+			}
+			if !ip.Equal(net.ParseIP(tt.ip)) {
+				t.Errorf("Input IP was modified to %s", ip)
+			}
+		})
+	}
+}
+
+func TestParseConfigDomainPolicy(t *testing.T) {
+	listFile := filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(listFile, []byte("# trackers\ntracker.example\n*.ads.example\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	invalidListFile := filepath.Join(t.TempDir(), "invalid.txt")
+	if err := os.WriteFile(invalidListFile, []byte("foo.*.example\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name                 string
+		input                string
+		expectPolicy         bool
+		expectedPatternCount int
+		expectedRequireMatch bool
+		shouldError          bool
+		errorContains        string
+	}{
+		{
+			name: "no domain policy",
+			input: `ipdestinationguard {
+				mode nft-local
+			}`,
+			expectPolicy: false,
+		},
+		{
+			name: "allow and deny domains",
+			input: `ipdestinationguard {
+				mode nft-local
+				allowDomains example.com *.example.org
+				denyDomains ads.example.com
+				requireDomainMatch
+			}`,
+			expectPolicy:         true,
+			expectedPatternCount: 3,
+			expectedRequireMatch: true,
+		},
+		{
+			name: "deny list file",
+			input: `ipdestinationguard {
+				mode nft-local
+				denyDomainsFile ` + listFile + `
+			}`,
+			expectPolicy:         true,
+			expectedPatternCount: 2,
+		},
+		{
+			name: "invalid domain",
+			input: `ipdestinationguard {
+				mode nft-local
+				allowDomains foo.*.example
+			}`,
+			shouldError:   true,
+			errorContains: "invalid domain pattern",
+		},
+		{
+			name: "allowDomains without value",
+			input: `ipdestinationguard {
+				mode nft-local
+				allowDomains
+			}`,
+			shouldError:   true,
+			errorContains: "allowDomains directive requires at least one domain",
+		},
+		{
+			name: "missing list file",
+			input: `ipdestinationguard {
+				mode nft-local
+				allowDomainsFile ` + filepath.Join(t.TempDir(), "missing.txt") + `
+			}`,
+			shouldError:   true,
+			errorContains: "reading",
+		},
+		{
+			name: "invalid list file",
+			input: `ipdestinationguard {
+				mode nft-local
+				denyDomainsFile ` + invalidListFile + `
+			}`,
+			shouldError:   true,
+			errorContains: "invalid domain pattern",
+		},
+		{
+			name: "requireDomainMatch with argument",
+			input: `ipdestinationguard {
+				mode nft-local
+				requireDomainMatch yes
+			}`,
+			shouldError:   true,
+			errorContains: "requireDomainMatch directive expects no arguments",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tt.input)
+			c.Next() // consume plugin name
+
+			config, err := parseConfig(c)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error containing '%s', but got no error", tt.errorContains)
+					return
+				}
+				if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', but got: %v", tt.errorContains, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			if !tt.expectPolicy {
+				if config.domainPolicy != nil {
+					t.Errorf("Expected no domain policy, got %+v", config.domainPolicy)
+				}
+				return
+			}
+
+			if config.domainPolicy == nil {
+				t.Fatal("Expected a domain policy, got nil")
+			}
+
+			if len(config.domainPolicy.patterns) != tt.expectedPatternCount {
+				t.Errorf("Expected %d patterns, got %d", tt.expectedPatternCount, len(config.domainPolicy.patterns))
+			}
+
+			if config.domainPolicy.requireMatch != tt.expectedRequireMatch {
+				t.Errorf("Expected requireMatch %v, got %v", tt.expectedRequireMatch, config.domainPolicy.requireMatch)
+			}
+		})
+	}
+}
+
+func TestParseConfigTTLPolicy(t *testing.T) {
+	tests := []struct {
+		name                     string
+		input                    string
+		expectedGracePeriod      time.Duration
+		expectedMinLifetime      time.Duration
+		expectedMaxLifetime      time.Duration
+		expectedRecoveryLifetime time.Duration
+		expectedOverrideCount    int
+		shouldError              bool
+		errorContains            string
+	}{
+		{
+			name: "defaults",
+			input: `ipdestinationguard {
+				mode nft-local
+			}`,
+			expectedGracePeriod:      defaultGracePeriod,
+			expectedRecoveryLifetime: defaultRecoveryLifetime,
+		},
+		{
+			name: "all directives",
+			input: `ipdestinationguard {
+				mode nft-local
+				gracePeriod 2m
+				minLifetime 5m
+				maxLifetime 24h
+				recoveryLifetime 1h
+				domainLifetime 12h jvm.example *.java.example
+			}`,
+			expectedGracePeriod:      2 * time.Minute,
+			expectedMinLifetime:      5 * time.Minute,
+			expectedMaxLifetime:      24 * time.Hour,
+			expectedRecoveryLifetime: time.Hour,
+			expectedOverrideCount:    2,
+		},
+		{
+			name: "grace period of zero",
+			input: `ipdestinationguard {
+				mode nft-local
+				gracePeriod 0s
+			}`,
+			expectedGracePeriod:      0,
+			expectedRecoveryLifetime: defaultRecoveryLifetime,
+		},
+		{
+			name: "negative grace period",
+			input: `ipdestinationguard {
+				mode nft-local
+				gracePeriod -5s
+			}`,
+			shouldError:   true,
+			errorContains: "invalid gracePeriod",
+		},
+		{
+			name: "invalid minLifetime",
+			input: `ipdestinationguard {
+				mode nft-local
+				minLifetime forever
+			}`,
+			shouldError:   true,
+			errorContains: "invalid minLifetime",
+		},
+		{
+			name: "maxLifetime without value",
+			input: `ipdestinationguard {
+				mode nft-local
+				maxLifetime
+			}`,
+			shouldError:   true,
+			errorContains: "maxLifetime directive expects exactly one argument",
+		},
+		{
+			name: "recoveryLifetime of zero",
+			input: `ipdestinationguard {
+				mode nft-local
+				recoveryLifetime 0s
+			}`,
+			shouldError:   true,
+			errorContains: "invalid recoveryLifetime",
+		},
+		{
+			name: "domainLifetime without domain",
+			input: `ipdestinationguard {
+				mode nft-local
+				domainLifetime 1h
+			}`,
+			shouldError:   true,
+			errorContains: "domainLifetime directive requires a lifetime and at least one domain",
+		},
+		{
+			name: "domainLifetime with invalid lifetime",
+			input: `ipdestinationguard {
+				mode nft-local
+				domainLifetime 0s example.com
+			}`,
+			shouldError:   true,
+			errorContains: "invalid domainLifetime",
+		},
+		{
+			name: "domainLifetime with invalid domain",
+			input: `ipdestinationguard {
+				mode nft-local
+				domainLifetime 1h foo.*.example
+			}`,
+			shouldError:   true,
+			errorContains: "invalid domain pattern",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tt.input)
+			c.Next() // consume plugin name
+
+			config, err := parseConfig(c)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error containing '%s', but got no error", tt.errorContains)
+					return
+				}
+				if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', but got: %v", tt.errorContains, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			if config.ttlPolicy.gracePeriod != tt.expectedGracePeriod {
+				t.Errorf("Expected gracePeriod %v, got %v", tt.expectedGracePeriod, config.ttlPolicy.gracePeriod)
+			}
+			if config.ttlPolicy.minLifetime != tt.expectedMinLifetime {
+				t.Errorf("Expected minLifetime %v, got %v", tt.expectedMinLifetime, config.ttlPolicy.minLifetime)
+			}
+			if config.ttlPolicy.maxLifetime != tt.expectedMaxLifetime {
+				t.Errorf("Expected maxLifetime %v, got %v", tt.expectedMaxLifetime, config.ttlPolicy.maxLifetime)
+			}
+			if config.recoveryLifetime != tt.expectedRecoveryLifetime {
+				t.Errorf("Expected recoveryLifetime %v, got %v", tt.expectedRecoveryLifetime, config.recoveryLifetime)
+			}
+			if len(config.ttlPolicy.overrides) != tt.expectedOverrideCount {
+				t.Errorf("Expected %d overrides, got %d", tt.expectedOverrideCount, len(config.ttlPolicy.overrides))
+			}
+		})
+	}
+}
+
+func TestParseConfigAdminListen(t *testing.T) {
+	tests := []struct {
+		name             string
+		input            string
+		expectedAddress  string
+		expectedInsecure bool
+		shouldError      bool
+		errorContains    string
+	}{
+		{
+			name: "disabled by default",
+			input: `ipdestinationguard {
+				mode nft-local
+			}`,
+			expectedAddress: "",
+		},
+		{
+			name: "loopback address",
+			input: `ipdestinationguard {
+				mode nft-local
+				adminListen 127.0.0.1:9153
+			}`,
+			expectedAddress: "127.0.0.1:9153",
+		},
+		{
+			name: "ipv6 address",
+			input: `ipdestinationguard {
+				mode nft-local
+				adminListen [::1]:9153
+			}`,
+			expectedAddress: "[::1]:9153",
+		},
+		{
+			name: "address without port",
+			input: `ipdestinationguard {
+				mode nft-local
+				adminListen 127.0.0.1
+			}`,
+			shouldError:   true,
+			errorContains: "invalid adminListen address",
+		},
+		{
+			name: "without address",
+			input: `ipdestinationguard {
+				mode nft-local
+				adminListen
+			}`,
+			shouldError:   true,
+			errorContains: "adminListen directive expects an address and an optional 'insecure'",
+		},
+		{
+			name: "localhost",
+			input: `ipdestinationguard {
+				mode nft-local
+				adminListen localhost:9153
+			}`,
+			expectedAddress: "localhost:9153",
+		},
+		{
+			name: "non-loopback address",
+			input: `ipdestinationguard {
+				mode nft-local
+				adminListen 10.0.0.1:9153
+			}`,
+			shouldError:   true,
+			errorContains: "isn't a loopback address",
+		},
+		{
+			name: "all addresses",
+			input: `ipdestinationguard {
+				mode nft-local
+				adminListen :9153
+			}`,
+			shouldError:   true,
+			errorContains: "isn't a loopback address",
+		},
+		{
+			name: "non-loopback address with explicit opt-in",
+			input: `ipdestinationguard {
+				mode nft-local
+				adminListen 10.0.0.1:9153 insecure
+			}`,
+			expectedAddress:  "10.0.0.1:9153",
+			expectedInsecure: true,
+		},
+		{
+			name: "invalid option",
+			input: `ipdestinationguard {
+				mode nft-local
+				adminListen 10.0.0.1:9153 public
+			}`,
+			shouldError:   true,
+			errorContains: "invalid adminListen option 'public'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tt.input)
+			c.Next() // consume plugin name
+
+			config, err := parseConfig(c)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error containing '%s', but got no error", tt.errorContains)
+					return
+				}
+				if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', but got: %v", tt.errorContains, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			if config.adminListen != tt.expectedAddress {
+				t.Errorf("Expected adminListen '%s', got '%s'", tt.expectedAddress, config.adminListen)
+			}
+			if config.adminInsecure != tt.expectedInsecure {
+				t.Errorf("Expected adminInsecure %v, got %v", tt.expectedInsecure, config.adminInsecure)
+			}
+		})
+	}
+}
+
+func TestClaimSharedTable(t *testing.T) {
+	tests := []struct {
+		name          string
+		configure     []func(config *parsedConfig)
+		errorContains string
+	}{
+		{
+			name:      "blocks with the same ruleset",
+			configure: []func(config *parsedConfig){func(*parsedConfig) {}, func(*parsedConfig) {}},
+		},
+		{
+			name: "blocks with different rulesets",
+			configure: []func(config *parsedConfig){
+				func(*parsedConfig) {},
+				func(config *parsedConfig) { config.enforcement = EnforcementMonitor },
+			},
+			errorContains: "must configure the same ruleset",
+		},
+		{
+			name: "nflogGroup of a single block",
+			configure: []func(config *parsedConfig){
+				func(config *parsedConfig) { config.nflogGroup = 100 },
+			},
+		},
+		{
+			name: "nflogGroup of multiple blocks",
+			configure: []func(config *parsedConfig){
+				func(config *parsedConfig) { config.nflogGroup = 100 },
+				func(config *parsedConfig) { config.nflogGroup = 100 },
+			},
+			errorContains: "nflogGroup can only be used with a single ipdestinationguard block",
+		},
+		{
+			name: "different adminListen addresses",
+			configure: []func(config *parsedConfig){
+				func(config *parsedConfig) { config.adminListen = "127.0.0.1:9180" },
+				func(config *parsedConfig) { config.adminListen = "127.0.0.1:9181" },
+				func(*parsedConfig) {},
+			},
+		},
+		{
+			name: "same adminListen address",
+			configure: []func(config *parsedConfig){
+				func(config *parsedConfig) { config.adminListen = "127.0.0.1:9180" },
+				func(config *parsedConfig) { config.adminListen = "127.0.0.1:9180" },
+			},
+			errorContains: "is used by another ipdestinationguard block already",
+		},
+		{
+			name: "different stateFile paths",
+			configure: []func(config *parsedConfig){
+				func(config *parsedConfig) { config.stateFile = "/var/lib/coredns/a.json" },
+				func(config *parsedConfig) { config.stateFile = "/var/lib/coredns/b.json" },
+				func(*parsedConfig) {},
+			},
+		},
+		{
+			name: "same stateFile path",
+			configure: []func(config *parsedConfig){
+				func(config *parsedConfig) { config.stateFile = "/var/lib/coredns/state.json" },
+				func(config *parsedConfig) { config.stateFile = "/var/lib/coredns/./state.json" },
+			},
+			errorContains: "stateFile '/var/lib/coredns/state.json' is used by another ipdestinationguard block already",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", "")
+
+			var err error
+			for _, configure := range tt.configure {
+				config := testAdminConfig(t, ScopeGlobal)
+				configure(config)
+				if err = claimSharedTable(c, config); err != nil {
+					break
+				}
+			}
+
+			if tt.errorContains == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errorContains) {
+				t.Errorf("Expected error containing '%s', got %v", tt.errorContains, err)
+			}
+		})
+	}
+}
+
+func TestParseConfigEnforcement(t *testing.T) {
+	tests := []struct {
+		name                string
+		input               string
+		expectedEnforcement Enforcement
+		shouldError         bool
+		errorContains       string
+	}{
+		{
+			name: "enforce by default",
+			input: `ipdestinationguard {
+				mode nft-local
+			}`,
+			expectedEnforcement: EnforcementEnforce,
+		},
+		{
+			name:                "enforce by default in single-line format",
+			input:               `ipdestinationguard nft-local 9.9.9.9`,
+			expectedEnforcement: EnforcementEnforce,
+		},
+		{
+			name: "monitor",
+			input: `ipdestinationguard {
+				mode nft-both
+				enforcement monitor
+			}`,
+			expectedEnforcement: EnforcementMonitor,
+		},
+		{
+			name: "explicit enforce",
+			input: `ipdestinationguard {
+				mode nft-local
+				enforcement enforce
+			}`,
+			expectedEnforcement: EnforcementEnforce,
+		},
+		{
+			name: "invalid enforcement",
+			input: `ipdestinationguard {
+				mode nft-local
+				enforcement dry-run
+			}`,
+			shouldError:   true,
+			errorContains: "invalid enforcement 'dry-run'",
+		},
+		{
+			name: "without argument",
+			input: `ipdestinationguard {
+				mode nft-local
+				enforcement
+			}`,
+			shouldError:   true,
+			errorContains: "enforcement directive expects exactly one argument",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tt.input)
+			c.Next() // consume plugin name
+
+			config, err := parseConfig(c)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error containing '%s', but got no error", tt.errorContains)
+					return
+				}
+				if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', but got: %v", tt.errorContains, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			if config.enforcement != tt.expectedEnforcement {
+				t.Errorf("Expected enforcement '%s', got '%s'", tt.expectedEnforcement, config.enforcement)
+			}
+		})
+	}
+}
+
+func TestParseConfigOnShutdown(t *testing.T) {
+	tests := []struct {
+		name               string
+		input              string
+		expectedOnShutdown ShutdownAction
+		expectedOwnedTable bool
+		shouldError        bool
+		errorContains      string
+	}{
+		{
+			name: "keep by default",
+			input: `ipdestinationguard {
+				mode nft-local
+			}`,
+			expectedOnShutdown: ShutdownKeep,
+		},
+		{
+			name:               "keep by default in single-line format",
+			input:              `ipdestinationguard nft-local 9.9.9.9`,
+			expectedOnShutdown: ShutdownKeep,
+		},
+		{
+			name: "remove",
+			input: `ipdestinationguard {
+				mode nft-local
+				onShutdown remove
+			}`,
+			expectedOnShutdown: ShutdownRemove,
+		},
+		{
+			name: "freeze",
+			input: `ipdestinationguard {
+				mode nft-both
+				onShutdown freeze
+			}`,
+			expectedOnShutdown: ShutdownFreeze,
+		},
+		{
+			name: "owned table",
+			input: `ipdestinationguard {
+				mode nft-local
+				onShutdown remove
+				ownedTable
+			}`,
+			expectedOnShutdown: ShutdownRemove,
+			expectedOwnedTable: true,
+		},
+		{
+			name: "invalid action",
+			input: `ipdestinationguard {
+				mode nft-local
+				onShutdown flush
+			}`,
+			shouldError:   true,
+			errorContains: "invalid onShutdown 'flush'",
+		},
+		{
+			name: "without argument",
+			input: `ipdestinationguard {
+				mode nft-local
+				onShutdown
+			}`,
+			shouldError:   true,
+			errorContains: "onShutdown directive expects exactly one argument",
+		},
+		{
+			name: "owned table with argument",
+			input: `ipdestinationguard {
+				mode nft-local
+				ownedTable yes
+			}`,
+			shouldError:   true,
+			errorContains: "ownedTable directive expects no arguments",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tt.input)
+			c.Next() // consume plugin name
+
+			config, err := parseConfig(c)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error containing '%s', but got no error", tt.errorContains)
+					return
+				}
+				if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', but got: %v", tt.errorContains, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			if config.onShutdown != tt.expectedOnShutdown {
+				t.Errorf("Expected onShutdown '%s', got '%s'", tt.expectedOnShutdown, config.onShutdown)
+			}
+
+			if config.ownedTable != tt.expectedOwnedTable {
+				t.Errorf("Expected ownedTable %v, got %v", tt.expectedOwnedTable, config.ownedTable)
+			}
+		})
+	}
+}
+
+func TestParseConfigOnFirewallError(t *testing.T) {
+	tests := []struct {
+		name           string
+		input          string
+		expectedAction FirewallErrorAction
+		shouldError    bool
+		errorContains  string
+	}{
+		{
+			name: "pass by default",
+			input: `ipdestinationguard {
+				mode nft-local
+			}`,
+			expectedAction: FirewallErrorPass,
+		},
+		{
+			name:           "pass by default in single-line format",
+			input:          `ipdestinationguard nft-local 9.9.9.9`,
+			expectedAction: FirewallErrorPass,
+		},
+		{
+			name: "servfail",
+			input: `ipdestinationguard {
+				mode nft-local
+				commitMode sync
+				onFirewallError servfail
+			}`,
+			expectedAction: FirewallErrorServfail,
+		},
+		{
+			name: "strip",
+			input: `ipdestinationguard {
+				mode nft-local
+				commitMode sync
+				onFirewallError strip
+			}`,
+			expectedAction: FirewallErrorStrip,
+		},
+		{
+			name: "invalid action",
+			input: `ipdestinationguard {
+				mode nft-local
+				onFirewallError refuse
+			}`,
+			shouldError:   true,
+			errorContains: "invalid onFirewallError 'refuse'",
+		},
+		{
+			name: "without action",
+			input: `ipdestinationguard {
+				mode nft-local
+				onFirewallError
+			}`,
+			shouldError:   true,
+			errorContains: "onFirewallError directive expects exactly one argument",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tt.input)
+			c.Next() // consume plugin name
+
+			config, err := parseConfig(c)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error containing '%s', but got no error", tt.errorContains)
+					return
+				}
+				if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', but got: %v", tt.errorContains, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			if config.onFirewallError != tt.expectedAction {
+				t.Errorf("Expected onFirewallError '%s', got '%s'", tt.expectedAction, config.onFirewallError)
+			}
+		})
+	}
+}
+
+func TestParseConfigQueue(t *testing.T) {
+	tests := []struct {
+		name                  string
+		input                 string
+		expectedSize          int
+		expectedQueueOverflow QueueOverflowPolicy
+		shouldError           bool
+		errorContains         string
+	}{
+		{
+			name: "defaults",
+			input: `ipdestinationguard {
+				mode nft-local
+			}`,
+			expectedSize:          defaultQueueSize,
+			expectedQueueOverflow: QueueOverflowBlock,
+		},
+		{
+			name: "size only",
+			input: `ipdestinationguard {
+				mode nft-local
+				queue 500
+			}`,
+			expectedSize:          500,
+			expectedQueueOverflow: QueueOverflowBlock,
+		},
+		{
+			name: "size and overflow policy",
+			input: `ipdestinationguard {
+				mode nft-local
+				queue 500 servfail
+			}`,
+			expectedSize:          500,
+			expectedQueueOverflow: QueueOverflowServfail,
+		},
+		{
+			name: "invalid size",
+			input: `ipdestinationguard {
+				mode nft-local
+				queue 0 drop
+			}`,
+			shouldError:   true,
+			errorContains: "invalid queue size '0'",
+		},
+		{
+			name: "invalid overflow policy",
+			input: `ipdestinationguard {
+				mode nft-local
+				queue 500 refuse
+			}`,
+			shouldError:   true,
+			errorContains: "invalid queue overflow policy 'refuse'",
+		},
+		{
+			name: "without arguments",
+			input: `ipdestinationguard {
+				mode nft-local
+				queue
+			}`,
+			shouldError:   true,
+			errorContains: "queue directive expects a size and an optional overflow policy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tt.input)
+			c.Next() // consume plugin name
+
+			config, err := parseConfig(c)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error containing '%s', but got no error", tt.errorContains)
+					return
+				}
+				if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', but got: %v", tt.errorContains, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			if config.queueSize != tt.expectedSize || config.queueOverflow != tt.expectedQueueOverflow {
+				t.Errorf("Expected queue %d %s, got %d %s", tt.expectedSize, tt.expectedQueueOverflow, config.queueSize, config.queueOverflow)
+			}
+		})
+	}
+}
+
+func TestParseConfigReconcileInterval(t *testing.T) {
+	tests := []struct {
+		name             string
+		input            string
+		expectedInterval time.Duration
+		shouldError      bool
+		errorContains    string
+	}{
+		{
+			name: "one minute by default",
+			input: `ipdestinationguard {
+				mode nft-local
+			}`,
+			expectedInterval: time.Minute,
+		},
+		{
+			name:             "one minute by default in single-line format",
+			input:            `ipdestinationguard nft-local 9.9.9.9`,
+			expectedInterval: time.Minute,
+		},
+		{
+			name: "interval",
+			input: `ipdestinationguard {
+				mode nft-local
+				reconcileInterval 10s
+			}`,
+			expectedInterval: 10 * time.Second,
+		},
+		{
+			name: "disabled",
+			input: `ipdestinationguard {
+				mode nft-local
+				reconcileInterval 0s
+			}`,
+			expectedInterval: 0,
+		},
+		{
+			name: "negative interval",
+			input: `ipdestinationguard {
+				mode nft-local
+				reconcileInterval -1m
+			}`,
+			shouldError:   true,
+			errorContains: "invalid reconcileInterval '-1m'",
+		},
+		{
+			name: "without interval",
+			input: `ipdestinationguard {
+				mode nft-local
+				reconcileInterval
+			}`,
+			shouldError:   true,
+			errorContains: "reconcileInterval directive expects exactly one argument",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tt.input)
+			c.Next() // consume plugin name
+
+			config, err := parseConfig(c)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error containing '%s', but got no error", tt.errorContains)
+					return
+				}
+				if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', but got: %v", tt.errorContains, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			if config.reconcileInterval != tt.expectedInterval {
+				t.Errorf("Expected reconcileInterval %v, got %v", tt.expectedInterval, config.reconcileInterval)
+			}
+		})
+	}
+}
+
+func TestParseConfigNflogGroup(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		expectedGroup uint16
+		shouldError   bool
+		errorContains string
+	}{
+		{
+			name: "disabled by default",
+			input: `ipdestinationguard {
+				mode nft-local
+			}`,
+			expectedGroup: 0,
+		},
+		{
+			name: "group",
+			input: `ipdestinationguard {
+				mode nft-local
+				nflogGroup 100
+			}`,
+			expectedGroup: 100,
+		},
+		{
+			name: "group zero",
+			input: `ipdestinationguard {
+				mode nft-local
+				nflogGroup 0
+			}`,
+			shouldError:   true,
+			errorContains: "invalid nflogGroup '0'",
+		},
+		{
+			name: "group out of range",
+			input: `ipdestinationguard {
+				mode nft-local
+				nflogGroup 65536
+			}`,
+			shouldError:   true,
+			errorContains: "must be a number between 1 and 65535",
+		},
+		{
+			name: "without group",
+			input: `ipdestinationguard {
+				mode nft-local
+				nflogGroup
+			}`,
+			shouldError:   true,
+			errorContains: "nflogGroup directive expects exactly one argument",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tt.input)
+			c.Next() // consume plugin name
+
+			config, err := parseConfig(c)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error containing '%s', but got no error", tt.errorContains)
+					return
+				}
+				if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', but got: %v", tt.errorContains, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			if config.nflogGroup != tt.expectedGroup {
+				t.Errorf("Expected nflogGroup %d, got %d", tt.expectedGroup, config.nflogGroup)
+			}
+		})
+	}
+}
+
+func TestParseConfigLearn(t *testing.T) {
+	tests := []struct {
+		name             string
+		input            string
+		expectedFile     string
+		expectedDuration time.Duration
+		shouldError      bool
+		errorContains    string
+	}{
+		{
+			name: "disabled by default",
+			input: `ipdestinationguard {
+				mode nft-local
+			}`,
+		},
+		{
+			name: "file with default duration",
+			input: `ipdestinationguard {
+				mode nft-local
+				learn /var/lib/coredns/learned.conf
+			}`,
+			expectedFile:     "/var/lib/coredns/learned.conf",
+			expectedDuration: defaultLearnDuration,
+		},
+		{
+			name: "file with duration",
+			input: `ipdestinationguard {
+				mode nft-local
+				learn /var/lib/coredns/learned.conf 7d
+			}`,
+			shouldError:   true,
+			errorContains: "invalid learn duration '7d'",
+		},
+		{
+			name: "relative file with duration",
+			input: `ipdestinationguard {
+				mode nft-local
+				learn learned.conf 168h
+			}`,
+			expectedFile:     "learned.conf",
+			expectedDuration: 168 * time.Hour,
+		},
+		{
+			name: "zero duration",
+			input: `ipdestinationguard {
+				mode nft-local
+				learn learned.conf 0s
+			}`,
+			shouldError:   true,
+			errorContains: "must be a duration greater than zero",
+		},
+		{
+			name: "without file",
+			input: `ipdestinationguard {
+				mode nft-local
+				learn
+			}`,
+			shouldError:   true,
+			errorContains: "learn directive expects a file and an optional duration",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tt.input)
+			c.Next() // consume plugin name
+
+			config, err := parseConfig(c)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error containing '%s', but got no error", tt.errorContains)
+					return
+				}
+				if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', but got: %v", tt.errorContains, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			// Relative files are resolved against the root of the server, which is empty in tests
+			if config.learnFile != tt.expectedFile {
+				t.Errorf("Expected learn file '%s', got '%s'", tt.expectedFile, config.learnFile)
+			}
+
+			if config.learnDuration != tt.expectedDuration {
+				t.Errorf("Expected learn duration %v, got %v", tt.expectedDuration, config.learnDuration)
+			}
+		})
+	}
+}
+
+func TestParseConfigStateFile(t *testing.T) {
+	tests := []struct {
+		name             string
+		input            string
+		expectedFile     string
+		expectedInterval time.Duration
+		shouldError      bool
+		errorContains    string
+	}{
+		{
+			name: "disabled by default",
+			input: `ipdestinationguard {
+				mode nft-local
+			}`,
+		},
+		{
+			name: "file with default interval",
+			input: `ipdestinationguard {
+				mode nft-local
+				stateFile /var/lib/coredns/state.json
+			}`,
+			expectedFile:     "/var/lib/coredns/state.json",
+			expectedInterval: defaultStateInterval,
+		},
+		{
+			name: "invalid interval",
+			input: `ipdestinationguard {
+				mode nft-local
+				stateFile /var/lib/coredns/state.json 1d
+			}`,
+			shouldError:   true,
+			errorContains: "invalid stateFile interval '1d'",
+		},
+		{
+			name: "relative file with interval",
+			input: `ipdestinationguard {
+				mode nft-local
+				stateFile state.json 5m
+			}`,
+			expectedFile:     "state.json",
+			expectedInterval: 5 * time.Minute,
+		},
+		{
+			name: "zero interval",
+			input: `ipdestinationguard {
+				mode nft-local
+				stateFile state.json 0s
+			}`,
+			shouldError:   true,
+			errorContains: "must be a duration greater than zero",
+		},
+		{
+			name: "without file",
+			input: `ipdestinationguard {
+				mode nft-local
+				stateFile
+			}`,
+			shouldError:   true,
+			errorContains: "stateFile directive expects a file and an optional interval",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tt.input)
+			c.Next() // consume plugin name
+
+			config, err := parseConfig(c)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("Expected error containing '%s', but got no error", tt.errorContains)
+					return
+				}
+				if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', but got: %v", tt.errorContains, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			// Relative files are resolved against the root of the server, which is empty in tests
+			if config.stateFile != tt.expectedFile {
+				t.Errorf("Expected state file '%s', got '%s'", tt.expectedFile, config.stateFile)
+			}
+
+			if config.stateInterval != tt.expectedInterval {
+				t.Errorf("Expected state interval %v, got %v", tt.expectedInterval, config.stateInterval)
+			}
+		})
+	}
+}
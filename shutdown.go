@@ -0,0 +1,175 @@
+package ipdestinationguard
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// The kernel removes a table with this flag, once the netlink socket that created it is closed (NFT_TABLE_F_OWNER,
+// which golang.org/x/sys/unix doesn't define).
+const nftTableFlagOwner = 0x2
+
+// Returns the flags of given listed table. The nftables library decodes them in native byte order, but the kernel
+// sends them in network byte order.
+func tableFlags(table *nftables.Table) uint32 {
+	return binary.BigEndian.Uint32(binaryutil.NativeEndian.PutUint32(table.Flags))
+}
+
+// Creates the table of this plugin, or recreates it, if the owner flag of an existing table doesn't match the config.
+// The flag of an existing table can't be changed, so the dynamic entries of a recreated table are lost, unless they
+// are handed over on a reload.
+func (manager *NFTablesManager) prepareTable(targetTable *nftables.Table, owned bool) error {
+	existingTables, err := manager.nlInterface.ListTablesOfFamily(targetTable.Family)
+	if err != nil {
+		return err
+	}
+
+	for _, existingTable := range existingTables {
+		if existingTable.Name != targetTable.Name {
+			continue
+		}
+		if (tableFlags(existingTable)&nftTableFlagOwner != 0) == owned {
+			// Like a table of the boot script, or of a previous run
+			log.Infof("Taking over the existing table %s, keeping the elements of its sets", targetTable.Name)
+			continue
+		}
+
+		log.Warningf("Recreating table %s, as ownedTable changed", targetTable.Name)
+		manager.nlInterface.DelTable(targetTable)
+		if err := manager.nlInterface.Flush(); err != nil {
+			nftablesFlushErrorsTotal.Inc()
+			return err
+		}
+	}
+
+	if !owned {
+		manager.nlInterface.AddTable(targetTable)
+		return nil
+	}
+
+	return manager.addOwnedTable(targetTable)
+}
+
+// Creates given table with the owner flag through the socket of nlInterface, as the nftables library can't set table
+// flags. Does nothing, if the table exists already.
+func (manager *NFTablesManager) addOwnedTable(targetTable *nftables.Table) error {
+	if manager.netlinkConn == nil {
+		return errors.New("the netlink socket for an owned table is unavailable")
+	}
+
+	attributes, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_TABLE_NAME, Data: []byte(targetTable.Name + "\x00")},
+		{Type: unix.NFTA_TABLE_FLAGS, Data: binaryutil.BigEndian.PutUint32(nftTableFlagOwner)},
+	})
+	if err != nil {
+		return err
+	}
+
+	batchHeader := []byte{0, unix.NFNETLINK_V0, 0, unix.NFNL_SUBSYS_NFTABLES}
+	messages := []netlink.Message{
+		{
+			Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_MSG_BATCH_BEGIN), Flags: netlink.Request},
+			Data:   batchHeader,
+		},
+		{
+			Header: netlink.Header{
+				Type:  netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | unix.NFT_MSG_NEWTABLE),
+				Flags: netlink.Request | netlink.Acknowledge | netlink.Create,
+			},
+			Data: append([]byte{byte(targetTable.Family), unix.NFNETLINK_V0, 0, 0}, attributes...),
+		},
+		{
+			Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_MSG_BATCH_END), Flags: netlink.Request},
+			Data:   batchHeader,
+		},
+	}
+
+	if _, err := manager.netlinkConn.SendMessages(messages); err != nil {
+		return fmt.Errorf("error creating owned table %s: %w", targetTable.Name, err)
+	}
+	if _, err := manager.netlinkConn.Receive(); err != nil {
+		return fmt.Errorf("error creating owned table %s: %w", targetTable.Name, err)
+	}
+
+	return nil
+}
+
+// FinalShutdown applies the configured onShutdown action, once CoreDNS stops. Registered as OnFinalShutdown callback,
+// so it runs after Shutdown stopped the manager goroutine.
+func (manager *NFTablesManager) FinalShutdown() error {
+	targetTable := &nftables.Table{Name: tableName, Family: nftables.TableFamilyINet}
+
+	switch manager.onShutdown {
+	case ShutdownRemove:
+		manager.nlInterface.DelTable(targetTable)
+		// Another server block might have removed the table already
+		if err := manager.nlInterface.Flush(); err != nil && !errors.Is(err, unix.ENOENT) {
+			return fmt.Errorf("error removing table %s: %w", tableName, err)
+		}
+		log.Infof("Removed table %s, all traffic is allowed again", tableName)
+
+	case ShutdownFreeze:
+		frozenCount, err := manager.freezeEntries(time.Now())
+		if err != nil {
+			return fmt.Errorf("error freezing the allowlist: %w", err)
+		}
+		log.Infof("Froze %d allowlist entries, they stay allowed until CoreDNS starts again", frozenCount)
+	}
+
+	return nil
+}
+
+// Replaces the entries of the allowList, that are still valid, with elements without timeout, so they stay allowed
+// while nothing maintains the sets. A later start recovers them with the recovery lifetime. Returns the number of
+// frozen entries. The manager goroutine must have stopped already.
+func (manager *NFTablesManager) freezeEntries(now time.Time) (int, error) {
+	elementsToDelete := make(map[*nftables.Set][]nftables.SetElement)
+	frozenElements := make(map[*nftables.Set][]nftables.SetElement)
+	frozenCount := 0
+
+	for _, route := range manager.allowList {
+		if !route.validUnitl.After(now) {
+			continue
+		}
+
+		targetSet := manager.allowSetFor(route)
+		element := nftables.SetElement{Key: route.elementKey()}
+		// Elements about to expire might be gone already, and deleting those would fail the whole batch, so they're
+		// only added. If they still exist, they keep their timeout
+		if route.validUnitl.After(now.Add(refreshSafetyMargin)) {
+			elementsToDelete[targetSet] = append(elementsToDelete[targetSet], element)
+		}
+		frozenElements[targetSet] = append(frozenElements[targetSet], element)
+		frozenCount++
+	}
+
+	if frozenCount == 0 {
+		return 0, nil
+	}
+
+	// An existing element keeps its timeout, so it's deleted and added again in the same transaction
+	for targetSet, elements := range elementsToDelete {
+		if err := manager.nlInterface.SetDeleteElements(targetSet, elements); err != nil {
+			return 0, err
+		}
+	}
+	for targetSet, elements := range frozenElements {
+		if err := manager.nlInterface.SetAddElements(targetSet, elements); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := manager.nlInterface.Flush(); err != nil {
+		nftablesFlushErrorsTotal.Inc()
+		return 0, err
+	}
+
+	return frozenCount, nil
+}
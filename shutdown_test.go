@@ -0,0 +1,98 @@
+package ipdestinationguard
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestTableFlags(t *testing.T) {
+	// The kernel sends NFTA_TABLE_FLAGS in network byte order, which the nftables library decodes in native byte order
+	table := &nftables.Table{Flags: binaryutil.NativeEndian.Uint32(binaryutil.BigEndian.PutUint32(nftTableFlagOwner))}
+
+	if flags := tableFlags(table); flags != nftTableFlagOwner {
+		t.Errorf("Expected flags %#x, got %#x", nftTableFlagOwner, flags)
+	}
+}
+
+func TestFreezeEntries(t *testing.T) {
+	manager := newTestNFTablesManager(t, testAdminConfig(t, ScopeClient))
+
+	for _, entry := range []struct {
+		ip    string
+		scope string
+	}{
+		{"192.0.2.1", ""},
+		{"2001:db8::1", ""},
+		{"192.0.2.2", "10.0.0.5"},
+	} {
+		if err := manager.AddTemporaryRoute(net.ParseIP(entry.ip), time.Hour, entry.scope); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := manager.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	frozenCount, err := manager.freezeEntries(time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if frozenCount != 3 {
+		t.Errorf("Expected 3 frozen entries, got %d", frozenCount)
+	}
+
+	// Entries, that expired meanwhile, aren't frozen
+	frozenCount, err = manager.freezeEntries(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if frozenCount != 0 {
+		t.Errorf("Expected no frozen entries, got %d", frozenCount)
+	}
+}
+
+func TestFreezeEntriesWithinSafetyMargin(t *testing.T) {
+	var elementMessages []string
+	nlInterface, err := nftables.New(nftables.WithTestDial(func(req []netlink.Message) ([]netlink.Message, error) {
+		for _, message := range req {
+			switch message.Header.Type & 0xff {
+			case unix.NFT_MSG_NEWSETELEM:
+				elementMessages = append(elementMessages, "add")
+			case unix.NFT_MSG_DELSETELEM:
+				elementMessages = append(elementMessages, "delete")
+			}
+		}
+		return req, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager := newStoppedTestNFTablesManager(t, testAdminConfig(t, ScopeGlobal))
+	manager.nlInterface = nlInterface
+
+	now := time.Now()
+	manager.storeRoute(&allowRoute{ipAddress: net.ParseIP("192.0.2.1").To4(), validUnitl: now.Add(time.Second)})
+	manager.storeRoute(&allowRoute{ipAddress: net.ParseIP("2001:db8::1"), validUnitl: now.Add(time.Hour)})
+
+	frozenCount, err := manager.freezeEntries(now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if frozenCount != 2 {
+		t.Errorf("Expected 2 frozen entries, got %d", frozenCount)
+	}
+
+	// The element about to expire might be gone already, so only the IPv6 set gets a delete
+	if expected := []string{"delete", "add", "add"}; !slices.Equal(elementMessages, expected) {
+		t.Errorf("Expected element messages %v, got %v", expected, elementMessages)
+	}
+}
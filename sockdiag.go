@@ -0,0 +1,134 @@
+package ipdestinationguard
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Returned, if the kernel can't be asked via sock_diag (like without the diag modules, or in a sandbox without
+// netlink access), so the lookup falls back to /proc.
+var errSockDiagUnavailable = errors.New("sock_diag unavailable")
+
+// Asks the kernel for the owner of the local socket, that uses given address as its local address, only changed by
+// tests. Returns errSockDiagUnavailable, if sock_diag can't be used.
+var querySocketOwner = querySockDiag
+
+// Constants of linux/inet_diag.h, that golang.org/x/sys/unix lacks.
+const (
+	inetDiagReqBytecode = 1  // INET_DIAG_REQ_BYTECODE
+	inetDiagCgroupID    = 21 // INET_DIAG_CGROUP_ID, since linux 5.7
+	inetDiagBCSourceEq  = 11 // INET_DIAG_BC_S_EQ
+
+	inetDiagReqLength = 56 // sizeof(struct inet_diag_req_v2)
+	inetDiagMsgLength = 72 // sizeof(struct inet_diag_msg)
+)
+
+// Asks sock_diag for the sockets of given protocol bound to given port, and returns the owner of the one using given
+// address. Like parseProcNetSockets, sockets bound to the wildcard address only match, if local is set. Both address
+// families are asked, as sockets bound to "::" receive IPv4 queries as well.
+func querySockDiag(protocol uint8, ip net.IP, port int, local bool) (*socketOwner, error) {
+	conn, err := netlink.Dial(unix.NETLINK_SOCK_DIAG, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errSockDiagUnavailable, err)
+	}
+	defer conn.Close()
+
+	var wildcardOwner *socketOwner
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		messages, err := conn.Execute(sockDiagRequest(family, protocol, port))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errSockDiagUnavailable, err)
+		}
+
+		for _, message := range messages {
+			localIP, localPort, owner, err := parseSockDiagMessage(message.Data)
+			if err != nil {
+				return nil, err
+			}
+			if localPort != port {
+				continue
+			}
+
+			if localIP.Equal(ip) {
+				return owner, nil
+			}
+			if local && localIP.IsUnspecified() && wildcardOwner == nil {
+				wildcardOwner = owner
+			}
+		}
+	}
+
+	return wildcardOwner, nil
+}
+
+// Returns a dump request for the sockets of given family and protocol in any state, that are bound to given local
+// port. The kernel filters them, so only a few sockets are reported, however many exist.
+func sockDiagRequest(family uint8, protocol uint8, port int) netlink.Message {
+	// struct inet_diag_req_v2: family, protocol, extensions, padding, states and the zero socket id of a dump
+	request := make([]byte, inetDiagReqLength)
+	request[0] = family
+	request[1] = protocol
+	binary.NativeEndian.PutUint32(request[4:], ^uint32(0))
+
+	// A single comparison of the local port, which continues with the end of the program (accept) if it's equal, and
+	// jumps past it (reject) otherwise. The port is compared in host byte order
+	bytecode := make([]byte, 8)
+	bytecode[0], bytecode[1] = inetDiagBCSourceEq, 8
+	binary.NativeEndian.PutUint16(bytecode[2:], 12)
+	binary.NativeEndian.PutUint16(bytecode[6:], uint16(port))
+
+	attributes, _ := netlink.MarshalAttributes([]netlink.Attribute{{Type: inetDiagReqBytecode, Data: bytecode}})
+
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.SOCK_DIAG_BY_FAMILY),
+			Flags: netlink.Request | netlink.Dump,
+		},
+		Data: append(request, attributes...),
+	}
+}
+
+// Parses a struct inet_diag_msg with its attributes, and returns the local address and port of the socket, and its
+// owner. The cgroup id stays 0 on kernels, that don't report it.
+func parseSockDiagMessage(data []byte) (net.IP, int, *socketOwner, error) {
+	if len(data) < inetDiagMsgLength {
+		return nil, 0, nil, fmt.Errorf("sock_diag message of %d bytes is too short", len(data))
+	}
+
+	// family, state, timer, retrans, then the socket id: source port and address in network byte order
+	var localIP net.IP
+	switch data[0] {
+	case unix.AF_INET:
+		localIP = net.IP(append([]byte{}, data[8:12]...))
+	case unix.AF_INET6:
+		localIP = net.IP(append([]byte{}, data[8:24]...))
+	default:
+		return nil, 0, nil, fmt.Errorf("unsupported sock_diag family %d", data[0])
+	}
+	localPort := int(binary.BigEndian.Uint16(data[4:6]))
+
+	owner := &socketOwner{
+		uid:   binary.NativeEndian.Uint32(data[64:68]),
+		inode: uint64(binary.NativeEndian.Uint32(data[68:72])),
+	}
+
+	decoder, err := netlink.NewAttributeDecoder(data[inetDiagMsgLength:])
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	for decoder.Next() {
+		if decoder.Type() == inetDiagCgroupID {
+			owner.cgroupID = decoder.Uint64()
+		}
+	}
+	if err := decoder.Err(); err != nil {
+		return nil, 0, nil, err
+	}
+
+	return localIP, localPort, owner, nil
+}
@@ -0,0 +1,122 @@
+package ipdestinationguard
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseSockDiagMessage(t *testing.T) {
+	message := make([]byte, inetDiagMsgLength)
+	message[0] = unix.AF_INET6
+	binary.BigEndian.PutUint16(message[4:], 40000)
+	copy(message[8:], net.ParseIP("::ffff:127.0.0.1"))
+	binary.NativeEndian.PutUint32(message[64:], 1000)
+	binary.NativeEndian.PutUint32(message[68:], 1234)
+
+	cgroupID := make([]byte, 8)
+	binary.NativeEndian.PutUint64(cgroupID, 5678)
+	attributes, err := netlink.MarshalAttributes([]netlink.Attribute{{Type: inetDiagCgroupID, Data: cgroupID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localIP, localPort, owner, err := parseSockDiagMessage(append(message, attributes...))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !localIP.Equal(net.ParseIP("127.0.0.1")) || localPort != 40000 {
+		t.Errorf("Expected 127.0.0.1:40000, got %v:%d", localIP, localPort)
+	}
+	if *owner != (socketOwner{uid: 1000, inode: 1234, cgroupID: 5678}) {
+		t.Errorf("Unexpected owner %+v", owner)
+	}
+
+	// Kernels before 5.7 don't report the cgroup id
+	if _, _, owner, err := parseSockDiagMessage(message); err != nil || owner.cgroupID != 0 {
+		t.Errorf("Expected no cgroup id, got %+v and %v", owner, err)
+	}
+
+	if _, _, _, err := parseSockDiagMessage(message[:40]); err == nil {
+		t.Error("Expected an error for a truncated message")
+	}
+}
+
+func TestQuerySockDiag(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	wildcardConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wildcardConn.Close()
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	owner, err := querySockDiag(unix.IPPROTO_UDP, net.ParseIP("127.0.0.1"), port, true)
+	if errors.Is(err, errSockDiagUnavailable) {
+		t.Skipf("sock_diag isn't available: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if owner == nil {
+		t.Fatal("Expected the socket to be found")
+	}
+
+	file, err := conn.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var stat unix.Stat_t
+	if err := unix.Fstat(int(file.Fd()), &stat); err != nil {
+		t.Fatal(err)
+	}
+	if owner.uid != uint32(os.Getuid()) || owner.inode != stat.Ino {
+		t.Errorf("Expected uid %d and inode %d, got %+v", os.Getuid(), stat.Ino, owner)
+	}
+
+	// The kernel only reports the sockets bound to the port
+	diagConn, err := netlink.Dial(unix.NETLINK_SOCK_DIAG, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer diagConn.Close()
+	messages, err := diagConn.Execute(sockDiagRequest(unix.AF_INET, unix.IPPROTO_UDP, port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Errorf("Expected 1 socket bound to port %d, got %d", port, len(messages))
+	}
+
+	// Sockets bound to the wildcard address only match clients of the host itself
+	wildcardPort := wildcardConn.LocalAddr().(*net.UDPAddr).Port
+	for _, tt := range []struct {
+		ip            string
+		local         bool
+		expectedFound bool
+	}{
+		{ip: "127.0.0.1", local: true, expectedFound: true},
+		{ip: "10.0.0.5", local: false, expectedFound: false},
+	} {
+		t.Run(fmt.Sprintf("wildcard %s", tt.ip), func(t *testing.T) {
+			owner, err := querySockDiag(unix.IPPROTO_UDP, net.ParseIP(tt.ip), wildcardPort, tt.local)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if (owner != nil) != tt.expectedFound {
+				t.Errorf("Expected found %v, got %+v", tt.expectedFound, owner)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package ipdestinationguard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+// Version of the state file format. Files of other versions are ignored, so an upgrade starts with the kernel sets only.
+const stateFileVersion = 1
+
+// Default interval the dynamic allowlist is saved to the state file in.
+const defaultStateInterval = time.Minute
+
+// The content of the state file.
+type stateFileContent struct {
+	Version int          `json:"version"`
+	Saved   time.Time    `json:"saved"`
+	Scope   Scope        `json:"scope"` // Scope of the entries, scoped entries of another scope can't be restored
+	Entries []stateEntry `json:"entries"`
+}
+
+// A dynamic allowlist entry within the state file.
+type stateEntry struct {
+	IP      string    `json:"ip"`
+	Scope   string    `json:"scope,omitempty"` // Label of the scope, like AllowListEntry.Scope
+	Domain  string    `json:"domain,omitempty"`
+	Client  string    `json:"client,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// Returns the state file content for given allowList, without the entries, that expired already.
+func newStateFileContent(allowList map[routeKey]*allowRoute, scope Scope, now time.Time) *stateFileContent {
+	content := &stateFileContent{
+		Version: stateFileVersion,
+		Saved:   now,
+		Scope:   scope,
+		Entries: make([]stateEntry, 0, len(allowList)),
+	}
+
+	for _, route := range allowList {
+		if !route.validUnitl.After(now) {
+			continue
+		}
+
+		content.Entries = append(content.Entries, stateEntry{
+			IP:      route.ipAddress.String(),
+			Scope:   route.scopeLabel,
+			Domain:  route.domain,
+			Client:  route.client,
+			Expires: route.validUnitl,
+		})
+	}
+
+	return content
+}
+
+// Saves the entries of the allowList to the state file. Runs on the manager goroutine, or after it stopped.
+func (manager *NFTablesManager) saveState(now time.Time) error {
+	data, err := json.Marshal(newStateFileContent(manager.allowList, manager.scope, now))
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(manager.stateFile, data)
+}
+
+// Reads the state file and adds its entries, that didn't expire yet, to the allowList and the kernel sets. Entries
+// recovered from the kernel keep their expiry, and only get their domain and client back. Returns the number of
+// added IPv4 and IPv6 entries.
+func (manager *NFTablesManager) restoreState(now time.Time) (int, int, error) {
+	data, err := os.ReadFile(manager.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var content stateFileContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return 0, 0, fmt.Errorf("invalid state file %s: %w", manager.stateFile, err)
+	}
+	if content.Version != stateFileVersion {
+		return 0, 0, fmt.Errorf("state file %s has version %d, but only version %d is supported", manager.stateFile, content.Version, stateFileVersion)
+	}
+
+	// Entries are only stored after their elements were flushed, so the allowList never holds entries the kernel lacks
+	restoredRoutes := make(map[routeKey]*allowRoute)
+	elementsToAdd := make(map[*nftables.Set][]nftables.SetElement)
+	var ipv4AddedCount, ipv6AddedCount int
+
+	for _, entry := range content.Entries {
+		if !entry.Expires.After(now) {
+			continue
+		}
+
+		ip := net.ParseIP(entry.IP)
+		if ip == nil {
+			continue
+		}
+		if ipv4 := ip.To4(); ipv4 != nil {
+			ip = ipv4
+		}
+
+		// Scoped entries only fit the sets of the same scope
+		if entry.Scope != "" && content.Scope != manager.scope {
+			continue
+		}
+		scopeKey, scopeLabel, err := manager.parseScopeLabel(entry.Scope)
+		if err != nil {
+			continue
+		}
+		if manager.scope == ScopeClient && scopeKey != nil && len(scopeKey) != len(ip) {
+			continue
+		}
+
+		route := &allowRoute{ipAddress: ip, scopeKey: scopeKey, scopeLabel: scopeLabel}
+		if existingRoute, exists := manager.allowList[route.key()]; exists {
+			existingRoute.domain = entry.Domain
+			existingRoute.client = entry.Client
+			continue
+		}
+		if _, exists := restoredRoutes[route.key()]; exists {
+			continue
+		}
+
+		route.validUnitl = entry.Expires
+		route.domain = entry.Domain
+		route.client = entry.Client
+		restoredRoutes[route.key()] = route
+
+		targetSet := manager.allowSetFor(route)
+		elementsToAdd[targetSet] = append(elementsToAdd[targetSet], nftables.SetElement{
+			Key:     route.elementKey(),
+			Timeout: elementTimeout(route.validUnitl, now),
+		})
+
+		if len(ip) == net.IPv4len {
+			ipv4AddedCount++
+		} else {
+			ipv6AddedCount++
+		}
+	}
+
+	if len(elementsToAdd) == 0 {
+		return 0, 0, nil
+	}
+
+	for targetSet, elements := range elementsToAdd {
+		if err := manager.nlInterface.SetAddElements(targetSet, elements); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if err := manager.flush(flushPathPrepare, now); err != nil {
+		nftablesFlushErrorsTotal.Inc()
+		return 0, 0, err
+	}
+
+	for _, route := range restoredRoutes {
+		manager.storeRoute(route)
+	}
+
+	return ipv4AddedCount, ipv6AddedCount, nil
+}
+
+// Writes given data to a temporary file next to given path first, and renames it afterwards, so the file is never
+// read half-written.
+func writeFileAtomically(path string, data []byte) error {
+	tempFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	if err := os.Rename(tempFile.Name(), path); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,246 @@
+package ipdestinationguard
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Returns the config of the admin tests with a state file in a temporary directory.
+func testStateConfig(t *testing.T, scope Scope) *parsedConfig {
+	t.Helper()
+
+	config := testAdminConfig(t, scope)
+	config.stateFile = filepath.Join(t.TempDir(), "state.json")
+	config.stateInterval = time.Hour
+
+	return config
+}
+
+func TestSaveAndRestoreState(t *testing.T) {
+	config := testStateConfig(t, ScopeClient)
+
+	manager := newTestNFTablesManager(t, config)
+	manager.AddRoutes(&QueryInfo{Name: "example.com.", Client: &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 5353}},
+		[]RouteEntry{{IP: net.ParseIP("192.0.2.1").To4(), TTL: 300}})
+	if err := manager.AddTemporaryRoute(net.ParseIP("2001:db8::1"), time.Hour, ""); err != nil {
+		t.Fatal(err)
+	}
+	expected := mustEntries(t, manager)
+
+	if err := manager.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newStoppedTestNFTablesManager(t, config)
+	ipv4Count, ipv6Count, err := restored.restoreState(time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ipv4Count != 1 || ipv6Count != 1 {
+		t.Errorf("Expected 1 IPv4 and 1 IPv6 entry, got %d and %d", ipv4Count, ipv6Count)
+	}
+
+	for _, expectedEntry := range expected {
+		route, exists := restored.allowList[parseRouteKey(expectedEntry.Scope+"/"+expectedEntry.IP)]
+		if expectedEntry.Scope == "" {
+			route, exists = restored.allowList[parseRouteKey(expectedEntry.IP)]
+		}
+		if !exists {
+			t.Errorf("Expected entry %s/%s to be restored", expectedEntry.Scope, expectedEntry.IP)
+			continue
+		}
+
+		if !route.validUnitl.Equal(expectedEntry.Expires) || route.domain != expectedEntry.Domain || route.client != expectedEntry.Client {
+			t.Errorf("Expected %+v, got expiry %v, domain '%s' and client '%s'", expectedEntry, route.validUnitl, route.domain, route.client)
+		}
+	}
+}
+
+func TestRestoreState(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name          string
+		scope         Scope
+		content       string
+		expectedKeys  []string
+		shouldError   bool
+		errorContains string
+	}{
+		{
+			name:  "expired entries are dropped",
+			scope: ScopeGlobal,
+			content: stateFileJSON(t, stateFileContent{Version: stateFileVersion, Scope: ScopeGlobal, Entries: []stateEntry{
+				{IP: "192.0.2.1", Expires: now.Add(time.Hour)},
+				{IP: "192.0.2.2", Expires: now.Add(-time.Minute)},
+			}}),
+			expectedKeys: []string{"192.0.2.1"},
+		},
+		{
+			name:  "scoped entries of another scope are dropped",
+			scope: ScopeClient,
+			content: stateFileJSON(t, stateFileContent{Version: stateFileVersion, Scope: ScopeUser, Entries: []stateEntry{
+				{IP: "192.0.2.1", Expires: now.Add(time.Hour)},
+				{IP: "192.0.2.2", Scope: "1000", Expires: now.Add(time.Hour)},
+			}}),
+			expectedKeys: []string{"192.0.2.1"},
+		},
+		{
+			name:  "scoped entries of the same scope are kept",
+			scope: ScopeClient,
+			content: stateFileJSON(t, stateFileContent{Version: stateFileVersion, Scope: ScopeClient, Entries: []stateEntry{
+				{IP: "192.0.2.2", Scope: "10.0.0.5", Expires: now.Add(time.Hour)},
+				{IP: "2001:db8::1", Scope: "10.0.0.5", Expires: now.Add(time.Hour)},
+			}}),
+			expectedKeys: []string{"10.0.0.5/192.0.2.2"},
+		},
+		{
+			name:          "unsupported version",
+			scope:         ScopeGlobal,
+			content:       `{"version": 2, "entries": []}`,
+			shouldError:   true,
+			errorContains: "has version 2",
+		},
+		{
+			name:          "invalid json",
+			scope:         ScopeGlobal,
+			content:       `{"version":`,
+			shouldError:   true,
+			errorContains: "invalid state file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testStateConfig(t, tt.scope)
+			if err := os.WriteFile(config.stateFile, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			manager := newStoppedTestNFTablesManager(t, config)
+
+			_, _, err := manager.restoreState(now)
+			if tt.shouldError {
+				if err == nil || !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', got %v", tt.errorContains, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if len(manager.allowList) != len(tt.expectedKeys) {
+				t.Fatalf("Expected %d entries, got %d", len(tt.expectedKeys), len(manager.allowList))
+			}
+			for _, key := range tt.expectedKeys {
+				if _, exists := manager.allowList[parseRouteKey(key)]; !exists {
+					t.Errorf("Expected entry '%s' to be restored", key)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreStateKeepsRecoveredExpiry(t *testing.T) {
+	config := testStateConfig(t, ScopeGlobal)
+	now := time.Now()
+
+	content := stateFileJSON(t, stateFileContent{Version: stateFileVersion, Scope: ScopeGlobal, Entries: []stateEntry{
+		{IP: "192.0.2.1", Domain: "example.com.", Client: "10.0.0.5", Expires: now.Add(time.Hour)},
+	}})
+	if err := os.WriteFile(config.stateFile, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	manager := newStoppedTestNFTablesManager(t, config)
+
+	// Recovered from the kernel set, which knows the real timeout
+	recovered := &allowRoute{ipAddress: net.ParseIP("192.0.2.1").To4(), validUnitl: now.Add(10 * time.Minute)}
+	manager.storeRoute(recovered)
+
+	ipv4Count, _, err := manager.restoreState(now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ipv4Count != 0 {
+		t.Errorf("Expected no added entry, got %d", ipv4Count)
+	}
+
+	if !recovered.validUnitl.Equal(now.Add(10*time.Minute)) || recovered.domain != "example.com." || recovered.client != "10.0.0.5" {
+		t.Errorf("Expected the kernel expiry with the saved domain and client, got %v, '%s' and '%s'", recovered.validUnitl, recovered.domain, recovered.client)
+	}
+}
+
+func TestRestoreStateFailedFlush(t *testing.T) {
+	config := testStateConfig(t, ScopeGlobal)
+	now := time.Now()
+
+	content := stateFileJSON(t, stateFileContent{Version: stateFileVersion, Scope: ScopeGlobal, Entries: []stateEntry{
+		{IP: "192.0.2.1", Domain: "example.com.", Expires: now.Add(time.Hour)},
+	}})
+	if err := os.WriteFile(config.stateFile, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var failing atomic.Bool
+	failing.Store(true)
+	manager := newStoppedTestNFTablesManager(t, config)
+	manager.nlInterface = newFailingTestConn(t, &failing)
+
+	if _, _, err := manager.restoreState(now); err == nil {
+		t.Fatal("Expected the flush to fail")
+	}
+
+	// The kernel lacks the elements, so the allowList must not claim them
+	if len(manager.allowList) != 0 || len(manager.expiries) != 0 {
+		t.Errorf("Expected no restored entries after the failed flush, got %v", manager.allowList)
+	}
+	if manager.flushFailures.Load() != 1 {
+		t.Errorf("Expected the failed flush to be recorded, got %d failures", manager.flushFailures.Load())
+	}
+}
+
+func TestRestoreStateWithoutFile(t *testing.T) {
+	config := testStateConfig(t, ScopeGlobal)
+	manager := &NFTablesManager{stateFile: config.stateFile}
+
+	if _, _, err := manager.restoreState(time.Now()); err != nil {
+		t.Errorf("Expected a missing state file to be ignored, got %v", err)
+	}
+}
+
+// Returns a manager for given config, whose goroutine stopped without saving the state, so its allowList can be used
+// directly.
+func newStoppedTestNFTablesManager(t *testing.T, config *parsedConfig) *NFTablesManager {
+	t.Helper()
+
+	withoutState := *config
+	withoutState.stateFile = ""
+
+	manager := newTestNFTablesManager(t, &withoutState)
+	if err := manager.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	manager.stateFile = config.stateFile
+
+	return manager
+}
+
+// Returns given state file content as JSON.
+func stateFileJSON(t *testing.T, content stateFileContent) string {
+	t.Helper()
+
+	data, err := json.Marshal(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
@@ -0,0 +1,85 @@
+package ipdestinationguard
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Default time added to the TTL of an answer, as clients might use an address a bit longer than its TTL.
+const defaultGracePeriod = 30 * time.Second
+
+// Default lifetime of recovered entries, whose real expiry time is unknown.
+const defaultRecoveryLifetime = 330 * time.Second
+
+// A domainLifetime entry, which replaces the lifetime of answers for matching names.
+type lifetimeOverride struct {
+	pattern  domainPattern
+	lifetime time.Duration
+}
+
+// TTLPolicy determines, how long the addresses of an answer stay allowed.
+type TTLPolicy struct {
+	gracePeriod time.Duration      // Added to the TTL of each record
+	minLifetime time.Duration      // Lower bound of the lifetime, 0 for none
+	maxLifetime time.Duration      // Upper bound of the lifetime, 0 for none
+	overrides   []lifetimeOverride // Fixed lifetimes for matching names
+}
+
+// Returns the policy used without any TTL directives, which allows addresses for their TTL plus 30 seconds.
+func defaultTTLPolicy() *TTLPolicy {
+	return &TTLPolicy{gracePeriod: defaultGracePeriod}
+}
+
+// Lifetime returns how long an address of the answer for given query, with given record TTL, stays allowed.
+// An override matching the queried name or its CNAME chain wins over the TTL, otherwise the TTL plus the grace
+// period is clamped to the minimum and maximum lifetime.
+func (policy *TTLPolicy) Lifetime(query *QueryInfo, ttl uint32) time.Duration {
+	if policy == nil {
+		policy = defaultTTLPolicy()
+	}
+
+	if lifetime, found := policy.override(query); found {
+		return lifetime
+	}
+
+	lifetime := time.Duration(ttl)*time.Second + policy.gracePeriod
+	if policy.minLifetime > 0 && lifetime < policy.minLifetime {
+		lifetime = policy.minLifetime
+	}
+	if policy.maxLifetime > 0 && lifetime > policy.maxLifetime {
+		lifetime = policy.maxLifetime
+	}
+
+	return lifetime
+}
+
+// Returns the lifetime of the most specific override matching the queried name or any name of its CNAME chain.
+func (policy *TTLPolicy) override(query *QueryInfo) (time.Duration, bool) {
+	if len(policy.overrides) == 0 || query == nil {
+		return 0, false
+	}
+
+	names := make([]string, 0, 1+len(query.CNAMEChain))
+	names = append(names, query.Name)
+	names = append(names, query.CNAMEChain...)
+
+	var lifetime time.Duration
+	bestSpecificity := -1
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		name = dns.CanonicalName(name)
+
+		for i := range policy.overrides {
+			override := &policy.overrides[i]
+			if specificity := override.pattern.specificity(); specificity > bestSpecificity && override.pattern.matches(name) {
+				bestSpecificity = specificity
+				lifetime = override.lifetime
+			}
+		}
+	}
+
+	return lifetime, bestSpecificity >= 0
+}
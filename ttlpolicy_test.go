@@ -0,0 +1,96 @@
+package ipdestinationguard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLPolicyLifetime(t *testing.T) {
+	overridePattern := func(domain string) domainPattern {
+		pattern, err := parseDomainPattern(domain, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pattern
+	}
+
+	overrides := []lifetimeOverride{
+		{pattern: overridePattern("jvm.example"), lifetime: time.Hour},
+		{pattern: overridePattern("api.jvm.example"), lifetime: 10 * time.Minute},
+	}
+
+	tests := []struct {
+		name     string
+		policy   *TTLPolicy
+		query    *QueryInfo
+		ttl      uint32
+		expected time.Duration
+	}{
+		{
+			name:     "nil policy uses the default grace period",
+			policy:   nil,
+			ttl:      60,
+			expected: 90 * time.Second,
+		},
+		{
+			name:     "default policy with ttl 0",
+			policy:   defaultTTLPolicy(),
+			ttl:      0,
+			expected: 30 * time.Second,
+		},
+		{
+			name:     "custom grace period",
+			policy:   &TTLPolicy{gracePeriod: 5 * time.Minute},
+			ttl:      60,
+			expected: 6 * time.Minute,
+		},
+		{
+			name:     "clamped to minimum",
+			policy:   &TTLPolicy{gracePeriod: 30 * time.Second, minLifetime: 5 * time.Minute},
+			ttl:      0,
+			expected: 5 * time.Minute,
+		},
+		{
+			name:     "clamped to maximum",
+			policy:   &TTLPolicy{gracePeriod: 30 * time.Second, maxLifetime: time.Hour},
+			ttl:      86400,
+			expected: time.Hour,
+		},
+		{
+			name:     "override of the queried name",
+			policy:   &TTLPolicy{gracePeriod: 30 * time.Second, maxLifetime: time.Minute, overrides: overrides},
+			query:    &QueryInfo{Name: "db.jvm.example."},
+			ttl:      60,
+			expected: time.Hour,
+		},
+		{
+			name:     "most specific override wins",
+			policy:   &TTLPolicy{gracePeriod: 30 * time.Second, overrides: overrides},
+			query:    &QueryInfo{Name: "v1.api.jvm.example."},
+			ttl:      60,
+			expected: 10 * time.Minute,
+		},
+		{
+			name:     "override of a cname target",
+			policy:   &TTLPolicy{gracePeriod: 30 * time.Second, overrides: overrides},
+			query:    &QueryInfo{Name: "www.example.com.", CNAMEChain: []string{"lb.jvm.example."}},
+			ttl:      60,
+			expected: time.Hour,
+		},
+		{
+			name:     "no matching override",
+			policy:   &TTLPolicy{gracePeriod: 30 * time.Second, overrides: overrides},
+			query:    &QueryInfo{Name: "www.example.com."},
+			ttl:      60,
+			expected: 90 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := tt.policy.Lifetime(tt.query, tt.ttl); result != tt.expected {
+				t.Errorf("Expected lifetime %v, got %v", tt.expected, result)
+			}
+		})
+	}
+}